@@ -0,0 +1,268 @@
+package wrgld
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-logr/logr"
+	"github.com/pckhoi/uma"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/local"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/localidp"
+	wrgldoapiserver "github.com/wrgl/wrgld/pkg/oapi/server"
+	"github.com/wrgl/wrgld/pkg/oidcauth"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+	"github.com/wrgl/wrgld/pkg/tokens"
+	wrgldutils "github.com/wrgl/wrgld/pkg/utils"
+)
+
+func writeUnauthorized(rw http.ResponseWriter) {
+	rw.Header().Add("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusUnauthorized)
+	rw.Write([]byte(`{"message":"Unauthorized","code":"unauthorized"}`))
+}
+
+func resourceNameFunc(c *conf.Config) func(r *http.Request, rsc uma.Resource) string {
+	return func(r *http.Request, rsc uma.Resource) string {
+		if c.Auth == nil {
+			return ""
+		}
+		return c.Auth.RepositoryName
+	}
+}
+
+func anonymousRead(c *conf.Config) bool {
+	return c.Auth != nil && c.Auth.AnonymousRead
+}
+
+// keycloakAuth authorizes requests with RPTs issued by Keycloak. The repository
+// is registered as an UMA resource if it is not already. adminRoles are granted
+// the admin scope on that resource.
+func keycloakAuth(rd *local.RepoDir, client *http.Client, c *conf.Config, adminRoles []string, baseURL *url.URL, logger, umaLogger logr.Logger, disableTokenExpirationCheck bool) (wrgldutils.Middleware, *uma.KeycloakProvider, string, error) {
+	rs := rd.OpenUMAStore()
+	kc := c.Auth.Keycloak
+	ctx := context.Background()
+	opts := []uma.KeycloakOption{
+		uma.WithKeycloakOwnerManagedAccess(),
+	}
+	if client != nil {
+		ctx = oidc.ClientContext(ctx, client)
+		opts = append(opts, uma.WithKeycloakClient(client))
+	}
+	kp, err := uma.NewKeycloakProvider(
+		kc.Issuer,
+		kc.ClientID,
+		kc.ClientSecret,
+		oidc.NewRemoteKeySet(ctx, kc.Issuer+"/protocol/openid-connect/certs"),
+		logger.WithName("KeycloakProvider").V(1),
+		opts...,
+	)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	manOpts := &uma.ManagerOptions{
+		GetBaseURL: func(r *http.Request) url.URL {
+			return *baseURL
+		},
+		GetProvider: func(r *http.Request) uma.Provider {
+			return kp
+		},
+		GetResourceStore: func(r *http.Request) uma.ResourceStore {
+			return rs
+		},
+		GetResourceName:             resourceNameFunc(c),
+		EditUnauthorizedResponse:    writeUnauthorized,
+		DisableTokenExpirationCheck: disableTokenExpirationCheck,
+	}
+	if anonymousRead(c) {
+		manOpts.AnonymousScopes = func(r *http.Request, resource uma.Resource) (scopes []string) {
+			return []string{"read"}
+		}
+	}
+	umaMan := wrgldoapiserver.UMAManager(*manOpts, umaLogger)
+
+	var resourceID string
+	resourceID, err = rs.Get(c.Auth.RepositoryName)
+	if err != nil {
+		if kc.ResourceID != "" {
+			if err := rs.Set(c.Auth.RepositoryName, kc.ResourceID); err != nil {
+				return nil, nil, "", fmt.Errorf("error setting resource id: %w", err)
+			}
+			resourceID = kc.ResourceID
+		} else {
+			resp, err := umaMan.RegisterResourceAt(nil, rs, kp, *baseURL, "")
+			if err != nil {
+				return nil, nil, "", err
+			}
+			resourceID = resp.ID
+		}
+	}
+	if len(adminRoles) > 0 {
+		if err = grantKeycloakAdmin(kp, resourceID, adminRoles); err != nil {
+			return nil, nil, "", fmt.Errorf("error granting admin scope: %w", err)
+		}
+	}
+	return umaMan.Middleware, kp, resourceID, nil
+}
+
+// grantKeycloakAdmin adds the admin scope to resources registered before the
+// scope existed, then creates or updates a permission granting roles every
+// scope of the resource. Keycloak does not know that admin implies read and
+// write, so all three are granted.
+func grantKeycloakAdmin(kp *uma.KeycloakProvider, resourceID string, roles []string) error {
+	rsc, err := kp.GetResource(resourceID)
+	if err != nil {
+		return err
+	}
+	scopes := make([]string, 0, len(rsc.ResourceScopes)+1)
+	hasAdmin := false
+	for _, sc := range rsc.ResourceScopes {
+		scopes = append(scopes, sc.Name)
+		hasAdmin = hasAdmin || sc.Name == tokens.ScopeAdmin
+	}
+	if !hasAdmin {
+		scopes = append(scopes, tokens.ScopeAdmin)
+		if err = kp.UpdateResource(resourceID, &uma.Resource{
+			ResourceType: uma.ResourceType{
+				Type:           rsc.Type,
+				IconUri:        rsc.IconUri,
+				ResourceScopes: scopes,
+			},
+			Name:               rsc.Name,
+			OwnerManagedAccess: rsc.OwnerManagedAccess,
+		}); err != nil {
+			return err
+		}
+	}
+	perm := &uma.KcPermission{
+		Name:        "admin-" + resourceID,
+		Description: "admins can read, write and administer",
+		Scopes:      []string{tokens.ScopeRead, tokens.ScopeWrite, tokens.ScopeAdmin},
+		Roles:       roles,
+	}
+	perms, err := kp.ListPermissions(url.Values{"name": {perm.Name}, "resource": {resourceID}})
+	if err != nil {
+		return err
+	}
+	for _, p := range perms {
+		if p.Name == perm.Name {
+			perm.ID = p.ID
+			return kp.UpdatePermission(p.ID, perm)
+		}
+	}
+	_, err = kp.CreatePermissionForResource(resourceID, perm)
+	return err
+}
+
+// oidcAuth authorizes requests with JWTs issued by any OpenID Connect provider,
+// granting scopes based on roles or groups in token claims
+func oidcAuth(client *http.Client, c *conf.Config, oc *wrgldconf.OIDC, baseURL *url.URL, umaLogger logr.Logger, disableTokenExpirationCheck bool) (wrgldutils.Middleware, error) {
+	ctx := context.Background()
+	if client != nil {
+		ctx = oidc.ClientContext(ctx, client)
+	}
+	a, err := oidcauth.NewAuthenticator(ctx, oc, disableTokenExpirationCheck)
+	if err != nil {
+		return nil, err
+	}
+	man := wrgldoapiserver.UMAManager(uma.ManagerOptions{
+		GetBaseURL: func(r *http.Request) url.URL {
+			return *baseURL
+		},
+		GetResourceName: resourceNameFunc(c),
+		CustomEnforce: func(r *http.Request, resource uma.Resource, scopes []string) bool {
+			if claims := oidcauth.GetClaims(r); claims != nil {
+				return claims.HasScopes(scopes...)
+			}
+			if anonymousRead(c) {
+				return len(scopes) == 1 && scopes[0] == "read"
+			}
+			return false
+		},
+		EditUnauthorizedResponse: writeUnauthorized,
+	}, umaLogger)
+	authenticate := a.Middleware(writeUnauthorized)
+	return func(h http.Handler) http.Handler {
+		return authenticate(man.Middleware(h))
+	}, nil
+}
+
+// LocalIDPKeyFilename is the file inside the repository directory that holds
+// the key signing tokens of the built-in identity provider
+const LocalIDPKeyFilename = "localidp.key"
+
+// localAuth authorizes requests with RPTs issued by the built-in identity
+// provider, which is served under {baseURL}/oauth2. Logins are throttled with
+// the "login" class of limiter if it is not nil.
+func localAuth(rd *local.RepoDir, c *conf.Config, lc *wrgldconf.Local, baseURL *url.URL, limiter *ratelimit.Limiter, logger, umaLogger logr.Logger, disableTokenExpirationCheck bool) (wrgldutils.Middleware, error) {
+	key, err := localidp.LoadOrCreateKey(filepath.Join(rd.FullPath, LocalIDPKeyFilename))
+	if err != nil {
+		return nil, err
+	}
+	users, err := localidp.NewUserStore(lc.UsersPath(rd.FullPath))
+	if err != nil {
+		return nil, err
+	}
+	opts := []localidp.ProviderOption{localidp.WithLogger(logger.WithName("localidp"))}
+	if lc.AccessTokenTTL > 0 {
+		opts = append(opts, localidp.WithAccessTokenTTL(time.Duration(lc.AccessTokenTTL)))
+	}
+	if lc.RefreshTokenTTL > 0 {
+		opts = append(opts, localidp.WithRefreshTokenTTL(time.Duration(lc.RefreshTokenTTL)))
+	}
+	if limiter != nil {
+		opts = append(opts, localidp.WithRateLimiter(limiter))
+	}
+	p, err := localidp.NewProvider(strings.TrimSuffix(baseURL.String(), "/")+"/oauth2", key, users, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rs := rd.OpenUMAStore()
+	getName := resourceNameFunc(c)
+	manOpts := uma.ManagerOptions{
+		GetBaseURL: func(r *http.Request) url.URL {
+			return *baseURL
+		},
+		GetProvider: func(r *http.Request) uma.Provider {
+			return p
+		},
+		GetResourceStore: func(r *http.Request) uma.ResourceStore {
+			return rs
+		},
+		GetResourceName: func(r *http.Request, rsc uma.Resource) string {
+			if s := getName(r, rsc); s != "" {
+				return s
+			}
+			return localidp.Realm
+		},
+		// tickets name the required scopes so that users lacking them are
+		// turned away when requesting an RPT
+		IncludeScopesInPermissionTicket: true,
+		EditUnauthorizedResponse:        writeUnauthorized,
+		DisableTokenExpirationCheck:     disableTokenExpirationCheck,
+	}
+	if anonymousRead(c) {
+		manOpts.AnonymousScopes = func(r *http.Request, resource uma.Resource) (scopes []string) {
+			return []string{"read"}
+		}
+	}
+	man := wrgldoapiserver.UMAManager(manOpts, umaLogger)
+	prefix := p.PathPrefix()
+	return func(h http.Handler) http.Handler {
+		h = man.Middleware(h)
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				p.ServeHTTP(rw, r)
+				return
+			}
+			h.ServeHTTP(rw, r)
+		})
+	}, nil
+}
@@ -0,0 +1,28 @@
+package wrgld
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/go-logr/stdr"
+)
+
+// newLogger creates the process logger. format is either "text" or "json".
+func newLogger(format string, verbosity int) (logr.Logger, error) {
+	switch format {
+	case "", "text":
+		stdr.SetVerbosity(verbosity)
+		return stdr.New(log.Default()), nil
+	case "json":
+		return funcr.NewJSON(func(obj string) {
+			fmt.Fprintln(os.Stderr, obj)
+		}, funcr.Options{
+			LogTimestamp: true,
+			Verbosity:    verbosity,
+		}), nil
+	}
+	return logr.Discard(), fmt.Errorf("invalid log format %q, valid options are \"text\" and \"json\"", format)
+}
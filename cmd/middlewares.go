@@ -4,36 +4,21 @@ import (
 	"fmt"
 	"net/http"
 	"runtime/debug"
-	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pckhoi/uma"
+	"github.com/wrgl/wrgld/pkg/certauth"
+	"github.com/wrgl/wrgld/pkg/oidcauth"
 	"github.com/wrgl/wrgld/pkg/server"
+	"github.com/wrgl/wrgld/pkg/tokens"
 )
 
-type loggingMiddleware struct {
-	handler http.Handler
-	logger  logr.Logger
-}
-
-func (h *loggingMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	h.handler.ServeHTTP(rw, r)
-	h.logger.Info("request", "method", r.Method, "uri", r.URL.RequestURI(), "elapsed", time.Since(start))
-}
-
-func LoggingMiddleware(logger logr.Logger) func(handler http.Handler) http.Handler {
-	return func(handler http.Handler) http.Handler {
-		return &loggingMiddleware{handler: handler, logger: logger}
-	}
-}
-
 type recoveryMiddleware struct {
 	handler http.Handler
 	logger  logr.Logger
 }
 
-func (h *recoveryMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+func (h *recoveryMiddleware) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	defer func() {
 		if r := recover(); r != nil {
 			var err error
@@ -42,11 +27,11 @@ func (h *recoveryMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request)
 			} else {
 				err = fmt.Errorf("%v", r)
 			}
-			h.logger.Error(err, "panic recovered", "stack", string(debug.Stack()))
-			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			h.logger.Error(err, "panic recovered", "request_id", server.RequestID(req), "stack", string(debug.Stack()))
+			server.SendError(rw, req, http.StatusInternalServerError, "internal server error")
 		}
 	}()
-	h.handler.ServeHTTP(rw, r)
+	h.handler.ServeHTTP(rw, req)
 }
 
 func RecoveryMiddleware(logger logr.Logger) func(handler http.Handler) http.Handler {
@@ -55,15 +40,48 @@ func RecoveryMiddleware(logger logr.Logger) func(handler http.Handler) http.Hand
 	}
 }
 
+// principals drops empty names
+func principals(names ...string) []string {
+	sl := make([]string, 0, len(names))
+	for _, s := range names {
+		if s != "" {
+			sl = append(sl, s)
+		}
+	}
+	return sl
+}
+
 func SetAuthorMiddleware(logger logr.Logger) func(handler http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			claims := uma.GetClaims(r)
-			if claims != nil {
+			if tok := tokens.GetToken(r); tok != nil {
+				r = server.SetAuthor(r, &server.Author{
+					Email: tok.AuthorEmail,
+					Name:  tok.AuthorName,
+				})
+				r = server.SetPrincipals(r, principals(tok.Name, tok.AuthorEmail))
+				r = server.SetSubject(r, "token:"+tok.ID)
+			} else if id := certauth.GetIdentity(r); id != nil {
+				r = server.SetAuthor(r, &server.Author{
+					Email: id.Email,
+					Name:  id.Name,
+				})
+				r = server.SetPrincipals(r, principals(id.Subject, id.Email))
+				r = server.SetSubject(r, "cert:"+id.Subject)
+			} else if claims := oidcauth.GetClaims(r); claims != nil {
+				r = server.SetAuthor(r, &server.Author{
+					Email: claims.Email,
+					Name:  claims.Name,
+				})
+				r = server.SetPrincipals(r, principals(append([]string{claims.Subject, claims.Email}, claims.Roles...)...))
+				r = server.SetSubject(r, claims.Subject)
+			} else if claims := uma.GetClaims(r); claims != nil {
 				r = server.SetAuthor(r, &server.Author{
 					Email: claims.Email,
 					Name:  claims.Name,
 				})
+				r = server.SetPrincipals(r, principals(claims.PreferredUsername, claims.Email))
+				r = server.SetSubject(r, claims.Sub)
 			}
 			handler.ServeHTTP(w, r)
 		})
@@ -0,0 +1,90 @@
+package wrgld
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/probes"
+)
+
+// probeKey is read from the objects store by the store check. It does not
+// need to exist, any error other than not found fails the check.
+var probeKey = []byte("wrgld-probe")
+
+func storeCheck(db objects.Store) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if _, err := db.Get(probeKey); err != nil && !errors.Is(err, objects.ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+}
+
+// ProbeChecks returns checks reporting the health of this server. The objects
+// store is checked for liveness, while auth provider reachability, free disk
+// space at the repository directory and draining state only affect readiness.
+func (s *Server) ProbeChecks(client *http.Client, minFreeDisk uint64) []probes.Check {
+	checks := []probes.Check{
+		probes.ReadyCheck("draining", s),
+		{
+			Name:     "store",
+			Liveness: true,
+			Func:     storeCheck(s.objstore),
+		},
+		probes.DiskCheck("disk", s.repoPath, minFreeDisk),
+	}
+	if s.authURL != "" {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		checks = append(checks, probes.Check{
+			Name: "auth",
+			Func: func(ctx context.Context) error {
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.authURL, nil)
+				if err != nil {
+					return err
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return err
+				}
+				resp.Body.Close()
+				if resp.StatusCode >= 500 {
+					return fmt.Errorf("GET %s: status %d", s.authURL, resp.StatusCode)
+				}
+				return nil
+			},
+		})
+	}
+	return checks
+}
+
+// ProbeInfo returns details shown at /debug/status
+func (s *Server) ProbeInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version":              version,
+		"uptime":               time.Since(s.startTime).Round(time.Second).String(),
+		"draining":             s.srv.Draining(),
+		"uploadPackSessions":   len(s.upSessions.List()),
+		"receivePackSessions":  len(s.rpSessions.List()),
+		"authProviderEndpoint": s.authURL,
+	}
+}
+
+// Collectors returns Prometheus collectors reporting open sessions and the
+// size of the objects store
+func (s *Server) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		metrics.NewSessionsCollector(
+			func() int { return len(s.upSessions.List()) },
+			func() int { return len(s.rpSessions.List()) },
+		),
+		metrics.NewBadgerCollector(s.kvPath),
+	}
+}
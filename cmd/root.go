@@ -2,20 +2,25 @@ package wrgld
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
-	"github.com/go-logr/stdr"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/wrgl/wrgl/pkg/conf"
 	conffs "github.com/wrgl/wrgl/pkg/conf/fs"
 	"github.com/wrgl/wrgl/pkg/local"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/probes"
+	"github.com/wrgl/wrgld/pkg/tlsreload"
+	"github.com/wrgl/wrgld/pkg/tracing"
 )
 
 var version string
@@ -33,11 +38,21 @@ func RootCmd() *cobra.Command {
 			"",
 			"  # increase read and write timeout",
 			"  wrgld --read-timeout 60s --write-timeout 60s",
+			"",
+			"  # serve HTTPS and verify client certificates",
+			"  wrgld --tls-cert server.crt --tls-key server.key --tls-client-ca ca.crt",
+			"",
+			"  # export a tenth of traces to an OpenTelemetry collector",
+			"  wrgld --otlp-endpoint http://localhost:4318 --trace-sample-ratio 0.1",
 		}, "\n"),
 		Version: version,
 		Args:    cobra.MaximumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
-			logger := stdr.New(log.Default())
+			verbosity := viper.GetInt("log-verbosity")
+			logger, err := newLogger(viper.GetString("log-format"), verbosity)
+			if err != nil {
+				return err
+			}
 			var dir string
 			if len(args) > 0 {
 				dir = args[0]
@@ -78,15 +93,36 @@ func RootCmd() *cobra.Command {
 					return err
 				}
 			}
-			if c.Auth == nil || c.Auth.Keycloak == nil {
-				return fmt.Errorf("auth config not defined")
+			var wc *wrgldconf.Config
+			if fp := viper.GetString("wrgld-config-file"); fp != "" {
+				wc, err = wrgldconf.Open(fp)
+			} else {
+				wc, err = wrgldconf.OpenDefault(rd.FullPath)
 			}
-			if c.Auth.RepositoryName == "" {
-				return fmt.Errorf("auth.repositoryName not defined")
+			if err != nil {
+				return err
 			}
-
-			if s := viper.GetString("resource-id"); s != "" {
-				c.Auth.Keycloak.ResourceID = s
+			if wc.Auth == nil || (wc.Auth.OIDC == nil && wc.Auth.Local == nil) {
+				// without a generic OIDC provider or the built-in identity
+				// provider, Keycloak must be configured
+				if c.Auth == nil || c.Auth.Keycloak == nil {
+					return fmt.Errorf("auth config not defined")
+				}
+				if c.Auth.RepositoryName == "" {
+					return fmt.Errorf("auth.repositoryName not defined")
+				}
+				if s := viper.GetString("resource-id"); s != "" {
+					c.Auth.Keycloak.ResourceID = s
+				}
+				if roles := viper.GetStringSlice("admin-role"); len(roles) > 0 {
+					if wc.Auth == nil {
+						wc.Auth = &wrgldconf.Auth{}
+					}
+					if wc.Auth.Keycloak == nil {
+						wc.Auth.Keycloak = &wrgldconf.Keycloak{}
+					}
+					wc.Auth.Keycloak.AdminRoles = append(wc.Auth.Keycloak.AdminRoles, roles...)
+				}
 			}
 
 			var client *http.Client
@@ -96,8 +132,7 @@ func RootCmd() *cobra.Command {
 				if err != nil {
 					return err
 				}
-				transport := &http.Transport{}
-				*transport = *(http.DefaultTransport).(*http.Transport)
+				transport := http.DefaultTransport.(*http.Transport).Clone()
 				transport.Proxy = func(r *http.Request) (*url.URL, error) {
 					return proxyURL, nil
 				}
@@ -105,16 +140,77 @@ func RootCmd() *cobra.Command {
 					Transport: transport,
 				}
 			}
-			verbosity := viper.GetInt("log-verbosity")
 			if verbosity > 0 {
 				logger.Info("log verbosity", "v", verbosity)
 			}
-			stdr.SetVerbosity(verbosity)
-			server, _, _, err := NewServer(rd, client, c, logger, false)
+			shutdownTracing, err := tracing.Setup(tracing.Options{
+				ServiceName:    "wrgld",
+				ServiceVersion: version,
+				OTLPEndpoint:   viper.GetString("otlp-endpoint"),
+				OTLPHeaders:    viper.GetStringMapString("otlp-header"),
+				File:           viper.GetString("trace-file"),
+				SampleRatio:    viper.GetFloat64("trace-sample-ratio"),
+			})
+			if err != nil {
+				return err
+			}
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := shutdownTracing(ctx); err != nil {
+					logger.Error(err, "error flushing spans")
+				}
+			}()
+			server, _, _, err := NewServer(rd, client, c, wc, logger, false)
 			if err != nil {
 				return
 			}
 			defer server.Close()
+			var reloader *tlsreload.Reloader
+			certFile, keyFile := viper.GetString("tls-cert"), viper.GetString("tls-key")
+			clientCA := viper.GetString("tls-client-ca")
+			if (certFile == "") != (keyFile == "") {
+				return fmt.Errorf("--tls-cert and --tls-key must be given together")
+			}
+			if certFile == "" && clientCA != "" {
+				return fmt.Errorf("--tls-client-ca requires --tls-cert and --tls-key")
+			}
+			if clientCA == "" && viper.GetBool("tls-require-client-cert") {
+				return fmt.Errorf("--tls-require-client-cert requires --tls-client-ca")
+			}
+			if certFile != "" {
+				var opts []tlsreload.ReloaderOption
+				if clientCA != "" {
+					opts = append(opts, tlsreload.WithClientCA(clientCA))
+				}
+				reloader, err = tlsreload.NewReloader(certFile, keyFile, logger, opts...)
+				if err != nil {
+					return err
+				}
+			}
+			for _, c := range server.Collectors() {
+				if err = prometheus.Register(c); err != nil {
+					return err
+				}
+			}
+			probesOpts := []probes.ServerOption{
+				probes.WithCheckTimeout(viper.GetDuration("probe-timeout")),
+				probes.WithInfo(server.ProbeInfo),
+			}
+			if reloader != nil {
+				probesOpts = append(probesOpts, probes.WithTLSConfig(reloader.TLSConfig(tls.NoClientCert)))
+			}
+			probesSrv := probes.NewServer(
+				viper.GetString("probes-addr"),
+				server.ProbeChecks(client, uint64(viper.GetInt64("min-free-disk-mb"))<<20),
+				probesOpts...,
+			)
+			go func() {
+				if err := probesSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logger.Error(err, "error serving probes")
+				}
+			}()
+			defer probesSrv.Shutdown(context.Background())
 			readTimeout := viper.GetDuration("read-timeout")
 			writeTimeout := viper.GetDuration("write-timeout")
 			port := viper.GetInt("port")
@@ -124,18 +220,45 @@ func RootCmd() *cobra.Command {
 				Handler:      server,
 				Addr:         fmt.Sprintf(":%d", port),
 			}
-			defer srv.Shutdown(context.Background())
-			return srv.ListenAndServe()
+			serve := srv.ListenAndServe
+			if reloader != nil {
+				clientAuth := tls.VerifyClientCertIfGiven
+				if viper.GetBool("tls-require-client-cert") {
+					clientAuth = tls.RequireAndVerifyClientCert
+				}
+				srv.TLSConfig = reloader.TLSConfig(clientAuth)
+				logger.Info("serving https", "port", port)
+				serve = func() error { return srv.ListenAndServeTLS("", "") }
+			}
+			return serveUntilSignal(srv, server, serve, viper.GetDuration("shutdown-delay"), viper.GetDuration("shutdown-timeout"), logger)
 		},
 	}
 	cmd.Flags().IntP("port", "p", 80, "port number to listen to")
 	cmd.Flags().Duration("read-timeout", 30*time.Second, "request read timeout as described at https://pkg.go.dev/net/http#Server.ReadTimeout")
-	cmd.Flags().Duration("write-timeout", 30*time.Second, "response write timeout as described at https://pkg.go.dev/net/http#Server.WriteTimeout")
-	cmd.Flags().String("proxy", "", "make all outgoing requests through this proxy")
+	cmd.Flags().Duration("write-timeout", 30*time.Second, "response write timeout as described at https://pkg.go.dev/net/http#Server.WriteTimeout. Streams of /events and /changes are not cut by it as long as each chunk is written within 30s")
+	cmd.Flags().String("proxy", "", "make all outgoing requests through this proxy, except trace exports")
 	cmd.Flags().String("badger-log", "", `set Badger log level, valid options are "error", "warning", "debug", and "info" (defaults to "error")`)
 	cmd.Flags().String("config-file", "", "read config from file")
+	cmd.Flags().String("wrgld-config-file", "", fmt.Sprintf("read wrgld-specific config from file (defaults to %s inside the repository directory)", wrgldconf.DefaultFilename))
 	cmd.Flags().Int("log-verbosity", 0, "verbosity level. Higher means more logs")
+	cmd.Flags().String("log-format", "text", `log format, valid options are "text" and "json". JSON logs are written one object per line`)
 	cmd.Flags().String("resource-id", "", "UMA resource id created in keycloak. If not given, the server will attempt to create the resource when authorization is required.")
+	cmd.Flags().StringSlice("admin-role", nil, "Keycloak role granted the admin scope on the repository at startup. Can be repeated. Admin scope is required for garbage collection, session, token, webhook and config endpoints")
+	cmd.Flags().String("tls-cert", "", "serve HTTPS with this PEM certificate file. The file is reloaded when it changes")
+	cmd.Flags().String("tls-key", "", "PEM private key file of --tls-cert. The file is reloaded when it changes")
+	cmd.Flags().String("tls-client-ca", "", "verify client certificates against this PEM CA bundle. Verified certificates are mapped to authors and scopes with auth.clientCertificates in wrgld config")
+	cmd.Flags().Bool("tls-require-client-cert", false, "reject connections without a client certificate verified against --tls-client-ca")
+	cmd.Flags().Duration("shutdown-delay", 5*time.Second, "on SIGTERM or SIGINT, how long to keep serving after reporting not ready so that load balancers stop routing to the server")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "on SIGTERM or SIGINT, how long to wait for each of sessions, requests and webhook payloads in progress before exiting")
+	cmd.Flags().String("probes-addr", probes.DefaultAddr, "address serving /ready, /healthz, /debug/status and /metrics")
+	cmd.Flags().Duration("probe-timeout", probes.DefaultCheckTimeout, "how long each health check can take before it fails")
+	cmd.Flags().Int64("min-free-disk-mb", 100, "report not ready when free disk space at the repository directory falls below this many megabytes")
+	cmd.Flags().String("otlp-endpoint", "", "export traces to this OTLP/HTTP receiver, such as http://localhost:4318. Spans are posted as protobuf to /v1/traces, through HTTPS_PROXY or HTTP_PROXY from the environment rather than --proxy")
+	cmd.Flags().StringToString("otlp-header", nil, "header sent with every trace export request, in the form key=value. Can be repeated")
+	cmd.Flags().String("trace-file", "", "append traces to this file as JSON lines")
+	cmd.Flags().Float64("trace-sample-ratio", 1, "fraction of traces to sample when the caller did not decide. Traces continued from a sampled caller are always sampled")
+	cmd.AddCommand(tokenCmd())
+	cmd.AddCommand(userCmd())
 	viper.BindPFlags(cmd.Flags())
 	viper.SetEnvPrefix("wrgld")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
@@ -2,12 +2,12 @@ package wrgld
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-logr/logr"
 	"github.com/pckhoi/uma"
 	"github.com/rs/cors"
@@ -15,10 +15,18 @@ import (
 	"github.com/wrgl/wrgl/pkg/local"
 	"github.com/wrgl/wrgl/pkg/objects"
 	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/certauth"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/cron"
+	"github.com/wrgl/wrgld/pkg/eventstream"
+	"github.com/wrgl/wrgld/pkg/gc"
 	wrgldoapiserver "github.com/wrgl/wrgld/pkg/oapi/server"
-	"github.com/wrgl/wrgld/pkg/probes"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
 	"github.com/wrgl/wrgld/pkg/server"
+	"github.com/wrgl/wrgld/pkg/tokens"
 	wrgldutils "github.com/wrgl/wrgld/pkg/utils"
+	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
 type ServerOptions struct {
@@ -34,43 +42,68 @@ type ServerOptions struct {
 
 type Server struct {
 	handler    http.Handler
+	srv        *server.Server
 	cleanups   []func()
-	upSessions *server.UploadPackSessionMap
-	rpSessions *server.ReceivePackSessionMap
+	upSessions server.UploadPackSessionStore
+	rpSessions server.ReceivePackSessionStore
+	dispatcher *webhook.Dispatcher
+	objstore   objects.Store
+	repoPath   string
+	kvPath     string
+	startTime  time.Time
+
+	// persistentSessions is true if sessions outlive the process
+	persistentSessions bool
+
+	// authURL is fetched to check that the auth provider is reachable
+	authURL string
 }
 
-func NewServer(rd *local.RepoDir, client *http.Client, c *conf.Config, logger logr.Logger, disableTokenExpirationCheck bool) (*Server, *uma.KeycloakProvider, string, error) {
+func NewServer(rd *local.RepoDir, client *http.Client, c *conf.Config, wc *wrgldconf.Config, logger logr.Logger, disableTokenExpirationCheck bool) (*Server, *uma.KeycloakProvider, string, error) {
 	objstore, err := rd.OpenObjectsStore()
 	if err != nil {
 		return nil, nil, "", err
 	}
 	refstore := rd.OpenRefStore()
+	outbox, err := webhook.NewOutbox(filepath.Join(rd.FullPath, "webhooks"))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	deliveryLog, err := webhook.NewDeliveryLog(filepath.Join(rd.FullPath, "webhooks", "deliveries.jsonl"))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	eventLogOpts := []eventstream.LogOption{eventstream.WithFile(filepath.Join(rd.FullPath, "events.jsonl"))}
+	if wc.MaxEvents > 0 {
+		eventLogOpts = append(eventLogOpts, eventstream.WithMaxEvents(wc.MaxEvents))
+	}
+	eventLog, err := eventstream.NewLog(logger, eventLogOpts...)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	auditLog, err := audit.NewLog(filepath.Join(rd.FullPath, "audit.jsonl"))
+	if err != nil {
+		return nil, nil, "", err
+	}
 	s := &Server{
-		upSessions: server.NewUploadPackSessionMap(0, 0),
-		rpSessions: server.NewReceivePackSessionMap(0, 0),
+		dispatcher: webhook.NewDispatcher(outbox, logger, webhook.WithDispatcherDeliveryLog(deliveryLog)),
+		objstore:   objstore,
+		repoPath:   rd.FullPath,
+		kvPath:     rd.KVPath(),
+		startTime:  time.Now(),
 		cleanups: []func(){
 			func() { rd.Close() },
 			func() { objstore.Close() },
 		},
 	}
-	rs := rd.OpenUMAStore()
-	kc := c.Auth.Keycloak
-	ctx := context.Background()
-	opts := []uma.KeycloakOption{
-		uma.WithKeycloakOwnerManagedAccess(),
-	}
-	if client != nil {
-		ctx = oidc.ClientContext(ctx, client)
-		opts = append(opts, uma.WithKeycloakClient(client))
-	}
-	kp, err := uma.NewKeycloakProvider(
-		kc.Issuer,
-		kc.ClientID,
-		kc.ClientSecret,
-		oidc.NewRemoteKeySet(ctx, kc.Issuer+"/protocol/openid-connect/certs"),
-		logger.WithName("KeycloakProvider").V(1),
-		opts...,
-	)
+	if err = s.openSessionStores(wc.Sessions); err != nil {
+		return nil, nil, "", err
+	}
+	if err = s.dispatcher.Start(); err != nil {
+		return nil, nil, "", err
+	}
+	s.cleanups = append(s.cleanups, s.dispatcher.Stop)
+	gcRunner, gcScheduler, err := s.startGC(objstore, refstore, c, wc.GC, logger)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -79,49 +112,68 @@ func NewServer(rd *local.RepoDir, client *http.Client, c *conf.Config, logger lo
 		return nil, nil, "", err
 	}
 	umaLogger := logger.WithName("uma").V(1)
-	manOpts := &uma.ManagerOptions{
+	var limiter *ratelimit.Limiter
+	if wc.RateLimits != nil {
+		limiter = ratelimit.NewLimiter(wc.RateLimits)
+	}
+	var (
+		authMiddleware wrgldutils.Middleware
+		kp             *uma.KeycloakProvider
+		resourceID     string
+	)
+	if wc.Auth != nil && wc.Auth.OIDC != nil {
+		authMiddleware, err = oidcAuth(client, c, wc.Auth.OIDC, baseURL, umaLogger, disableTokenExpirationCheck)
+		s.authURL = strings.TrimSuffix(wc.Auth.OIDC.Issuer, "/") + "/.well-known/openid-configuration"
+	} else if wc.Auth != nil && wc.Auth.Local != nil {
+		authMiddleware, err = localAuth(rd, c, wc.Auth.Local, baseURL, limiter, logger, umaLogger, disableTokenExpirationCheck)
+	} else {
+		var adminRoles []string
+		if wc.Auth != nil && wc.Auth.Keycloak != nil {
+			adminRoles = wc.Auth.Keycloak.AdminRoles
+		}
+		authMiddleware, kp, resourceID, err = keycloakAuth(rd, client, c, adminRoles, baseURL, logger, umaLogger, disableTokenExpirationCheck)
+		s.authURL = c.Auth.Keycloak.Issuer + "/protocol/openid-connect/certs"
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	tokenStore, err := tokens.NewStore(filepath.Join(rd.FullPath, TokensFilename))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	// requests bearing a wrgld token are checked against the scopes of the
+	// token instead of going through the auth provider
+	tokenMan := wrgldoapiserver.UMAManager(uma.ManagerOptions{
 		GetBaseURL: func(r *http.Request) url.URL {
 			return *baseURL
 		},
-		GetProvider: func(r *http.Request) uma.Provider {
-			return kp
-		},
-		GetResourceStore: func(r *http.Request) uma.ResourceStore {
-			return rs
+		GetResourceName: resourceNameFunc(c),
+		CustomEnforce: func(r *http.Request, resource uma.Resource, scopes []string) bool {
+			tok := tokens.GetToken(r)
+			return tok != nil && tok.HasScopes(scopes...)
 		},
-		GetResourceName: func(r *http.Request, rsc uma.Resource) string {
-			return c.Auth.RepositoryName
+		EditUnauthorizedResponse: writeUnauthorized,
+	}, umaLogger)
+
+	// requests authenticated with a client certificate are checked against the
+	// scopes mapped to the certificate subject
+	certMan := wrgldoapiserver.UMAManager(uma.ManagerOptions{
+		GetBaseURL: func(r *http.Request) url.URL {
+			return *baseURL
 		},
-		EditUnauthorizedResponse: func(rw http.ResponseWriter) {
-			rw.Header().Add("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusUnauthorized)
-			rw.Write([]byte(`{"message":"Unauthorized"}`))
+		GetResourceName: resourceNameFunc(c),
+		CustomEnforce: func(r *http.Request, resource uma.Resource, scopes []string) bool {
+			id := certauth.GetIdentity(r)
+			return id != nil && id.HasScopes(scopes...)
 		},
-		DisableTokenExpirationCheck: disableTokenExpirationCheck,
-	}
-	if c.Auth.AnonymousRead {
-		manOpts.AnonymousScopes = func(r *http.Request, resource uma.Resource) (scopes []string) {
-			return []string{"read"}
-		}
+		EditUnauthorizedResponse: writeUnauthorized,
+	}, umaLogger)
+	var clientCerts []wrgldconf.ClientCertificate
+	if wc.Auth != nil {
+		clientCerts = wc.Auth.ClientCertificates
 	}
-	umaMan := wrgldoapiserver.UMAManager(*manOpts, umaLogger)
 
-	var resourceID string
-	resourceID, err = rs.Get(c.Auth.RepositoryName)
-	if err != nil {
-		if kc.ResourceID != "" {
-			if err := rs.Set(c.Auth.RepositoryName, kc.ResourceID); err != nil {
-				return nil, nil, "", fmt.Errorf("error setting resource id: %w", err)
-			}
-			resourceID = kc.ResourceID
-		} else {
-			resp, err := umaMan.RegisterResourceAt(nil, rs, kp, *baseURL, "")
-			if err != nil {
-				return nil, nil, "", err
-			}
-			resourceID = resp.ID
-		}
-	}
 	srv := server.NewServer(
 		nil,
 		func(r *http.Request) objects.Store { return objstore },
@@ -130,21 +182,56 @@ func NewServer(rd *local.RepoDir, client *http.Client, c *conf.Config, logger lo
 		func(r *http.Request) server.UploadPackSessionStore { return s.upSessions },
 		func(r *http.Request) server.ReceivePackSessionStore { return s.rpSessions },
 		logger,
+		server.WithWebhookSenderOptions(
+			webhook.WithWebhooks(wc.Webhooks...),
+			webhook.WithDispatcher(s.dispatcher),
+			webhook.WithDeliveryLog(deliveryLog),
+		),
+		server.WithEventLog(func(r *http.Request) *eventstream.Log { return eventLog }),
+		server.WithTokenStore(func(r *http.Request) *tokens.Store { return tokenStore }),
+		server.WithRefPolicies(func(r *http.Request) []wrgldconf.RefPolicy { return wc.RefPolicies }),
+		server.WithAuditLog(func(r *http.Request) *audit.Log { return auditLog }),
+		server.WithRateLimiter(func(r *http.Request) *ratelimit.Limiter { return limiter }),
+		server.WithIngestLimits(func(r *http.Request) *wrgldconf.IngestLimits { return wc.IngestLimits }),
+		server.WithGCRunner(func(r *http.Request) *gc.Runner { return gcRunner }),
 	)
-	go probes.StartServer(srv)
+	s.srv = srv
+	if gcScheduler != nil {
+		gcScheduler.Start()
+		s.cleanups = append(s.cleanups, gcScheduler.Stop)
+	}
 	s.handler = wrgldutils.ApplyMiddlewares(
 		srv,
 		SetAuthorMiddleware(logger),
-		umaMan.Middleware,
-		LoggingMiddleware(logger),
+		func(h http.Handler) http.Handler {
+			return certauth.Middleware(
+				clientCerts,
+				tokens.Middleware(
+					func(r *http.Request) *tokens.Store { return tokenStore },
+					authMiddleware(h), tokenMan.Middleware(h), writeUnauthorized,
+					func(rw http.ResponseWriter, r *http.Request, err error) {
+						logger.Error(err, "error authenticating token")
+						server.SendError(rw, r, http.StatusServiceUnavailable, "token store unavailable")
+					},
+				),
+				certMan.Middleware(h),
+			)
+		},
 		RecoveryMiddleware(logger),
+		server.AccessLogMiddleware(logger, wc.AccessLog, func(r *http.Request) string {
+			if c.Auth == nil {
+				return ""
+			}
+			return c.Auth.RepositoryName
+		}),
+		server.RequestIDMiddleware,
 	)
 	if c.Cors != nil && len(c.Cors.AllowedOrigins) > 0 {
 		corsOpts := cors.Options{
 			AllowedOrigins:   c.Cors.AllowedOrigins,
 			AllowedHeaders:   []string{"*"},
 			AllowCredentials: true,
-			ExposedHeaders:   []string{"Www-Authenticate"},
+			ExposedHeaders:   []string{"Www-Authenticate", server.RequestIDHeader},
 		}
 		logger.Info("enable cors", "options", corsOpts)
 		c := cors.New(corsOpts)
@@ -153,13 +240,120 @@ func NewServer(rd *local.RepoDir, client *http.Client, c *conf.Config, logger lo
 	return s, kp, resourceID, nil
 }
 
+// Ready implements probes.Probable
+func (s *Server) Ready() bool {
+	return s.srv.Ready()
+}
+
+// openSessionStores keeps sessions in memory, or in files if c.Dir is set so
+// that they survive restarts
+func (s *Server) openSessionStores(c *wrgldconf.Sessions) error {
+	if c == nil || c.Dir == "" {
+		var ttl time.Duration
+		if c != nil {
+			ttl = time.Duration(c.TTL)
+		}
+		upSessions := server.NewUploadPackSessionMap(0, ttl)
+		rpSessions := server.NewReceivePackSessionMap(0, ttl)
+		s.upSessions = upSessions
+		s.rpSessions = rpSessions
+		s.cleanups = append(s.cleanups, upSessions.Stop, rpSessions.Stop)
+		return nil
+	}
+	dir := c.Dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.repoPath, dir)
+	}
+	var err error
+	if s.upSessions, err = server.NewUploadPackSessionFileStore(filepath.Join(dir, "upload-pack"), time.Duration(c.TTL)); err != nil {
+		return err
+	}
+	if s.rpSessions, err = server.NewReceivePackSessionFileStore(filepath.Join(dir, "receive-pack"), time.Duration(c.TTL)); err != nil {
+		return err
+	}
+	s.persistentSessions = true
+	return nil
+}
+
+// startGC creates the garbage collection runner and, if c.Schedule is set, a
+// scheduler to run it in the background once started. Scheduled runs are
+// skipped while pushes or commits are writing objects or receive-pack
+// sessions are open, and are recorded like manual runs.
+func (s *Server) startGC(db objects.Store, rs ref.Store, c *conf.Config, gcc *wrgldconf.GC, logger logr.Logger) (*gc.Runner, *gc.Scheduler, error) {
+	opts := []gc.HistoryOption{gc.WithFile(filepath.Join(s.repoPath, "gc_history.jsonl"))}
+	if gcc != nil && gcc.MaxRuns > 0 {
+		opts = append(opts, gc.WithMaxRuns(gcc.MaxRuns))
+	}
+	history, err := gc.NewHistory(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	runner := gc.NewRunner(db, rs, history)
+	s.cleanups = append(s.cleanups, runner.Wait)
+	if gcc == nil || gcc.Schedule == "" {
+		return runner, nil, nil
+	}
+	schedule, err := cron.Parse(gcc.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+	scheduler := gc.NewScheduler(runner, schedule, logger,
+		gc.WithTransactionTTL(c.GetTransactionTTL),
+		gc.WithBusy(func() bool {
+			return runner.Holders() > 0 || len(s.rpSessions.List()) > 0
+		}),
+		// the scheduler is started once s.srv is set
+		gc.WithOnDone(func(run *gc.Run) { s.srv.ScheduledGCCompleted(context.Background(), run) }),
+	)
+	return runner, scheduler, nil
+}
+
+// drainPollInterval is how often Drain checks for remaining sessions
+const drainPollInterval = 100 * time.Millisecond
+
+// drainSessionIdle is how long Drain waits after the last upload-pack or
+// receive-pack request so that clients in between requests of a session can
+// carry on
+const drainSessionIdle = 2 * time.Second
+
+// Drain waits until no upload-pack or receive-pack request is in progress or
+// ended within drainSessionIdle, or until ctx is done. Sessions left idle for
+// longer are abandoned, and sessions saved to files are not waited for since
+// they can be resumed after a restart. StartDraining must be called first.
+func (s *Server) Drain(ctx context.Context) error {
+	if s.persistentSessions {
+		return nil
+	}
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for !s.srv.PackRequestsIdle(drainSessionIdle) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// StartDraining marks the server as not ready and refuses new upload-pack and
+// receive-pack sessions
+func (s *Server) StartDraining() {
+	s.srv.StartDraining()
+}
+
+// WaitForWebhooks waits for webhook payloads of past requests to be handed to
+// the dispatcher or for ctx to be done. Deliveries in progress are waited for
+// by Close.
+func (s *Server) WaitForWebhooks(ctx context.Context) error {
+	return s.srv.WaitForWebhooks(ctx)
+}
+
 func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	s.handler.ServeHTTP(rw, r)
 }
 
 func (s *Server) Close() error {
-	s.upSessions.Stop()
-	s.rpSessions.Stop()
 	for i := len(s.cleanups) - 1; i >= 0; i-- {
 		s.cleanups[i]()
 	}
@@ -0,0 +1,58 @@
+package wrgld
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// serveUntilSignal runs serve until it fails or SIGTERM or SIGINT is received.
+// On signal, the server stops being ready, new sessions are refused and
+// streams of events and changes end. After delay, so that load balancers stop
+// routing to the server, sessions with requests in progress are waited for,
+// then the listener is closed and requests in progress are waited for, then
+// webhook payloads are waited for. Each of the three waits lasts up to
+// timeout. Closing stores is left to the caller.
+func serveUntilSignal(srv *http.Server, server *Server, serve func() error, delay, timeout time.Duration, logger logr.Logger) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigCh)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-sigCh:
+		logger.Info("shutting down", "signal", sig.String(), "delay", delay, "timeout", timeout)
+	}
+	server.StartDraining()
+	time.Sleep(delay)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Drain(ctx); err != nil {
+		logger.Info("sessions still in progress at shutdown deadline")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error(err, "error waiting for requests in progress")
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.WaitForWebhooks(ctx); err != nil {
+		logger.Info("webhook payloads still pending at shutdown deadline")
+	}
+	logger.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,183 @@
+package wrgld
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wrgl/wrgl/pkg/local"
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+// TokensFilename is the file inside the repository directory that stores
+// hashed access tokens
+const TokensFilename = "tokens.json"
+
+func openTokenStore(cmd *cobra.Command) (*tokens.Store, error) {
+	dir, err := cmd.Flags().GetString("wrgl-dir")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir, err = local.FindWrglDir()
+		if err != nil {
+			return nil, err
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("repository not initialized in current directory. Initialize with command:\n  wrgl init")
+		}
+	}
+	return tokens.NewStore(filepath.Join(dir, TokensFilename))
+}
+
+func tokenCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Manage personal access tokens and service-account tokens.",
+		Long: strings.Join([]string{
+			"Manage personal access tokens and service-account tokens.",
+			"",
+			"Tokens are sent as bearer tokens in place of tokens issued by the authorization server,",
+			"which suits cron jobs and CI. Only a hash of each token is stored in the repository",
+			"directory, so a token is only shown once when it is created. Changes are picked up by",
+			"a running server without restart.",
+		}, "\n"),
+	}
+	cmd.PersistentFlags().String("wrgl-dir", "", "repository directory (defaults to <working_dir>/.wrgl)")
+	cmd.AddCommand(tokenCreateCmd())
+	cmd.AddCommand(tokenListCmd())
+	cmd.AddCommand(tokenRevokeCmd())
+	return cmd
+}
+
+func tokenCreateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create NAME",
+		Short: "Create a token and print its secret.",
+		Example: strings.Join([]string{
+			"  # create a read-only token for a user that expires in 30 days",
+			"  wrgld token create laptop --author-name \"John Doe\" --author-email john@domain.com --expires-in 720h",
+			"",
+			"  # create a service-account token that can push",
+			"  wrgld token create ci --service --scope write",
+		}, "\n"),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ts, err := openTokenStore(cmd)
+			if err != nil {
+				return err
+			}
+			scopes, err := cmd.Flags().GetStringSlice("scope")
+			if err != nil {
+				return err
+			}
+			service, err := cmd.Flags().GetBool("service")
+			if err != nil {
+				return err
+			}
+			authorName, err := cmd.Flags().GetString("author-name")
+			if err != nil {
+				return err
+			}
+			authorEmail, err := cmd.Flags().GetString("author-email")
+			if err != nil {
+				return err
+			}
+			expiresIn, err := cmd.Flags().GetDuration("expires-in")
+			if err != nil {
+				return err
+			}
+			tok := &tokens.Token{
+				Name:        args[0],
+				Kind:        tokens.KindPersonal,
+				Scopes:      scopes,
+				AuthorName:  authorName,
+				AuthorEmail: authorEmail,
+			}
+			if service {
+				tok.Kind = tokens.KindService
+				if tok.AuthorName == "" {
+					tok.AuthorName = tok.Name
+				}
+			} else if authorEmail == "" {
+				return fmt.Errorf("--author-email is required for personal tokens")
+			}
+			if expiresIn > 0 {
+				t := time.Now().Add(expiresIn)
+				tok.ExpiresAt = &t
+			}
+			tok, secret, err := ts.Create(tok)
+			if err != nil {
+				return err
+			}
+			cmd.Printf("Created %s token %s (id %s)\n", tok.Kind, tok.Name, tok.ID)
+			cmd.Println("Store the token now, it cannot be shown again:")
+			cmd.Println(secret)
+			return nil
+		},
+	}
+	cmd.Flags().StringSlice("scope", []string{tokens.ScopeRead}, "scope to grant: read, write or admin. Can be repeated")
+	cmd.Flags().Bool("service", false, "create a service-account token instead of a personal access token")
+	cmd.Flags().String("author-name", "", "author name of commits made with this token")
+	cmd.Flags().String("author-email", "", "author email of commits made with this token")
+	cmd.Flags().Duration("expires-in", 0, "expire the token after this duration (never expires if not set)")
+	return cmd
+}
+
+func formatTokenTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func tokenListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List tokens.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ts, err := openTokenStore(cmd)
+			if err != nil {
+				return err
+			}
+			sl, err := ts.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tKIND\tAUTHOR\tSCOPES\tEXPIRES\tLAST USED")
+			for _, tok := range sl {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					tok.ID, tok.Name, tok.Kind, tok.AuthorEmail, strings.Join(tok.Scopes, ","),
+					formatTokenTime(tok.ExpiresAt), formatTokenTime(tok.LastUsedAt),
+				)
+			}
+			return w.Flush()
+		},
+	}
+	return cmd
+}
+
+func tokenRevokeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "revoke ID",
+		Short: "Revoke a token.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ts, err := openTokenStore(cmd)
+			if err != nil {
+				return err
+			}
+			if err := ts.Revoke(args[0]); err != nil {
+				return err
+			}
+			cmd.Printf("Revoked token %s\n", args[0])
+			return nil
+		},
+	}
+	return cmd
+}
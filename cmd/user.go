@@ -0,0 +1,248 @@
+package wrgld
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/wrgl/wrgl/pkg/local"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/localidp"
+	"github.com/wrgl/wrgld/pkg/tokens"
+	"golang.org/x/term"
+)
+
+func openUserStore(cmd *cobra.Command) (*localidp.UserStore, error) {
+	dir, err := cmd.Flags().GetString("wrgl-dir")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		dir, err = local.FindWrglDir()
+		if err != nil {
+			return nil, err
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("repository not initialized in current directory. Initialize with command:\n  wrgl init")
+		}
+	}
+	wc, err := wrgldconf.OpenDefault(dir)
+	if err != nil {
+		return nil, err
+	}
+	lc := &wrgldconf.Local{}
+	if wc.Auth != nil && wc.Auth.Local != nil {
+		lc = wc.Auth.Local
+	}
+	return localidp.NewUserStore(lc.UsersPath(dir))
+}
+
+// readPassword reads password from the file given with --password-file, or
+// prompts for it if stdin is a terminal, or reads the first line of stdin
+func readPassword(cmd *cobra.Command) (string, error) {
+	fp, err := cmd.Flags().GetString("password-file")
+	if err != nil {
+		return "", err
+	}
+	if fp != "" {
+		b, err := os.ReadFile(fp)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		cmd.Print("Password: ")
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		cmd.Println()
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("error reading password from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func userCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "user",
+		Short: "Manage users of the built-in identity provider.",
+		Long: strings.Join([]string{
+			"Manage users of the built-in identity provider.",
+			"",
+			"The built-in identity provider is enabled with \"auth.local\" in wrgld config. Users",
+			"log in with \"wrgl credentials\" or any wrgl command that needs authorization, then",
+			"enter their username and password in the browser. Only bcrypt hashes of passwords",
+			"are stored. Changes are picked up by a running server without restart.",
+		}, "\n"),
+	}
+	cmd.PersistentFlags().String("wrgl-dir", "", "repository directory (defaults to <working_dir>/.wrgl)")
+	cmd.AddCommand(userAddCmd())
+	cmd.AddCommand(userUpdateCmd())
+	cmd.AddCommand(userPasswdCmd())
+	cmd.AddCommand(userListCmd())
+	cmd.AddCommand(userRemoveCmd())
+	return cmd
+}
+
+func userAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add USERNAME",
+		Short: "Add a user.",
+		Example: strings.Join([]string{
+			"  # add a user that can push, prompting for password",
+			"  wrgld user add john --name \"John Doe\" --email john@domain.com --scope write",
+			"",
+			"  # add a read-only user with password from a file",
+			"  wrgld user add jane --email jane@domain.com --password-file ./password.txt",
+		}, "\n"),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			us, err := openUserStore(cmd)
+			if err != nil {
+				return err
+			}
+			u := &localidp.User{Username: args[0]}
+			if u.Name, err = cmd.Flags().GetString("name"); err != nil {
+				return err
+			}
+			if u.Email, err = cmd.Flags().GetString("email"); err != nil {
+				return err
+			}
+			if u.Scopes, err = cmd.Flags().GetStringSlice("scope"); err != nil {
+				return err
+			}
+			password, err := readPassword(cmd)
+			if err != nil {
+				return err
+			}
+			if err = us.Add(u, password); err != nil {
+				return err
+			}
+			cmd.Printf("Added user %s\n", u.Username)
+			return nil
+		},
+	}
+	cmd.Flags().String("name", "", "full name, used as author name of commits")
+	cmd.Flags().String("email", "", "email, used as author email of commits")
+	cmd.Flags().StringSlice("scope", []string{tokens.ScopeRead}, "scope to grant: read, write or admin. Can be repeated")
+	cmd.Flags().String("password-file", "", "read password from file instead of stdin")
+	return cmd
+}
+
+func userUpdateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "update USERNAME",
+		Short: "Change name, email or scopes of a user.",
+		Example: strings.Join([]string{
+			"  # grant admin scope to a user",
+			"  wrgld user update john --scope admin",
+		}, "\n"),
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			us, err := openUserStore(cmd)
+			if err != nil {
+				return err
+			}
+			u, err := us.Get(args[0])
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("name") {
+				u.Name, _ = cmd.Flags().GetString("name")
+			}
+			if cmd.Flags().Changed("email") {
+				u.Email, _ = cmd.Flags().GetString("email")
+			}
+			if cmd.Flags().Changed("scope") {
+				u.Scopes, _ = cmd.Flags().GetStringSlice("scope")
+			}
+			if err = us.Update(u); err != nil {
+				return err
+			}
+			cmd.Printf("Updated user %s\n", u.Username)
+			return nil
+		},
+	}
+	cmd.Flags().String("name", "", "full name, used as author name of commits")
+	cmd.Flags().String("email", "", "email, used as author email of commits")
+	cmd.Flags().StringSlice("scope", nil, "scope to grant: read, write or admin. Can be repeated. Replaces existing scopes")
+	return cmd
+}
+
+func userPasswdCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "passwd USERNAME",
+		Short: "Change password of a user.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			us, err := openUserStore(cmd)
+			if err != nil {
+				return err
+			}
+			password, err := readPassword(cmd)
+			if err != nil {
+				return err
+			}
+			if err = us.SetPassword(args[0], password); err != nil {
+				return err
+			}
+			cmd.Printf("Changed password of user %s\n", args[0])
+			return nil
+		},
+	}
+	cmd.Flags().String("password-file", "", "read password from file instead of stdin")
+	return cmd
+}
+
+func userListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List users.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			us, err := openUserStore(cmd)
+			if err != nil {
+				return err
+			}
+			sl, err := us.List()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "USERNAME\tNAME\tEMAIL\tSCOPES")
+			for _, u := range sl {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Username, u.Name, u.Email, strings.Join(u.Scopes, ","))
+			}
+			return w.Flush()
+		},
+	}
+	return cmd
+}
+
+func userRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove USERNAME",
+		Short: "Remove a user.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			us, err := openUserStore(cmd)
+			if err != nil {
+				return err
+			}
+			if err := us.Remove(args[0]); err != nil {
+				return err
+			}
+			cmd.Printf("Removed user %s\n", args[0])
+			return nil
+		},
+	}
+	return cmd
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/wrgl/wrgl/pkg/factory"
 	"github.com/wrgl/wrgl/pkg/ref"
 	refhelpers "github.com/wrgl/wrgl/pkg/ref/helpers"
+	"github.com/wrgl/wrgld/pkg/server"
 	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
 )
 
@@ -49,14 +50,17 @@ func unauthenticate(t *testing.T, uri string) {
 	require.NoError(t, cs.Flush())
 }
 
-func httpError(t *testing.T, code int, message string) *apiclient.HTTPError {
+func httpError(t *testing.T, code int, message string, errCode server.ErrorCode) *apiclient.HTTPError {
 	err := &apiclient.HTTPError{
 		Code: code,
 		Body: &payload.Error{
 			Message: message,
 		},
 	}
-	b, merr := json.Marshal(err.Body)
+	b, merr := json.Marshal(struct {
+		payload.Error
+		Code server.ErrorCode `json:"code"`
+	}{*err.Body, errCode})
 	require.NoError(t, merr)
 	err.RawBody = b
 	return err
@@ -65,7 +69,7 @@ func httpError(t *testing.T, code int, message string) *apiclient.HTTPError {
 func assertCmdUnauthorized(t *testing.T, cmd *cobra.Command, url string) {
 	t.Helper()
 	assertCmdFailed(t, cmd, "",
-		httpError(t, http.StatusUnauthorized, "Unauthorized"),
+		httpError(t, http.StatusUnauthorized, "Unauthorized", server.CodeUnauthorized),
 	)
 }
 
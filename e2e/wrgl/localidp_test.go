@@ -0,0 +1,89 @@
+package e2e_wrgl_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	"github.com/pckhoi/uma/pkg/rp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	conffs "github.com/wrgl/wrgl/pkg/conf/fs"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldcmd "github.com/wrgl/wrgld/cmd"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/localidp"
+)
+
+func TestLocalIDPAuth(t *testing.T) {
+	rd, cleanUp := createRepoDir(t)
+	defer cleanUp()
+
+	users, err := localidp.NewUserStore(filepath.Join(rd.FullPath, wrgldconf.DefaultUsersFile))
+	require.NoError(t, err)
+	require.NoError(t, users.Add(&localidp.User{
+		Username: "jane",
+		Name:     "Jane Doe",
+		Email:    "jane@domain.com",
+		Scopes:   []string{"write"},
+	}, "secret"))
+	require.NoError(t, users.Add(&localidp.User{Username: "bob", Scopes: []string{"read"}}, "pass"))
+
+	cs := conffs.NewStore(rd.FullPath, conffs.LocalSource, "")
+	c, err := cs.Open()
+	require.NoError(t, err)
+	handler := &wrappedHandler{}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	c.BaseURL = ts.URL
+	srv, kp, _, err := wrgldcmd.NewServer(rd, nil, c, &wrgldconf.Config{
+		Auth: &wrgldconf.Auth{
+			Local: &wrgldconf.Local{},
+		},
+	}, testr.New(t), false)
+	require.NoError(t, err)
+	defer srv.Close()
+	assert.Nil(t, kp)
+	handler.h = srv
+
+	// login the same way "wrgl" does upon receiving an UMA ticket
+	newClient := func(username, password string) *apiclient.Client {
+		cli, err := apiclient.NewClient(ts.URL, testr.New(t), apiclient.WithUMATicketHandler(
+			func(asURI, ticket, oldRPT string, logger logr.Logger) (string, error) {
+				assert.Equal(t, ts.URL+"/oauth2", asURI)
+				kc, err := rp.NewKeycloakClient(asURI, "wrgl", "", http.DefaultClient)
+				if err != nil {
+					return "", err
+				}
+				creds, err := kc.AuthenticateUserWithPassword(username, password)
+				if err != nil {
+					return "", err
+				}
+				return kc.RequestRPT(creds.AccessToken, rp.RPTRequest{Ticket: ticket, RPT: oldRPT})
+			},
+		))
+		require.NoError(t, err)
+		return cli
+	}
+
+	_, err = newClient("jane", "wrong").GetRefs(nil, nil)
+	assert.Error(t, err)
+
+	reader := newClient("bob", "pass")
+	_, err = reader.GetRefs(nil, nil)
+	require.NoError(t, err)
+	_, err = reader.Commit("main", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	assert.Error(t, err)
+
+	writer := newClient("jane", "secret")
+	cr, err := writer.Commit("main", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	com, err := writer.GetCommit((*cr.Sum)[:])
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", com.AuthorName)
+	assert.Equal(t, "jane@domain.com", com.AuthorEmail)
+}
@@ -0,0 +1,87 @@
+package e2e_wrgl_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	conffs "github.com/wrgl/wrgl/pkg/conf/fs"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldcmd "github.com/wrgl/wrgld/cmd"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	oidctest "github.com/wrgl/wrgld/pkg/oidcauth/test"
+)
+
+func TestOIDCAuth(t *testing.T) {
+	rd, cleanUp := createRepoDir(t)
+	defer cleanUp()
+	iss := oidctest.NewIssuer(t)
+
+	cs := conffs.NewStore(rd.FullPath, conffs.LocalSource, "")
+	c, err := cs.Open()
+	require.NoError(t, err)
+	handler := &wrappedHandler{}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	c.BaseURL = ts.URL
+	srv, kp, _, err := wrgldcmd.NewServer(rd, nil, c, &wrgldconf.Config{
+		Auth: &wrgldconf.Auth{
+			OIDC: &wrgldconf.OIDC{
+				Issuer:   iss.URL,
+				ClientID: "wrgld",
+				Scopes: map[string][]string{
+					"read":  {"reader", "writer"},
+					"write": {"writer"},
+				},
+			},
+		},
+	}, testr.New(t), false)
+	require.NoError(t, err)
+	defer srv.Close()
+	assert.Nil(t, kp)
+	handler.h = srv
+
+	newClient := func(roles ...string) *apiclient.Client {
+		opts := []apiclient.ClientOption{}
+		if roles != nil {
+			opts = append(opts, apiclient.WithRelyingPartyToken(iss.Sign(t, jwt.MapClaims{
+				"sub":   "123",
+				"aud":   "wrgld",
+				"name":  "Jane Doe",
+				"email": "jane@domain.com",
+				"roles": roles,
+			})))
+		}
+		cli, err := apiclient.NewClient(ts.URL, testr.New(t), opts...)
+		require.NoError(t, err)
+		return cli
+	}
+
+	_, err = newClient().GetRefs(nil, nil)
+	assertHTTPCode(t, err, http.StatusUnauthorized)
+
+	_, err = newClient("reader").GetRefs(nil, nil)
+	require.NoError(t, err)
+	_, err = newClient("reader").Commit("main", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	assertHTTPCode(t, err, http.StatusUnauthorized)
+
+	writer := newClient("writer")
+	cr, err := writer.Commit("main", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	com, err := writer.GetCommit((*cr.Sum)[:])
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", com.AuthorName)
+	assert.Equal(t, "jane@domain.com", com.AuthorEmail)
+}
+
+func assertHTTPCode(t *testing.T, err error, code int) {
+	t.Helper()
+	v, ok := err.(*apiclient.HTTPError)
+	require.True(t, ok, "error was %v", err)
+	assert.Equal(t, code, v.Code)
+}
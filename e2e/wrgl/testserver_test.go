@@ -20,6 +20,7 @@ import (
 	"github.com/wrgl/wrgl/pkg/credentials"
 	"github.com/wrgl/wrgl/pkg/local"
 	wrgldcmd "github.com/wrgl/wrgld/cmd"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
 	"gopkg.in/dnaeon/go-vcr.v3/recorder"
 )
 
@@ -72,7 +73,7 @@ func newTestServer(t *testing.T, rd *local.RepoDir, cassetteName string, updateV
 	logger := testr.NewWithOptions(t, testr.Options{
 		Verbosity: 1,
 	})
-	srv, kp, resourceID, err := wrgldcmd.NewServer(rd, rec.GetDefaultClient(), c, logger, true)
+	srv, kp, resourceID, err := wrgldcmd.NewServer(rd, rec.GetDefaultClient(), c, &wrgldconf.Config{}, logger, true)
 	require.NoError(t, err)
 	handler.h = srv
 
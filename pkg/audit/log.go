@@ -0,0 +1,230 @@
+// Package audit keeps a durable, append-only trail of mutating actions such as
+// commits, transaction changes, pushes and garbage collection.
+package audit
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ActionCommit             = "commit"
+	ActionTransactionCreate  = "transaction.create"
+	ActionTransactionCommit  = "transaction.commit"
+	ActionTransactionDiscard = "transaction.discard"
+	ActionReceivePack        = "receive-pack"
+	ActionGarbageCollect     = "gc"
+)
+
+// RefUpdate is a ref changed by an action. OldSum is empty when the ref is
+// created, Sum is empty when it is deleted.
+type RefUpdate struct {
+	Ref    string `json:"ref"`
+	OldSum string `json:"oldSum,omitempty"`
+	Sum    string `json:"sum,omitempty"`
+}
+
+// Record describes a single mutating action
+type Record struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+
+	AuthorName  string `json:"authorName,omitempty"`
+	AuthorEmail string `json:"authorEmail,omitempty"`
+
+	// Subject identifies the credential used, such as the "sub" claim of a JWT
+	// or the id of a wrgld token
+	Subject   string `json:"subject,omitempty"`
+	ClientIP  string `json:"clientIp,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+
+	TransactionID string      `json:"transactionId,omitempty"`
+	Refs          []RefUpdate `json:"refs,omitempty"`
+
+	// Sum is the sum of the object created by the action, such as the commit
+	// created by a transaction commit
+	Sum string `json:"sum,omitempty"`
+}
+
+// Filter narrows down records returned by Log.List. Zero fields are ignored.
+type Filter struct {
+	Action        string
+	AuthorEmail   string
+	Subject       string
+	TransactionID string
+
+	// Ref matches records that updated this ref
+	Ref   string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+func (f *Filter) match(rec *Record) bool {
+	if f.Action != "" && f.Action != rec.Action {
+		return false
+	}
+	if f.AuthorEmail != "" && f.AuthorEmail != rec.AuthorEmail {
+		return false
+	}
+	if f.Subject != "" && f.Subject != rec.Subject {
+		return false
+	}
+	if f.TransactionID != "" && f.TransactionID != rec.TransactionID {
+		return false
+	}
+	if f.Ref != "" {
+		found := false
+		for _, u := range rec.Refs {
+			if u.Ref == f.Ref {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Log is an append-only log of records stored as newline delimited JSON.
+// Unlike other logs kept by wrgld, it is never compacted.
+type Log struct {
+	fp    string
+	mutex sync.Mutex
+}
+
+func NewLog(fp string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return nil, err
+	}
+	return &Log{fp: fp}, nil
+}
+
+// Record assigns an id and time to rec if they are not set, then appends it
+// to the log. The file is synced before returning.
+func (l *Log) Record(rec *Record) error {
+	if rec.ID == "" {
+		rec.ID = uuid.New().String()
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// List returns records matching f, most recent first
+func (l *Log) List(f *Filter) ([]*Record, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	file, err := os.Open(l.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Record{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	sl := []*Record{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		rec := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			// skip partially written line
+			continue
+		}
+		sl = append(sl, rec)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	result := []*Record{}
+	for i := len(sl) - 1; i >= 0; i-- {
+		if f != nil && !f.match(sl[i]) {
+			continue
+		}
+		result = append(result, sl[i])
+		if f != nil && f.Limit > 0 && len(result) >= f.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+var csvHeader = []string{
+	"id", "time", "action", "authorName", "authorEmail", "subject", "clientIp",
+	"requestId", "transactionId", "sum", "ref", "oldSum", "newSum",
+}
+
+// WriteCSV writes records as CSV. A record that updated multiple refs takes
+// one row per ref.
+func WriteCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		row := []string{
+			rec.ID, rec.Time.Format(time.RFC3339Nano), rec.Action, rec.AuthorName,
+			rec.AuthorEmail, rec.Subject, rec.ClientIP, rec.RequestID,
+			rec.TransactionID, rec.Sum,
+		}
+		if len(rec.Refs) == 0 {
+			if err := cw.Write(append(row, "", "", "")); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, u := range rec.Refs {
+			if err := cw.Write(append(row[:len(row):len(row)], u.Ref, u.OldSum, u.Sum)); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ClientIP returns the host part of remoteAddr
+func ClientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
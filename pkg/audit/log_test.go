@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	l, err := NewLog(fp)
+	require.NoError(t, err)
+	sl, err := l.List(nil)
+	require.NoError(t, err)
+	assert.Empty(t, sl)
+
+	start := time.Now()
+	require.NoError(t, l.Record(&Record{
+		Action:      ActionCommit,
+		AuthorEmail: "john@domain.com",
+		Subject:     "john",
+		Sum:         "abc",
+		Refs:        []RefUpdate{{Ref: "heads/main", Sum: "abc"}},
+	}))
+	require.NoError(t, l.Record(&Record{Action: ActionTransactionCreate, TransactionID: "123", AuthorEmail: "jane@domain.com"}))
+	require.NoError(t, l.Record(&Record{
+		Action:        ActionTransactionCommit,
+		TransactionID: "123",
+		AuthorEmail:   "jane@domain.com",
+		Refs: []RefUpdate{
+			{Ref: "heads/alpha", OldSum: "def", Sum: "ghi"},
+			{Ref: "heads/main", OldSum: "abc", Sum: "jkl"},
+		},
+	}))
+
+	// records persist across instances
+	l, err = NewLog(fp)
+	require.NoError(t, err)
+	sl, err = l.List(nil)
+	require.NoError(t, err)
+	require.Len(t, sl, 3)
+	assert.Equal(t, ActionTransactionCommit, sl[0].Action)
+	assert.Equal(t, ActionCommit, sl[2].Action)
+	assert.NotEmpty(t, sl[2].ID)
+	assert.False(t, sl[2].Time.Before(start))
+
+	for _, c := range []struct {
+		f       *Filter
+		actions []string
+	}{
+		{&Filter{Action: ActionCommit}, []string{ActionCommit}},
+		{&Filter{AuthorEmail: "jane@domain.com"}, []string{ActionTransactionCommit, ActionTransactionCreate}},
+		{&Filter{Subject: "john"}, []string{ActionCommit}},
+		{&Filter{TransactionID: "123", Limit: 1}, []string{ActionTransactionCommit}},
+		{&Filter{Ref: "heads/main"}, []string{ActionTransactionCommit, ActionCommit}},
+		{&Filter{Since: time.Now().Add(time.Hour)}, []string{}},
+		{&Filter{Until: start.Add(-time.Hour)}, []string{}},
+	} {
+		sl, err = l.List(c.f)
+		require.NoError(t, err)
+		actions := []string{}
+		for _, rec := range sl {
+			actions = append(actions, rec.Action)
+		}
+		assert.Equal(t, c.actions, actions, "%+v", c.f)
+	}
+
+	sl, err = l.List(&Filter{AuthorEmail: "jane@domain.com"})
+	require.NoError(t, err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(t, WriteCSV(buf, sl))
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 4)
+	assert.Equal(t, "id,time,action,authorName,authorEmail,subject,clientIp,requestId,transactionId,sum,ref,oldSum,newSum", string(lines[0]))
+	assert.Contains(t, string(lines[1]), ",transaction.commit,,jane@domain.com,,,,123,,heads/alpha,def,ghi")
+	assert.Contains(t, string(lines[2]), ",transaction.commit,,jane@domain.com,,,,123,,heads/main,abc,jkl")
+	assert.Contains(t, string(lines[3]), ",transaction.create,,jane@domain.com,,,,123,,,,")
+}
+
+func TestClientIP(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", ClientIP("127.0.0.1:5432"))
+	assert.Equal(t, "::1", ClientIP("[::1]:5432"))
+	assert.Equal(t, "pipe", ClientIP("pipe"))
+}
@@ -0,0 +1,85 @@
+// Package certauth authenticates requests with verified TLS client
+// certificates, mapping certificate subjects to authors and scopes.
+package certauth
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+// Identity is what a client certificate is mapped to
+type Identity struct {
+	// Subject is the distinguished name of the certificate subject
+	Subject string
+	Name    string
+	Email   string
+	Scopes  []string
+}
+
+// HasScopes returns true if all of the given scopes are granted
+func (i *Identity) HasScopes(scopes ...string) bool {
+	granted := tokens.ExpandScopes(i.Scopes)
+outer:
+	for _, s := range scopes {
+		for _, v := range granted {
+			if v == s {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+type identityKey struct{}
+
+func SetIdentity(r *http.Request, id *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// GetIdentity returns the identity of the client certificate that
+// authenticated the request, or nil if the request was not authenticated with
+// a client certificate
+func GetIdentity(r *http.Request) *Identity {
+	if i := r.Context().Value(identityKey{}); i != nil {
+		return i.(*Identity)
+	}
+	return nil
+}
+
+// Match returns the identity of the first mapping matching the certificate
+// subject, or nil if none matches
+func Match(mappings []wrgldconf.ClientCertificate, cert *x509.Certificate) *Identity {
+	dn := cert.Subject.String()
+	for _, m := range mappings {
+		if m.Subject == dn || m.Subject == cert.Subject.CommonName {
+			return &Identity{
+				Subject: dn,
+				Name:    m.Name,
+				Email:   m.Email,
+				Scopes:  m.Scopes,
+			}
+		}
+	}
+	return nil
+}
+
+// Middleware authenticates requests that present a verified client
+// certificate matching one of mappings and no Authorization header. Such
+// requests are passed to certHandler with the identity stored in the request
+// context, while other requests are passed to fallback untouched.
+func Middleware(mappings []wrgldconf.ClientCertificate, fallback, certHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if id := Match(mappings, r.TLS.VerifiedChains[0][0]); id != nil {
+				certHandler.ServeHTTP(rw, SetIdentity(r, id))
+				return
+			}
+		}
+		fallback.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,68 @@
+package certauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+func TestMiddleware(t *testing.T) {
+	mappings := []wrgldconf.ClientCertificate{
+		{Subject: "CN=ci,O=Example", Name: "CI", Email: "ci@example.com", Scopes: []string{"write"}},
+		{Subject: "reporter", Email: "reporter@example.com", Scopes: []string{"read"}},
+	}
+	ci := &x509.Certificate{Subject: pkix.Name{CommonName: "ci", Organization: []string{"Example"}}}
+	reporter := &x509.Certificate{Subject: pkix.Name{CommonName: "reporter", Organization: []string{"Other"}}}
+	stranger := &x509.Certificate{Subject: pkix.Name{CommonName: "ci", Organization: []string{"Other"}}}
+
+	var got *Identity
+	var fellBack bool
+	h := Middleware(mappings,
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			got, fellBack = GetIdentity(r), true
+		}),
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			got, fellBack = GetIdentity(r), false
+		}),
+	)
+	serve := func(cert *x509.Certificate, header http.Header) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	serve(ci, nil)
+	assert.False(t, fellBack)
+	assert.Equal(t, &Identity{Subject: "CN=ci,O=Example", Name: "CI", Email: "ci@example.com", Scopes: []string{"write"}}, got)
+	assert.True(t, got.HasScopes("read", "write"))
+	assert.False(t, got.HasScopes("admin"))
+
+	serve(reporter, nil)
+	assert.False(t, fellBack)
+	assert.Equal(t, "CN=reporter,O=Other", got.Subject)
+	assert.True(t, got.HasScopes("read"))
+	assert.False(t, got.HasScopes("write"))
+
+	serve(stranger, nil)
+	assert.True(t, fellBack)
+	assert.Nil(t, got)
+
+	// bearer tokens take precedence
+	serve(ci, http.Header{"Authorization": {"Bearer abc"}})
+	assert.True(t, fellBack)
+
+	serve(nil, nil)
+	assert.True(t, fellBack)
+}
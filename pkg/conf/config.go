@@ -0,0 +1,456 @@
+package wrgldconf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/cron"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFilename is the name of the wrgld config file inside the repository
+// directory. Unlike the repository config shared with wrgl, this file holds
+// settings that only concern wrgld.
+const DefaultFilename = "wrgld.yaml"
+
+type Webhook struct {
+	conf.Webhook `yaml:",inline"`
+
+	// Concurrency is the maximum number of deliveries in flight to this webhook.
+	// Defaults to 1
+	Concurrency int `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+
+	// Timeout is how long to wait for this webhook to answer each delivery.
+	// Defaults to 10s
+	Timeout conf.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+	// MaxAttempts is the number of delivery attempts before a delivery is moved to
+	// the dead-letter queue. Defaults to 10
+	MaxAttempts int `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"`
+
+	// Refs are glob patterns such as "heads/release-*". Only available to
+	// webhooks in wrgld config. When not empty, only events concerning at least
+	// one matching ref are sent to this webhook, and parts of an event
+	// concerning other refs are left out. Events that do not concern any ref
+	// such as gcCompleted are always sent.
+	Refs []string `yaml:"refs,omitempty" json:"refs,omitempty"`
+
+	// DiffStats adds the parent sum and a summary of changes (rows and columns
+	// added, removed or modified, and the data profile difference) to each
+	// commit in commit events sent to this webhook. Only available to webhooks
+	// in wrgld config.
+	DiffStats bool `yaml:"diffStats,omitempty" json:"diffStats,omitempty"`
+}
+
+// MatchRef returns true if this webhook has no ref patterns or if ref (e.g.
+// "heads/main") matches one of them
+func (wh *Webhook) MatchRef(ref string) bool {
+	if len(wh.Refs) == 0 {
+		return true
+	}
+	for _, pat := range wh.Refs {
+		if ok, _ := pathpkg.Match(pat, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RefPolicy restricts updates to refs matching any of its patterns. Reading is
+// not restricted.
+type RefPolicy struct {
+	// Refs are glob patterns such as "heads/main" or "heads/release-*"
+	Refs []string `yaml:"refs" json:"refs"`
+
+	// ReadOnly rejects every update to matching refs
+	ReadOnly bool `yaml:"readOnly,omitempty" json:"readOnly,omitempty"`
+
+	// TransactionOnly rejects updates to matching refs except those made by
+	// committing a transaction
+	TransactionOnly bool `yaml:"transactionOnly,omitempty" json:"transactionOnly,omitempty"`
+
+	// Owners are the only users allowed to update matching refs. Each entry is
+	// matched against the username, email, and roles or groups of the caller,
+	// as found in token claims. Anyone with the write scope may update matching
+	// refs if empty.
+	Owners []string `yaml:"owners,omitempty" json:"owners,omitempty"`
+}
+
+// MatchRef returns true if ref (e.g. "heads/main") matches one of the patterns
+func (p *RefPolicy) MatchRef(ref string) bool {
+	for _, pat := range p.Refs {
+		if ok, _ := pathpkg.Match(pat, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultRoleClaims are the claims read for roles and groups when
+// OIDC.RoleClaims is empty
+var DefaultRoleClaims = []string{"roles", "groups"}
+
+// OIDC configures authentication with any OpenID Connect provider in place of
+// Keycloak. Instead of UMA permissions, scopes are granted based on roles or
+// groups found in token claims.
+type OIDC struct {
+	// Issuer is the issuer URL. The provider is configured from the discovery
+	// document at {issuer}/.well-known/openid-configuration
+	Issuer string `yaml:"issuer" json:"issuer"`
+
+	// ClientID is checked against the audience of tokens. The audience is not
+	// checked if empty
+	ClientID string `yaml:"clientID,omitempty" json:"clientID,omitempty"`
+
+	// RoleClaims are the claims holding roles or groups of the user. Nested
+	// claims are reached with dotted paths such as "realm_access.roles".
+	// Defaults to DefaultRoleClaims
+	RoleClaims []string `yaml:"roleClaims,omitempty" json:"roleClaims,omitempty"`
+
+	// Scopes maps each scope ("read", "write" or "admin") to the roles or groups
+	// granted that scope. Role "*" grants the scope to every authenticated user.
+	// Write implies read, admin implies read and write.
+	Scopes map[string][]string `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+}
+
+// DefaultUsersFile is where local users are stored when Local.UsersFile is
+// empty
+const DefaultUsersFile = "users.json"
+
+// Local enables the built-in identity provider, for deployments without
+// Keycloak or any other authorization server. Users are managed with the
+// "wrgld user" command and log in with the OAuth2 device or password flow.
+type Local struct {
+	// UsersFile holds users and their bcrypt password hashes. Relative paths are
+	// resolved against the repository directory. Defaults to DefaultUsersFile
+	UsersFile string `yaml:"usersFile,omitempty" json:"usersFile,omitempty"`
+
+	// AccessTokenTTL is how long access tokens and RPTs are valid. Defaults to 1h
+	AccessTokenTTL conf.Duration `yaml:"accessTokenTTL,omitempty" json:"accessTokenTTL,omitempty"`
+
+	// RefreshTokenTTL is how long refresh tokens are valid. Defaults to 720h
+	RefreshTokenTTL conf.Duration `yaml:"refreshTokenTTL,omitempty" json:"refreshTokenTTL,omitempty"`
+}
+
+// UsersPath returns the path of the users file given the repository directory
+func (l *Local) UsersPath(dir string) string {
+	if l.UsersFile == "" {
+		return filepath.Join(dir, DefaultUsersFile)
+	}
+	if filepath.IsAbs(l.UsersFile) {
+		return l.UsersFile
+	}
+	return filepath.Join(dir, l.UsersFile)
+}
+
+// Keycloak holds wrgld-specific settings used when authorizing with Keycloak.
+// Credentials are kept in the repository config.
+type Keycloak struct {
+	// AdminRoles are Keycloak roles granted the admin scope (together with read
+	// and write) on the repository resource at startup
+	AdminRoles []string `yaml:"adminRoles,omitempty" json:"adminRoles,omitempty"`
+}
+
+type Auth struct {
+	OIDC *OIDC `yaml:"oidc,omitempty" json:"oidc,omitempty"`
+
+	Local *Local `yaml:"local,omitempty" json:"local,omitempty"`
+
+	Keycloak *Keycloak `yaml:"keycloak,omitempty" json:"keycloak,omitempty"`
+
+	// ClientCertificates authenticate requests that present a verified client
+	// certificate and no bearer token. Only used when client certificates are
+	// verified, see the --tls-client-ca flag.
+	ClientCertificates []ClientCertificate `yaml:"clientCertificates,omitempty" json:"clientCertificates,omitempty"`
+}
+
+// ClientCertificate maps the subject of a client certificate to an author and
+// scopes
+type ClientCertificate struct {
+	// Subject is matched against either the common name or the distinguished
+	// name of the certificate subject, such as "CN=ci,O=Example"
+	Subject string `yaml:"subject" json:"subject"`
+
+	// Name and Email are recorded as the author of commits
+	Name  string `yaml:"name,omitempty" json:"name,omitempty"`
+	Email string `yaml:"email,omitempty" json:"email,omitempty"`
+
+	// Scopes granted to the certificate: "read", "write" or "admin". Write
+	// implies read, admin implies read and write.
+	Scopes []string `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+}
+
+// Route classes that rate limits can be configured for
+const (
+	RouteClassRead        = "read"
+	RouteClassWrite       = "write"
+	RouteClassCommit      = "commit"
+	RouteClassUploadPack  = "upload-pack"
+	RouteClassReceivePack = "receive-pack"
+
+	// RouteClassLogin covers the token endpoint and the device login page of
+	// the built-in identity provider. Its clients are identified by IP address
+	// and username.
+	RouteClassLogin = "login"
+)
+
+// RateLimit throttles each client, identified by the subject of its
+// credential or by its IP address if anonymous
+type RateLimit struct {
+	// RequestsPerSecond is the sustained request rate of a token bucket. Zero
+	// means unlimited.
+	RequestsPerSecond float64 `yaml:"requestsPerSecond,omitempty" json:"requestsPerSecond,omitempty"`
+
+	// Burst is the size of the token bucket. Defaults to RequestsPerSecond
+	// rounded up.
+	Burst int `yaml:"burst,omitempty" json:"burst,omitempty"`
+
+	// MaxConcurrent caps how many requests a client can have in progress. For
+	// upload-pack and receive-pack, it caps open sessions instead. Zero means
+	// unlimited.
+	MaxConcurrent int `yaml:"maxConcurrent,omitempty" json:"maxConcurrent,omitempty"`
+}
+
+type RateLimits struct {
+	// Default applies to route classes not listed in Classes
+	Default *RateLimit `yaml:"default,omitempty" json:"default,omitempty"`
+
+	// Classes maps a route class ("read", "write", "commit", "upload-pack",
+	// "receive-pack" or "login") to its limit. Commits are not counted as
+	// writes.
+	Classes map[string]*RateLimit `yaml:"classes,omitempty" json:"classes,omitempty"`
+}
+
+// ForClass returns the limit of a route class, which is nil if unlimited
+func (c *RateLimits) ForClass(class string) *RateLimit {
+	if c == nil {
+		return nil
+	}
+	if v, ok := c.Classes[class]; ok {
+		return v
+	}
+	return c.Default
+}
+
+// Sessions controls where upload-pack and receive-pack sessions are kept in
+// between requests
+type Sessions struct {
+	// Dir is where sessions are saved, so that they survive restarts and can
+	// be resumed by any instance that mounts the same directory. Relative
+	// paths are resolved against the repository directory. Sessions are kept
+	// in memory if it is empty.
+	Dir string `yaml:"dir,omitempty" json:"dir,omitempty"`
+
+	// TTL is how long a session can last since it started. Defaults to 24h.
+	TTL conf.Duration `yaml:"ttl,omitempty" json:"ttl,omitempty"`
+}
+
+// GC schedules garbage collection in the background
+type GC struct {
+	// Schedule is a cron expression with minute, hour, day of month, month and
+	// day of week fields such as "0 3 * * *", or a descriptor such as
+	// "@daily". Times are in the local time zone of the server. Garbage
+	// collection only runs on request if it is empty.
+	Schedule string `yaml:"schedule,omitempty" json:"schedule,omitempty"`
+
+	// MaxRuns is the number of most recent runs kept in the history. Defaults
+	// to 100
+	MaxRuns int `yaml:"maxRuns,omitempty" json:"maxRuns,omitempty"`
+}
+
+// IngestLimits cap the size of uploaded data so that a single upload cannot
+// exhaust the disk. Zero fields mean unlimited.
+type IngestLimits struct {
+	// MaxCommitBytes caps the request body of a commit as well as the CSV
+	// file after decompression
+	MaxCommitBytes int64 `yaml:"maxCommitBytes,omitempty" json:"maxCommitBytes,omitempty"`
+
+	// MaxRows caps the number of rows of a committed CSV file, not counting
+	// the header
+	MaxRows int `yaml:"maxRows,omitempty" json:"maxRows,omitempty"`
+
+	// MaxColumns caps the number of columns of a committed CSV file
+	MaxColumns int `yaml:"maxColumns,omitempty" json:"maxColumns,omitempty"`
+
+	// MaxCellLength caps the length in bytes of each cell of a committed CSV
+	// file
+	MaxCellLength int `yaml:"maxCellLength,omitempty" json:"maxCellLength,omitempty"`
+
+	// MaxPushObjects caps the number of objects received in a single push
+	MaxPushObjects int `yaml:"maxPushObjects,omitempty" json:"maxPushObjects,omitempty"`
+
+	// MaxPushBytes caps the uncompressed size of packfiles received in a
+	// single push
+	MaxPushBytes int64 `yaml:"maxPushBytes,omitempty" json:"maxPushBytes,omitempty"`
+}
+
+// AccessLog controls which requests are logged and what is redacted from them
+type AccessLog struct {
+	// SampleRatio is the fraction of requests answered with a status below 400
+	// that are logged. Other requests are always logged. Defaults to 1.
+	SampleRatio *float64 `yaml:"sampleRatio,omitempty" json:"sampleRatio,omitempty"`
+
+	// Payloads logs JSON payloads of requests and responses that have one
+	Payloads bool `yaml:"payloads,omitempty" json:"payloads,omitempty"`
+
+	// RedactQueryParams are query parameters whose values are replaced with
+	// "REDACTED", in addition to DefaultRedactedQueryParams
+	RedactQueryParams []string `yaml:"redactQueryParams,omitempty" json:"redactQueryParams,omitempty"`
+
+	// RedactFields are fields of logged payloads whose values are replaced
+	// with "REDACTED" at any depth, in addition to DefaultRedactedFields
+	RedactFields []string `yaml:"redactFields,omitempty" json:"redactFields,omitempty"`
+}
+
+var (
+	DefaultRedactedQueryParams = []string{"access_token", "token", "client_secret"}
+	DefaultRedactedFields      = []string{"password", "secret", "secretToken", "token", "accessToken", "refreshToken", "clientSecret"}
+)
+
+type Config struct {
+	// Webhooks are registered in addition to webhooks in repository config. Unlike
+	// those, delivery of each webhook here can be tuned, and only webhooks here
+	// can filter events by ref or receive diff stats. Webhooks in repository
+	// config receive every event of their event types without diff stats.
+	Webhooks []Webhook `yaml:"webhooks,omitempty" json:"webhooks,omitempty"`
+
+	// MaxEvents is the number of most recent events retained so that clients of
+	// the /events endpoint can resume. Defaults to 1000
+	MaxEvents int `yaml:"maxEvents,omitempty" json:"maxEvents,omitempty"`
+
+	Auth *Auth `yaml:"auth,omitempty" json:"auth,omitempty"`
+
+	// RefPolicies restrict who can update which refs. Only the first policy
+	// matching a ref applies to it.
+	RefPolicies []RefPolicy `yaml:"refPolicies,omitempty" json:"refPolicies,omitempty"`
+
+	// RateLimits throttle clients. There is no limit if it is not set.
+	RateLimits *RateLimits `yaml:"rateLimits,omitempty" json:"rateLimits,omitempty"`
+
+	// IngestLimits cap commits and pushes. There is no limit if it is not set.
+	IngestLimits *IngestLimits `yaml:"ingestLimits,omitempty" json:"ingestLimits,omitempty"`
+
+	// AccessLog controls request logging. Every request is logged without
+	// payloads if it is not set.
+	AccessLog *AccessLog `yaml:"accessLog,omitempty" json:"accessLog,omitempty"`
+
+	// Sessions controls where sessions are kept. They are kept in memory if
+	// it is not set.
+	Sessions *Sessions `yaml:"sessions,omitempty" json:"sessions,omitempty"`
+
+	// GC schedules garbage collection. It only runs on request if it is not
+	// set.
+	GC *GC `yaml:"gc,omitempty" json:"gc,omitempty"`
+}
+
+// Open reads config at path. An empty config is returned if the file does not
+// exist.
+func Open(path string) (*Config, error) {
+	c := &Config{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	for _, wh := range c.Webhooks {
+		for _, pat := range wh.Refs {
+			if _, err := pathpkg.Match(pat, ""); err != nil {
+				return nil, fmt.Errorf("invalid ref pattern %q for webhook %s: %w", pat, wh.URL, err)
+			}
+		}
+	}
+	for i, p := range c.RefPolicies {
+		if len(p.Refs) == 0 {
+			return nil, fmt.Errorf("refPolicies[%d].refs is empty", i)
+		}
+		for _, pat := range p.Refs {
+			if _, err := pathpkg.Match(pat, ""); err != nil {
+				return nil, fmt.Errorf("invalid ref pattern %q in refPolicies[%d]: %w", pat, i, err)
+			}
+		}
+	}
+	if c.RateLimits != nil {
+		if rl := c.RateLimits.Default; rl != nil && (rl.RequestsPerSecond < 0 || rl.Burst < 0 || rl.MaxConcurrent < 0) {
+			return nil, fmt.Errorf("rateLimits.default cannot be negative")
+		}
+		for class, rl := range c.RateLimits.Classes {
+			switch class {
+			case RouteClassRead, RouteClassWrite, RouteClassCommit, RouteClassUploadPack, RouteClassReceivePack, RouteClassLogin:
+			default:
+				return nil, fmt.Errorf("invalid route class %q in rateLimits.classes", class)
+			}
+			if rl != nil && (rl.RequestsPerSecond < 0 || rl.Burst < 0 || rl.MaxConcurrent < 0) {
+				return nil, fmt.Errorf("rateLimits.classes.%s cannot be negative", class)
+			}
+		}
+	}
+	if l := c.IngestLimits; l != nil && (l.MaxCommitBytes < 0 || l.MaxRows < 0 || l.MaxColumns < 0 ||
+		l.MaxCellLength < 0 || l.MaxPushObjects < 0 || l.MaxPushBytes < 0) {
+		return nil, fmt.Errorf("ingestLimits cannot be negative")
+	}
+	if l := c.AccessLog; l != nil && l.SampleRatio != nil && (*l.SampleRatio < 0 || *l.SampleRatio > 1) {
+		return nil, fmt.Errorf("accessLog.sampleRatio must be between 0 and 1")
+	}
+	if c.Sessions != nil && c.Sessions.TTL < 0 {
+		return nil, fmt.Errorf("sessions.ttl cannot be negative")
+	}
+	if c.GC != nil {
+		if c.GC.Schedule != "" {
+			if _, err := cron.Parse(c.GC.Schedule); err != nil {
+				return nil, fmt.Errorf("gc.schedule: %w", err)
+			}
+		}
+		if c.GC.MaxRuns < 0 {
+			return nil, fmt.Errorf("gc.maxRuns cannot be negative")
+		}
+	}
+	if c.Auth != nil && c.Auth.OIDC != nil && c.Auth.Local != nil {
+		return nil, fmt.Errorf("auth.oidc and auth.local cannot be both set")
+	}
+	if c.Auth != nil {
+		for i, cc := range c.Auth.ClientCertificates {
+			if cc.Subject == "" {
+				return nil, fmt.Errorf("auth.clientCertificates[%d].subject is required", i)
+			}
+			for _, scope := range cc.Scopes {
+				switch scope {
+				case "read", "write", "admin":
+				default:
+					return nil, fmt.Errorf("invalid scope %q in auth.clientCertificates[%d].scopes", scope, i)
+				}
+			}
+		}
+	}
+	if c.Auth != nil && c.Auth.OIDC != nil {
+		if c.Auth.OIDC.Issuer == "" {
+			return nil, fmt.Errorf("auth.oidc.issuer is required")
+		}
+		for scope := range c.Auth.OIDC.Scopes {
+			switch scope {
+			case "read", "write", "admin":
+			default:
+				return nil, fmt.Errorf("invalid scope %q in auth.oidc.scopes", scope)
+			}
+		}
+	}
+	return c, nil
+}
+
+// OpenDefault reads config at DefaultFilename inside repository directory dir
+func OpenDefault(dir string) (*Config, error) {
+	return Open(filepath.Join(dir, DefaultFilename))
+}
@@ -0,0 +1,287 @@
+package wrgldconf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	// missing file
+	c, err := OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{}, c)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`webhooks:
+  - url: http://my-etl/hook
+    eventTypes: [commit, refUpdate]
+    secretToken: abc
+    concurrency: 4
+    timeout: 30s
+    maxAttempts: 5
+    refs: [heads/release-*]
+    diffStats: true
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{
+		Webhooks: []Webhook{
+			{
+				Webhook: conf.Webhook{
+					URL:         "http://my-etl/hook",
+					EventTypes:  []conf.WebhookEventType{conf.CommitEventType, conf.RefUpdateEventType},
+					SecretToken: "abc",
+				},
+				Concurrency: 4,
+				Timeout:     conf.Duration(30 * time.Second),
+				MaxAttempts: 5,
+				Refs:        []string{"heads/release-*"},
+				DiffStats:   true,
+			},
+		},
+	}, c)
+	assert.True(t, c.Webhooks[0].MatchRef("heads/release-1"))
+	assert.False(t, c.Webhooks[0].MatchRef("heads/main"))
+
+	// invalid ref pattern
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`webhooks:
+  - url: http://my-etl/hook
+    refs: ["heads/[a-"]
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  oidc:
+    issuer: https://idp.example.com
+    clientID: wrgld
+    roleClaims: [realm_access.roles]
+    scopes:
+      read: ["*"]
+      write: [data-engineers]
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{
+		Auth: &Auth{
+			OIDC: &OIDC{
+				Issuer:     "https://idp.example.com",
+				ClientID:   "wrgld",
+				RoleClaims: []string{"realm_access.roles"},
+				Scopes: map[string][]string{
+					"read":  {"*"},
+					"write": {"data-engineers"},
+				},
+			},
+		},
+	}, c)
+
+	// invalid scope
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  oidc:
+    issuer: https://idp.example.com
+    scopes:
+      delete: [admins]
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  local:
+    accessTokenTTL: 15m
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{
+		Auth: &Auth{
+			Local: &Local{
+				AccessTokenTTL: conf.Duration(15 * time.Minute),
+			},
+		},
+	}, c)
+	assert.Equal(t, filepath.Join(dir, DefaultUsersFile), c.Auth.Local.UsersPath(dir))
+	c.Auth.Local.UsersFile = "/etc/wrgld/users.json"
+	assert.Equal(t, "/etc/wrgld/users.json", c.Auth.Local.UsersPath(dir))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  keycloak:
+    adminRoles: [wrgl-admins]
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wrgl-admins"}, c.Auth.Keycloak.AdminRoles)
+
+	// oidc and local are mutually exclusive
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  oidc:
+    issuer: https://idp.example.com
+  local: {}
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`refPolicies:
+  - refs: [heads/main]
+    transactionOnly: true
+    owners: [data-leads]
+  - refs: [heads/archive-*, tags/*]
+    readOnly: true
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []RefPolicy{
+		{Refs: []string{"heads/main"}, TransactionOnly: true, Owners: []string{"data-leads"}},
+		{Refs: []string{"heads/archive-*", "tags/*"}, ReadOnly: true},
+	}, c.RefPolicies)
+	assert.True(t, c.RefPolicies[1].MatchRef("tags/v1"))
+	assert.False(t, c.RefPolicies[1].MatchRef("heads/main"))
+
+	// invalid ref policies
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`refPolicies:
+  - readOnly: true
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`refPolicies:
+  - refs: ["heads/[a-"]
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`rateLimits:
+  default:
+    requestsPerSecond: 10
+  classes:
+    commit:
+      requestsPerSecond: 0.5
+      maxConcurrent: 2
+    upload-pack:
+      maxConcurrent: 4
+    login:
+      requestsPerSecond: 1
+      burst: 5
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &RateLimit{RequestsPerSecond: 10}, c.RateLimits.ForClass(RouteClassRead))
+	assert.Equal(t, &RateLimit{RequestsPerSecond: 0.5, MaxConcurrent: 2}, c.RateLimits.ForClass(RouteClassCommit))
+	assert.Equal(t, &RateLimit{MaxConcurrent: 4}, c.RateLimits.ForClass(RouteClassUploadPack))
+	assert.Equal(t, &RateLimit{RequestsPerSecond: 1, Burst: 5}, c.RateLimits.ForClass(RouteClassLogin))
+
+	// invalid rate limits
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`rateLimits:
+  classes:
+    delete:
+      requestsPerSecond: 1
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`rateLimits:
+  default:
+    burst: -1
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`ingestLimits:
+  maxCommitBytes: 1048576
+  maxRows: 1000
+  maxPushObjects: 500
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &IngestLimits{
+		MaxCommitBytes: 1048576,
+		MaxRows:        1000,
+		MaxPushObjects: 500,
+	}, c.IngestLimits)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`ingestLimits:
+  maxColumns: -1
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`accessLog:
+  sampleRatio: 0.25
+  payloads: true
+  redactFields: [ssn]
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	ratio := 0.25
+	assert.Equal(t, &AccessLog{
+		SampleRatio:  &ratio,
+		Payloads:     true,
+		RedactFields: []string{"ssn"},
+	}, c.AccessLog)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`accessLog:
+  sampleRatio: 2
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`sessions:
+  dir: /var/lib/wrgld/sessions
+  ttl: 2h
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &Sessions{
+		Dir: "/var/lib/wrgld/sessions",
+		TTL: conf.Duration(2 * time.Hour),
+	}, c.Sessions)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`sessions:
+  ttl: -1h
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`gc:
+  schedule: "0 3 * * sun"
+  maxRuns: 20
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, &GC{Schedule: "0 3 * * sun", MaxRuns: 20}, c.GC)
+	for _, s := range []string{
+		"gc:\n  schedule: \"0 25 * * *\"\n",
+		"gc:\n  maxRuns: -1\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(s), 0644))
+		_, err = OpenDefault(dir)
+		assert.Error(t, err)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  clientCertificates:
+    - subject: CN=ci,O=Example
+      name: CI
+      email: ci@example.com
+      scopes: [write]
+`), 0644))
+	c, err = OpenDefault(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []ClientCertificate{
+		{Subject: "CN=ci,O=Example", Name: "CI", Email: "ci@example.com", Scopes: []string{"write"}},
+	}, c.Auth.ClientCertificates)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  clientCertificates:
+    - subject: ci
+      scopes: [delete]
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, DefaultFilename), []byte(`auth:
+  clientCertificates:
+    - scopes: [read]
+`), 0644))
+	_, err = OpenDefault(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,187 @@
+// Package cron parses standard 5-field cron expressions and computes when
+// they next fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLookahead is how far Next searches before giving up on expressions that
+// never fire, such as "0 0 30 2 *"
+const maxLookahead = 5 * 366 * 24 * time.Hour
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var fields = []field{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	// 7 is accepted as Sunday and folded into 0
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Schedule is a parsed cron expression. Times are matched in the location of
+// the time given to Next.
+type Schedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// domStar and dowStar are set if the day fields are "*". As in most cron
+	// implementations, a day matches if either day field matches when both
+	// are restricted.
+	domStar bool
+	dowStar bool
+}
+
+// Parse parses an expression made of minute, hour, day of month, month and
+// day of week fields. Each field is "*", a number, a range "a-b" or a comma
+// separated list of those, optionally followed by a step such as "*/15".
+// Months and days of week can be given by their 3-letter English names.
+// Descriptors @yearly, @monthly, @weekly, @daily and @hourly are also
+// accepted.
+func Parse(expr string) (*Schedule, error) {
+	s := &Schedule{expr: expr}
+	spec := strings.TrimSpace(expr)
+	if v, ok := descriptors[strings.ToLower(spec)]; ok {
+		spec = v
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected %d fields, found %d", expr, len(fields), len(parts))
+	}
+	bits := []*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range fields {
+		b, err := f.parse(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		*bits[i] = b
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domStar = parts[2] == "*"
+	s.dowStar = parts[4] == "*"
+	return s, nil
+}
+
+func (f *field) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepStr, f.name)
+			}
+			step = n
+		}
+		var lo, hi int
+		if rng == "*" {
+			lo, hi = f.min, f.max
+		} else {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(a); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(b); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("invalid range %q in %s field", rng, f.name)
+				}
+			} else if hasStep {
+				// "5/15" means every 15 starting from 5
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (f *field) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q in %s field", s, f.name)
+	}
+	return v, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first time after t that the schedule fires, with seconds
+// truncated. It returns the zero time if the schedule never fires.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Add(time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	limit := t.Add(maxLookahead)
+	for t.Before(limit) {
+		if s.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,69 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleNext(t *testing.T) {
+	from := time.Date(2022, 3, 15, 10, 20, 30, 0, time.UTC) // a Tuesday
+	for _, c := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2022, 3, 15, 10, 21, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2022, 3, 15, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2022, 3, 15, 10, 25, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2022, 3, 16, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2022, 3, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2022, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2022, 3, 20, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * sat,sun", time.Date(2022, 3, 19, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2022, 3, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 9-17/4 * * mon-fri", time.Date(2022, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 1 * fri", time.Date(2022, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(c.expr)
+		require.NoError(t, err, c.expr)
+		assert.Equal(t, c.next, s.Next(from), c.expr)
+		assert.Equal(t, c.expr, s.String())
+	}
+}
+
+func TestScheduleNextLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+7", 7*60*60)
+	s, err := Parse("0 3 * * *")
+	require.NoError(t, err)
+	assert.Equal(t,
+		time.Date(2022, 3, 16, 3, 0, 0, 0, loc),
+		s.Next(time.Date(2022, 3, 15, 18, 0, 0, 0, time.UTC).In(loc)),
+	)
+}
+
+func TestParseError(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@every",
+	} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
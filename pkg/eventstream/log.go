@@ -0,0 +1,283 @@
+// Package eventstream keeps a bounded log of recent repository events and
+// broadcasts new events to live subscribers such as the /events endpoint.
+package eventstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+const (
+	// DefaultMaxEvents is the number of most recent events kept by a Log
+	DefaultMaxEvents = 1000
+
+	subscriberBufferSize = 64
+
+	// ResetEventType is the type of the entry that Subscribe returns in place
+	// of a backlog when events after the requested sequence number are no
+	// longer retained. Subscribers should reload what they track, such as
+	// refs, then resume after the reset entry.
+	ResetEventType conf.WebhookEventType = "reset"
+)
+
+// Entry is an event as it was published
+type Entry struct {
+	// Seq is a sequence number that increases with each event. It is used as
+	// SSE event id.
+	Seq  uint64                `json:"seq"`
+	Type conf.WebhookEventType `json:"type"`
+
+	// Refs are refs that the event concerns
+	Refs []string        `json:"refs,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// MatchPrefixes returns true if prefixes is empty, if this entry concerns no
+// ref such as a garbage collection, or if one of the refs of this entry starts
+// with one of prefixes
+func (e *Entry) MatchPrefixes(prefixes []string) bool {
+	if len(prefixes) == 0 || len(e.Refs) == 0 {
+		return true
+	}
+	for _, r := range e.Refs {
+		for _, p := range prefixes {
+			if strings.HasPrefix(r, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type subscriber struct {
+	ch chan *Entry
+}
+
+// send returns false if the subscriber buffer is full
+func (s *subscriber) send(entries []*Entry) bool {
+	for _, e := range entries {
+		select {
+		case s.ch <- e:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Log keeps the most recent events in memory, and optionally in a file so that
+// they survive restarts. It implements webhook.EventSink.
+type Log struct {
+	entries   []*Entry
+	maxEvents int
+	seq       uint64
+	fp        string
+	count     int
+	subs      map[*subscriber]struct{}
+	logger    logr.Logger
+	mutex     sync.Mutex
+}
+
+type LogOption func(l *Log)
+
+func WithMaxEvents(n int) LogOption {
+	return func(l *Log) {
+		l.maxEvents = n
+	}
+}
+
+// WithFile persists events as newline delimited JSON at fp
+func WithFile(fp string) LogOption {
+	return func(l *Log) {
+		l.fp = fp
+	}
+}
+
+func NewLog(logger logr.Logger, opts ...LogOption) (*Log, error) {
+	l := &Log{
+		maxEvents: DefaultMaxEvents,
+		subs:      map[*subscriber]struct{}{},
+		logger:    logger.WithName("EventLog"),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.fp != "" {
+		if err := l.load(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *Log) load() error {
+	f, err := os.Open(l.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		e := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// skip partially written line
+			continue
+		}
+		l.count++
+		l.push(e)
+	}
+	return scanner.Err()
+}
+
+func (l *Log) push(e *Entry) {
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.maxEvents {
+		l.entries = l.entries[len(l.entries)-l.maxEvents:]
+	}
+	if e.Seq > l.seq {
+		l.seq = e.Seq
+	}
+}
+
+// persist appends entries to the file, rewriting it when it grows to twice the
+// maximum number of events
+func (l *Log) persist(entries []*Entry) error {
+	if l.count+len(entries) > l.maxEvents*2 {
+		return l.rewrite()
+	}
+	f, err := os.OpenFile(l.fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	l.count += len(entries)
+	return f.Close()
+}
+
+func (l *Log) rewrite() error {
+	tmp := l.fp + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range l.entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	l.count = len(l.entries)
+	return os.Rename(tmp, l.fp)
+}
+
+// Publish appends events to the log and sends them to subscribers
+func (l *Log) Publish(evts ...webhook.Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	entries := make([]*Entry, 0, len(evts))
+	for _, evt := range evts {
+		b, err := json.Marshal(evt)
+		if err != nil {
+			l.logger.Error(err, "error marshaling event", "type", evt.GetType())
+			continue
+		}
+		e := &Entry{
+			Seq:  l.seq + 1,
+			Type: evt.GetType(),
+			Refs: webhook.EventRefs(evt),
+			Data: b,
+		}
+		l.push(e)
+		entries = append(entries, e)
+	}
+	if l.fp != "" {
+		if err := l.persist(entries); err != nil {
+			l.logger.Error(err, "error persisting events")
+		}
+	}
+	for sub := range l.subs {
+		if !sub.send(entries) {
+			// subscriber is too slow, it can resume with the last event id it
+			// received
+			l.logger.Info("dropping slow subscriber")
+			delete(l.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// Since returns retained entries with sequence number greater than seq
+func (l *Log) Since(seq uint64) []*Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.since(seq)
+}
+
+func (l *Log) since(seq uint64) []*Entry {
+	i := len(l.entries)
+	for i > 0 && l.entries[i-1].Seq > seq {
+		i--
+	}
+	result := make([]*Entry, len(l.entries)-i)
+	copy(result, l.entries[i:])
+	return result
+}
+
+// missed returns true if entries published after seq are no longer retained,
+// or if seq was never published, such as when the log was not persisted across
+// a restart
+func (l *Log) missed(seq uint64) bool {
+	if seq > l.seq {
+		return true
+	}
+	if len(l.entries) == 0 {
+		return seq < l.seq
+	}
+	return seq+1 < l.entries[0].Seq
+}
+
+// Subscribe returns retained entries published after seq and a channel that
+// receives entries published from now on. If some entries after seq are no
+// longer retained, the backlog is a single entry of ResetEventType whose
+// sequence number is that of the last published entry. The channel is closed
+// when cancel is called or when the subscriber falls too far behind.
+func (l *Log) Subscribe(seq uint64) (backlog []*Entry, ch <-chan *Entry, cancel func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sub := &subscriber{ch: make(chan *Entry, subscriberBufferSize)}
+	l.subs[sub] = struct{}{}
+	if l.missed(seq) {
+		backlog = []*Entry{{Seq: l.seq, Type: ResetEventType, Data: json.RawMessage("{}")}}
+	} else {
+		backlog = l.since(seq)
+	}
+	return backlog, sub.ch, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if _, ok := l.subs[sub]; ok {
+			delete(l.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
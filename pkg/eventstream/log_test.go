@@ -0,0 +1,90 @@
+package eventstream
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+func seqs(sl []*Entry) (result []uint64) {
+	for _, e := range sl {
+		result = append(result, e.Seq)
+	}
+	return
+}
+
+func TestLog(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "events.jsonl")
+	l, err := NewLog(testr.New(t), WithFile(fp), WithMaxEvents(3))
+	require.NoError(t, err)
+	assert.Empty(t, l.Since(0))
+
+	backlog, ch, cancel := l.Subscribe(0)
+	assert.Empty(t, backlog)
+	l.Publish(
+		&webhook.RefUpdateEvent{Ref: "heads/main", Sum: "abc"},
+		&webhook.CommitEvent{Commits: []webhook.Commit{{Ref: "heads/dev", Sum: "def"}}},
+	)
+	e := <-ch
+	assert.Equal(t, uint64(1), e.Seq)
+	assert.Equal(t, conf.RefUpdateEventType, e.Type)
+	assert.Equal(t, []string{"heads/main"}, e.Refs)
+	assert.Contains(t, string(e.Data), `"sum":"abc"`)
+	e = <-ch
+	assert.Equal(t, uint64(2), e.Seq)
+	assert.Equal(t, []string{"heads/dev"}, e.Refs)
+	assert.True(t, e.MatchPrefixes(nil))
+	assert.True(t, e.MatchPrefixes([]string{"heads/d"}))
+	assert.False(t, e.MatchPrefixes([]string{"heads/m", "tags/"}))
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	// only the most recent events are retained
+	l.Publish(&webhook.GCEvent{}, &webhook.GCEvent{})
+	assert.Equal(t, []uint64{2, 3, 4}, seqs(l.Since(0)))
+	// events without refs are never filtered out
+	assert.True(t, l.Since(3)[0].MatchPrefixes([]string{"heads/d"}))
+	assert.Equal(t, []uint64{4}, seqs(l.Since(3)))
+	assert.Empty(t, l.Since(4))
+
+	// events survive restart
+	l, err = NewLog(testr.New(t), WithFile(fp), WithMaxEvents(3))
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 3, 4}, seqs(l.Since(0)))
+	l.Publish(&webhook.GCEvent{}, &webhook.GCEvent{}, &webhook.GCEvent{})
+	l, err = NewLog(testr.New(t), WithFile(fp), WithMaxEvents(3))
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5, 6, 7}, seqs(l.Since(0)))
+
+	// subscribers that missed events are told to reset
+	for seq, backlog := range map[uint64][]uint64{4: {5, 6, 7}, 7: nil, 3: {7}, 8: {7}} {
+		sl, _, cancel := l.Subscribe(seq)
+		cancel()
+		assert.Equal(t, backlog, seqs(sl), "seq %d", seq)
+		if seq == 3 || seq == 8 {
+			assert.Equal(t, ResetEventType, sl[0].Type)
+			assert.True(t, sl[0].MatchPrefixes([]string{"heads/main"}))
+		}
+	}
+}
+
+func TestLogSlowSubscriber(t *testing.T) {
+	l, err := NewLog(testr.New(t))
+	require.NoError(t, err)
+	_, ch, cancel := l.Subscribe(0)
+	defer cancel()
+	for i := 0; i <= subscriberBufferSize; i++ {
+		l.Publish(&webhook.GCEvent{})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	assert.Equal(t, subscriberBufferSize, n)
+}
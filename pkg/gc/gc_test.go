@@ -0,0 +1,300 @@
+package gc
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/objects"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgld/pkg/cron"
+)
+
+func statuses(sl []*Run) (result []string) {
+	for _, run := range sl {
+		result = append(result, run.Status)
+	}
+	return
+}
+
+func TestHistory(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "gc_history.jsonl")
+	h, err := NewHistory(WithFile(fp), WithMaxRuns(2))
+	require.NoError(t, err)
+	assert.Empty(t, h.List())
+
+	require.NoError(t, h.Add(&Run{Status: StatusSuccess}))
+	require.NoError(t, h.Add(&Run{Status: StatusFailure}))
+	require.NoError(t, h.Add(&Run{Status: StatusSkipped}))
+	assert.Equal(t, []string{StatusSkipped, StatusFailure}, statuses(h.List()))
+
+	// runs survive restart
+	for i := 0; i < 3; i++ {
+		h, err = NewHistory(WithFile(fp), WithMaxRuns(2))
+		require.NoError(t, err)
+		assert.Equal(t, []string{StatusSkipped, StatusFailure}, statuses(h.List()))
+	}
+	require.NoError(t, h.Add(&Run{Status: StatusSuccess}))
+	require.NoError(t, h.Add(&Run{Status: StatusSuccess}))
+	h, err = NewHistory(WithFile(fp), WithMaxRuns(2))
+	require.NoError(t, err)
+	assert.Equal(t, []string{StatusSuccess, StatusSuccess}, statuses(h.List()))
+	assert.LessOrEqual(t, h.count, 4)
+}
+
+func TestRunner(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	h, err := NewHistory()
+	require.NoError(t, err)
+	r := NewRunner(db, rs, h)
+
+	sum1, c1 := factory.CommitRandom(t, db, nil)
+	require.NoError(t, ref.CommitHead(rs, "main", sum1, c1, nil))
+	sum2, _ := factory.CommitRandom(t, db, nil)
+
+	run, err := r.Run(TriggerManual, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, TriggerManual, run.Trigger)
+	assert.Equal(t, StatusSuccess, run.Status)
+	assert.Equal(t, 1, run.Reclaimed["commit"])
+	assert.Equal(t, 1, run.Reclaimed["table"])
+	assert.True(t, objects.CommitExist(db, sum1))
+	assert.False(t, objects.CommitExist(db, sum2))
+	assert.False(t, r.Running())
+
+	// only one run at a time
+	r.lock.Lock()
+	_, err = r.Run(TriggerManual, time.Hour)
+	assert.Equal(t, ErrRunning, err)
+	r.lock.Unlock()
+
+	st := r.Status()
+	assert.False(t, st.Running)
+	assert.Empty(t, st.Schedule)
+	assert.Nil(t, st.NextRun)
+	assert.Equal(t, run, st.LastRun)
+	assert.Equal(t, []*Run{run}, st.Runs)
+}
+
+func TestScheduler(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	h, err := NewHistory()
+	require.NoError(t, err)
+	r := NewRunner(db, rs, h)
+	sched, err := cron.Parse("0 3 * * *")
+	require.NoError(t, err)
+	var busy int32 = 1
+	done := make(chan *Run, 1)
+	s := NewScheduler(r, sched, testr.New(t), WithBusy(func() bool {
+		return atomic.LoadInt32(&busy) == 1
+	}), WithOnDone(func(run *Run) { done <- run }))
+	// the schedule fires shortly after starting
+	now := time.Date(2022, 1, 1, 2, 59, 59, 990000000, time.UTC)
+	s.now = func() time.Time { return now }
+
+	s.Start()
+	require.Eventually(t, func() bool { return len(h.List()) > 0 }, time.Second, 10*time.Millisecond)
+	atomic.StoreInt32(&busy, 0)
+	require.Eventually(t, func() bool { return r.Status().LastRun != nil }, time.Second, 10*time.Millisecond)
+	s.Stop()
+
+	st := r.Status()
+	assert.Equal(t, "0 3 * * *", st.Schedule)
+	assert.Equal(t, time.Date(2022, 1, 1, 3, 0, 0, 0, time.UTC), *st.NextRun)
+	runs := st.Runs
+	last := runs[len(runs)-1]
+	assert.Equal(t, StatusSkipped, last.Status)
+	assert.Equal(t, TriggerScheduled, last.Trigger)
+	assert.Equal(t, "pushes in progress", last.Error)
+	assert.Equal(t, StatusSuccess, st.LastRun.Status)
+	assert.Equal(t, TriggerScheduled, st.LastRun.Trigger)
+	// skipped runs are not reported
+	assert.Equal(t, st.LastRun.StartedAt, (<-done).StartedAt)
+	assert.Empty(t, done)
+}
+
+func TestDryRun(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	r := NewRunner(db, rs, nil)
+
+	rep, err := r.DryRun(time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, rep.Transactions)
+	assert.Empty(t, rep.Commits)
+
+	sum1, c1 := factory.CommitRandom(t, db, nil)
+	require.NoError(t, ref.CommitHead(rs, "main", sum1, c1, nil))
+	sum2, c2 := factory.CommitRandom(t, db, nil)
+	sum3, c3 := factory.CommitRandom(t, db, [][]byte{sum1})
+	tid, err := rs.NewTransaction(&ref.Transaction{Status: ref.TSInProgress, Begin: time.Now().Add(-2 * time.Hour)})
+	require.NoError(t, err)
+	require.NoError(t, ref.SaveTransactionRef(rs, *tid, "main", sum3))
+
+	rep, err = r.DryRun(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{tid.String()}, rep.Transactions)
+	sums := func(sl []*Object) (result []string) {
+		for _, obj := range sl {
+			assert.Greater(t, obj.Bytes, int64(0))
+			result = append(result, obj.Sum)
+		}
+		return
+	}
+	assert.ElementsMatch(t, []string{hex.EncodeToString(sum2), hex.EncodeToString(sum3)}, sums(rep.Commits))
+	assert.ElementsMatch(t, []string{hex.EncodeToString(c2.Table), hex.EncodeToString(c3.Table)}, sums(rep.Tables))
+	var blocks, blockIndices int
+	for _, sum := range [][]byte{c2.Table, c3.Table} {
+		tbl, err := objects.GetTable(db, sum)
+		require.NoError(t, err)
+		blocks += len(tbl.Blocks)
+		blockIndices += len(tbl.BlockIndices)
+	}
+	assert.Len(t, sums(rep.Blocks), blocks)
+	assert.Len(t, sums(rep.BlockIndices), blockIndices)
+	var total int64
+	for _, sl := range [][]*Object{rep.Commits, rep.Tables, rep.Blocks, rep.BlockIndices} {
+		for _, obj := range sl {
+			total += obj.Bytes
+		}
+	}
+	assert.Equal(t, total, rep.Bytes)
+
+	// nothing is removed
+	assert.True(t, objects.CommitExist(db, sum2))
+	_, err = rs.GetTransaction(*tid)
+	require.NoError(t, err)
+
+	// a run removes what was reported
+	run, err := r.Run(TriggerManual, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"transaction": 1,
+		"commit":      len(rep.Commits),
+		"table":       len(rep.Tables),
+		"block":       len(rep.Blocks),
+		"block_index": len(rep.BlockIndices),
+	}, run.Reclaimed)
+	rep, err = r.DryRun(time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, rep.Transactions)
+	assert.Empty(t, rep.Commits)
+}
+
+func TestStart(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	h, err := NewHistory()
+	require.NoError(t, err)
+	r := NewRunner(db, rs, h)
+	sum, _ := factory.CommitRandom(t, db, nil)
+
+	done := make(chan *Job, 2)
+	wait := func(id uuid.UUID) *Job {
+		t.Helper()
+		j := <-done
+		assert.Equal(t, id, j.ID)
+		polled, ok := r.Job(id)
+		require.True(t, ok)
+		assert.Equal(t, j, polled)
+		return j
+	}
+
+	j, err := r.Start(TriggerManual, time.Hour, true, func(j *Job) { done <- j })
+	require.NoError(t, err)
+	assert.True(t, j.DryRun)
+	j = wait(j.ID)
+	assert.Equal(t, StatusSuccess, j.Status)
+	assert.Empty(t, j.Phase)
+	require.NotNil(t, j.FinishedAt)
+	require.NotNil(t, j.Report)
+	assert.Len(t, j.Report.Commits, 1)
+	assert.True(t, objects.CommitExist(db, sum))
+	assert.Empty(t, h.List())
+
+	// runs hold the lock until they finish
+	r.lock.Lock()
+	_, err = r.Start(TriggerManual, time.Hour, false, nil)
+	assert.Equal(t, ErrRunning, err)
+	r.lock.Unlock()
+
+	j, err = r.Start(TriggerManual, time.Hour, false, func(j *Job) { done <- j })
+	require.NoError(t, err)
+	j = wait(j.ID)
+	assert.Equal(t, StatusSuccess, j.Status)
+	assert.Nil(t, j.Report)
+	assert.Equal(t, 1, j.Reclaimed["commit"])
+	assert.False(t, objects.CommitExist(db, sum))
+	r.Wait()
+	require.Len(t, h.List(), 1)
+	assert.Equal(t, TriggerManual, h.List()[0].Trigger)
+	assert.True(t, r.lock.TryLock())
+	r.lock.Unlock()
+
+	_, ok := r.Job(uuid.New())
+	assert.False(t, ok)
+}
+
+func TestAcquire(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	h, err := NewHistory()
+	require.NoError(t, err)
+	r := NewRunner(db, rs, h)
+	sum, _ := factory.CommitRandom(t, db, nil)
+	started := time.Now()
+
+	release1, err := r.Acquire()
+	require.NoError(t, err)
+	release2, err := r.Acquire()
+	require.NoError(t, err)
+	assert.Equal(t, 2, r.Holders())
+	release2()
+	release2()
+	assert.Equal(t, 1, r.Holders())
+
+	// runs wait for holders and hold off new ones meanwhile
+	done := make(chan *Job, 1)
+	_, err = r.Start(TriggerManual, time.Hour, false, func(j *Job) { done <- j })
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		release, err := r.Acquire()
+		if err == nil {
+			release()
+		}
+		return err == ErrCollecting
+	}, time.Second, time.Millisecond)
+	assert.True(t, objects.CommitExist(db, sum))
+	assert.False(t, r.CollectedSince(started))
+	release1()
+	j := <-done
+	assert.Equal(t, StatusSuccess, j.Status)
+	assert.False(t, objects.CommitExist(db, sum))
+	assert.Equal(t, 0, r.Holders())
+	assert.True(t, r.CollectedSince(started))
+
+	release, err := r.Acquire()
+	require.NoError(t, err)
+	release()
+
+	// the last run is remembered across restarts
+	r = NewRunner(db, rs, h)
+	assert.True(t, r.CollectedSince(started))
+	assert.False(t, r.CollectedSince(time.Now()))
+}
@@ -0,0 +1,168 @@
+package gc
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRuns is the number of runs kept by a history unless
+// WithMaxRuns is given
+const DefaultMaxRuns = 100
+
+const (
+	TriggerManual    = "manual"
+	TriggerScheduled = "scheduled"
+
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+	StatusSkipped = "skipped"
+)
+
+// Run is a single garbage collection run. Skipped runs have the same start and
+// finish time, and the reason they were skipped as error.
+type Run struct {
+	Trigger    string    `json:"trigger"`
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Error      string    `json:"error,omitempty"`
+
+	// Reclaimed is the number of objects removed by type: "transaction",
+	// "commit", "table", "block" or "block_index"
+	Reclaimed map[string]int `json:"reclaimed,omitempty"`
+}
+
+// History keeps the most recent runs in memory, and optionally in a file so
+// that they survive restarts
+type History struct {
+	runs    []*Run
+	maxRuns int
+	fp      string
+	count   int
+	mutex   sync.Mutex
+}
+
+type HistoryOption func(h *History)
+
+func WithMaxRuns(n int) HistoryOption {
+	return func(h *History) {
+		h.maxRuns = n
+	}
+}
+
+// WithFile persists runs as newline delimited JSON at fp
+func WithFile(fp string) HistoryOption {
+	return func(h *History) {
+		h.fp = fp
+	}
+}
+
+func NewHistory(opts ...HistoryOption) (*History, error) {
+	h := &History{maxRuns: DefaultMaxRuns}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.fp != "" {
+		if err := os.MkdirAll(filepath.Dir(h.fp), 0755); err != nil {
+			return nil, err
+		}
+		if err := h.load(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *History) load() error {
+	f, err := os.Open(h.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		run := &Run{}
+		if err := json.Unmarshal(scanner.Bytes(), run); err != nil {
+			// skip partially written line
+			continue
+		}
+		h.count++
+		h.push(run)
+	}
+	return scanner.Err()
+}
+
+func (h *History) push(run *Run) {
+	h.runs = append(h.runs, run)
+	if len(h.runs) > h.maxRuns {
+		h.runs = h.runs[len(h.runs)-h.maxRuns:]
+	}
+}
+
+// persist appends run to the file, rewriting it when it grows to twice the
+// maximum number of runs
+func (h *History) persist(run *Run) error {
+	if h.count+1 > h.maxRuns*2 {
+		return h.rewrite()
+	}
+	f, err := os.OpenFile(h.fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(run); err != nil {
+		f.Close()
+		return err
+	}
+	h.count++
+	return f.Close()
+}
+
+func (h *History) rewrite() error {
+	tmp := h.fp + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, run := range h.runs {
+		if err := enc.Encode(run); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	h.count = len(h.runs)
+	return os.Rename(tmp, h.fp)
+}
+
+// Add appends run to the history. The run is kept in memory even if it
+// cannot be persisted.
+func (h *History) Add(run *Run) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.push(run)
+	if h.fp != "" {
+		return h.persist(run)
+	}
+	return nil
+}
+
+// List returns runs, most recent first
+func (h *History) List() []*Run {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	sl := make([]*Run, 0, len(h.runs))
+	for i := len(h.runs) - 1; i >= 0; i-- {
+		sl = append(sl, h.runs[i])
+	}
+	return sl
+}
@@ -0,0 +1,142 @@
+package gc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxJobs is the number of most recent jobs kept by a runner
+const maxJobs = 100
+
+// JobRunning is the status of a job in progress. Finished jobs have status
+// StatusSuccess or StatusFailure.
+const JobRunning = "running"
+
+// Job is the progress or outcome of a run started with Runner.Start
+type Job struct {
+	ID         uuid.UUID  `json:"id"`
+	DryRun     bool       `json:"dryRun,omitempty"`
+	Status     string     `json:"status"`
+	Phase      string     `json:"phase,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	// Reclaimed is the number of objects removed so far by type
+	Reclaimed map[string]int `json:"reclaimed,omitempty"`
+
+	// Report is what a dry run found to remove, set once it finishes
+	Report *Report `json:"report,omitempty"`
+}
+
+type job struct {
+	id        uuid.UUID
+	dryRun    bool
+	startedAt time.Time
+	rec       *reclaimed
+
+	mutex      sync.Mutex
+	phase      string
+	finishedAt time.Time
+	err        error
+	report     *Report
+}
+
+func (j *job) setPhase(phase string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.phase = phase
+}
+
+func (j *job) finish(report *Report, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.finishedAt = time.Now()
+	j.report = report
+	j.err = err
+}
+
+func (j *job) snapshot() *Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	v := &Job{
+		ID:        j.id,
+		DryRun:    j.dryRun,
+		Status:    JobRunning,
+		Phase:     j.phase,
+		StartedAt: j.startedAt,
+		Report:    j.report,
+	}
+	if !j.dryRun {
+		v.Reclaimed = j.rec.toMap()
+	}
+	if !j.finishedAt.IsZero() {
+		t := j.finishedAt
+		v.FinishedAt = &t
+		v.Phase = ""
+		if j.err != nil {
+			v.Status = StatusFailure
+			v.Error = j.err.Error()
+		} else {
+			v.Status = StatusSuccess
+		}
+	}
+	return v
+}
+
+// Start runs garbage collection, or a dry run if dryRun is true, in the
+// background and returns the job right away. A run returns ErrRunning if
+// another run is in progress, dry runs do not wait for other runs. onDone is
+// called with the finished job if it is not nil.
+func (r *Runner) Start(trigger string, transactionTTL time.Duration, dryRun bool, onDone func(j *Job)) (*Job, error) {
+	if !dryRun && !r.lock.TryLock() {
+		return nil, ErrRunning
+	}
+	j := &job{id: uuid.New(), dryRun: dryRun, startedAt: time.Now()}
+	j.rec = newReclaimed(j.setPhase)
+	r.addJob(j)
+	r.jobsWG.Add(1)
+	go func() {
+		defer r.jobsWG.Done()
+		if dryRun {
+			j.finish(r.report(transactionTTL, j.setPhase))
+		} else {
+			_, err := r.run(trigger, transactionTTL, j.rec)
+			r.lock.Unlock()
+			j.finish(nil, err)
+		}
+		if onDone != nil {
+			onDone(j.snapshot())
+		}
+	}()
+	return j.snapshot(), nil
+}
+
+func (r *Runner) addJob(j *job) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.jobs = append(r.jobs, j)
+	if len(r.jobs) > maxJobs {
+		r.jobs = r.jobs[len(r.jobs)-maxJobs:]
+	}
+}
+
+// Job returns a job started by Start. It returns false if the job does not
+// exist or is too old to be kept.
+func (r *Runner) Job(id uuid.UUID) (*Job, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, j := range r.jobs {
+		if j.id == id {
+			return j.snapshot(), true
+		}
+	}
+	return nil, false
+}
+
+// Wait waits for jobs in progress to finish
+func (r *Runner) Wait() {
+	r.jobsWG.Wait()
+}
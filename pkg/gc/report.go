@@ -0,0 +1,229 @@
+package gc
+
+import (
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgl/pkg/ref"
+)
+
+// Phases of a run, in order. Dry runs skip the commits phase since commits to
+// remove are known once reachable commits are found.
+const (
+	PhaseTransactions = "transactions"
+	PhaseFindCommits  = "find_commits"
+	PhaseTables       = "tables"
+	PhaseBlocks       = "blocks"
+	PhaseBlockIndices = "block_indices"
+	PhaseCommits      = "commits"
+)
+
+// keys of objects as laid out by wrgl, used to estimate their size
+const (
+	commitPrefix       = "com/"
+	tablePrefix        = "tbl/"
+	tableIndexPrefix   = "tblidx/"
+	tableProfilePrefix = "tblsum/"
+	blockPrefix        = "blk/"
+	blockIndexPrefix   = "blkidx/"
+)
+
+// transactionsPageSize is the number of transactions read at a time
+const transactionsPageSize = 100
+
+// Object is an object that garbage collection would remove
+type Object struct {
+	Sum string `json:"sum"`
+
+	// Bytes is the size of the stored object. The size of a table includes
+	// its index and profile.
+	Bytes int64 `json:"bytes"`
+}
+
+// Report lists what garbage collection would remove without removing
+// anything
+type Report struct {
+	// Transactions are IDs of transactions in progress that began before the
+	// transaction TTL. Their refs are removed, which may leave their commits
+	// unreachable.
+	Transactions []string  `json:"transactions"`
+	Commits      []*Object `json:"commits"`
+	Tables       []*Object `json:"tables"`
+	Blocks       []*Object `json:"blocks"`
+	BlockIndices []*Object `json:"blockIndices"`
+
+	// Bytes is the total size of objects to remove. The disk space actually
+	// reclaimed differs since the storage engine compresses values and
+	// reclaims space lazily.
+	Bytes int64 `json:"bytes"`
+}
+
+func (rep *Report) add(sl *[]*Object, sum []byte, size int64) {
+	*sl = append(*sl, &Object{Sum: hex.EncodeToString(sum), Bytes: size})
+	rep.Bytes += size
+}
+
+// DryRun reports what a run would remove given transactionTTL. It does not
+// wait for a run in progress.
+func (r *Runner) DryRun(transactionTTL time.Duration) (*Report, error) {
+	return r.report(transactionTTL, func(string) {})
+}
+
+// report finds objects to remove the same way transaction.GarbageCollect and
+// prune.Prune do
+func (r *Runner) report(transactionTTL time.Duration, setPhase func(phase string)) (*Report, error) {
+	rep := &Report{
+		Transactions: []string{},
+		Commits:      []*Object{},
+		Tables:       []*Object{},
+		Blocks:       []*Object{},
+		BlockIndices: []*Object{},
+	}
+	setPhase(PhaseTransactions)
+	expired, err := expiredTransactions(r.rs, transactionTTL)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := ref.ListAllRefs(r.rs)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range expired {
+		rep.Transactions = append(rep.Transactions, id.String())
+		prefix := ref.TransactionRef(id.String(), "")
+		for name := range refs {
+			if strings.HasPrefix(name, prefix) {
+				delete(refs, name)
+			}
+		}
+	}
+
+	setPhase(PhaseFindCommits)
+	q, err := ref.NewCommitsQueue(r.db, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, sum := range refs {
+		if err = q.Insert(sum); err != nil {
+			return nil, err
+		}
+	}
+	reachable := map[string]struct{}{}
+	for {
+		sum, _, err := q.PopInsertParents()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		reachable[string(sum)] = struct{}{}
+	}
+	commitKeys, err := objects.GetAllCommitKeys(r.db)
+	if err != nil {
+		return nil, err
+	}
+	var surviving [][]byte
+	for _, sum := range commitKeys {
+		if _, ok := reachable[string(sum)]; ok {
+			surviving = append(surviving, sum)
+			continue
+		}
+		rep.add(&rep.Commits, sum, r.size(commitPrefix, sum))
+	}
+	if len(rep.Commits) == 0 {
+		// nothing else is pruned unless some commits are
+		return rep, nil
+	}
+
+	setPhase(PhaseTables)
+	keepTables := map[string]struct{}{}
+	for _, sum := range surviving {
+		com, err := objects.GetCommit(r.db, sum)
+		if err != nil {
+			return nil, err
+		}
+		keepTables[string(com.Table)] = struct{}{}
+	}
+	tableKeys, err := objects.GetAllTableKeys(r.db)
+	if err != nil {
+		return nil, err
+	}
+	keepBlocks := map[string]struct{}{}
+	keepBlockIndices := map[string]struct{}{}
+	for _, sum := range tableKeys {
+		if _, ok := keepTables[string(sum)]; !ok {
+			rep.add(&rep.Tables, sum,
+				r.size(tablePrefix, sum)+r.size(tableIndexPrefix, sum)+r.size(tableProfilePrefix, sum),
+			)
+			continue
+		}
+		tbl, err := objects.GetTable(r.db, sum)
+		if err != nil {
+			return nil, err
+		}
+		for _, blk := range tbl.Blocks {
+			keepBlocks[string(blk)] = struct{}{}
+		}
+		for _, blk := range tbl.BlockIndices {
+			keepBlockIndices[string(blk)] = struct{}{}
+		}
+	}
+
+	setPhase(PhaseBlocks)
+	if err = r.reportUnkept(rep, &rep.Blocks, blockPrefix, keepBlocks, objects.GetAllBlockKeys); err != nil {
+		return nil, err
+	}
+	setPhase(PhaseBlockIndices)
+	if err = r.reportUnkept(rep, &rep.BlockIndices, blockIndexPrefix, keepBlockIndices, objects.GetAllBlockIndexKeys); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+func (r *Runner) reportUnkept(rep *Report, sl *[]*Object, prefix string, keep map[string]struct{}, getKeys func(objects.Store) ([][]byte, error)) error {
+	keys, err := getKeys(r.db)
+	if err != nil {
+		return err
+	}
+	for _, sum := range keys {
+		if _, ok := keep[string(sum)]; !ok {
+			rep.add(sl, sum, r.size(prefix, sum))
+		}
+	}
+	return nil
+}
+
+// size returns the size of an object, or 0 if it does not exist
+func (r *Runner) size(prefix string, sum []byte) int64 {
+	b, err := r.db.Get(append([]byte(prefix), sum...))
+	if err != nil {
+		return 0
+	}
+	return int64(len(b))
+}
+
+// expiredTransactions returns IDs of transactions that GarbageCollect would
+// remove
+func expiredTransactions(rs ref.Store, ttl time.Duration) ([]uuid.UUID, error) {
+	cutOff := time.Now().Add(-ttl)
+	ids := []uuid.UUID{}
+	for offset := 0; ; offset += transactionsPageSize {
+		txs, err := rs.ListTransactions(offset, transactionsPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			if tx.Status == ref.TSInProgress && !tx.Begin.After(cutOff) {
+				ids = append(ids, tx.ID)
+			}
+		}
+		if len(txs) < transactionsPageSize {
+			return ids, nil
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package gc runs garbage collection, either on demand or on a schedule, and
+// keeps a history of runs.
+package gc
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgl/pkg/pbar"
+	"github.com/wrgl/wrgl/pkg/prune"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgl/pkg/transaction"
+	"github.com/wrgl/wrgld/pkg/metrics"
+)
+
+// ErrRunning is returned by Runner.Run and Runner.Start if garbage
+// collection is already running on the repository
+var ErrRunning = errors.New("garbage collection is already running")
+
+// ErrCollecting is returned by Runner.Acquire while garbage collection is
+// running or waiting to run
+var ErrCollecting = errors.New("garbage collection is in progress")
+
+// reclaimCounter is a progress bar that counts objects removed by garbage
+// collection, both in a run and as metrics
+type reclaimCounter struct {
+	pbar.Bar
+	objType string
+	n       *int64
+}
+
+func (b *reclaimCounter) Incr() {
+	b.IncrBy(1)
+}
+
+func (b *reclaimCounter) IncrBy(n int) {
+	atomic.AddInt64(b.n, int64(n))
+	metrics.GCReclaimedObjects.WithLabelValues(b.objType).Add(float64(n))
+}
+
+type reclaimed struct {
+	counts   map[string]*int64
+	mutex    sync.Mutex
+	setPhase func(phase string)
+}
+
+func newReclaimed(setPhase func(phase string)) *reclaimed {
+	return &reclaimed{counts: map[string]*int64{}, setPhase: setPhase}
+}
+
+// counter returns a progress bar factory that counts objects of objType. The
+// factory is called when the phase starts.
+func (r *reclaimed) counter(objType, phase string) func() pbar.Bar {
+	n := new(int64)
+	r.mutex.Lock()
+	r.counts[objType] = n
+	r.mutex.Unlock()
+	return func() pbar.Bar {
+		r.setPhase(phase)
+		return &reclaimCounter{Bar: pbar.NewNoopBar(), objType: objType, n: n}
+	}
+}
+
+func (r *reclaimed) toMap() map[string]int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	m := map[string]int{}
+	for k, n := range r.counts {
+		if v := atomic.LoadInt64(n); v > 0 {
+			m[k] = int(v)
+		}
+	}
+	return m
+}
+
+// Runner runs garbage collection on a repository, one run at a time
+type Runner struct {
+	db      objects.Store
+	rs      ref.Store
+	history *History
+	lock    sync.Mutex
+	running atomic.Bool
+
+	// repoLock is held for writing by runs and for reading by work that
+	// writes objects, see Acquire
+	repoLock sync.RWMutex
+	holders  atomic.Int64
+
+	// collectedAt is when the most recent run started removing objects
+	collectedAt time.Time
+
+	// schedule and nextRun are set by a scheduler
+	schedule string
+	nextRun  time.Time
+	mutex    sync.Mutex
+
+	// jobs are runs started by Start, oldest first
+	jobs   []*job
+	jobsWG sync.WaitGroup
+}
+
+// NewRunner creates a runner for a repository. Runs are recorded in history
+// if it is not nil.
+func NewRunner(db objects.Store, rs ref.Store, history *History) *Runner {
+	r := &Runner{db: db, rs: rs, history: history}
+	if history != nil {
+		for _, run := range history.List() {
+			if run.Status != StatusSkipped {
+				r.collectedAt = run.StartedAt
+				break
+			}
+		}
+	}
+	return r
+}
+
+// Run removes transactions older than transactionTTL, then prunes objects
+// that are no longer reachable from any ref. It returns ErrRunning right away
+// if another run is in progress, and waits for holders of the repository to
+// release it before removing anything. The run is returned even if it failed.
+func (r *Runner) Run(trigger string, transactionTTL time.Duration) (*Run, error) {
+	if !r.lock.TryLock() {
+		return nil, ErrRunning
+	}
+	defer r.lock.Unlock()
+	return r.run(trigger, transactionTTL, newReclaimed(func(string) {}))
+}
+
+// run must be called with the lock held. It waits for holders of the
+// repository to release it, see Acquire.
+func (r *Runner) run(trigger string, transactionTTL time.Duration, rec *reclaimed) (*Run, error) {
+	r.running.Store(true)
+	metrics.GCRunning.Set(1)
+	defer func() {
+		r.running.Store(false)
+		metrics.GCRunning.Set(0)
+	}()
+	r.repoLock.Lock()
+	defer r.repoLock.Unlock()
+	run := &Run{Trigger: trigger, StartedAt: time.Now()}
+	r.mutex.Lock()
+	r.collectedAt = run.StartedAt
+	r.mutex.Unlock()
+	err := r.collect(transactionTTL, rec)
+	run.Reclaimed = rec.toMap()
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = StatusFailure
+		run.Error = err.Error()
+	} else {
+		run.Status = StatusSuccess
+	}
+	metrics.GCDuration.Observe(run.FinishedAt.Sub(run.StartedAt).Seconds())
+	r.record(run)
+	return run, err
+}
+
+func (r *Runner) collect(transactionTTL time.Duration, rec *reclaimed) error {
+	if err := transaction.GarbageCollect(r.db, r.rs, transactionTTL, rec.counter("transaction", PhaseTransactions)()); err != nil {
+		return err
+	}
+	return prune.Prune(r.db, r.rs, &prune.PruneOptions{
+		FindCommitsPbar: func() pbar.Bar {
+			rec.setPhase(PhaseFindCommits)
+			return pbar.NewNoopBar()
+		},
+		PruneTablesPbar:       rec.counter("table", PhaseTables),
+		PruneBlocksPbar:       rec.counter("block", PhaseBlocks),
+		PruneBlockIndicesPbar: rec.counter("block_index", PhaseBlockIndices),
+		PruneCommitsPbar:      rec.counter("commit", PhaseCommits),
+	})
+}
+
+// skip records a run that did not happen because of reason
+func (r *Runner) skip(trigger, reason string) *Run {
+	now := time.Now()
+	run := &Run{
+		Trigger:    trigger,
+		Status:     StatusSkipped,
+		StartedAt:  now,
+		FinishedAt: now,
+		Error:      reason,
+	}
+	r.record(run)
+	return run
+}
+
+func (r *Runner) record(run *Run) {
+	metrics.GCRuns.WithLabelValues(run.Status).Inc()
+	metrics.GCLastRunTimestamp.WithLabelValues(run.Status).Set(float64(run.FinishedAt.Unix()))
+	if r.history != nil {
+		// the history is informational, failing to persist it does not fail
+		// the run
+		_ = r.history.Add(run)
+	}
+}
+
+// Running returns true if a run is in progress
+func (r *Runner) Running() bool {
+	return r.running.Load()
+}
+
+// Acquire keeps runs from starting until release is called, for work that
+// writes objects that are not yet reachable from any ref. It returns
+// ErrCollecting right away if a run is in progress or waiting for other
+// holders to release.
+func (r *Runner) Acquire() (release func(), err error) {
+	if !r.repoLock.TryRLock() {
+		return nil, ErrCollecting
+	}
+	r.holders.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.holders.Add(-1)
+			r.repoLock.RUnlock()
+		})
+	}, nil
+}
+
+// Holders returns the number of Acquire calls that are not released yet
+func (r *Runner) Holders() int {
+	return int(r.holders.Load())
+}
+
+// CollectedSince returns true if a run started removing objects after t.
+// Work that spans several acquisitions can use it to find out whether
+// objects it wrote earlier may be gone.
+func (r *Runner) CollectedSince(t time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.collectedAt.After(t)
+}
+
+// Status is the state of garbage collection on a repository
+type Status struct {
+	Running bool `json:"running"`
+
+	// Schedule and NextRun are only set if runs are scheduled
+	Schedule string     `json:"schedule,omitempty"`
+	NextRun  *time.Time `json:"nextRun,omitempty"`
+
+	// LastRun is the most recent run that was not skipped
+	LastRun *Run `json:"lastRun,omitempty"`
+
+	// Runs are recent runs including skipped ones, most recent first
+	Runs []*Run `json:"runs"`
+}
+
+// Status returns the current state and history of runs
+func (r *Runner) Status() *Status {
+	st := &Status{Running: r.Running(), Runs: []*Run{}}
+	r.mutex.Lock()
+	st.Schedule = r.schedule
+	if !r.nextRun.IsZero() {
+		t := r.nextRun
+		st.NextRun = &t
+	}
+	r.mutex.Unlock()
+	if r.history != nil {
+		st.Runs = r.history.List()
+	}
+	for _, run := range st.Runs {
+		if run.Status != StatusSkipped {
+			st.LastRun = run
+			break
+		}
+	}
+	return st
+}
+
+func (r *Runner) setSchedule(schedule string, nextRun time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.schedule = schedule
+	r.nextRun = nextRun
+}
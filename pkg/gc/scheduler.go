@@ -0,0 +1,126 @@
+package gc
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/cron"
+)
+
+// Scheduler runs garbage collection in the background according to a cron
+// schedule
+type Scheduler struct {
+	runner         *Runner
+	schedule       *cron.Schedule
+	transactionTTL func() time.Duration
+	busy           func() bool
+	onDone         func(run *Run)
+	logger         logr.Logger
+	now            func() time.Time
+	stop           chan struct{}
+	done           chan struct{}
+}
+
+type SchedulerOption func(s *Scheduler)
+
+// WithTransactionTTL sets how long transactions are kept before they are
+// removed. Defaults to conf.DefaultTransactionTTL.
+func WithTransactionTTL(transactionTTL func() time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.transactionTTL = transactionTTL
+	}
+}
+
+// WithBusy skips a scheduled run if busy returns true, such as when pushes
+// are in progress. Objects of an ongoing push are not reachable from any ref
+// yet, so garbage collection would remove them.
+func WithBusy(busy func() bool) SchedulerOption {
+	return func(s *Scheduler) {
+		s.busy = busy
+	}
+}
+
+// WithOnDone calls onDone after each successful scheduled run, such as to
+// record it in the audit log
+func WithOnDone(onDone func(run *Run)) SchedulerOption {
+	return func(s *Scheduler) {
+		s.onDone = onDone
+	}
+}
+
+func NewScheduler(runner *Runner, schedule *cron.Schedule, logger logr.Logger, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		runner:         runner,
+		schedule:       schedule,
+		transactionTTL: func() time.Duration { return time.Duration(conf.DefaultTransactionTTL) },
+		busy:           func() bool { return false },
+		logger:         logger.WithName("GCScheduler"),
+		now:            time.Now,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start runs garbage collection each time the schedule fires until Stop is
+// called
+func (s *Scheduler) Start() {
+	go s.loop()
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	for {
+		now := s.now()
+		next := s.schedule.Next(now)
+		s.runner.setSchedule(s.schedule.String(), next)
+		if next.IsZero() {
+			s.logger.Info("schedule never fires", "schedule", s.schedule.String())
+			<-s.stop
+			return
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.tick()
+		}
+	}
+}
+
+func (s *Scheduler) tick() {
+	if s.busy() {
+		s.logger.Info("skipping garbage collection while pushes are in progress")
+		s.runner.skip(TriggerScheduled, "pushes in progress")
+		return
+	}
+	run, err := s.runner.Run(TriggerScheduled, s.transactionTTL())
+	if err == ErrRunning {
+		s.logger.Info("skipping garbage collection already in progress")
+		s.runner.skip(TriggerScheduled, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error(err, "garbage collection failed")
+		return
+	}
+	s.logger.Info("garbage collection completed",
+		"elapsed", run.FinishedAt.Sub(run.StartedAt).String(),
+		"reclaimed", run.Reclaimed,
+	)
+	if s.onDone != nil {
+		s.onDone(run)
+	}
+}
+
+// Stop stops scheduling runs and waits for the run in progress to finish
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,476 @@
+package localidp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	GrantTypePassword          = "password"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTypeUMATicket         = "urn:ietf:params:oauth:grant-type:uma-ticket"
+
+	// userCodeChars leaves out characters that are easily confused
+	userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// TokenResponse is returned from the token endpoint
+type TokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresIn int    `json:"refresh_expires_in,omitempty"`
+}
+
+// DeviceAuthResponse is returned from the device authorization endpoint
+type DeviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// deviceLogin is a pending device authorization
+type deviceLogin struct {
+	userCode  string
+	expiresAt time.Time
+	lastPoll  time.Time
+
+	// username is set once the user approves the login
+	username string
+}
+
+func writeJSON(rw http.ResponseWriter, status int, obj interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(obj)
+}
+
+// writeOAuthError writes an error response as described in RFC 6749 section
+// 5.2
+func writeOAuthError(rw http.ResponseWriter, status int, code, description string) {
+	obj := map[string]string{"error": code}
+	if description != "" {
+		obj["error_description"] = description
+	}
+	writeJSON(rw, status, obj)
+}
+
+// ServeHTTP serves the OpenID discovery document, the signing key, the token
+// endpoint, the device authorization endpoint and the page where users approve
+// device logins.
+func (p *Provider) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, p.issuerPath) {
+	case "/.well-known/openid-configuration":
+		p.handleDiscovery(rw, r)
+	case "/certs":
+		p.handleCerts(rw, r)
+	case "/token":
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.rateLimit(rw, r, p.handleToken, func(rw http.ResponseWriter, r *http.Request) {
+			writeOAuthError(rw, http.StatusTooManyRequests, "slow_down", "rate limit exceeded")
+		})
+	case "/device/auth":
+		if r.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		p.handleDeviceAuth(rw, r)
+	case "/device":
+		if r.Method != http.MethodPost {
+			p.handleDevicePage(rw, r)
+			return
+		}
+		p.rateLimit(rw, r, p.handleDevicePage, func(rw http.ResponseWriter, r *http.Request) {
+			writeDevicePage(rw, http.StatusTooManyRequests, &devicePageData{
+				UserCode: normalizeUserCode(r.PostForm.Get("user_code")),
+				Username: r.PostForm.Get("username"),
+				Error:    "Too many attempts. Try again later.",
+			})
+		})
+	default:
+		http.NotFound(rw, r)
+	}
+}
+
+func (p *Provider) handleDiscovery(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"token_endpoint":                        p.issuer + "/token",
+		"device_authorization_endpoint":         p.issuer + "/device/auth",
+		"jwks_uri":                              p.issuer + "/certs",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"grant_types_supported": []string{
+			GrantTypePassword, GrantTypeClientCredentials, GrantTypeRefreshToken,
+			GrantTypeDeviceCode, GrantTypeUMATicket,
+		},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+	})
+}
+
+func (p *Provider) handleCerts(rw http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": p.kid,
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	})
+}
+
+// serverError logs err and answers with an OAuth server_error, for failures
+// that the client cannot fix
+func (p *Provider) serverError(rw http.ResponseWriter, err error, msg string) {
+	p.logger.Error(err, msg)
+	writeOAuthError(rw, http.StatusInternalServerError, "server_error", "")
+}
+
+func (p *Provider) issueTokens(rw http.ResponseWriter, u *User) {
+	access, err := p.sign(p.userClaims(u, typAccess, p.accessTokenTTL))
+	if err != nil {
+		p.serverError(rw, err, "error signing access token")
+		return
+	}
+	refresh, err := p.sign(p.userClaims(u, typRefresh, p.refreshTokenTTL))
+	if err != nil {
+		p.serverError(rw, err, "error signing refresh token")
+		return
+	}
+	writeJSON(rw, http.StatusOK, &TokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(p.accessTokenTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int(p.refreshTokenTTL.Seconds()),
+	})
+}
+
+func (p *Provider) handleToken(rw http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(rw, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	switch r.PostForm.Get("grant_type") {
+	case GrantTypePassword:
+		p.loginWithPassword(rw, r.PostForm.Get("username"), r.PostForm.Get("password"))
+	case GrantTypeClientCredentials:
+		// lets "wrgl credentials authenticate" log in as a local user, with the
+		// username as client id and the password as client secret
+		p.loginWithPassword(rw, r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"))
+	case GrantTypeRefreshToken:
+		p.handleRefreshGrant(rw, r)
+	case GrantTypeDeviceCode:
+		p.handleDeviceCodeGrant(rw, r)
+	case GrantTypeUMATicket:
+		p.handleUMATicketGrant(rw, r)
+	default:
+		writeOAuthError(rw, http.StatusBadRequest, "unsupported_grant_type", "")
+	}
+}
+
+func (p *Provider) loginWithPassword(rw http.ResponseWriter, username, password string) {
+	u, retryAfter, err := p.authenticate(username, password)
+	if retryAfter > 0 {
+		setRetryAfter(rw, retryAfter)
+		writeOAuthError(rw, http.StatusTooManyRequests, "invalid_grant", "too many failed logins")
+		return
+	}
+	if err == ErrInvalidCredentials {
+		writeOAuthError(rw, http.StatusUnauthorized, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		p.serverError(rw, err, "error authenticating user")
+		return
+	}
+	p.issueTokens(rw, u)
+}
+
+// userFromToken verifies token and returns the user it was issued to. The user
+// is looked up again so that removed users cannot renew their tokens.
+func (p *Provider) userFromToken(token, typ string) (*User, error) {
+	claims, err := p.parse(token, typ)
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return p.users.Get(sub)
+}
+
+func (p *Provider) handleRefreshGrant(rw http.ResponseWriter, r *http.Request) {
+	u, err := p.userFromToken(r.PostForm.Get("refresh_token"), typRefresh)
+	if err != nil {
+		writeOAuthError(rw, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+	p.issueTokens(rw, u)
+}
+
+func randomUserCode() string {
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeChars))))
+		if err != nil {
+			panic(err)
+		}
+		b[i] = userCodeChars[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:])
+}
+
+// normalizeUserCode lets users type the code in lower case or without the dash
+func normalizeUserCode(s string) string {
+	s = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(s))
+	if len(s) != 8 {
+		return s
+	}
+	return s[:4] + "-" + s[4:]
+}
+
+// removeExpiredDevices must be called with p.mutex held
+func (p *Provider) removeExpiredDevices(now time.Time) {
+	for code, d := range p.devices {
+		if now.After(d.expiresAt) {
+			delete(p.devices, code)
+		}
+	}
+}
+
+func (p *Provider) handleDeviceAuth(rw http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	deviceCode := hex.EncodeToString(b)
+	userCode := randomUserCode()
+	now := time.Now()
+	p.mutex.Lock()
+	p.removeExpiredDevices(now)
+	p.devices[deviceCode] = &deviceLogin{
+		userCode:  userCode,
+		expiresAt: now.Add(p.deviceCodeTTL),
+	}
+	p.mutex.Unlock()
+	writeJSON(rw, http.StatusOK, &DeviceAuthResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         p.issuer + "/device",
+		VerificationURIComplete: p.issuer + "/device?user_code=" + userCode,
+		ExpiresIn:               int(p.deviceCodeTTL.Seconds()),
+		Interval:                p.pollInterval,
+	})
+}
+
+// handleDeviceCodeGrant answers polls of the device as described in RFC 8628
+// section 3.5
+func (p *Provider) handleDeviceCodeGrant(rw http.ResponseWriter, r *http.Request) {
+	deviceCode := r.PostForm.Get("device_code")
+	now := time.Now()
+	p.mutex.Lock()
+	d, ok := p.devices[deviceCode]
+	if !ok {
+		p.mutex.Unlock()
+		writeOAuthError(rw, http.StatusBadRequest, "invalid_grant", "unknown device code")
+		return
+	}
+	if now.After(d.expiresAt) {
+		delete(p.devices, deviceCode)
+		p.mutex.Unlock()
+		writeOAuthError(rw, http.StatusBadRequest, "expired_token", "")
+		return
+	}
+	if d.username == "" {
+		slowDown := !d.lastPoll.IsZero() && now.Sub(d.lastPoll) < time.Duration(p.pollInterval)*time.Second/2
+		d.lastPoll = now
+		p.mutex.Unlock()
+		if slowDown {
+			writeOAuthError(rw, http.StatusBadRequest, "slow_down", "")
+		} else {
+			writeOAuthError(rw, http.StatusBadRequest, "authorization_pending", "")
+		}
+		return
+	}
+	delete(p.devices, deviceCode)
+	p.mutex.Unlock()
+	u, err := p.users.Get(d.username)
+	if err == ErrUserNotFound {
+		writeOAuthError(rw, http.StatusBadRequest, "access_denied", "")
+		return
+	}
+	if err != nil {
+		p.serverError(rw, err, "error reading user")
+		return
+	}
+	p.issueTokens(rw, u)
+}
+
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>wrgld login</title></head>
+<body>
+{{if .Approved}}
+<p>Logged in as {{.Username}}. You can close this page and return to your device.</p>
+{{else}}
+<h1>Log in to wrgld</h1>
+{{if .Error}}<p style="color:red">{{.Error}}</p>{{end}}
+<form method="post">
+<p><label>Code <input name="user_code" value="{{.UserCode}}" autocomplete="off" required></label></p>
+<p><label>Username <input name="username" value="{{.Username}}" autocomplete="username" required></label></p>
+<p><label>Password <input name="password" type="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Log in</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type devicePageData struct {
+	UserCode string
+	Username string
+	Error    string
+	Approved bool
+}
+
+func writeDevicePage(rw http.ResponseWriter, status int, data *devicePageData) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	devicePage.Execute(rw, data)
+}
+
+// handleDevicePage shows a login form on GET and approves the device login
+// matching the submitted user code on POST
+func (p *Provider) handleDevicePage(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeDevicePage(rw, http.StatusOK, &devicePageData{
+			UserCode: r.URL.Query().Get("user_code"),
+		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := &devicePageData{
+		UserCode: normalizeUserCode(r.PostForm.Get("user_code")),
+		Username: r.PostForm.Get("username"),
+	}
+	u, retryAfter, err := p.authenticate(data.Username, r.PostForm.Get("password"))
+	if retryAfter > 0 {
+		setRetryAfter(rw, retryAfter)
+		data.Error = "Too many failed logins. Try again later."
+		writeDevicePage(rw, http.StatusTooManyRequests, data)
+		return
+	}
+	if err == ErrInvalidCredentials {
+		data.Error = "Invalid username or password."
+		writeDevicePage(rw, http.StatusUnauthorized, data)
+		return
+	}
+	if err != nil {
+		p.logger.Error(err, "error authenticating user")
+		data.Error = "Something went wrong. Try again later."
+		writeDevicePage(rw, http.StatusInternalServerError, data)
+		return
+	}
+	now := time.Now()
+	p.mutex.Lock()
+	p.removeExpiredDevices(now)
+	var found *deviceLogin
+	for _, d := range p.devices {
+		if d.userCode == data.UserCode && d.username == "" {
+			found = d
+			break
+		}
+	}
+	if found != nil {
+		found.username = u.Username
+	}
+	p.mutex.Unlock()
+	if found == nil {
+		data.Error = "Invalid or expired code."
+		writeDevicePage(rw, http.StatusBadRequest, data)
+		return
+	}
+	data.Approved = true
+	writeDevicePage(rw, http.StatusOK, data)
+}
+
+// handleUMATicketGrant exchanges an access token and a permission ticket for an
+// RPT granting the scopes of the user on the resource named in the ticket
+func (p *Provider) handleUMATicketGrant(rw http.ResponseWriter, r *http.Request) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		writeOAuthError(rw, http.StatusUnauthorized, "invalid_client", "bearer token required")
+		return
+	}
+	u, err := p.userFromToken(strings.TrimPrefix(header, "Bearer "), typAccess)
+	if err != nil {
+		writeOAuthError(rw, http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	ticket, err := p.parse(r.PostForm.Get("ticket"), typTicket)
+	if err != nil {
+		writeOAuthError(rw, http.StatusBadRequest, "invalid_grant", "invalid ticket")
+		return
+	}
+	granted := u.GrantedScopes()
+	m := map[string]struct{}{}
+	for _, s := range granted {
+		m[s] = struct{}{}
+	}
+	requested, _ := ticket["scopes"].([]interface{})
+	for _, s := range requested {
+		s, _ := s.(string)
+		if _, ok := m[s]; !ok {
+			writeOAuthError(rw, http.StatusForbidden, "access_denied", "not_authorized")
+			return
+		}
+	}
+	claims := p.userClaims(u, typAccess, p.accessTokenTTL)
+	claims["authorization"] = map[string]interface{}{
+		"permissions": []map[string]interface{}{
+			{
+				"rsid":   ticket["rsid"],
+				"scopes": granted,
+			},
+		},
+	}
+	rpt, err := p.sign(claims)
+	if err != nil {
+		p.serverError(rw, err, "error signing RPT")
+		return
+	}
+	writeJSON(rw, http.StatusOK, &TokenResponse{
+		AccessToken: rpt,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(p.accessTokenTTL.Seconds()),
+	})
+}
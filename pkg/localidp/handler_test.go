@@ -0,0 +1,323 @@
+package localidp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/pckhoi/uma"
+	"github.com/pckhoi/uma/pkg/rp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+)
+
+func startProvider(t *testing.T, opts ...ProviderOption) (*Provider, *UserStore) {
+	t.Helper()
+	dir := t.TempDir()
+	key, err := LoadOrCreateKey(filepath.Join(dir, "localidp.key"))
+	require.NoError(t, err)
+	// the key is reused on restart
+	key2, err := LoadOrCreateKey(filepath.Join(dir, "localidp.key"))
+	require.NoError(t, err)
+	assert.True(t, key.Equal(key2))
+
+	users, err := NewUserStore(filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	require.NoError(t, users.Add(&User{
+		Username: "john",
+		Name:     "John Doe",
+		Email:    "john@domain.com",
+		Scopes:   []string{"write"},
+	}, "secret"))
+	require.NoError(t, users.Add(&User{Username: "alice", Scopes: []string{"read"}}, "pass"))
+
+	var p *Provider
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(rw, r)
+	}))
+	t.Cleanup(ts.Close)
+	p, err = NewProvider(ts.URL+"/oauth2", key, users, append([]ProviderOption{WithPollInterval(1)}, opts...)...)
+	require.NoError(t, err)
+	return p, users
+}
+
+func postForm(t *testing.T, u string, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.PostForm(u, form)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	m := map[string]interface{}{}
+	if strings.Contains(resp.Header.Get("Content-Type"), "application/json") {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	}
+	return resp.StatusCode, m
+}
+
+func TestPasswordAndRPT(t *testing.T) {
+	p, users := startProvider(t)
+	assert.Equal(t, "/oauth2/", p.PathPrefix())
+
+	kc, err := rp.NewKeycloakClient(p.Issuer(), "wrgl", "", http.DefaultClient)
+	require.NoError(t, err)
+	_, err = kc.AuthenticateUserWithPassword("john", "wrong")
+	assert.Error(t, err)
+	creds, err := kc.AuthenticateUserWithPassword("john", "secret")
+	require.NoError(t, err)
+	assert.NotEmpty(t, creds.RefreshToken)
+
+	// a user can also log in as a client, which "wrgl credentials authenticate"
+	// relies on
+	kc2, err := rp.NewKeycloakClient(p.Issuer(), "alice", "pass", http.DefaultClient)
+	require.NoError(t, err)
+	aliceCreds, err := kc2.Authenticate()
+	require.NoError(t, err)
+
+	creds, err = kc.RefreshCredentials(*creds)
+	require.NoError(t, err)
+
+	ticket, err := p.CreatePermissionTicket("rsc-1", "write")
+	require.NoError(t, err)
+	rpt, err := kc.RequestRPT(creds.AccessToken, rp.RPTRequest{Ticket: ticket})
+	require.NoError(t, err)
+	b, err := p.VerifySignature(context.Background(), rpt)
+	require.NoError(t, err)
+	claims := &uma.Claims{}
+	require.NoError(t, json.Unmarshal(b, claims))
+	assert.Equal(t, "John Doe", claims.Name)
+	assert.Equal(t, "john@domain.com", claims.Email)
+	assert.True(t, claims.IsValid("rsc-1", false, []string{"write"}, testr.New(t)))
+	assert.False(t, claims.IsValid("rsc-2", false, []string{"read"}, testr.New(t)))
+
+	// alice lacks the write scope named in the ticket
+	_, err = kc.RequestRPT(aliceCreds.AccessToken, rp.RPTRequest{Ticket: ticket})
+	assert.Error(t, err)
+	ticket, err = p.CreatePermissionTicket("rsc-1", "read")
+	require.NoError(t, err)
+	_, err = kc.RequestRPT(aliceCreds.AccessToken, rp.RPTRequest{Ticket: ticket})
+	require.NoError(t, err)
+
+	// tokens of other types are not accepted in place of an access token
+	_, err = kc.RequestRPT(aliceCreds.RefreshToken, rp.RPTRequest{Ticket: ticket})
+	assert.Error(t, err)
+	_, err = kc.RequestRPT(aliceCreds.AccessToken, rp.RPTRequest{Ticket: aliceCreds.AccessToken})
+	assert.Error(t, err)
+
+	// removed users cannot renew their tokens
+	require.NoError(t, users.Remove("alice"))
+	_, err = kc.RefreshCredentials(rp.Credentials{RefreshToken: aliceCreds.RefreshToken})
+	assert.Error(t, err)
+	_, err = kc.RequestRPT(aliceCreds.AccessToken, rp.RPTRequest{Ticket: ticket})
+	assert.Error(t, err)
+}
+
+func TestDeviceFlow(t *testing.T) {
+	p, _ := startProvider(t)
+
+	code, m := postForm(t, p.Issuer()+"/device/auth", url.Values{"client_id": {"wrgl"}})
+	require.Equal(t, http.StatusOK, code)
+	deviceCode := m["device_code"].(string)
+	userCode := m["user_code"].(string)
+	assert.Equal(t, p.Issuer()+"/device", m["verification_uri"])
+	assert.Equal(t, float64(1), m["interval"])
+
+	pollForm := url.Values{
+		"client_id":   {"wrgl"},
+		"grant_type":  {GrantTypeDeviceCode},
+		"device_code": {deviceCode},
+	}
+	code, m = postForm(t, p.Issuer()+"/token", pollForm)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "authorization_pending", m["error"])
+
+	resp, err := http.Get(p.Issuer() + "/device?user_code=" + userCode)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {userCode},
+		"username":  {"john"},
+		"password":  {"wrong"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {"XXXX-XXXX"},
+		"username":  {"john"},
+		"password":  {"secret"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// codes can be typed in lower case without the dash
+	resp, err = http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {strings.ToLower(strings.Replace(userCode, "-", "", 1))},
+		"username":  {"john"},
+		"password":  {"secret"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	code, m = postForm(t, p.Issuer()+"/token", pollForm)
+	require.Equal(t, http.StatusOK, code, "%v", m)
+	assert.NotEmpty(t, m["access_token"])
+	assert.NotEmpty(t, m["refresh_token"])
+	u, err := p.userFromToken(m["access_token"].(string), typAccess)
+	require.NoError(t, err)
+	assert.Equal(t, "john", u.Username)
+
+	// device code can only be used once
+	code, m = postForm(t, p.Issuer()+"/token", pollForm)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "invalid_grant", m["error"])
+}
+
+func TestLoginBackoff(t *testing.T) {
+	p, _ := startProvider(t, WithLoginBackoff(time.Minute, 2*time.Minute))
+	// moves the last failure of username back in time instead of sleeping,
+	// since logins can be slow
+	elapse := func(username string, d time.Duration) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.failures[username].last = p.failures[username].last.Add(-d)
+	}
+	login := func(username, password string) (int, map[string]interface{}) {
+		t.Helper()
+		return postForm(t, p.Issuer()+"/token", url.Values{
+			"grant_type": {GrantTypePassword},
+			"client_id":  {"wrgl"},
+			"username":   {username},
+			"password":   {password},
+		})
+	}
+	for i := 0; i < freeLoginFailures; i++ {
+		code, m := login("john", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Equal(t, "invalid_grant", m["error"])
+	}
+
+	// the password is not checked while the username is locked out
+	resp, err := http.PostForm(p.Issuer()+"/token", url.Values{
+		"grant_type": {GrantTypePassword},
+		"username":   {"john"},
+		"password":   {"secret"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 10)
+	resp, err = http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {"XXXX-XXXX"},
+		"username":  {"john"},
+		"password":  {"secret"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// other users are not affected
+	code, _ := login("alice", "pass")
+	assert.Equal(t, http.StatusOK, code)
+
+	elapse("john", time.Minute)
+	code, m := login("john", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	// the lockout doubles with every further failure
+	assert.Equal(t, 2*time.Minute, p.lockedOut("john", time.Now()).Round(time.Minute))
+	code, m = login("john", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, "invalid_grant", m["error"])
+
+	// a successful login clears the failures
+	elapse("john", 2*time.Minute)
+	code, _ = login("john", "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, time.Duration(0), p.lockedOut("john", time.Now()))
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	p, _ := startProvider(t, WithRateLimiter(ratelimit.NewLimiter(&wrgldconf.RateLimits{
+		Classes: map[string]*wrgldconf.RateLimit{
+			wrgldconf.RouteClassLogin: {RequestsPerSecond: 0.1, Burst: 2},
+		},
+	})))
+	login := func(username, password string) *http.Response {
+		t.Helper()
+		resp, err := http.PostForm(p.Issuer()+"/token", url.Values{
+			"grant_type": {GrantTypePassword},
+			"username":   {username},
+			"password":   {password},
+		})
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusOK, login("john", "secret").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, login("john", "wrong").StatusCode)
+	resp := login("john", "secret")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// clients are keyed by IP address and username
+	assert.Equal(t, http.StatusOK, login("alice", "pass").StatusCode)
+
+	// the device login page shares the limit
+	resp, err := http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {"XXXX-XXXX"},
+		"username":  {"john"},
+		"password":  {"secret"},
+	})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	resp, err = http.Get(p.Issuer() + "/device")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestUserStoreFailure(t *testing.T) {
+	p, users := startProvider(t, WithLogger(testr.New(t)))
+
+	// an unreadable user store is answered with an error instead of a panic
+	require.NoError(t, os.WriteFile(users.path, []byte("not json"), 0644))
+	require.NoError(t, os.Chtimes(users.path, time.Now(), time.Now().Add(time.Hour)))
+	status, m := postForm(t, p.Issuer()+"/token", url.Values{
+		"grant_type": {GrantTypePassword},
+		"username":   {"john"},
+		"password":   {"secret"},
+	})
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, "server_error", m["error"])
+
+	resp, err := http.PostForm(p.Issuer()+"/device", url.Values{
+		"user_code": {"ABCD-EFGH"},
+		"username":  {"john"},
+		"password":  {"secret"},
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "Something went wrong")
+}
@@ -0,0 +1,46 @@
+package localidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// LoadOrCreateKey reads the PEM-encoded RSA key that signs tokens from path,
+// generating and saving a new key if the file does not exist. Tokens issued
+// before a key is replaced are no longer accepted.
+func LoadOrCreateKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(b)
+		if block == nil || block.Type != "RSA PRIVATE KEY" {
+			return nil, fmt.Errorf("no RSA private key found in %s", path)
+		}
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err = os.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func keyID(key *rsa.PrivateKey) string {
+	sum := sha256.Sum256(key.N.Bytes())
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,300 @@
+// Package localidp is a built-in identity provider for deployments without an
+// external authorization server. Local users log in with the OAuth2 device or
+// password flow, then exchange their access token and an UMA ticket for an RPT,
+// exactly as they would with Keycloak. This keeps it compatible with the
+// "wrgl credentials" commands and the wrgl client.
+package localidp
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/pckhoi/uma"
+	"github.com/pckhoi/uma/pkg/httputil"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+)
+
+const (
+	// Realm is sent in the WWW-Authenticate header of 401 responses
+	Realm = "wrgld"
+
+	// ClientID is the audience of tokens issued by this provider
+	ClientID = "wrgld"
+
+	typAccess  = "Bearer"
+	typRefresh = "Refresh"
+	typTicket  = "Ticket"
+
+	ticketTTL = 5 * time.Minute
+)
+
+var errNotSupported = errors.New("not supported by the local identity provider")
+
+type ProviderOption func(p *Provider)
+
+// WithAccessTokenTTL sets how long access tokens and RPTs are valid. Defaults
+// to 1 hour
+func WithAccessTokenTTL(d time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.accessTokenTTL = d
+	}
+}
+
+// WithRefreshTokenTTL sets how long refresh tokens are valid. Defaults to 30
+// days
+func WithRefreshTokenTTL(d time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.refreshTokenTTL = d
+	}
+}
+
+// WithDeviceCodeTTL sets how long a user has to approve a device login.
+// Defaults to 10 minutes
+func WithDeviceCodeTTL(d time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.deviceCodeTTL = d
+	}
+}
+
+// WithPollInterval sets the minimum interval in seconds between polls of the
+// token endpoint during a device login. Defaults to 5
+func WithPollInterval(seconds int) ProviderOption {
+	return func(p *Provider) {
+		p.pollInterval = seconds
+	}
+}
+
+// WithLoginBackoff sets how long a username is locked out after
+// freeLoginFailures consecutive failed logins. The lockout starts at base and
+// doubles with every further failure up to max. Defaults to 1 second and 5
+// minutes
+func WithLoginBackoff(base, max time.Duration) ProviderOption {
+	return func(p *Provider) {
+		p.backoffBase = base
+		p.backoffMax = max
+	}
+}
+
+// WithRateLimiter throttles the token endpoint and the device login page
+// using the "login" class of l
+func WithRateLimiter(l *ratelimit.Limiter) ProviderOption {
+	return func(p *Provider) {
+		p.limiter = l
+	}
+}
+
+// WithLogger logs errors that users cannot fix, such as failures to read the
+// user store, to logger
+func WithLogger(logger logr.Logger) ProviderOption {
+	return func(p *Provider) {
+		p.logger = logger
+	}
+}
+
+// Provider issues tokens to users in a UserStore and serves the OAuth2
+// endpoints under its issuer URL. It also implements uma.Provider so that an
+// uma.Manager can use it in place of Keycloak.
+type Provider struct {
+	issuer          string
+	issuerPath      string
+	key             *rsa.PrivateKey
+	kid             string
+	users           *UserStore
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	deviceCodeTTL   time.Duration
+	pollInterval    int
+	backoffBase     time.Duration
+	backoffMax      time.Duration
+	limiter         *ratelimit.Limiter
+	logger          logr.Logger
+
+	mutex    sync.Mutex
+	devices  map[string]*deviceLogin
+	failures map[string]*loginFailures
+}
+
+var _ uma.Provider = (*Provider)(nil)
+
+// NewProvider creates a provider at issuer, which is the URL the provider's
+// handler is served at.
+func NewProvider(issuer string, key *rsa.PrivateKey, users *UserStore, opts ...ProviderOption) (*Provider, error) {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		issuer:          strings.TrimSuffix(issuer, "/"),
+		issuerPath:      strings.TrimSuffix(u.Path, "/"),
+		key:             key,
+		kid:             keyID(key),
+		users:           users,
+		accessTokenTTL:  time.Hour,
+		refreshTokenTTL: 30 * 24 * time.Hour,
+		deviceCodeTTL:   10 * time.Minute,
+		pollInterval:    5,
+		backoffBase:     time.Second,
+		backoffMax:      5 * time.Minute,
+		devices:         map[string]*deviceLogin{},
+		failures:        map[string]*loginFailures{},
+		logger:          logr.Discard(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// Issuer returns the issuer URL
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// PathPrefix returns the path that every endpoint of this provider starts with
+func (p *Provider) PathPrefix() string {
+	return p.issuerPath + "/"
+}
+
+func (p *Provider) sign(claims jwt.MapClaims) (string, error) {
+	claims["iss"] = p.issuer
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = p.kid
+	return tok.SignedString(p.key)
+}
+
+// parse verifies signature, expiry and issuer of token and checks that it is
+// of type typ
+func (p *Provider) parse(token string, typ string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return &p.key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(p.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if s, _ := claims["typ"].(string); s != typ {
+		return nil, fmt.Errorf("unexpected token type %q", s)
+	}
+	return claims, nil
+}
+
+func (p *Provider) userClaims(u *User, typ string, ttl time.Duration) jwt.MapClaims {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"typ": typ,
+		"sub": u.Username,
+		"jti": uuid.New().String(),
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	if typ != typRefresh {
+		claims["aud"] = ClientID
+		claims["preferred_username"] = u.Username
+		if u.Name != "" {
+			claims["name"] = u.Name
+		}
+		if u.Email != "" {
+			claims["email"] = u.Email
+		}
+	}
+	return claims
+}
+
+// VerifySignature implements uma.KeySet. Only the signature is verified, the
+// uma.Manager validates claims.
+func (p *Provider) VerifySignature(ctx context.Context, token string) ([]byte, error) {
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return &p.key.PublicKey, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+}
+
+// Authenticate implements uma.Provider. The local provider has no protection
+// API to authenticate against.
+func (p *Provider) Authenticate(client *http.Client) (*httputil.ClientCreds, error) {
+	return nil, errNotSupported
+}
+
+// CreateResource implements uma.Provider. Resources are not stored, any
+// resource id in a valid ticket is trusted.
+func (p *Provider) CreateResource(request *uma.Resource) (*uma.ExpandedResource, error) {
+	scopes := make([]uma.Scope, len(request.ResourceScopes))
+	for i, s := range request.ResourceScopes {
+		scopes[i] = uma.Scope{Name: s}
+	}
+	return &uma.ExpandedResource{
+		ID:             uuid.New().String(),
+		Name:           request.Name,
+		Type:           request.Type,
+		ResourceScopes: scopes,
+		URIs:           []string{request.URI},
+	}, nil
+}
+
+// GetResource implements uma.Provider
+func (p *Provider) GetResource(id string) (*uma.ExpandedResource, error) {
+	return &uma.ExpandedResource{ID: id}, nil
+}
+
+// UpdateResource implements uma.Provider
+func (p *Provider) UpdateResource(id string, resource *uma.Resource) error {
+	return nil
+}
+
+// DeleteResource implements uma.Provider
+func (p *Provider) DeleteResource(id string) error {
+	return nil
+}
+
+// ListResources implements uma.Provider
+func (p *Provider) ListResources(urlQuery url.Values) ([]string, error) {
+	return nil, errNotSupported
+}
+
+// CreatePermissionTicket implements uma.Provider. The ticket is a short-lived
+// signed token naming the resource and scopes.
+func (p *Provider) CreatePermissionTicket(resourceID string, scopes ...string) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"typ":  typTicket,
+		"rsid": resourceID,
+		"iat":  now.Unix(),
+		"exp":  now.Add(ticketTTL).Unix(),
+	}
+	if len(scopes) > 0 {
+		claims["scopes"] = scopes
+	}
+	return p.sign(claims)
+}
+
+// WWWAuthenticateDirectives implements uma.Provider
+func (p *Provider) WWWAuthenticateDirectives() uma.WWWAuthenticateDirectives {
+	return uma.WWWAuthenticateDirectives{
+		Realm: Realm,
+		AsUri: p.issuer,
+	}
+}
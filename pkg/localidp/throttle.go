@@ -0,0 +1,124 @@
+package localidp
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/audit"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+const (
+	// freeLoginFailures is how many consecutive failed logins a username is
+	// allowed before it is locked out
+	freeLoginFailures = 3
+
+	// maxFailureEntries is how many usernames with failed logins are kept
+	// before stale entries are dropped
+	maxFailureEntries = 10000
+)
+
+// loginFailures counts consecutive failed logins of a username
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func setRetryAfter(rw http.ResponseWriter, d time.Duration) {
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Max(1, math.Ceil(d.Seconds())))))
+}
+
+// formUsername returns the username a login request is made for. Users log in
+// as clients with the client credentials grant.
+func formUsername(r *http.Request) string {
+	if v := r.PostForm.Get("username"); v != "" {
+		return v
+	}
+	return r.PostForm.Get("client_id")
+}
+
+// rateLimit serves r with next unless the client IP and username of r have
+// exceeded the rate or concurrency limit of the login class, in which case
+// deny is called instead
+func (p *Provider) rateLimit(rw http.ResponseWriter, r *http.Request, next, deny func(rw http.ResponseWriter, r *http.Request)) {
+	if p.limiter == nil {
+		next(rw, r)
+		return
+	}
+	// a malformed form is reported by next
+	r.ParseForm()
+	client := "ip:" + audit.ClientIP(r.RemoteAddr) + " user:" + formUsername(r)
+	if retryAfter, ok := p.limiter.Allow(wrgldconf.RouteClassLogin, client); !ok {
+		setRetryAfter(rw, retryAfter)
+		deny(rw, r)
+		return
+	}
+	release, ok := p.limiter.Acquire(wrgldconf.RouteClassLogin, client)
+	if !ok {
+		setRetryAfter(rw, time.Second)
+		deny(rw, r)
+		return
+	}
+	defer release()
+	next(rw, r)
+}
+
+// lockedOut returns how long username must wait before its password is
+// checked again
+func (p *Provider) lockedOut(username string, now time.Time) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f, ok := p.failures[username]
+	if !ok || f.count < freeLoginFailures {
+		return 0
+	}
+	d := p.backoffBase << (f.count - freeLoginFailures)
+	if f.count-freeLoginFailures > 30 || d <= 0 || d > p.backoffMax {
+		d = p.backoffMax
+	}
+	return f.last.Add(d).Sub(now)
+}
+
+// removeStaleFailures forgets usernames whose last failed login is older than
+// the longest lockout
+func (p *Provider) removeStaleFailures(now time.Time) {
+	for k, f := range p.failures {
+		if now.Sub(f.last) > p.backoffMax {
+			delete(p.failures, k)
+		}
+	}
+}
+
+// authenticate checks the password of username unless it is locked out after
+// too many failed logins, in which case it returns how long to wait
+func (p *Provider) authenticate(username, password string) (u *User, retryAfter time.Duration, err error) {
+	now := time.Now()
+	if d := p.lockedOut(username, now); d > 0 {
+		return nil, d, nil
+	}
+	u, err = p.users.Authenticate(username, password)
+	if err != nil && err != ErrInvalidCredentials {
+		return nil, 0, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err == nil {
+		delete(p.failures, username)
+		return u, 0, nil
+	}
+	f, ok := p.failures[username]
+	if !ok {
+		if len(p.failures) >= maxFailureEntries {
+			p.removeStaleFailures(now)
+		}
+		f = &loginFailures{}
+		p.failures[username] = f
+	} else if now.Sub(f.last) > p.backoffMax {
+		f.count = 0
+	}
+	f.count++
+	f.last = now
+	return nil, 0, err
+}
@@ -0,0 +1,269 @@
+package localidp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/tokens"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrUserExists         = errors.New("user already exists")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+// User is a local user. Only a bcrypt hash of the password is stored.
+type User struct {
+	Username     string    `json:"username"`
+	Name         string    `json:"name,omitempty"`
+	Email        string    `json:"email,omitempty"`
+	Scopes       []string  `json:"scopes"`
+	PasswordHash string    `json:"passwordHash"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// GrantedScopes returns the scopes of the user together with the scopes they
+// imply
+func (u *User) GrantedScopes() []string {
+	return tokens.ExpandScopes(u.Scopes)
+}
+
+// UserStore persists users in a single JSON file. Changes made to the file by
+// another process, such as the "wrgld user" command, are picked up on the next
+// lookup.
+type UserStore struct {
+	path    string
+	mutex   sync.Mutex
+	users   []*User
+	modTime time.Time
+	size    int64
+}
+
+func NewUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *UserStore) reload() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.users = nil
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size && s.users != nil {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	users := []*User{}
+	if err = json.Unmarshal(b, &users); err != nil {
+		return fmt.Errorf("error parsing %s: %w", s.path, err)
+	}
+	s.users = users
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *UserStore) save() error {
+	sort.Slice(s.users, func(i, j int) bool {
+		return s.users[i].Username < s.users[j].Username
+	})
+	b, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+		s.size = fi.Size()
+	}
+	return nil
+}
+
+func (s *UserStore) find(username string) (int, *User) {
+	for i, u := range s.users {
+		if u.Username == username {
+			return i, u
+		}
+	}
+	return -1, nil
+}
+
+func validateUser(u *User) error {
+	if u.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	return tokens.ValidateScopes(u.Scopes)
+}
+
+// Add creates a user with the given password
+func (s *UserStore) Add(u *User, password string) error {
+	if err := validateUser(u); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	if _, v := s.find(u.Username); v != nil {
+		return ErrUserExists
+	}
+	obj := *u
+	obj.PasswordHash = string(hash)
+	obj.CreatedAt = time.Now()
+	s.users = append(s.users, &obj)
+	return s.save()
+}
+
+// Update replaces name, email and scopes of an existing user. The password is
+// left unchanged.
+func (s *UserStore) Update(u *User) error {
+	if err := validateUser(u); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	_, v := s.find(u.Username)
+	if v == nil {
+		return ErrUserNotFound
+	}
+	v.Name = u.Name
+	v.Email = u.Email
+	v.Scopes = u.Scopes
+	return s.save()
+}
+
+// SetPassword replaces the password of an existing user
+func (s *UserStore) SetPassword(username, password string) error {
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	_, v := s.find(username)
+	if v == nil {
+		return ErrUserNotFound
+	}
+	v.PasswordHash = string(hash)
+	return s.save()
+}
+
+// Remove deletes the user with the given username
+func (s *UserStore) Remove(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	i, v := s.find(username)
+	if v == nil {
+		return ErrUserNotFound
+	}
+	s.users = append(s.users[:i], s.users[i+1:]...)
+	return s.save()
+}
+
+// List returns all users sorted by username
+func (s *UserStore) List() ([]*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	result := make([]*User, len(s.users))
+	for i, u := range s.users {
+		obj := *u
+		result[i] = &obj
+	}
+	return result, nil
+}
+
+// Get returns the user with the given username
+func (s *UserStore) Get(username string) (*User, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	if _, v := s.find(username); v != nil {
+		obj := *v
+		return &obj, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// compareDummyHash spends as long as checking the password of an existing
+// user so that response times do not reveal which usernames exist
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		var err error
+		dummyHash, err = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		if err != nil {
+			panic(err)
+		}
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// Authenticate returns the user if password matches, otherwise
+// ErrInvalidCredentials
+func (s *UserStore) Authenticate(username, password string) (*User, error) {
+	u, err := s.Get(username)
+	if err == ErrUserNotFound {
+		compareDummyHash(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
@@ -0,0 +1,71 @@
+package localidp
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+func TestUserStore(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "users.json")
+	s, err := NewUserStore(fp)
+	require.NoError(t, err)
+
+	assert.Error(t, s.Add(&User{Scopes: []string{"read"}}, "secret"))
+	assert.Error(t, s.Add(&User{Username: "john", Scopes: []string{"read"}}, ""))
+	assert.ErrorIs(t, s.Add(&User{Username: "john", Scopes: []string{"delete"}}, "secret"), tokens.ErrInvalidScope)
+
+	require.NoError(t, s.Add(&User{
+		Username: "john",
+		Name:     "John Doe",
+		Email:    "john@domain.com",
+		Scopes:   []string{"write"},
+	}, "secret"))
+	assert.Equal(t, ErrUserExists, s.Add(&User{Username: "john", Scopes: []string{"read"}}, "abc"))
+	require.NoError(t, s.Add(&User{Username: "alice", Scopes: []string{"read"}}, "pass"))
+
+	u, err := s.Get("john")
+	require.NoError(t, err)
+	assert.False(t, strings.Contains(u.PasswordHash, "secret"))
+	assert.Equal(t, []string{"read", "write"}, u.GrantedScopes())
+
+	_, err = s.Authenticate("john", "wrong")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = s.Authenticate("nobody", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	// unknown users are checked against a dummy hash
+	assert.NotEmpty(t, dummyHash)
+	u, err = s.Authenticate("john", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "john@domain.com", u.Email)
+
+	// another process sees the same users
+	s2, err := NewUserStore(fp)
+	require.NoError(t, err)
+	require.NoError(t, s2.SetPassword("john", "new-secret"))
+	require.NoError(t, s2.Update(&User{Username: "john", Name: "Johnny", Scopes: []string{"admin"}}))
+	_, err = s.Authenticate("john", "secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	u, err = s.Authenticate("john", "new-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "Johnny", u.Name)
+	assert.Equal(t, "", u.Email)
+	assert.Equal(t, []string{"admin"}, u.Scopes)
+
+	sl, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, sl, 2)
+	assert.Equal(t, "alice", sl[0].Username)
+	assert.Equal(t, "john", sl[1].Username)
+
+	require.NoError(t, s.Remove("alice"))
+	assert.Equal(t, ErrUserNotFound, s.Remove("alice"))
+	assert.Equal(t, ErrUserNotFound, s.SetPassword("alice", "abc"))
+	assert.Equal(t, ErrUserNotFound, s.Update(&User{Username: "alice", Scopes: []string{"read"}}))
+	_, err = s2.Get("alice")
+	assert.Equal(t, ErrUserNotFound, err)
+}
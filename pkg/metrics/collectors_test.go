@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionsCollector(t *testing.T) {
+	c := NewSessionsCollector(func() int { return 2 }, func() int { return 1 })
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP wrgld_pack_sessions Number of open upload-pack and receive-pack sessions.
+# TYPE wrgld_pack_sessions gauge
+wrgld_pack_sessions{type="receive-pack"} 1
+wrgld_pack_sessions{type="upload-pack"} 2
+`)))
+}
+
+func TestBadgerCollector(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{
+		"000001.sst":  10,
+		"000002.sst":  5,
+		"000001.vlog": 7,
+		"MANIFEST":    3,
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0644))
+	}
+	c := NewBadgerCollector(dir)
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP wrgld_badger_lsm_size_bytes Size of Badger LSM tree files.
+# TYPE wrgld_badger_lsm_size_bytes gauge
+wrgld_badger_lsm_size_bytes 15
+# HELP wrgld_badger_vlog_size_bytes Size of Badger value log files.
+# TYPE wrgld_badger_vlog_size_bytes gauge
+wrgld_badger_vlog_size_bytes 7
+`)))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewBadgerCollector(filepath.Join(dir, "missing")))
+	_, err := reg.Gather()
+	assert.Error(t, err)
+}
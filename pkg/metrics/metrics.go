@@ -0,0 +1,142 @@
+// Package metrics defines the Prometheus metrics of wrgld. Metrics are
+// registered with the default registry, which the probes server exposes at
+// /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "wrgld"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests by route template, method and status code.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"route", "method", "code"})
+
+	HTTPRequestBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_bytes_total",
+		Help:      "Bytes read from HTTP request bodies by route template.",
+	}, []string{"route"})
+
+	HTTPResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "response_bytes_total",
+		Help:      "Bytes written to HTTP response bodies by route template.",
+	}, []string{"route"})
+
+	IngestRows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "rows_total",
+		Help:      "Number of rows ingested by commits.",
+	})
+
+	IngestRowsPerSecond = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "rows_per_second",
+		Help:      "Ingest throughput of each commit.",
+		Buckets:   prometheus.ExponentialBuckets(100, 4, 8),
+	})
+
+	// IngestPhaseDuration is labeled with phase "sort", which reads and sorts
+	// rows, or "insert", which saves blocks and the table
+	IngestPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "ingest",
+		Name:      "phase_duration_seconds",
+		Help:      "Time taken by each phase of ingesting a commit.",
+		Buckets:   prometheus.ExponentialBuckets(.01, 4, 9),
+	}, []string{"phase"})
+
+	// DiffDuration is labeled with kind "diff" for the diff endpoint or
+	// "summary" for diff stats sent to webhooks
+	DiffDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "diff",
+		Name:      "duration_seconds",
+		Help:      "Time taken to diff two tables.",
+		Buckets:   prometheus.ExponentialBuckets(.01, 4, 9),
+	}, []string{"kind"})
+
+	// WebhookDeliveries is labeled with outcome "success" for 2xx answers,
+	// "failure" for other answers, or "error" when no answer was received
+	WebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "Number of webhook delivery attempts by outcome.",
+	}, []string{"outcome"})
+
+	WebhookDeliveryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "delivery_duration_seconds",
+		Help:      "Time taken by webhook delivery attempts.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	WebhookDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "webhook",
+		Name:      "dead_letters_total",
+		Help:      "Number of deliveries given up after exhausting retries.",
+	})
+
+	// GCRuns is labeled with result "success", "failure" or "skipped"
+	GCRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "runs_total",
+		Help:      "Number of garbage collection runs by result.",
+	}, []string{"result"})
+
+	GCDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "duration_seconds",
+		Help:      "Time taken by garbage collection runs.",
+		Buckets:   prometheus.ExponentialBuckets(.1, 4, 8),
+	})
+
+	// GCReclaimedObjects is labeled with type "transaction", "commit", "table",
+	// "block" or "block_index"
+	GCReclaimedObjects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "reclaimed_objects_total",
+		Help:      "Number of objects removed by garbage collection by type.",
+	}, []string{"type"})
+
+	GCRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "running",
+		Help:      "Whether garbage collection is in progress.",
+	})
+
+	// GCLastRunTimestamp is labeled with result "success", "failure" or
+	// "skipped"
+	GCLastRunTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Time the last garbage collection run with each result finished, as a Unix timestamp.",
+	}, []string{"result"})
+)
@@ -11,7 +11,7 @@ var UMAResourceTypes = map[string]uma.ResourceType{
 		Type:           "https://www.wrgl.co/rsrcs/repository",
 		Description:    "A Wrgl repository",
 		IconUri:        "https://www.wrgl.co/rsrcs/repository/icon.png",
-		ResourceScopes: []string{"read", "write"},
+		ResourceScopes: []string{"read", "write", "admin"},
 	},
 }
 
@@ -29,10 +29,17 @@ var umaDefaultSecurity uma.Security = []map[string][]string{
 
 var umaPaths = []uma.Path{
 	uma.NewPath("/gc", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
 		"POST": {
 			Security: []map[string][]string{
 				{
-					"oidc": {"write"},
+					"oidc": {"admin"},
 				},
 			},
 		},
@@ -43,9 +50,49 @@ var umaPaths = []uma.Path{
 	uma.NewPath("/rows", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/audit", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/blocks", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/config", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
+	uma.NewPath("/events", nil, map[string]uma.Operation{
+		"GET": {},
+	}),
+	uma.NewPath("/tokens", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+		"POST": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
+	uma.NewPath("/changes", nil, map[string]uma.Operation{
+		"GET": {},
+	}),
 	uma.NewPath("/commits", nil, map[string]uma.Operation{
 		"GET": {},
 		"POST": {
@@ -59,9 +106,36 @@ var umaPaths = []uma.Path{
 	uma.NewPath("/objects", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/sessions", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
+	uma.NewPath("/tokens/{id}", nil, map[string]uma.Operation{
+		"DELETE": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/upload-pack", nil, map[string]uma.Operation{
 		"POST": {},
 	}),
+	uma.NewPath("/gc/jobs/{id}", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/receive-pack", nil, map[string]uma.Operation{
 		"POST": {
 			Security: []map[string][]string{
@@ -80,9 +154,27 @@ var umaPaths = []uma.Path{
 			},
 		},
 	}),
+	uma.NewPath("/sessions/{id}", nil, map[string]uma.Operation{
+		"DELETE": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/tables/{hash}", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/webhooks/ping", nil, map[string]uma.Operation{
+		"POST": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/commits/{hash}", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
@@ -102,6 +194,15 @@ var umaPaths = []uma.Path{
 	uma.NewPath("/refs/heads/{branch}", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/webhooks/deliveries", nil, map[string]uma.Operation{
+		"GET": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/tables/{hash}/blocks", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
@@ -111,6 +212,15 @@ var umaPaths = []uma.Path{
 	uma.NewPath("/commits/{hash}/profile", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
+	uma.NewPath("/webhooks/deliveries/{id}/redeliver", nil, map[string]uma.Operation{
+		"POST": {
+			Security: []map[string][]string{
+				{
+					"oidc": {"admin"},
+				},
+			},
+		},
+	}),
 	uma.NewPath("/diff/{newCommitHash}/{oldCommitHash}", nil, map[string]uma.Operation{
 		"GET": {},
 	}),
@@ -0,0 +1,176 @@
+// Package oidcauth authenticates requests with JWTs issued by any OpenID
+// Connect provider and grants scopes based on roles or groups in their claims.
+package oidcauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+// AnyRole grants a scope to every authenticated user when listed among the
+// roles of that scope
+const AnyRole = "*"
+
+// Claims are what wrgld needs to know about an authenticated user
+type Claims struct {
+	Subject string
+	Name    string
+	Email   string
+	Roles   []string
+	Scopes  []string
+}
+
+// HasScopes returns true if all of the given scopes are granted
+func (c *Claims) HasScopes(scopes ...string) bool {
+	m := map[string]struct{}{}
+	for _, s := range c.Scopes {
+		m[s] = struct{}{}
+	}
+	for _, s := range scopes {
+		if _, ok := m[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type Authenticator struct {
+	verifier *oidc.IDTokenVerifier
+	conf     *wrgldconf.OIDC
+}
+
+// NewAuthenticator discovers the provider at c.Issuer. ctx is used for every
+// subsequent request to the provider, such as fetching signing keys, so it
+// should not be canceled. Use oidc.ClientContext to set the http client.
+func NewAuthenticator(ctx context.Context, c *wrgldconf.OIDC, skipExpiryCheck bool) (*Authenticator, error) {
+	p, err := oidc.NewProvider(ctx, c.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering oidc provider %s: %w", c.Issuer, err)
+	}
+	return &Authenticator{
+		verifier: p.Verifier(&oidc.Config{
+			ClientID:          c.ClientID,
+			SkipClientIDCheck: c.ClientID == "",
+			SkipExpiryCheck:   skipExpiryCheck,
+		}),
+		conf: c,
+	}, nil
+}
+
+// Authenticate verifies rawToken and extracts its claims
+func (a *Authenticator) Authenticate(ctx context.Context, rawToken string) (*Claims, error) {
+	tok, err := a.verifier.Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	if err = tok.Claims(&m); err != nil {
+		return nil, err
+	}
+	c := &Claims{
+		Subject: tok.Subject,
+	}
+	c.Name, _ = m["name"].(string)
+	if c.Name == "" {
+		c.Name, _ = m["preferred_username"].(string)
+	}
+	c.Email, _ = m["email"].(string)
+	claimNames := a.conf.RoleClaims
+	if len(claimNames) == 0 {
+		claimNames = wrgldconf.DefaultRoleClaims
+	}
+	for _, name := range claimNames {
+		c.Roles = append(c.Roles, lookupStrings(m, strings.Split(name, "."))...)
+	}
+	c.Scopes = a.scopesForRoles(c.Roles)
+	return c, nil
+}
+
+func (a *Authenticator) scopesForRoles(roles []string) []string {
+	m := map[string]struct{}{AnyRole: {}}
+	for _, r := range roles {
+		m[r] = struct{}{}
+	}
+	scopes := []string{}
+	for scope, granted := range a.conf.Scopes {
+		for _, r := range granted {
+			if _, ok := m[r]; ok {
+				scopes = append(scopes, scope)
+				break
+			}
+		}
+	}
+	return tokens.ExpandScopes(scopes)
+}
+
+// lookupStrings follows path into nested claims and returns the string or
+// strings found at the end
+func lookupStrings(m map[string]interface{}, path []string) []string {
+	v, ok := m[path[0]]
+	if !ok {
+		return nil
+	}
+	if len(path) > 1 {
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		return lookupStrings(sub, path[1:])
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		sl := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				sl = append(sl, s)
+			}
+		}
+		return sl
+	}
+	return nil
+}
+
+type claimsKey struct{}
+
+func SetClaims(r *http.Request, c *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, c))
+}
+
+// GetClaims returns claims of the authenticated user, or nil if the request is
+// anonymous
+func GetClaims(r *http.Request) *Claims {
+	if i := r.Context().Value(claimsKey{}); i != nil {
+		return i.(*Claims)
+	}
+	return nil
+}
+
+// Middleware verifies the bearer token of each request and stores its claims
+// in the request context. Requests without a bearer token are passed on as
+// anonymous requests. Requests with an invalid token get a 401 response from
+// unauthorized.
+func (a *Authenticator) Middleware(unauthorized func(rw http.ResponseWriter)) func(handler http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if !strings.HasPrefix(header, "Bearer ") {
+				handler.ServeHTTP(rw, r)
+				return
+			}
+			c, err := a.Authenticate(r.Context(), strings.TrimPrefix(header, "Bearer "))
+			if err != nil {
+				unauthorized(rw)
+				return
+			}
+			handler.ServeHTTP(rw, SetClaims(r, c))
+		})
+	}
+}
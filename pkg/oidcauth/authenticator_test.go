@@ -0,0 +1,103 @@
+package oidcauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	oidctest "github.com/wrgl/wrgld/pkg/oidcauth/test"
+)
+
+func TestAuthenticator(t *testing.T) {
+	iss := oidctest.NewIssuer(t)
+	ctx := context.Background()
+	a, err := NewAuthenticator(ctx, &wrgldconf.OIDC{
+		Issuer:     iss.URL,
+		ClientID:   "wrgld",
+		RoleClaims: []string{"groups", "realm_access.roles"},
+		Scopes: map[string][]string{
+			"read":  {AnyRole},
+			"write": {"data-engineers"},
+			"admin": {"wrgl-admins"},
+		},
+	}, false)
+	require.NoError(t, err)
+
+	c, err := a.Authenticate(ctx, iss.Sign(t, jwt.MapClaims{
+		"sub":    "123",
+		"aud":    "wrgld",
+		"name":   "John Doe",
+		"email":  "john@domain.com",
+		"groups": []string{"data-engineers"},
+		"realm_access": map[string]interface{}{
+			"roles": []string{"offline_access"},
+		},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, &Claims{
+		Subject: "123",
+		Name:    "John Doe",
+		Email:   "john@domain.com",
+		Roles:   []string{"data-engineers", "offline_access"},
+		Scopes:  []string{"read", "write"},
+	}, c)
+	assert.True(t, c.HasScopes("read", "write"))
+	assert.False(t, c.HasScopes("admin"))
+
+	// nested claim and preferred_username
+	c, err = a.Authenticate(ctx, iss.Sign(t, jwt.MapClaims{
+		"sub":                "456",
+		"aud":                "wrgld",
+		"preferred_username": "jane",
+		"realm_access": map[string]interface{}{
+			"roles": []string{"wrgl-admins"},
+		},
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, "jane", c.Name)
+	// admin implies write
+	assert.Equal(t, []string{"admin", "read", "write"}, c.Scopes)
+
+	// wrong audience
+	_, err = a.Authenticate(ctx, iss.Sign(t, jwt.MapClaims{"sub": "123", "aud": "other"}))
+	assert.Error(t, err)
+
+	// expired
+	_, err = a.Authenticate(ctx, iss.Sign(t, jwt.MapClaims{
+		"sub": "123", "aud": "wrgld", "exp": time.Now().Add(-time.Minute).Unix(),
+	}))
+	assert.Error(t, err)
+
+	// middleware
+	var got *Claims
+	handler := a.Middleware(func(rw http.ResponseWriter) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = GetClaims(r)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/refs/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, got)
+
+	req := httptest.NewRequest(http.MethodGet, "/refs/", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/refs/", nil)
+	req.Header.Set("Authorization", "Bearer "+iss.Sign(t, jwt.MapClaims{"sub": "789", "aud": "wrgld", "email": "a@b.c"}))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.NotNil(t, got)
+	assert.Equal(t, "a@b.c", got.Email)
+	assert.Equal(t, []string{"read"}, got.Scopes)
+}
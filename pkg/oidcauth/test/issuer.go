@@ -0,0 +1,74 @@
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+// Issuer is a minimal OpenID Connect provider serving a discovery document and
+// the key that signs its tokens
+type Issuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func NewIssuer(t *testing.T) *Issuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	iss := &Issuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"issuer":                                iss.URL,
+			"authorization_endpoint":                iss.URL + "/auth",
+			"token_endpoint":                        iss.URL + "/token",
+			"jwks_uri":                              iss.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "test",
+					"alg": "RS256",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// Sign returns a token signed by this issuer. "iss" and "exp" claims are added
+// if missing.
+func (iss *Issuer) Sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = iss.URL
+	}
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = "test"
+	s, err := tok.SignedString(iss.key)
+	require.NoError(t, err)
+	return s
+}
@@ -0,0 +1,31 @@
+package probes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var ErrDiskSpaceUnsupported = errors.New("free disk space is not supported on this platform")
+
+// DiskCheck fails when the file system containing path has less than minFree
+// bytes available. It always passes on platforms where free space cannot be
+// determined.
+func DiskCheck(name, path string, minFree uint64) Check {
+	return Check{
+		Name: name,
+		Func: func(ctx context.Context) error {
+			free, err := FreeDiskSpace(path)
+			if errors.Is(err, ErrDiskSpaceUnsupported) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if free < minFree {
+				return fmt.Errorf("%d bytes free at %s, below threshold of %d bytes", free, path, minFree)
+			}
+			return nil
+		},
+	}
+}
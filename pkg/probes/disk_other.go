@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package probes
+
+// FreeDiskSpace is not supported on this platform
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, ErrDiskSpaceUnsupported
+}
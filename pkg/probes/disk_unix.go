@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package probes
+
+import "syscall"
+
+// FreeDiskSpace returns the number of bytes available to unprivileged users
+// on the file system containing path
+func FreeDiskSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -1,36 +1,256 @@
+// Package probes serves readiness and liveness probes, Prometheus metrics and
+// a JSON status page on a port separate from the API.
 package probes
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const (
+	DefaultAddr         = ":2112"
+	DefaultCheckTimeout = 5 * time.Second
+)
+
 type Probable interface {
 	Ready() bool
 }
 
-func StartServer(s Probable) {
-	sm := http.NewServeMux()
-	sm.HandleFunc("/ready", func(rw http.ResponseWriter, r *http.Request) {
-		if s.Ready() {
-			_, err := rw.Write([]byte("ready"))
-			if err != nil {
-				panic(err)
+// Check is a named health check. Every check must pass for the server to be
+// ready, while only liveness checks must pass for it to be alive.
+type Check struct {
+	Name     string
+	Liveness bool
+	Func     func(ctx context.Context) error
+}
+
+// ReadyCheck fails when p is not ready
+func ReadyCheck(name string, p Probable) Check {
+	return Check{
+		Name: name,
+		Func: func(ctx context.Context) error {
+			if !p.Ready() {
+				return fmt.Errorf("not ready")
 			}
-		} else {
-			http.Error(rw, "not ready", http.StatusTooEarly)
+			return nil
+		},
+	}
+}
+
+type CheckResult struct {
+	Name      string `json:"name"`
+	Liveness  bool   `json:"liveness,omitempty"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	ElapsedMs int64  `json:"elapsedMs"`
+}
+
+type Status struct {
+	Ready  bool                   `json:"ready"`
+	Live   bool                   `json:"live"`
+	Checks []*CheckResult         `json:"checks"`
+	Info   map[string]interface{} `json:"info,omitempty"`
+}
+
+type Server struct {
+	checks  []Check
+	timeout time.Duration
+	info    func() map[string]interface{}
+	srv     *http.Server
+
+	// running holds checks that have not returned, so that a wedged check
+	// fails right away instead of piling up goroutines
+	running map[string]bool
+	mutex   sync.Mutex
+}
+
+type ServerOption func(s *Server)
+
+// WithTLSConfig serves probes over TLS
+func WithTLSConfig(c *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.srv.TLSConfig = c
+	}
+}
+
+// WithCheckTimeout sets how long each check can take before it fails.
+// Defaults to DefaultCheckTimeout
+func WithCheckTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeout = d
+	}
+}
+
+// WithInfo adds details returned by info to /debug/status
+func WithInfo(info func() map[string]interface{}) ServerOption {
+	return func(s *Server) {
+		s.info = info
+	}
+}
+
+// NewServer creates a server listening at addr. Addr defaults to DefaultAddr
+func NewServer(addr string, checks []Check, opts ...ServerOption) *Server {
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	s := &Server{
+		checks:  checks,
+		timeout: DefaultCheckTimeout,
+		running: map[string]bool{},
+	}
+	sm := http.NewServeMux()
+	sm.HandleFunc("/ready", s.handleReady)
+	sm.HandleFunc("/healthz", s.handleHealthz)
+	sm.HandleFunc("/debug/status", s.handleStatus)
+	sm.Handle("/metrics", promhttp.Handler())
+	s.srv = &http.Server{
+		Addr:    addr,
+		Handler: sm,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *Server) run(ctx context.Context, c Check) *CheckResult {
+	res := &CheckResult{Name: c.Name, Liveness: c.Liveness}
+	s.mutex.Lock()
+	if s.running[c.Name] {
+		s.mutex.Unlock()
+		res.Error = "previous check has not returned"
+		return res
+	}
+	s.running[c.Name] = true
+	s.mutex.Unlock()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			s.mutex.Lock()
+			delete(s.running, c.Name)
+			s.mutex.Unlock()
+		}()
+		errCh <- c.Func(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", s.timeout)
+	}
+	res.ElapsedMs = time.Since(start).Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.OK = true
+	}
+	return res
+}
+
+// Status runs checks concurrently. If livenessOnly is true, only liveness
+// checks are run.
+func (s *Server) Status(ctx context.Context, livenessOnly bool) *Status {
+	st := &Status{Ready: true, Live: true, Checks: []*CheckResult{}}
+	var (
+		wg    sync.WaitGroup
+		mutex sync.Mutex
+	)
+	for _, c := range s.checks {
+		if livenessOnly && !c.Liveness {
+			continue
 		}
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			res := s.run(ctx, c)
+			mutex.Lock()
+			defer mutex.Unlock()
+			st.Checks = append(st.Checks, res)
+		}(c)
+	}
+	wg.Wait()
+	sort.Slice(st.Checks, func(i, j int) bool {
+		return st.Checks[i].Name < st.Checks[j].Name
 	})
-	sm.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
-		_, err := rw.Write([]byte("ok"))
-		if err != nil {
-			panic(err)
+	for _, res := range st.Checks {
+		if !res.OK {
+			st.Ready = false
+			if res.Liveness {
+				st.Live = false
+			}
 		}
-	})
-	sm.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(":2112", sm)
+	}
+	return st
+}
+
+func failures(st *Status) string {
+	sl := []string{}
+	for _, res := range st.Checks {
+		if !res.OK {
+			sl = append(sl, fmt.Sprintf("%s: %s", res.Name, res.Error))
+		}
+	}
+	return strings.Join(sl, "\n")
+}
+
+func (s *Server) handleReady(rw http.ResponseWriter, r *http.Request) {
+	st := s.Status(r.Context(), false)
+	if !st.Ready {
+		http.Error(rw, "not ready\n"+failures(st), http.StatusServiceUnavailable)
+		return
+	}
+	rw.Write([]byte("ready"))
+}
+
+func (s *Server) handleHealthz(rw http.ResponseWriter, r *http.Request) {
+	st := s.Status(r.Context(), true)
+	if !st.Live {
+		http.Error(rw, "unhealthy\n"+failures(st), http.StatusServiceUnavailable)
+		return
+	}
+	rw.Write([]byte("ok"))
+}
+
+func (s *Server) handleStatus(rw http.ResponseWriter, r *http.Request) {
+	st := s.Status(r.Context(), false)
+	if s.info != nil {
+		st.Info = s.info()
+	}
+	b, err := json.Marshal(st)
 	if err != nil {
-		panic(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
+
+// Handler returns the handler serving all probes
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// ListenAndServe serves probes until Shutdown is called, after which it
+// returns http.ErrServerClosed
+func (s *Server) ListenAndServe() error {
+	if s.srv.TLSConfig != nil {
+		return s.srv.ListenAndServeTLS("", "")
 	}
+	return s.srv.ListenAndServe()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
 }
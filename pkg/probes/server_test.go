@@ -0,0 +1,116 @@
+package probes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type probable bool
+
+func (p *probable) Ready() bool {
+	return bool(*p)
+}
+
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestServer(t *testing.T) {
+	ready := probable(true)
+	var storeErr error
+	block := make(chan struct{})
+	var blocked bool
+	s := NewServer("", []Check{
+		ReadyCheck("draining", &ready),
+		{
+			Name:     "store",
+			Liveness: true,
+			Func: func(ctx context.Context) error {
+				if blocked {
+					<-block
+				}
+				return storeErr
+			},
+		},
+	}, WithCheckTimeout(50*time.Millisecond), WithInfo(func() map[string]interface{} {
+		return map[string]interface{}{"version": "1.2.3"}
+	}))
+	h := s.Handler()
+
+	code, body := get(t, h, "/ready")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", body)
+	code, body = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+
+	// readiness checks do not affect liveness
+	ready = false
+	code, body = get(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready\ndraining: not ready\n", body)
+	code, _ = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	ready = true
+	storeErr = fmt.Errorf("closed")
+	code, body = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unhealthy\nstore: closed\n", body)
+	code, _ = get(t, h, "/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	code, body = get(t, h, "/debug/status")
+	assert.Equal(t, http.StatusOK, code)
+	st := &Status{}
+	require.NoError(t, json.Unmarshal([]byte(body), st))
+	for _, res := range st.Checks {
+		res.ElapsedMs = 0
+	}
+	assert.Equal(t, &Status{
+		Ready: false,
+		Live:  false,
+		Checks: []*CheckResult{
+			{Name: "draining", OK: true},
+			{Name: "store", Liveness: true, Error: "closed"},
+		},
+		Info: map[string]interface{}{"version": "1.2.3"},
+	}, st)
+
+	// a wedged check times out, then fails right away until it returns
+	storeErr = nil
+	blocked = true
+	code, body = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unhealthy\nstore: timed out after 50ms\n", body)
+	code, body = get(t, h, "/healthz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unhealthy\nstore: previous check has not returned\n", body)
+	close(block)
+	assert.Eventually(t, func() bool {
+		code, _ := get(t, h, "/healthz")
+		return code == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDiskCheck(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, DiskCheck("disk", dir, 0).Func(context.Background()))
+	free, err := FreeDiskSpace(dir)
+	if err == ErrDiskSpaceUnsupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	assert.Error(t, DiskCheck("disk", dir, free+1<<40).Func(context.Background()))
+}
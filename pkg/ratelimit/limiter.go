@@ -0,0 +1,136 @@
+// Package ratelimit throttles clients with token buckets and caps how many
+// requests each client can have in progress.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+// maxIdleBuckets is how many buckets are kept before full buckets are dropped
+const maxIdleBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type key struct {
+	class  string
+	client string
+}
+
+// Limiter enforces wrgldconf.RateLimits. Clients are identified by an opaque
+// string such as the subject of a credential or an IP address.
+type Limiter struct {
+	conf     *wrgldconf.RateLimits
+	buckets  map[key]*bucket
+	inFlight map[key]int
+	now      func() time.Time
+	mutex    sync.Mutex
+}
+
+func NewLimiter(c *wrgldconf.RateLimits) *Limiter {
+	return &Limiter{
+		conf:     c,
+		buckets:  map[key]*bucket{},
+		inFlight: map[key]int{},
+		now:      time.Now,
+	}
+}
+
+func burst(rl *wrgldconf.RateLimit) float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return math.Max(1, math.Ceil(rl.RequestsPerSecond))
+}
+
+// refill adds tokens accumulated since the bucket was last used
+func (b *bucket) refill(rl *wrgldconf.RateLimit, now time.Time) {
+	b.tokens = math.Min(burst(rl), b.tokens+now.Sub(b.last).Seconds()*rl.RequestsPerSecond)
+	b.last = now
+}
+
+// dropFullBuckets forgets clients that are back to a full bucket since they
+// are indistinguishable from new clients
+func (l *Limiter) dropFullBuckets(now time.Time) {
+	for k, b := range l.buckets {
+		rl := l.conf.ForClass(k.class)
+		if rl == nil || rl.RequestsPerSecond <= 0 {
+			delete(l.buckets, k)
+			continue
+		}
+		b.refill(rl, now)
+		if b.tokens >= burst(rl) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Allow takes a token from the bucket of client for class. If the bucket is
+// empty, it returns false and how long until a token is available.
+func (l *Limiter) Allow(class, client string) (retryAfter time.Duration, ok bool) {
+	rl := l.conf.ForClass(class)
+	if rl == nil || rl.RequestsPerSecond <= 0 {
+		return 0, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	k := key{class, client}
+	b, ok := l.buckets[k]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFullBuckets(now)
+		}
+		b = &bucket{tokens: burst(rl), last: now}
+		l.buckets[k] = b
+	} else {
+		b.refill(rl, now)
+	}
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rl.RequestsPerSecond * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// MaxConcurrent returns the maximum number of requests or sessions a client
+// can have in progress for class, or 0 if unlimited
+func (l *Limiter) MaxConcurrent(class string) int {
+	if rl := l.conf.ForClass(class); rl != nil {
+		return rl.MaxConcurrent
+	}
+	return 0
+}
+
+// Acquire counts a request of client as in progress until release is called.
+// It returns false if the client already has MaxConcurrent requests in
+// progress.
+func (l *Limiter) Acquire(class, client string) (release func(), ok bool) {
+	max := l.MaxConcurrent(class)
+	if max <= 0 {
+		return func() {}, true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	k := key{class, client}
+	if l.inFlight[k] >= max {
+		return nil, false
+	}
+	l.inFlight[k]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			if l.inFlight[k]--; l.inFlight[k] <= 0 {
+				delete(l.inFlight, k)
+			}
+		})
+	}, true
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	l := NewLimiter(&wrgldconf.RateLimits{
+		Default: &wrgldconf.RateLimit{RequestsPerSecond: 2},
+		Classes: map[string]*wrgldconf.RateLimit{
+			wrgldconf.RouteClassCommit: {RequestsPerSecond: 0.5, Burst: 1},
+			wrgldconf.RouteClassRead:   {},
+		},
+	})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		_, ok := l.Allow(wrgldconf.RouteClassWrite, "a")
+		assert.True(t, ok)
+	}
+	retryAfter, ok := l.Allow(wrgldconf.RouteClassWrite, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	_, ok = l.Allow(wrgldconf.RouteClassWrite, "b")
+	assert.True(t, ok)
+
+	_, ok = l.Allow(wrgldconf.RouteClassCommit, "a")
+	assert.True(t, ok)
+	retryAfter, ok = l.Allow(wrgldconf.RouteClassCommit, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, retryAfter)
+
+	now = now.Add(time.Second)
+	_, ok = l.Allow(wrgldconf.RouteClassWrite, "a")
+	assert.True(t, ok)
+	retryAfter, ok = l.Allow(wrgldconf.RouteClassCommit, "a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// unlimited
+	for i := 0; i < 100; i++ {
+		_, ok = l.Allow(wrgldconf.RouteClassRead, "a")
+		require.True(t, ok)
+	}
+}
+
+func TestLimiterAcquire(t *testing.T) {
+	l := NewLimiter(&wrgldconf.RateLimits{
+		Classes: map[string]*wrgldconf.RateLimit{
+			wrgldconf.RouteClassCommit: {MaxConcurrent: 2},
+		},
+	})
+	assert.Equal(t, 2, l.MaxConcurrent(wrgldconf.RouteClassCommit))
+	assert.Equal(t, 0, l.MaxConcurrent(wrgldconf.RouteClassRead))
+
+	release1, ok := l.Acquire(wrgldconf.RouteClassCommit, "a")
+	require.True(t, ok)
+	release2, ok := l.Acquire(wrgldconf.RouteClassCommit, "a")
+	require.True(t, ok)
+	_, ok = l.Acquire(wrgldconf.RouteClassCommit, "a")
+	assert.False(t, ok)
+	_, ok = l.Acquire(wrgldconf.RouteClassCommit, "b")
+	assert.True(t, ok)
+
+	release1()
+	release1()
+	_, ok = l.Acquire(wrgldconf.RouteClassCommit, "a")
+	assert.True(t, ok)
+	_, ok = l.Acquire(wrgldconf.RouteClassCommit, "a")
+	assert.False(t, ok)
+	release2()
+	_, ok = l.Acquire(wrgldconf.RouteClassRead, "a")
+	assert.True(t, ok)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+// redacted replaces values of redacted query parameters and payload fields
+const redacted = "REDACTED"
+
+type accessLogger struct {
+	logger      logr.Logger
+	getRepo     func(r *http.Request) string
+	sampleRatio float64
+	payloads    bool
+	queryParams map[string]struct{}
+	fields      map[string]struct{}
+}
+
+func lowerSet(lists ...[]string) map[string]struct{} {
+	m := map[string]struct{}{}
+	for _, sl := range lists {
+		for _, s := range sl {
+			m[strings.ToLower(s)] = struct{}{}
+		}
+	}
+	return m
+}
+
+// AccessLogMiddleware logs each request once it is served, with its ID,
+// status, sizes, subject, repository and route template. c controls sampling,
+// payload logging and redaction, and can be nil. getRepo returns the name of
+// the repository a request is for, and can also be nil.
+func AccessLogMiddleware(logger logr.Logger, c *wrgldconf.AccessLog, getRepo func(r *http.Request) string) func(handler http.Handler) http.Handler {
+	l := &accessLogger{
+		logger:      logger,
+		getRepo:     getRepo,
+		sampleRatio: 1,
+		queryParams: lowerSet(wrgldconf.DefaultRedactedQueryParams),
+		fields:      lowerSet(wrgldconf.DefaultRedactedFields),
+	}
+	if c != nil {
+		if c.SampleRatio != nil {
+			l.sampleRatio = *c.SampleRatio
+		}
+		l.payloads = c.Payloads
+		l.queryParams = lowerSet(wrgldconf.DefaultRedactedQueryParams, c.RedactQueryParams)
+		l.fields = lowerSet(wrgldconf.DefaultRedactedFields, c.RedactFields)
+	}
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			l.serveHTTP(rw, r, handler)
+		})
+	}
+}
+
+func (l *accessLogger) serveHTTP(rw http.ResponseWriter, r *http.Request, next http.Handler) {
+	start := time.Now()
+	r, info := WithRequestInfo(r)
+	assignRequestID(rw, r, info)
+	var pr *payloadRecorder
+	if l.payloads {
+		pr = &payloadRecorder{}
+		r = setPayloadRecorder(r, pr)
+	}
+	var body *countingReader
+	if r.Body != nil {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	mrw := &metricsResponseWriter{ResponseWriter: rw}
+	next.ServeHTTP(mrw, r)
+
+	status := mrw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// failed requests are always logged
+	if status < http.StatusBadRequest && l.sampleRatio < 1 && rand.Float64() >= l.sampleRatio {
+		return
+	}
+	var bytesIn int64
+	if body != nil {
+		bytesIn = body.n
+	}
+	kvs := []interface{}{
+		"request_id", info.ID,
+		"method", r.Method,
+		"uri", l.redactURI(r.URL),
+		"route", info.Route,
+		"status", status,
+		"bytes_in", bytesIn,
+		"bytes_out", mrw.n,
+		"elapsed_ms", time.Since(start).Milliseconds(),
+		"subject", info.Subject,
+		"remote_addr", r.RemoteAddr,
+		"user_agent", r.UserAgent(),
+	}
+	if l.getRepo != nil {
+		kvs = append(kvs, "repo", l.getRepo(r))
+	}
+	if pr != nil {
+		if pr.requestInfo != nil {
+			kvs = append(kvs, "request_payload", l.redactPayload(pr.requestInfo))
+		}
+		if pr.responseInfo != nil {
+			kvs = append(kvs, "response_payload", l.redactPayload(pr.responseInfo))
+		}
+	}
+	l.logger.Info("request", kvs...)
+}
+
+// redactURI returns the request URI of u with values of redacted query
+// parameters replaced
+func (l *accessLogger) redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	q := u.Query()
+	var found bool
+	for k := range q {
+		if _, ok := l.queryParams[strings.ToLower(k)]; ok {
+			q[k] = []string{redacted}
+			found = true
+		}
+	}
+	if !found {
+		return u.RequestURI()
+	}
+	v := *u
+	v.RawQuery = q.Encode()
+	return v.RequestURI()
+}
+
+// redactPayload converts v to its JSON representation with values of redacted
+// fields replaced at any depth
+func (l *accessLogger) redactPayload(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	var obj interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err.Error()
+	}
+	return l.redactValue(obj)
+}
+
+func (l *accessLogger) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if _, ok := l.fields[strings.ToLower(k)]; ok {
+				v[k] = redacted
+			} else {
+				v[k] = l.redactValue(val)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = l.redactValue(val)
+		}
+	}
+	return v
+}
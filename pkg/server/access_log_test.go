@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/server"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	var lines []map[string]interface{}
+	logger := funcr.NewJSON(func(obj string) {
+		m := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(obj), &m))
+		lines = append(lines, m)
+	}, funcr.Options{})
+	newHandler := func(ratio float64) http.Handler {
+		return server.AccessLogMiddleware(logger, &wrgldconf.AccessLog{
+			SampleRatio:  &ratio,
+			Payloads:     true,
+			RedactFields: []string{"ssn"},
+		}, func(r *http.Request) string {
+			return "my-repo"
+		})(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			r = server.SetSubject(r, "token:abc")
+			server.GetRequestInfo(r).Route = "/things/"
+			if r.URL.Query().Get("fail") != "" {
+				server.SendError(rw, r, http.StatusBadRequest, "bad thing")
+				return
+			}
+			server.WriteJSON(rw, r, map[string]interface{}{
+				"token": "secret",
+				"items": []interface{}{map[string]interface{}{"SSN": "123", "name": "a"}},
+			})
+		}))
+	}
+
+	// successful requests are sampled out
+	rec := httptest.NewRecorder()
+	newHandler(0).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/things/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get(server.RequestIDHeader))
+	assert.Empty(t, lines)
+
+	handler := newHandler(1)
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/things/?access_token=xyz&limit=2", strings.NewReader("abc"))
+	req.Header.Set(server.RequestIDHeader, "req-1")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "req-1", rec.Header().Get(server.RequestIDHeader))
+	require.Len(t, lines, 1)
+	line := lines[0]
+	assert.Equal(t, "request", line["msg"])
+	assert.Equal(t, "req-1", line["request_id"])
+	assert.Equal(t, "POST", line["method"])
+	assert.Equal(t, "/things/?access_token=REDACTED&limit=2", line["uri"])
+	assert.Equal(t, "/things/", line["route"])
+	assert.Equal(t, float64(200), line["status"])
+	assert.Equal(t, float64(0), line["bytes_in"])
+	assert.Equal(t, float64(rec.Body.Len()), line["bytes_out"])
+	assert.Equal(t, "token:abc", line["subject"])
+	assert.Equal(t, "my-repo", line["repo"])
+	assert.Equal(t, map[string]interface{}{
+		"token": "REDACTED",
+		"items": []interface{}{map[string]interface{}{"SSN": "REDACTED", "name": "a"}},
+	}, line["response_payload"])
+
+	// failed requests are always logged, with the request id echoed in the
+	// error payload
+	lines = nil
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/things/?fail=1", nil)
+	req.Header.Set(server.RequestIDHeader, "not a valid id")
+	newHandler(0).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	id := rec.Header().Get(server.RequestIDHeader)
+	assert.NotEqual(t, "not a valid id", id)
+	assert.JSONEq(t, `{"message":"bad thing","code":"bad_request","requestId":"`+id+`"}`, rec.Body.String())
+	require.Len(t, lines, 1)
+	assert.Equal(t, id, lines[0]["request_id"])
+	assert.Equal(t, float64(400), lines[0]["status"])
+	assert.Equal(t, map[string]interface{}{
+		"message":   "bad thing",
+		"code":      "bad_request",
+		"requestId": id,
+	}, lines[0]["response_payload"])
+}
+
+func (s *testSuite) TestRequestID(t *testing.T) {
+	_, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	req, err := http.NewRequest(http.MethodGet, uri+"/commits/abc/", nil)
+	require.NoError(t, err)
+	req.Header.Set(server.RequestIDHeader, "my-request")
+	req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "my-request", resp.Header.Get(server.RequestIDHeader))
+	m := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	assert.Equal(t, "my-request", m["requestId"])
+}
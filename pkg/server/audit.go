@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/audit"
+)
+
+type ListAuditResponse struct {
+	Records []*audit.Record `json:"records"`
+}
+
+// recordAudit fills in who made the request then appends rec to the audit log.
+// The action has already taken place so failures are only logged.
+func (s *Server) recordAudit(r *http.Request, rec *audit.Record) {
+	s.auditRecorder(r)(rec)
+}
+
+// auditRecorder reads who made the request right away and returns a function
+// that records with it, for actions that complete after r is answered.
+func (s *Server) auditRecorder(r *http.Request) func(rec *audit.Record) {
+	if s.getAuditLog == nil {
+		return func(rec *audit.Record) {}
+	}
+	l := s.getAuditLog(r)
+	if l == nil {
+		return func(rec *audit.Record) {}
+	}
+	var authorName, authorEmail string
+	if author := GetAuthor(r); author != nil {
+		authorName = author.Name
+		authorEmail = author.Email
+	}
+	subject := GetSubject(r)
+	clientIP := audit.ClientIP(r.RemoteAddr)
+	requestID := RequestID(r)
+	return func(rec *audit.Record) {
+		rec.AuthorName = authorName
+		rec.AuthorEmail = authorEmail
+		rec.Subject = subject
+		rec.ClientIP = clientIP
+		rec.RequestID = requestID
+		if err := l.Record(rec); err != nil {
+			s.logger.Error(err, "error recording audit log", "action", rec.Action)
+		}
+	}
+}
+
+func auditRefUpdates(updates []proposedUpdate) []audit.RefUpdate {
+	sl := make([]audit.RefUpdate, len(updates))
+	for i, u := range updates {
+		sl[i] = audit.RefUpdate{
+			Ref:    u.Ref,
+			OldSum: hex.EncodeToString(u.OldSum),
+			Sum:    hex.EncodeToString(u.Sum),
+		}
+	}
+	return sl
+}
+
+func parseAuditFilter(r *http.Request) (*audit.Filter, error) {
+	query := r.URL.Query()
+	f := &audit.Filter{
+		Action:        query.Get("action"),
+		AuthorEmail:   query.Get("authorEmail"),
+		Subject:       query.Get("subject"),
+		TransactionID: query.Get("transactionId"),
+		Ref:           query.Get("ref"),
+	}
+	for key, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := query.Get(key); v != "" {
+			var err error
+			*t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("invalid " + key)
+			}
+		}
+	}
+	// CSV exports include every matching record unless limited explicitly
+	initial := 100
+	if query.Get("format") == "csv" {
+		initial = 0
+	}
+	limit, err := getQueryInt(query, "limit", initial)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, errors.New("invalid limit")
+	}
+	f.Limit = limit
+	return f, nil
+}
+
+func (s *Server) handleGetAudit(rw http.ResponseWriter, r *http.Request) {
+	var l *audit.Log
+	if s.getAuditLog != nil {
+		l = s.getAuditLog(r)
+	}
+	if l == nil {
+		SendError(rw, r, http.StatusNotFound, "audit log is not enabled")
+		return
+	}
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		SendError(rw, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sl, err := l.List(f)
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		if err = audit.WriteCSV(rw, sl); err != nil {
+			s.logger.Error(err, "error writing audit csv")
+		}
+		return
+	}
+	WriteJSON(rw, r, &ListAuditResponse{Records: sl})
+}
@@ -0,0 +1,145 @@
+package server_test
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/factory"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/pbar"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+)
+
+func (s *testSuite) TestAuditLog(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	newClient := func(token string) *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(token))
+		require.NoError(t, err)
+		return cli
+	}
+	cli := newClient(s.s.AdminToken(t))
+	rs := s.s.GetRS(repo)
+	csvReader := func() io.Reader {
+		return testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4))
+	}
+
+	cr, err := cli.Commit("main", "initial commit", "file.csv", csvReader(), nil, nil,
+		apiclient.WithRequestHeader(http.Header{"X-Request-Id": {"req-1"}}))
+	require.NoError(t, err)
+	sum1 := hex.EncodeToString((*cr.Sum)[:])
+
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	cr, err = cli.Commit("main", "second commit", "file.csv", csvReader(), nil, &tid)
+	require.NoError(t, err)
+	txSum := hex.EncodeToString((*cr.Sum)[:])
+	_, err = cli.CommitTransaction(tid)
+	require.NoError(t, err)
+	sum2, err := ref.GetHead(rs, "main")
+	require.NoError(t, err)
+
+	ctr, err = cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid2, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	_, err = cli.DiscardTransaction(tid2)
+	require.NoError(t, err)
+
+	// push a new branch
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	sum3, c3 := factory.CommitRandom(t, dbc, nil)
+	require.NoError(t, ref.CommitHead(rsc, "beta", sum3, c3, nil))
+	ses, err := apiclient.NewReceivePackSession(dbc, rsc, cli, map[string]*payload.Update{
+		"refs/heads/beta": {Sum: payload.BytesToHex(sum3)},
+	}, map[string][]byte{}, 0)
+	require.NoError(t, err)
+	_, err = ses.Start(pbar.NewContainer(io.Discard, true))
+	require.NoError(t, err)
+
+	_, err = cli.GarbageCollect()
+	require.NoError(t, err)
+
+	listAudit := func(query string) []*audit.Record {
+		t.Helper()
+		resp, err := cli.Request(http.MethodGet, "/audit/"+query, nil, nil)
+		require.NoError(t, err)
+		lar := &server.ListAuditResponse{}
+		parseJSONResponse(t, resp, lar)
+		return lar.Records
+	}
+	sl := listAudit("")
+	require.Len(t, sl, 8)
+	actions := []string{}
+	for _, rec := range sl {
+		actions = append(actions, rec.Action)
+		assert.Equal(t, server_testutils.Email, rec.AuthorEmail)
+		assert.Equal(t, server_testutils.Email, rec.Subject)
+		assert.Equal(t, "127.0.0.1", rec.ClientIP)
+		// requests without a request id header are assigned one
+		assert.NotEmpty(t, rec.RequestID)
+	}
+	assert.Equal(t, []string{
+		audit.ActionGarbageCollect,
+		audit.ActionReceivePack,
+		audit.ActionTransactionDiscard,
+		audit.ActionTransactionCreate,
+		audit.ActionTransactionCommit,
+		audit.ActionCommit,
+		audit.ActionTransactionCreate,
+		audit.ActionCommit,
+	}, actions)
+	assert.Equal(t, []audit.RefUpdate{{Ref: "heads/beta", Sum: hex.EncodeToString(sum3)}}, sl[1].Refs)
+	assert.Equal(t, tid2.String(), sl[2].TransactionID)
+	assert.Equal(t, []audit.RefUpdate{
+		{Ref: "heads/main", OldSum: sum1, Sum: hex.EncodeToString(sum2)},
+	}, sl[4].Refs)
+	assert.Equal(t, tid.String(), sl[5].TransactionID)
+	assert.Equal(t, txSum, sl[5].Sum)
+	assert.Empty(t, sl[5].Refs)
+	assert.Equal(t, "req-1", sl[7].RequestID)
+	assert.Equal(t, []audit.RefUpdate{{Ref: "heads/main", Sum: sum1}}, sl[7].Refs)
+
+	sl = listAudit("?ref=heads/main&limit=1")
+	require.Len(t, sl, 1)
+	assert.Equal(t, audit.ActionTransactionCommit, sl[0].Action)
+	sl = listAudit("?transactionId=" + tid.String())
+	require.Len(t, sl, 3)
+	sl = listAudit("?authorEmail=nobody@domain.com")
+	assert.Empty(t, sl)
+	sl = listAudit("?action=gc")
+	require.Len(t, sl, 1)
+	_, err = cli.Request(http.MethodGet, "/audit/?since=yesterday", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid since")
+
+	resp, err := cli.Request(http.MethodGet, "/audit/?format=csv&action=transaction.commit", nil, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, []string{"heads/main", sum1, hex.EncodeToString(sum2)}, rows[1][10:])
+
+	// only admins can read the audit log
+	_, err = newClient(s.s.Authorize(t, "dev@domain.com", "Dev", "write")).Request(http.MethodGet, "/audit/", nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+}
@@ -164,6 +164,11 @@ func (s *testSuite) TestAuthenticate(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	_, err = cli.GarbageCollect(apiclient.WithRequestHeader(authHeader(writeTok)))
+	assert.Error(t, err)
+
+	// garbage collection requires the admin scope
+	adminTok := s.s.Authorize(t, email, name, "admin")
+	_, err = cli.GarbageCollect(apiclient.WithRequestHeader(authHeader(adminTok)))
 	require.NoError(t, err)
 
 	// test scopes on transaction handlers
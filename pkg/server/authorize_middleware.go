@@ -22,3 +22,22 @@ func GetAuthor(r *http.Request) *Author {
 	}
 	return nil
 }
+
+type subjectKey struct{}
+
+// SetSubject stores an identifier of the credential used by the request, such
+// as the "sub" claim of a JWT or the id of a wrgld token. It is recorded in the
+// audit log and access log.
+func SetSubject(r *http.Request, subject string) *http.Request {
+	if v := GetRequestInfo(r); v != nil {
+		v.Subject = subject
+	}
+	return r.WithContext(context.WithValue(r.Context(), subjectKey{}, subject))
+}
+
+func GetSubject(r *http.Request) string {
+	if i := r.Context().Value(subjectKey{}); i != nil {
+		return i.(string)
+	}
+	return ""
+}
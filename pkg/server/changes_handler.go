@@ -0,0 +1,344 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/diff"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgl/pkg/ref"
+)
+
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+
+	// ChangeCommit marks the end of changes of a commit. Clients can resume
+	// the feed from the last commit whose marker they received.
+	ChangeCommit = "commit"
+
+	CTNDJSON = "application/x-ndjson"
+
+	// HeaderMoreChanges is set to "true" when commits after those streamed
+	// were left out because of the limit. Clients get them by sending the
+	// last commit marker as since.
+	HeaderMoreChanges = "X-Wrgl-More-Changes"
+
+	// DefaultChangesLimit is how many commits are streamed per request unless
+	// the limit query param says otherwise
+	DefaultChangesLimit = 100
+
+	// MaxChangesLimit is the largest limit accepted
+	MaxChangesLimit = 1000
+
+	// maxChangesWalk is how many first parents are walked from the head in
+	// search of since before it is considered not an ancestor
+	maxChangesWalk = 100000
+)
+
+// ChangeRecord is a single line of the changes feed
+type ChangeRecord struct {
+	Op         string            `json:"op"`
+	Commit     string            `json:"commit"`
+	CommitTime time.Time         `json:"commitTime"`
+	PK         map[string]string `json:"pk,omitempty"`
+	OldValues  map[string]string `json:"oldValues,omitempty"`
+	NewValues  map[string]string `json:"newValues,omitempty"`
+}
+
+// changedCommits returns sums of the first limit commits after since
+// (exclusive) up to head (inclusive) following first parents, oldest first.
+// Only the last limit sums walked are kept so that long histories take
+// bounded memory. more is true if commits after those returned were left out.
+// since can be nil, in which case the walk continues until the root commit.
+// Otherwise found is false if since is not met within maxChangesWalk commits.
+func changedCommits(db objects.Store, head, since []byte, limit int) (sums [][]byte, more, found bool, err error) {
+	ring := make([][]byte, limit)
+	n := 0
+	sum := head
+	for sum != nil {
+		if since != nil {
+			if bytes.Equal(sum, since) {
+				found = true
+				break
+			}
+			if n == maxChangesWalk {
+				return nil, false, false, nil
+			}
+		}
+		com, err := objects.GetCommit(db, sum)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("error getting commit %x: %w", sum, err)
+		}
+		ring[n%limit] = sum
+		n++
+		sum = nil
+		if len(com.Parents) > 0 {
+			sum = com.Parents[0]
+		}
+	}
+	if since != nil && !found {
+		return nil, false, false, nil
+	}
+	m := n
+	if m > limit {
+		m = limit
+	}
+	sums = make([][]byte, m)
+	for i := range sums {
+		sums[i] = ring[(n-1-i)%limit]
+	}
+	return sums, n > limit, true, nil
+}
+
+func rowValues(columns []string, row []string) map[string]string {
+	m := make(map[string]string, len(columns))
+	for i, col := range columns {
+		if i < len(row) {
+			m[col] = row[i]
+		}
+	}
+	return m
+}
+
+// pkValues returns values of primary key columns. Tables without primary key
+// are keyed by the whole row.
+func pkValues(tbl *objects.Table, row []string) map[string]string {
+	if len(tbl.PK) == 0 {
+		return rowValues(tbl.Columns, row)
+	}
+	m := make(map[string]string, len(tbl.PK))
+	for _, i := range tbl.PK {
+		if int(i) < len(row) {
+			m[tbl.Columns[i]] = row[i]
+		}
+	}
+	return m
+}
+
+// changesExtendEvery is how many records are written between extensions of
+// the write deadline
+const changesExtendEvery = 1000
+
+type changesWriter struct {
+	rw      http.ResponseWriter
+	enc     *json.Encoder
+	flusher http.Flusher
+	n       int
+}
+
+func (w *changesWriter) write(rec *ChangeRecord) error {
+	if w.n%changesExtendEvery == 0 {
+		extendWriteDeadline(w.rw)
+	}
+	w.n++
+	return w.enc.Encode(rec)
+}
+
+func (w *changesWriter) flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+}
+
+// writeRows writes every row of tbl as a change of op, which is either
+// ChangeInsert or ChangeDelete
+func writeRows(db objects.Store, w *changesWriter, com *objects.Commit, tbl *objects.Table, op string) error {
+	buf, err := diff.NewBlockBuffer([]objects.Store{db}, []*objects.Table{tbl})
+	if err != nil {
+		return err
+	}
+	commit := hex.EncodeToString(com.Sum)
+	for o := uint32(0); o < tbl.RowsCount; o++ {
+		blk, off := diff.RowToBlockAndOffset(o)
+		row, err := buf.GetRow(0, blk, off)
+		if err != nil {
+			return err
+		}
+		rec := &ChangeRecord{
+			Op:         op,
+			Commit:     commit,
+			CommitTime: com.Time,
+			PK:         pkValues(tbl, row),
+		}
+		if op == ChangeDelete {
+			rec.OldValues = rowValues(tbl.Columns, row)
+		} else {
+			rec.NewValues = rowValues(tbl.Columns, row)
+		}
+		if err = w.write(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDiffRows writes rows that differ between tbl and oldTbl
+func (s *Server) writeDiffRows(db objects.Store, w *changesWriter, com *objects.Commit, tbl, oldTbl *objects.Table, idx, oldIdx [][]string) error {
+	buf, err := diff.NewBlockBuffer([]objects.Store{db, db}, []*objects.Table{tbl, oldTbl})
+	if err != nil {
+		return err
+	}
+	commit := hex.EncodeToString(com.Sum)
+	errCh := make(chan error, 10)
+	diffChan, _ := diff.DiffTables(db, db, tbl, oldTbl, idx, oldIdx, errCh, s.logger.V(1))
+	var writeErr error
+	for obj := range diffChan {
+		if writeErr != nil {
+			// drain the channel so that DiffTables can finish
+			continue
+		}
+		rec := &ChangeRecord{
+			Commit:     commit,
+			CommitTime: com.Time,
+		}
+		if obj.Sum != nil {
+			blk, off := diff.RowToBlockAndOffset(obj.Offset)
+			row, err := buf.GetRow(0, blk, off)
+			if err != nil {
+				writeErr = err
+				continue
+			}
+			rec.NewValues = rowValues(tbl.Columns, row)
+			rec.PK = pkValues(tbl, row)
+		}
+		if obj.OldSum != nil {
+			blk, off := diff.RowToBlockAndOffset(obj.OldOffset)
+			row, err := buf.GetRow(1, blk, off)
+			if err != nil {
+				writeErr = err
+				continue
+			}
+			rec.OldValues = rowValues(oldTbl.Columns, row)
+			if rec.PK == nil {
+				rec.PK = pkValues(oldTbl, row)
+			}
+		}
+		switch {
+		case obj.OldSum == nil:
+			rec.Op = ChangeInsert
+		case obj.Sum == nil:
+			rec.Op = ChangeDelete
+		default:
+			rec.Op = ChangeUpdate
+		}
+		writeErr = w.write(rec)
+	}
+	close(errCh)
+	if err, ok := <-errCh; ok {
+		return err
+	}
+	return writeErr
+}
+
+// writeCommitChanges writes row changes between commit com and its first
+// parent, followed by a commit marker. If rows of the two tables cannot be
+// matched, every old row is deleted then every new row is inserted.
+func (s *Server) writeCommitChanges(db objects.Store, w *changesWriter, com *objects.Commit) error {
+	tbl, idx, err := getCommitTable(db, com.Sum)
+	if err != nil {
+		return err
+	}
+	if len(com.Parents) == 0 {
+		err = writeRows(db, w, com, tbl, ChangeInsert)
+	} else {
+		var oldTbl *objects.Table
+		var oldIdx [][]string
+		oldTbl, oldIdx, err = getCommitTable(db, com.Parents[0])
+		if err != nil {
+			return err
+		}
+		if rowsComparable(tbl, oldTbl) {
+			err = s.writeDiffRows(db, w, com, tbl, oldTbl, idx, oldIdx)
+		} else if err = writeRows(db, w, com, oldTbl, ChangeDelete); err == nil {
+			err = writeRows(db, w, com, tbl, ChangeInsert)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.write(&ChangeRecord{
+		Op:         ChangeCommit,
+		Commit:     hex.EncodeToString(com.Sum),
+		CommitTime: com.Time,
+	}); err != nil {
+		return err
+	}
+	w.flush()
+	return nil
+}
+
+// handleChanges streams row changes of up to limit commits after since toward
+// the head of ref as newline-delimited JSON. Only first parents are followed.
+func (s *Server) handleChanges(rw http.ResponseWriter, r *http.Request) {
+	if s.Draining() {
+		sendDraining(rw, r)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("ref")
+	if name == "" {
+		SendError(rw, r, http.StatusBadRequest, "missing ref query param")
+		return
+	}
+	head, err := ref.GetRef(s.getRS(r), name)
+	if err != nil {
+		s.handleErr(rw, r, notFound(err))
+		return
+	}
+	var since []byte
+	if v := query.Get("since"); v != "" {
+		if !sumRegexp.MatchString(v) {
+			SendError(rw, r, http.StatusBadRequest, "invalid since")
+			return
+		}
+		since, _ = hex.DecodeString(v)
+	}
+	limit, err := getQueryInt(query, "limit", DefaultChangesLimit)
+	if err != nil || limit <= 0 {
+		SendError(rw, r, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > MaxChangesLimit {
+		limit = MaxChangesLimit
+	}
+	db := s.getDB(r)
+	sums, more, found, err := changedCommits(db, head, since, limit)
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	if !found {
+		SendError(rw, r, http.StatusBadRequest, fmt.Sprintf("commit %x is not an ancestor of %s", since, name))
+		return
+	}
+	rw.Header().Set("Content-Type", CTNDJSON)
+	rw.Header().Set("Cache-Control", "no-cache")
+	if more {
+		rw.Header().Set(HeaderMoreChanges, "true")
+	}
+	rw.WriteHeader(http.StatusOK)
+	w := &changesWriter{rw: rw, enc: json.NewEncoder(rw)}
+	w.flusher, _ = rw.(http.Flusher)
+	for _, sum := range sums {
+		if s.Draining() {
+			// the client resumes from the last commit marker
+			return
+		}
+		com, err := objects.GetCommit(db, sum)
+		if err == nil {
+			err = s.writeCommitChanges(db, w, com)
+		}
+		if err != nil {
+			// the response has started, the missing commit marker tells the
+			// client to resume from the previous commit
+			s.logger.Error(err, "error writing changes", "commit", hex.EncodeToString(sum))
+			return
+		}
+	}
+}
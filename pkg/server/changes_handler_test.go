@@ -0,0 +1,164 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgld/pkg/server"
+)
+
+func getChanges(t *testing.T, cli *apiclient.Client, query string) []*server.ChangeRecord {
+	t.Helper()
+	resp, err := cli.Request(http.MethodGet, "/changes/?"+query, nil, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, server.CTNDJSON, resp.Header.Get("Content-Type"))
+	result := []*server.ChangeRecord{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		rec := &server.ChangeRecord{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), rec))
+		result = append(result, rec)
+	}
+	require.NoError(t, scanner.Err())
+	return result
+}
+
+func (s *testSuite) TestChangesHandler(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	db := s.s.GetDB(repo)
+	rs := s.s.GetRS(repo)
+
+	sum1, com1 := factory.Commit(t, db, []string{
+		"a,b",
+		"1,q",
+		"2,w",
+	}, []uint32{0}, nil)
+	sum2, com2 := factory.Commit(t, db, []string{
+		"a,b",
+		"1,e",
+		"3,r",
+	}, []uint32{0}, [][]byte{sum1})
+	require.NoError(t, ref.CommitHead(rs, "main", sum2, com2, nil))
+	c1 := hex.EncodeToString(sum1)
+	c2 := hex.EncodeToString(sum2)
+
+	_, err := cli.Request(http.MethodGet, "/changes/", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "missing ref query param")
+	_, err = cli.Request(http.MethodGet, "/changes/?ref=heads/abc", nil, nil)
+	assertHTTPError(t, err, http.StatusNotFound, "Not Found")
+	_, err = cli.Request(http.MethodGet, "/changes/?ref=heads/main&since=abc", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid since")
+	since, _ := factory.CommitRandom(t, db, nil)
+	_, err = cli.Request(http.MethodGet, fmt.Sprintf("/changes/?ref=heads/main&since=%x", since), nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, fmt.Sprintf("commit %x is not an ancestor of heads/main", since))
+
+	recs := getChanges(t, cli, "ref=heads/main")
+	require.Len(t, recs, 7)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, c1, recs[i].Commit)
+		assert.Equal(t, com1.Time.Unix(), recs[i].CommitTime.Unix())
+	}
+	assert.Equal(t, []*server.ChangeRecord{
+		{Op: server.ChangeInsert, PK: map[string]string{"a": "1"}, NewValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"a": "2"}, NewValues: map[string]string{"a": "2", "b": "w"}},
+		{Op: server.ChangeCommit},
+	}, stripCommit(recs[:3]))
+	assert.Equal(t, c2, recs[6].Commit)
+	assert.Equal(t, server.ChangeCommit, recs[6].Op)
+	assert.ElementsMatch(t, []*server.ChangeRecord{
+		{Op: server.ChangeUpdate, PK: map[string]string{"a": "1"}, OldValues: map[string]string{"a": "1", "b": "q"}, NewValues: map[string]string{"a": "1", "b": "e"}},
+		{Op: server.ChangeDelete, PK: map[string]string{"a": "2"}, OldValues: map[string]string{"a": "2", "b": "w"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"a": "3"}, NewValues: map[string]string{"a": "3", "b": "r"}},
+	}, stripCommit(recs[3:6]))
+
+	// resume from the first commit
+	assert.Equal(t, recs[3:], getChanges(t, cli, "ref=heads/main&since="+c1))
+	assert.Len(t, getChanges(t, cli, "ref=heads/main&since="+c2), 0)
+
+	// commits past the limit are left for the next request
+	_, err = cli.Request(http.MethodGet, "/changes/?ref=heads/main&limit=0", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid limit")
+	resp, err := cli.Request(http.MethodGet, "/changes/?ref=heads/main&limit=1", nil, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "true", resp.Header.Get(server.HeaderMoreChanges))
+	assert.Equal(t, recs[:3], getChanges(t, cli, "ref=heads/main&limit=1"))
+	resp, err = cli.Request(http.MethodGet, "/changes/?ref=heads/main&limit=1&since="+c1, nil, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, resp.Header.Get(server.HeaderMoreChanges))
+	assert.Equal(t, recs[3:], getChanges(t, cli, "ref=heads/main&limit=1&since="+c1))
+}
+
+func (s *testSuite) TestChangesHandlerUnmatchedRows(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	db := s.s.GetDB(repo)
+	rs := s.s.GetRS(repo)
+
+	sum1, _ := factory.Commit(t, db, []string{
+		"a,b",
+		"1,q",
+		"2,w",
+	}, []uint32{0}, nil)
+	// the primary key changes
+	sum2, _ := factory.Commit(t, db, []string{
+		"a,b",
+		"1,q",
+		"3,w",
+	}, []uint32{1}, [][]byte{sum1})
+	// columns of a table without primary key change
+	sum3, _ := factory.Commit(t, db, []string{
+		"a,b",
+		"1,q",
+	}, []uint32{}, [][]byte{sum2})
+	sum4, com4 := factory.Commit(t, db, []string{
+		"a,c",
+		"1,q",
+	}, []uint32{}, [][]byte{sum3})
+	require.NoError(t, ref.CommitHead(rs, "main", sum4, com4, nil))
+
+	recs := getChanges(t, cli, "ref=heads/main&since="+hex.EncodeToString(sum1))
+	require.Len(t, recs, 12)
+	for i, sum := range map[int][]byte{4: sum2, 8: sum3, 11: sum4} {
+		assert.Equal(t, hex.EncodeToString(sum), recs[i].Commit)
+	}
+	assert.Equal(t, []*server.ChangeRecord{
+		{Op: server.ChangeDelete, PK: map[string]string{"a": "1"}, OldValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeDelete, PK: map[string]string{"a": "2"}, OldValues: map[string]string{"a": "2", "b": "w"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"b": "q"}, NewValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"b": "w"}, NewValues: map[string]string{"a": "3", "b": "w"}},
+		{Op: server.ChangeCommit},
+		{Op: server.ChangeDelete, PK: map[string]string{"b": "q"}, OldValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeDelete, PK: map[string]string{"b": "w"}, OldValues: map[string]string{"a": "3", "b": "w"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"a": "1", "b": "q"}, NewValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeCommit},
+		{Op: server.ChangeDelete, PK: map[string]string{"a": "1", "b": "q"}, OldValues: map[string]string{"a": "1", "b": "q"}},
+		{Op: server.ChangeInsert, PK: map[string]string{"a": "1", "c": "q"}, NewValues: map[string]string{"a": "1", "c": "q"}},
+		{Op: server.ChangeCommit},
+	}, stripCommit(recs))
+	assert.Equal(t, recs[:9], getChanges(t, cli, "ref=heads/main&limit=2&since="+hex.EncodeToString(sum1)))
+}
+
+func stripCommit(recs []*server.ChangeRecord) []*server.ChangeRecord {
+	result := make([]*server.ChangeRecord, len(recs))
+	for i, rec := range recs {
+		obj := *rec
+		obj.Commit = ""
+		obj.CommitTime = time.Time{}
+		result[i] = &obj
+	}
+	return result
+}
@@ -2,8 +2,10 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -17,7 +19,11 @@ import (
 	"github.com/wrgl/wrgl/pkg/objects"
 	"github.com/wrgl/wrgl/pkg/ref"
 	"github.com/wrgl/wrgl/pkg/sorter"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
 	"github.com/wrgl/wrgld/pkg/webhook"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
@@ -27,13 +33,36 @@ func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
 		SendHTTPError(rw, r, http.StatusUnauthorized)
 		return
 	}
+	release, ok := s.holdOffGC(rw, r)
+	if !ok {
+		return
+	}
+	defer release()
+	limits := s.ingestLimits(r)
+	var body *bodyLimitReader
+	if limits != nil && limits.MaxCommitBytes > 0 {
+		if r.ContentLength > limits.MaxCommitBytes {
+			sendIngestLimitError(rw, r, &ingestLimitError{"maxCommitBytes", limits.MaxCommitBytes})
+			return
+		}
+		// the body might be chunked so its length is only known while reading
+		body = &bodyLimitReader{ReadCloser: r.Body, max: limits.MaxCommitBytes}
+		r.Body = body
+	}
 	err := r.ParseMultipartForm(0)
 	if err != nil {
 		if err == http.ErrNotMultipart || err == http.ErrMissingBoundary {
 			SendError(rw, r, http.StatusUnsupportedMediaType, err.Error())
 			return
 		}
-		panic(err)
+		if body != nil && sendIngestLimitError(rw, r, body.err) {
+			return
+		}
+		if !IsStorageUnavailable(err) {
+			err = badRequest(CodeBadRequest, err)
+		}
+		s.handleErr(rw, r, err)
+		return
 	}
 	branch := r.PostFormValue("branch")
 	if branch == "" {
@@ -57,16 +86,21 @@ func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
 	var f io.ReadCloser
 	f, err = fh.Open()
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	defer f.Close()
 	if strings.HasSuffix(fh.Filename, ".gz") {
 		f, err = gzip.NewReader(f)
 		if err != nil {
-			panic(err)
+			sendErr(rw, r, badRequest(CodeBadRequest, err))
+			return
 		}
 		defer f.Close()
 	}
+	if limits != nil {
+		f = io.NopCloser(newCSVLimitReader(f, limits))
+	}
 	var primaryKey []string
 	if sl := r.MultipartForm.Value["primaryKey"]; len(sl) > 0 && len(sl[0]) > 0 {
 		primaryKey = strings.Split(sl[0], ",")
@@ -87,21 +121,31 @@ func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if msg := s.refUpdateDenial(r, ref.HeadRef(branch), tid != nil); msg != "" {
+		SendError(rw, r, http.StatusForbidden, msg)
+		return
+	}
 
 	var opts = []ingest.InserterOption{}
 	sorter := s.sPool.Get().(*sorter.Sorter)
 	sorter.Reset()
 	defer s.sPool.Put(sorter)
-	sum, err := ingest.IngestTable(db, sorter, f, primaryKey, s.logger.V(1), opts...)
+	sum, err := s.ingestTable(r.Context(), db, sorter, f, primaryKey, opts...)
 	if err != nil {
-		if v, ok := err.(*csv.ParseError); ok {
+		if sendIngestLimitError(rw, r, err) {
+			return
+		} else if v, ok := err.(*csv.ParseError); ok {
 			sendCSVError(rw, r, v)
 			return
 		} else if v, ok := err.(*ingest.Error); ok {
-			SendError(rw, r, http.StatusBadRequest, fmt.Sprintf("ingest error: %s", v.Error()))
+			sendErrorCode(rw, r, http.StatusBadRequest, CodeInvalidCSV, fmt.Sprintf("ingest error: %s", v.Error()))
+			return
+		} else if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) {
+			sendErr(rw, r, badRequest(CodeBadRequest, err))
 			return
 		} else {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
 		}
 	}
 
@@ -119,41 +163,89 @@ func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
 	buf := bytes.NewBuffer(nil)
 	_, err = commit.WriteTo(buf)
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	commitSum, err := objects.SaveCommit(db, buf.Bytes())
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
+	var ws *webhook.Sender
 	if tid != nil {
 		if err = ref.SaveTransactionRef(rs, *tid, branch, commitSum); err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
 		}
 	} else {
+		ws = s.webhookSender(r)
+		preEvt := &webhook.PreReceiveEvent{
+			Action:      "commit",
+			AuthorName:  commit.AuthorName,
+			AuthorEmail: commit.AuthorEmail,
+		}
+		update := proposedUpdate{Ref: ref.HeadRef(branch), OldSum: parent, Sum: commitSum}
+		if err = preReceive(r.Context(), db, ws, preEvt, []proposedUpdate{update}, s.logger); err != nil {
+			s.handleErr(rw, r, preReceiveError(err))
+			return
+		}
+		if moved, err := refMoved(rs, update); err != nil {
+			s.handleErr(rw, r, err)
+			return
+		} else if moved {
+			SendError(rw, r, http.StatusConflict, fmt.Sprintf("branch %q updated since commit started", branch))
+			return
+		}
 		if err = ref.CommitHead(rs, branch, commitSum, commit, nil); err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
 		}
-		ws, err := webhook.NewSender(s.getConfig(r), s.logger, s.webhookSenderOpts...)
-		if err != nil {
-			panic(err)
+		commits := []webhook.Commit{
+			{
+				Sum:     hex.EncodeToString(commitSum),
+				Ref:     ref.HeadRef(branch),
+				Message: commit.Message,
+			},
+		}
+		if err = addDiffStats(r.Context(), db, ws, commits, [][]byte{parent}, preReceiveDiffs(preEvt), s.logger); err != nil {
+			s.logger.Error(err, "error computing diff stats", "branch", branch)
 		}
-		defer ws.Flush()
 		ws.EnqueueEvent(&webhook.CommitEvent{
-			Commits: []webhook.Commit{
-				{
-					Sum:     hex.EncodeToString(commitSum),
-					Ref:     ref.HeadRef(branch),
-					Message: commit.Message,
-				},
-			},
+			Commits:     commits,
 			AuthorName:  commit.AuthorName,
 			AuthorEmail: commit.AuthorEmail,
 		})
+		if parent == nil {
+			ws.EnqueueEvent(&webhook.BranchEvent{
+				Type:        webhook.BranchCreatedEventType,
+				Ref:         ref.HeadRef(branch),
+				Sum:         hex.EncodeToString(commitSum),
+				Action:      "commit",
+				AuthorName:  commit.AuthorName,
+				AuthorEmail: commit.AuthorEmail,
+			})
+		}
 	}
 
+	rec := &audit.Record{
+		Action: audit.ActionCommit,
+		Sum:    hex.EncodeToString(commitSum),
+	}
+	if tid != nil {
+		rec.TransactionID = tid.String()
+	} else {
+		rec.Refs = auditRefUpdates([]proposedUpdate{
+			{Ref: ref.HeadRef(branch), OldSum: parent, Sum: commitSum},
+		})
+	}
+	s.recordAudit(r, rec)
+
 	if s.postCommit != nil {
 		s.postCommit(r, commit, commitSum, branch, tid)
 	}
+	if ws != nil && !s.flushWebhooks(rw, r, ws) {
+		return
+	}
 	resp := &payload.CommitResponse{
 		Sum:   &payload.Hex{},
 		Table: &payload.Hex{},
@@ -162,3 +254,34 @@ func (s *Server) handleCommit(rw http.ResponseWriter, r *http.Request) {
 	copy((*resp.Table)[:], sum)
 	WriteJSON(rw, r, resp)
 }
+
+// ingestTable is ingest.IngestTable with each phase traced and the ingest
+// throughput recorded as metrics
+func (s *Server) ingestTable(ctx context.Context, db objects.Store, st *sorter.Sorter, f io.ReadCloser, pk []string, opts ...ingest.InserterOption) (sum []byte, err error) {
+	defer st.Close()
+	start := time.Now()
+	_, span := tracing.Start(ctx, "ingest sort")
+	err = st.SortFile(f, pk)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	sorted := time.Now()
+	metrics.IngestPhaseDuration.WithLabelValues("sort").Observe(sorted.Sub(start).Seconds())
+	_, span = tracing.Start(ctx, "ingest insert")
+	sum, err = ingest.NewInserter(db, st, s.logger.V(1), opts...).IngestTableFromSorter(st.Columns, st.PK)
+	if err != nil {
+		tracing.End(span, err)
+		return nil, err
+	}
+	metrics.IngestPhaseDuration.WithLabelValues("insert").Observe(time.Since(sorted).Seconds())
+	if tbl, err := objects.GetTable(db, sum); err == nil {
+		span.SetAttributes(attribute.Int64("wrgld.ingest.rows", int64(tbl.RowsCount)))
+		metrics.IngestRows.Add(float64(tbl.RowsCount))
+		if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+			metrics.IngestRowsPerSecond.Observe(float64(tbl.RowsCount) / elapsed)
+		}
+	}
+	span.End()
+	return sum, nil
+}
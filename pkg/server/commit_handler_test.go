@@ -100,6 +100,7 @@ func (s *testSuite) TestCommitHandler(t *testing.T) {
 	assert.Len(t, pl.Events, 1)
 	ce := pl.Events[0].(*webhook.CommitEvent)
 	assert.Equal(t, &webhook.CommitEvent{
+		ID:   ce.ID,
 		Type: conf.CommitEventType,
 		Commits: []webhook.Commit{
 			{
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/wrgl/wrgl/pkg/conf"
+)
+
+// handleGetConfig responds with the repository config. Secrets are left out.
+func (s *Server) handleGetConfig(rw http.ResponseWriter, r *http.Request) {
+	c := s.getConfig(r)
+	if c.Auth != nil && c.Auth.Keycloak != nil {
+		auth := *c.Auth
+		kc := *auth.Keycloak
+		kc.ClientSecret = ""
+		auth.Keycloak = &kc
+		c.Auth = &auth
+	}
+	if len(c.Webhooks) > 0 {
+		whs := make([]conf.Webhook, len(c.Webhooks))
+		for i, wh := range c.Webhooks {
+			wh.SecretToken = ""
+			whs[i] = wh
+		}
+		c.Webhooks = whs
+	}
+	WriteJSON(rw, r, &c)
+}
@@ -0,0 +1,59 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/conf"
+)
+
+func (s *testSuite) TestGetConfig(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	newClient := func(token string) *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(token))
+		require.NoError(t, err)
+		return cli
+	}
+	cli := newClient(s.s.AdminToken(t))
+	cs := s.s.GetConfS(repo)
+	c, err := cs.Open()
+	require.NoError(t, err)
+	c.Auth = &conf.Auth{
+		RepositoryName: "my repo",
+		Keycloak: &conf.AuthKeycloak{
+			Issuer:       "http://localhost:8080/realms/test-realm",
+			ClientID:     "wrgld",
+			ClientSecret: "change-me",
+		},
+	}
+	c.Webhooks = []conf.Webhook{
+		{URL: "http://my.site/hook", EventTypes: []conf.WebhookEventType{conf.RefUpdateEventType}, SecretToken: "abc"},
+	}
+	require.NoError(t, cs.Save(c))
+
+	resp, err := cli.Request(http.MethodGet, "/config/", nil, nil)
+	require.NoError(t, err)
+	m := &conf.Config{}
+	parseJSONResponse(t, resp, m)
+	assert.Equal(t, "my repo", m.Auth.RepositoryName)
+	assert.Equal(t, "wrgld", m.Auth.Keycloak.ClientID)
+	assert.Empty(t, m.Auth.Keycloak.ClientSecret)
+	require.Len(t, m.Webhooks, 1)
+	assert.Equal(t, "http://my.site/hook", m.Webhooks[0].URL)
+	assert.Empty(t, m.Webhooks[0].SecretToken)
+
+	// the stored config is left intact
+	c, err = cs.Open()
+	require.NoError(t, err)
+	assert.Equal(t, "change-me", c.Auth.Keycloak.ClientSecret)
+	assert.Equal(t, "abc", c.Webhooks[0].SecretToken)
+
+	writer := newClient(s.s.Authorize(t, "dev@domain.com", "Dev", "read", "write"))
+	_, err = writer.Request(http.MethodGet, "/config/", nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+}
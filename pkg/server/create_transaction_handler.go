@@ -1,8 +1,6 @@
 package server
 
 import (
-	"encoding/json"
-	"io"
 	"net/http"
 	"strings"
 
@@ -10,6 +8,8 @@ import (
 	"github.com/wrgl/wrgl/pkg/api"
 	"github.com/wrgl/wrgl/pkg/api/payload"
 	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
 func (s *Server) handleCreateTransaction(rw http.ResponseWriter, r *http.Request) {
@@ -17,12 +17,9 @@ func (s *Server) handleCreateTransaction(rw http.ResponseWriter, r *http.Request
 	rs := s.getRS(r)
 	if v := r.Header.Get("Content-Type"); strings.Contains(v, api.CTJSON) {
 		req := &payload.CreateTransactionRequest{}
-		b, err := io.ReadAll(r.Body)
-		if err != nil {
-			panic(err)
-		}
-		if err = json.Unmarshal(b, req); err != nil {
-			panic(err)
+		if err := decodeJSON(r, req); err != nil {
+			sendErr(rw, r, err)
+			return
 		}
 		id, err := uuid.Parse(req.ID)
 		if err != nil {
@@ -31,7 +28,7 @@ func (s *Server) handleCreateTransaction(rw http.ResponseWriter, r *http.Request
 		}
 		_, err = rs.GetTransaction(id)
 		if err == nil {
-			SendError(rw, r, http.StatusBadRequest, "transaction already created")
+			SendError(rw, r, http.StatusConflict, "transaction already created")
 			return
 		}
 		if req.Begin.IsZero() {
@@ -51,7 +48,25 @@ func (s *Server) handleCreateTransaction(rw http.ResponseWriter, r *http.Request
 	}
 	id, err := rs.NewTransaction(tx)
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
+	}
+	ws := s.webhookSender(r)
+	evt := &webhook.TransactionEvent{
+		Type:          webhook.TransactionCreatedEventType,
+		TransactionID: id.String(),
+	}
+	if author := GetAuthor(r); author != nil {
+		evt.AuthorName = author.Name
+		evt.AuthorEmail = author.Email
+	}
+	ws.EnqueueEvent(evt)
+	s.recordAudit(r, &audit.Record{
+		Action:        audit.ActionTransactionCreate,
+		TransactionID: id.String(),
+	})
+	if !s.flushWebhooks(rw, r, ws) {
+		return
 	}
 	WriteJSON(rw, r, &payload.CreateTransactionResponse{
 		ID: id.String(),
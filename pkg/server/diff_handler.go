@@ -5,33 +5,39 @@ import (
 	"encoding/hex"
 	"net/http"
 	"regexp"
+	"time"
 
 	"github.com/wrgl/wrgl/pkg/api/payload"
 	"github.com/wrgl/wrgl/pkg/diff"
 	diffprof "github.com/wrgl/wrgl/pkg/diff/prof"
 	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var diffURIPat = regexp.MustCompile(`/diff/([0-9a-f]{32})/([0-9a-f]{32})/`)
 
-func (s *Server) getTable(db objects.Store, x string) ([]byte, *objects.Table, [][]string) {
+// getTable returns the table of commit x along with its index
+func (s *Server) getTable(db objects.Store, x string) ([]byte, *objects.Table, [][]string, error) {
 	sum, err := hex.DecodeString(x)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, badRequest(CodeBadRequest, err)
 	}
 	com, err := objects.GetCommit(db, sum)
 	if err != nil {
-		return nil, nil, nil
+		return nil, nil, nil, notFound(err)
 	}
 	tbl, err := objects.GetTable(db, com.Table)
 	if err != nil {
-		return nil, nil, nil
+		return nil, nil, nil, notFound(err)
 	}
 	idx, err := objects.GetTableIndex(db, com.Table)
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, err
 	}
-	return com.Table, tbl, idx
+	return com.Table, tbl, idx, nil
 }
 
 func diffDataProfile(db objects.Store, resp *payload.DiffResponse, sum1, sum2 []byte) {
@@ -53,14 +59,14 @@ func (s *Server) handleDiff(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 	db := s.getDB(r)
-	sum1, tbl1, idx1 := s.getTable(db, m[1])
-	if tbl1 == nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+	sum1, tbl1, idx1, err := s.getTable(db, m[1])
+	if err != nil {
+		s.handleErr(rw, r, err)
 		return
 	}
-	sum2, tbl2, idx2 := s.getTable(db, m[2])
-	if tbl2 == nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+	sum2, tbl2, idx2, err := s.getTable(db, m[2])
+	if err != nil {
+		s.handleErr(rw, r, err)
 		return
 	}
 	resp := &payload.DiffResponse{
@@ -72,6 +78,11 @@ func (s *Server) handleDiff(rw http.ResponseWriter, r *http.Request) {
 		OldPK:       tbl2.PK,
 	}
 	if !bytes.Equal(sum1, sum2) {
+		start := time.Now()
+		_, span := tracing.Start(r.Context(), "diff", trace.WithAttributes(
+			attribute.String("wrgld.diff.table", resp.TableSum.String()),
+			attribute.String("wrgld.diff.old_table", resp.OldTableSum.String()),
+		))
 		errCh := make(chan error, 10)
 		opts := []diff.DiffOption{}
 		diffChan, _ := diff.DiffTables(db, db, tbl1, tbl2, idx1, idx2, errCh, s.logger.V(1), opts...)
@@ -90,8 +101,12 @@ func (s *Server) handleDiff(rw http.ResponseWriter, r *http.Request) {
 		close(errCh)
 		err, ok := <-errCh
 		if ok {
-			panic(err)
+			tracing.End(span, err)
+			s.handleErr(rw, r, err)
+			return
 		}
+		span.End()
+		metrics.DiffDuration.WithLabelValues("diff").Observe(time.Since(start).Seconds())
 		diffDataProfile(db, resp, sum1, sum2)
 	}
 	s.cacheControlImmutable(rw)
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/wrgl/wrgl/pkg/diff"
+	diffprof "github.com/wrgl/wrgl/pkg/diff/prof"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+func getCommitTable(db objects.Store, sum []byte) (*objects.Table, [][]string, error) {
+	com, err := objects.GetCommit(db, sum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting commit %x: %w", sum, err)
+	}
+	tbl, err := objects.GetTable(db, com.Table)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting table %x: %w", com.Table, err)
+	}
+	idx, err := objects.GetTableIndex(db, com.Table)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting table index %x: %w", com.Table, err)
+	}
+	return tbl, idx, nil
+}
+
+// rowsComparable returns false if rows of tbl cannot be matched with rows of
+// oldTbl, in which case diff.DiffTables emits nothing. That happens when the
+// primary key changes, or when columns of a table without primary key change.
+func rowsComparable(tbl, oldTbl *objects.Table) bool {
+	if !strSliceEqual(tbl.PrimaryKey(), oldTbl.PrimaryKey()) {
+		return false
+	}
+	return len(tbl.PK) > 0 || strSliceEqual(tbl.Columns, oldTbl.Columns)
+}
+
+func strSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if b[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func columnsDifference(a, b []string) (result []string) {
+	m := map[string]struct{}{}
+	for _, s := range b {
+		m[s] = struct{}{}
+	}
+	for _, s := range a {
+		if _, ok := m[s]; !ok {
+			result = append(result, s)
+		}
+	}
+	return
+}
+
+// diffCommitProfiles compares table profiles of commit sum and commit oldSum
+// the same way diffDataProfile does. Missing profiles are treated as empty.
+func diffCommitProfiles(db objects.Store, oldSum, sum []byte) (*diffprof.TableProfileDiff, error) {
+	com, err := objects.GetCommit(db, sum)
+	if err != nil {
+		return nil, fmt.Errorf("error getting commit %x: %w", sum, err)
+	}
+	newProf, _ := objects.GetTableProfile(db, com.Table)
+	var oldProf *objects.TableProfile
+	if oldSum != nil {
+		oldCom, err := objects.GetCommit(db, oldSum)
+		if err != nil {
+			return nil, fmt.Errorf("error getting commit %x: %w", oldSum, err)
+		}
+		oldProf, _ = objects.GetTableProfile(db, oldCom.Table)
+	}
+	return diffprof.DiffTableProfiles(newProf, oldProf), nil
+}
+
+// summarizeDiff counts rows and columns changed between the tables of commit
+// oldSum and commit sum. oldSum can be nil, in which case every row is added.
+// If rows of the two tables cannot be matched, the summary is marked as
+// rewritten and every row is either added or removed.
+func summarizeDiff(ctx context.Context, db objects.Store, oldSum, sum []byte, logger logr.Logger) (ds *webhook.DiffSummary, err error) {
+	tbl, idx, err := getCommitTable(db, sum)
+	if err != nil {
+		return nil, err
+	}
+	if oldSum == nil {
+		return &webhook.DiffSummary{
+			RowsAdded:    int(tbl.RowsCount),
+			ColumnsAdded: tbl.Columns,
+		}, nil
+	}
+	oldTbl, oldIdx, err := getCommitTable(db, oldSum)
+	if err != nil {
+		return nil, err
+	}
+	ds = &webhook.DiffSummary{
+		ColumnsAdded:   columnsDifference(tbl.Columns, oldTbl.Columns),
+		ColumnsRemoved: columnsDifference(oldTbl.Columns, tbl.Columns),
+	}
+	if !rowsComparable(tbl, oldTbl) {
+		ds.Rewritten = true
+		ds.RowsAdded = int(tbl.RowsCount)
+		ds.RowsRemoved = int(oldTbl.RowsCount)
+		return ds, nil
+	}
+	_, span := tracing.Start(ctx, "diff summary")
+	defer func() { tracing.End(span, err) }()
+	start := time.Now()
+	errCh := make(chan error, 10)
+	diffChan, _ := diff.DiffTables(db, db, tbl, oldTbl, idx, oldIdx, errCh, logger.V(1))
+	for obj := range diffChan {
+		switch {
+		case obj.OldSum == nil:
+			ds.RowsAdded++
+		case obj.Sum == nil:
+			ds.RowsRemoved++
+		default:
+			ds.RowsModified++
+		}
+	}
+	close(errCh)
+	if err, ok := <-errCh; ok {
+		return nil, err
+	}
+	metrics.DiffDuration.WithLabelValues("summary").Observe(time.Since(start).Seconds())
+	return ds, nil
+}
+
+// addDiffStats fills in parent sum and diff summary of each commit if at least
+// one webhook asked for them. parents holds the parent sum of each commit, nil
+// for the first commit of a branch. Summaries already computed for
+// pre-receive hooks are reused, see preReceiveDiffs.
+func addDiffStats(ctx context.Context, db objects.Store, ws *webhook.Sender, commits []webhook.Commit, parents [][]byte, known map[string]*webhook.DiffSummary, logger logr.Logger) error {
+	if !ws.HasDiffStatsHooks() {
+		return nil
+	}
+	for i := range commits {
+		sum, err := hex.DecodeString(commits[i].Sum)
+		if err != nil {
+			return err
+		}
+		if parents[i] != nil {
+			commits[i].ParentSum = hex.EncodeToString(parents[i])
+		}
+		if ds, ok := known[commits[i].Ref]; ok {
+			// the pre-receive event may still be referenced, it is not modified
+			v := *ds
+			commits[i].Diff = &v
+		} else {
+			commits[i].Diff, err = summarizeDiff(ctx, db, parents[i], sum, logger)
+			if err != nil {
+				return err
+			}
+		}
+		commits[i].Diff.DataProfile, err = diffCommitProfiles(db, parents[i], sum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
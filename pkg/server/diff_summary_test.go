@@ -0,0 +1,161 @@
+package server_test
+
+import (
+	"encoding/hex"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	server "github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+	"github.com/wrgl/wrgld/pkg/webhook"
+	webhooktest "github.com/wrgl/wrgld/pkg/webhook/test"
+)
+
+// diffSummaries returns the number of diff summaries computed so far
+func diffSummaries(t *testing.T) uint64 {
+	t.Helper()
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "wrgld_diff_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "kind" && l.GetValue() == "summary" {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestCommitDiffStats(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	wh1, getPayload1, cleanup := webhooktest.CreateWebhookHandler(t, []conf.WebhookEventType{conf.CommitEventType}, false)
+	defer cleanup()
+	wh2, getPayload2, cleanup := webhooktest.CreateWebhookHandler(t, []conf.WebhookEventType{conf.CommitEventType}, false)
+	defer cleanup()
+	wh3, _, cleanup := webhooktest.CreatePreReceiveHandler(t, "")
+	defer cleanup()
+	ts := server_testutils.NewServer(t, nil, server.WithWebhookSenderOptions(
+		webhook.WithWaitGroup(wg),
+		webhook.WithWebhooks(
+			wrgldconf.Webhook{Webhook: wh1, DiffStats: true},
+			wrgldconf.Webhook{Webhook: wh2},
+			wrgldconf.Webhook{Webhook: wh3},
+		),
+	))
+	defer ts.Close()
+	repo, cli, _, cleanup := ts.NewClient(t, "", true)
+	defer cleanup()
+	rs := ts.GetRS(repo)
+
+	cr1, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b"},
+		{"1", "q"},
+		{"2", "w"},
+	}), []string{"a"}, nil)
+	require.NoError(t, err)
+	wg.Wait()
+	pl := getPayload1()
+	require.NotNil(t, pl)
+	com := pl.Events[0].(*webhook.CommitEvent).Commits[0]
+	assert.Empty(t, com.ParentSum)
+	require.NotNil(t, com.Diff)
+	assert.Equal(t, 2, com.Diff.RowsAdded)
+	assert.Equal(t, []string{"a", "b"}, com.Diff.ColumnsAdded)
+	require.NotNil(t, com.Diff.DataProfile)
+	assert.Equal(t, uint32(2), com.Diff.DataProfile.NewRowsCount)
+	getPayload2()
+
+	// the summary sent to pre-receive hooks is reused
+	summaries := diffSummaries(t)
+	cr2, err := cli.Commit("alpha", "second commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b", "c"},
+		{"1", "e", "r"},
+		{"3", "t", "y"},
+		{"4", "u", "i"},
+	}), []string{"a"}, nil)
+	require.NoError(t, err)
+	wg.Wait()
+	assert.Equal(t, summaries+1, diffSummaries(t))
+	pl = getPayload1()
+	require.NotNil(t, pl)
+	com = pl.Events[0].(*webhook.CommitEvent).Commits[0]
+	assert.Equal(t, cr2.Sum.String(), com.Sum)
+	assert.Equal(t, cr1.Sum.String(), com.ParentSum)
+	require.NotNil(t, com.Diff)
+	assert.Equal(t, 2, com.Diff.RowsAdded)
+	assert.Equal(t, 1, com.Diff.RowsRemoved)
+	assert.Equal(t, 1, com.Diff.RowsModified)
+	assert.Equal(t, []string{"c"}, com.Diff.ColumnsAdded)
+	assert.Empty(t, com.Diff.ColumnsRemoved)
+	require.NotNil(t, com.Diff.DataProfile)
+	assert.Equal(t, uint32(2), com.Diff.DataProfile.OldRowsCount)
+	assert.Equal(t, uint32(3), com.Diff.DataProfile.NewRowsCount)
+
+	// webhook without diff stats only receives the basic commit
+	pl = getPayload2()
+	require.NotNil(t, pl)
+	assert.Equal(t, []webhook.Commit{
+		{Sum: cr2.Sum.String(), Ref: "heads/alpha", Message: "second commit"},
+	}, pl.Events[0].(*webhook.CommitEvent).Commits)
+
+	// rows cannot be matched once the primary key changes
+	cr3, err := cli.Commit("alpha", "third commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b", "c"},
+		{"1", "e", "r"},
+		{"3", "t", "y"},
+	}), []string{"b"}, nil)
+	require.NoError(t, err)
+	wg.Wait()
+	pl = getPayload1()
+	require.NotNil(t, pl)
+	com = pl.Events[0].(*webhook.CommitEvent).Commits[0]
+	assert.Equal(t, cr2.Sum.String(), com.ParentSum)
+	require.NotNil(t, com.Diff)
+	assert.Equal(t, 2, com.Diff.RowsAdded)
+	assert.Equal(t, 3, com.Diff.RowsRemoved)
+	assert.Equal(t, 0, com.Diff.RowsModified)
+	assert.True(t, com.Diff.Rewritten)
+	getPayload2()
+
+	// commits of a transaction are reported with the sums they are saved
+	// under once the transaction is committed
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	txcr, err := cli.Commit("alpha", "fourth commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b", "c"},
+		{"1", "e", "r"},
+	}), []string{"b"}, &tid)
+	require.NoError(t, err)
+	summaries = diffSummaries(t)
+	_, err = cli.CommitTransaction(tid)
+	require.NoError(t, err)
+	wg.Wait()
+	assert.Equal(t, summaries+1, diffSummaries(t))
+	head, err := ref.GetHead(rs, "alpha")
+	require.NoError(t, err)
+	assert.NotEqual(t, (*txcr.Sum)[:], head)
+	pl = getPayload1()
+	require.NotNil(t, pl)
+	com = pl.Events[0].(*webhook.CommitEvent).Commits[0]
+	assert.Equal(t, hex.EncodeToString(head), com.Sum)
+	assert.Equal(t, cr3.Sum.String(), com.ParentSum)
+	require.NotNil(t, com.Diff)
+	assert.Equal(t, 1, com.Diff.RowsRemoved)
+	require.NotNil(t, com.Diff.DataProfile)
+	assert.Equal(t, uint32(1), com.Diff.DataProfile.NewRowsCount)
+}
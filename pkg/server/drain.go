@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// errDraining is returned when a new session is requested while the server is
+// shutting down
+var errDraining = errors.New("server is shutting down")
+
+// StartDraining makes the server report not ready and refuse new upload-pack
+// and receive-pack sessions. Streams of events and changes end so that clients
+// resume them elsewhere. Other requests and sessions already in progress are
+// unaffected.
+func (s *Server) StartDraining() {
+	s.draining.Store(true)
+	s.drainOnce.Do(func() { close(s.drained) })
+}
+
+// Draining returns true once StartDraining was called
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// trackPackRequest counts an upload-pack or receive-pack request as in
+// progress until done is called
+func (s *Server) trackPackRequest() (done func()) {
+	s.packMutex.Lock()
+	s.packInFlight++
+	s.packMutex.Unlock()
+	return func() {
+		s.packMutex.Lock()
+		s.packInFlight--
+		s.packLastEnd = time.Now()
+		s.packMutex.Unlock()
+	}
+}
+
+// PackRequestsIdle returns true if no upload-pack or receive-pack request is
+// in progress or ended within d. Sessions left idle for longer are considered
+// abandoned.
+func (s *Server) PackRequestsIdle(d time.Duration) bool {
+	s.packMutex.Lock()
+	defer s.packMutex.Unlock()
+	return s.packInFlight == 0 && time.Since(s.packLastEnd) >= d
+}
+
+// Ready implements probes.Probable
+func (s *Server) Ready() bool {
+	return !s.Draining()
+}
+
+// WaitForWebhooks waits until webhook payloads of past requests are sent, or
+// persisted to the outbox if a dispatcher is used, or until ctx is done.
+func (s *Server) WaitForWebhooks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.webhookWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func sendDraining(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Retry-After", "5")
+	sendErrorCode(rw, r, http.StatusServiceUnavailable, CodeDraining, errDraining.Error())
+}
@@ -0,0 +1,92 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+)
+
+func (s *testSuite) TestDraining(t *testing.T) {
+	srv := server_testutils.NewServer(t, nil)
+	defer srv.Close()
+	repo, uri, _, cleanup := srv.NewRemote(t, "")
+	defer cleanup()
+	db := srv.GetDB(repo)
+	rs := srv.GetRS(repo)
+	sum, com := factory.CommitRandom(t, db, nil)
+	require.NoError(t, ref.CommitHead(rs, "main", sum, com, nil))
+	newClient := func() *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(srv.AdminToken(t)))
+		require.NoError(t, err)
+		return cli
+	}
+	assert.True(t, srv.Server().Ready())
+	assert.True(t, srv.Server().PackRequestsIdle(time.Hour))
+
+	// streams in progress end once draining starts
+	resp, err := newClient().Request(http.MethodGet, "/events/", nil, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	streamEnded := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		streamEnded <- err
+	}()
+
+	// start a session that is still negotiating when draining starts
+	cli := newClient()
+	_, _, err = cli.PostUploadPack(&payload.UploadPackRequest{
+		Wants: []*payload.Hex{payload.BytesToHex(sum)},
+		Haves: []*payload.Hex{payload.BytesToHex(testutils.SecureRandomBytes(16))},
+	})
+	require.NoError(t, err)
+	require.Len(t, srv.GetUpSessions(repo).List(), 1)
+
+	srv.Server().StartDraining()
+	assert.False(t, srv.Server().Ready())
+	select {
+	case err := <-streamEnded:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("event stream did not end")
+	}
+	_, err = newClient().Request(http.MethodGet, "/events/", nil, nil)
+	assertHTTPError(t, err, http.StatusServiceUnavailable, "server is shutting down")
+	_, err = newClient().Request(http.MethodGet, "/changes/?ref=heads/main", nil, nil)
+	assertHTTPError(t, err, http.StatusServiceUnavailable, "server is shutting down")
+	_, _, err = newClient().PostUploadPack(&payload.UploadPackRequest{
+		Wants: []*payload.Hex{payload.BytesToHex(sum)},
+		Done:  true,
+	})
+	assertHTTPError(t, err, http.StatusServiceUnavailable, "server is shutting down")
+
+	// the existing session can finish
+	_, pr, err := cli.PostUploadPack(&payload.UploadPackRequest{Done: true})
+	require.NoError(t, err)
+	require.NotNil(t, pr)
+	require.NoError(t, pr.Close())
+	assert.Len(t, srv.GetUpSessions(repo).List(), 0)
+	// pack requests ended just now
+	assert.False(t, srv.Server().PackRequestsIdle(time.Hour))
+	assert.True(t, srv.Server().PackRequestsIdle(0))
+
+	// other requests are served until the listener is closed
+	_, err = cli.GetHead("main")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Server().WaitForWebhooks(ctx))
+}
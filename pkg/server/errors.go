@@ -0,0 +1,278 @@
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// ErrorCode is a machine-readable identifier of an error, sent as the "code"
+// field of error payloads. Unlike messages, codes are stable across releases
+// so clients can branch on them.
+type ErrorCode string
+
+const (
+	CodeBadRequest         ErrorCode = "bad_request"
+	CodeInvalidJSON        ErrorCode = "invalid_json"
+	CodeInvalidCSV         ErrorCode = "invalid_csv"
+	CodeInvalidPackfile    ErrorCode = "invalid_packfile"
+	CodeUnauthorized       ErrorCode = "unauthorized"
+	CodeForbidden          ErrorCode = "forbidden"
+	CodePreReceiveDeclined ErrorCode = "pre_receive_declined"
+	CodePreReceiveFailed   ErrorCode = "pre_receive_failed"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeMethodNotAllowed   ErrorCode = "method_not_allowed"
+	CodeConflict           ErrorCode = "conflict"
+	CodeIngestLimit        ErrorCode = "ingest_limit_exceeded"
+	CodeUnsupportedMedia   ErrorCode = "unsupported_media_type"
+	CodeRateLimited        ErrorCode = "rate_limited"
+	CodeInternal           ErrorCode = "internal_error"
+	CodeDraining           ErrorCode = "server_draining"
+	CodeStorageUnavailable ErrorCode = "storage_unavailable"
+	CodeGCInProgress       ErrorCode = "gc_in_progress"
+)
+
+// codeForStatus returns the code of errors answered with status that are not
+// given a more specific code
+func codeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeIngestLimit
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeStorageUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Error is answered with Status and an error payload holding Code and
+// Message
+type Error struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+
+	// Err is the cause of the error. It is logged but never sent to clients.
+	Err error
+}
+
+// NewError creates an error answered with status. Code defaults to the code
+// of status if empty.
+func NewError(status int, code ErrorCode, message string) *Error {
+	if code == "" {
+		code = codeForStatus(status)
+	}
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// badRequest creates a 400 error caused by err, such as a malformed payload
+func badRequest(code ErrorCode, err error) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: code, Message: err.Error(), Err: err}
+}
+
+// storageErrors are returned when the store cannot serve any request until an
+// operator steps in
+var storageErrors = []error{
+	badger.ErrDBClosed,
+	badger.ErrBlockedWrites,
+	syscall.ENOSPC,
+	syscall.EROFS,
+	syscall.EIO,
+}
+
+// IsStorageUnavailable returns true if err means the store cannot be read or
+// written, such as when the disk is full or the database is closed
+func IsStorageUnavailable(err error) bool {
+	for _, target := range storageErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// asError converts err to an *Error. Errors that are not already one are
+// answered with 503 if storage is unavailable, or 500 otherwise.
+func asError(err error) *Error {
+	var v *Error
+	if errors.As(err, &v) {
+		return v
+	}
+	if IsStorageUnavailable(err) {
+		return &Error{
+			Status:  http.StatusServiceUnavailable,
+			Code:    CodeStorageUnavailable,
+			Message: "storage unavailable",
+			Err:     err,
+		}
+	}
+	return &Error{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: "internal server error",
+		Err:     err,
+	}
+}
+
+// sendErr answers r with err. CSV parse errors also report their location.
+func sendErr(rw http.ResponseWriter, r *http.Request, err error) {
+	var pe *csv.ParseError
+	if errors.As(err, &pe) {
+		sendCSVError(rw, r, pe)
+		return
+	}
+	e := asError(err)
+	sendErrorCode(rw, r, e.Status, e.Code, e.Message)
+}
+
+// logErr logs err if it is not caused by the client
+func (s *Server) logErr(r *http.Request, err error, withStack bool) {
+	e := asError(err)
+	if e.Status < http.StatusInternalServerError {
+		return
+	}
+	kvs := []interface{}{"request_id", RequestID(r), "method", r.Method, "uri", r.URL.RequestURI()}
+	if withStack && e.Code == CodeInternal {
+		kvs = append(kvs, "stack", string(debug.Stack()))
+	}
+	s.logger.Error(err, "error serving request", kvs...)
+}
+
+// handleErr answers r with err, logging errors that the client cannot fix
+func (s *Server) handleErr(rw http.ResponseWriter, r *http.Request, err error) {
+	s.logErr(r, err, false)
+	sendErr(rw, r, err)
+}
+
+// sessionStoreError converts err from a session store to a 503 error, since
+// sessions cannot be kept until the store recovers
+func sessionStoreError(err error) error {
+	return &Error{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeStorageUnavailable,
+		Message: "session store unavailable",
+		Err:     err,
+	}
+}
+
+// notFound converts err from reading an object to a 404 error, unless
+// storage is unavailable
+func notFound(err error) error {
+	if IsStorageUnavailable(err) {
+		return err
+	}
+	return &Error{
+		Status:  http.StatusNotFound,
+		Code:    CodeNotFound,
+		Message: http.StatusText(http.StatusNotFound),
+		Err:     err,
+	}
+}
+
+// handleStreamErr handles err raised while streaming a response. Until
+// anything is sent, err is answered like in handleErr. Once the response has
+// started, err is logged and the response is cut short so that the client
+// notices.
+func (s *Server) handleStreamErr(rw http.ResponseWriter, r *http.Request, err error, started bool) {
+	if !started {
+		s.handleErr(rw, r, err)
+		return
+	}
+	s.logErr(r, err, false)
+	panic(http.ErrAbortHandler)
+}
+
+// recoverError answers handlers that panicked with an error payload. Handlers
+// answer errors themselves, so this only catches bugs.
+func (s *Server) recoverError(rw http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("%v", v)
+	}
+	s.logErr(r, err, true)
+	if w, ok := rw.(*metricsResponseWriter); ok && w.status != 0 {
+		// part of the response was already sent, cut it short so that the
+		// client notices
+		panic(http.ErrAbortHandler)
+	}
+	sendErr(rw, r, err)
+}
+
+// unmatchedWriter replaces the plain text answer of the router to paths that
+// no route matches with an error payload
+type unmatchedWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	info     *RequestInfo
+	replaced bool
+}
+
+func (w *unmatchedWriter) WriteHeader(status int) {
+	if w.info.Route == "" && (status == http.StatusNotFound || status == http.StatusMethodNotAllowed) {
+		w.replaced = true
+		SendHTTPError(w.ResponseWriter, w.r, status)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *unmatchedWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the wrapper
+func (w *unmatchedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets streaming handlers reach the underlying writer to extend the
+// write deadline
+func (w *unmatchedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
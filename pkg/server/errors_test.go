@@ -0,0 +1,113 @@
+package server_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/go-logr/logr/testr"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/api"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/objects"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/server"
+)
+
+func assertErrorCode(t *testing.T, resp *http.Response, status int, code server.ErrorCode) {
+	t.Helper()
+	defer resp.Body.Close()
+	assert.Equal(t, status, resp.StatusCode)
+	assert.Equal(t, api.CTJSON, resp.Header.Get("Content-Type"))
+	m := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+	assert.Equal(t, string(code), m["code"])
+	assert.NotEmpty(t, m["message"])
+}
+
+func (s *testSuite) TestErrorCodes(t *testing.T) {
+	_, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	do := func(method, path, contentType, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, uri+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	assertErrorCode(t, do(http.MethodPost, "/transactions/", api.CTJSON, "{"), http.StatusBadRequest, server.CodeInvalidJSON)
+	assertErrorCode(t, do(http.MethodPost, "/upload-pack/", "text/plain", "abc"), http.StatusUnsupportedMediaType, server.CodeUnsupportedMedia)
+	assertErrorCode(t, do(http.MethodGet, "/no-such-route/", "", ""), http.StatusNotFound, server.CodeNotFound)
+	assertErrorCode(t, do(http.MethodGet, "/commits/"+strings.Repeat("a", 32)+"/", "", ""), http.StatusNotFound, server.CodeNotFound)
+
+	body := fmt.Sprintf(`{"id":%q,"begin":"2022-01-01T00:00:00Z","status":"in-progress"}`, uuid.New())
+	resp := do(http.MethodPost, "/transactions/", api.CTJSON, body)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	assertErrorCode(t, do(http.MethodPost, "/transactions/", api.CTJSON, body), http.StatusConflict, server.CodeConflict)
+}
+
+// closedStore fails every read as if the database was closed
+type closedStore struct {
+	objects.Store
+}
+
+func (s closedStore) Get(k []byte) ([]byte, error) {
+	return nil, badger.ErrDBClosed
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	s := server.NewServer(
+		nil,
+		func(r *http.Request) objects.Store { return closedStore{db} },
+		func(r *http.Request) ref.Store { return rs },
+		func(r *http.Request) conf.Config { return conf.Config{} },
+		nil, nil,
+		testr.New(t),
+	)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	sum := hex.EncodeToString(testutils.SecureRandomBytes(16))
+	for _, path := range []string{
+		"/commits/" + sum + "/",
+		"/commits/" + sum + "/profile/",
+		"/tables/" + sum + "/",
+		"/tables/" + sum + "/profile/",
+		"/tables/" + sum + "/blocks/",
+		"/tables/" + sum + "/rows/?offsets=0",
+		"/diff/" + sum + "/" + sum + "/",
+	} {
+		resp, err := http.Get(ts.URL + path)
+		require.NoError(t, err)
+		assertErrorCode(t, resp, http.StatusServiceUnavailable, server.CodeStorageUnavailable)
+	}
+
+	// errors that clients cannot act on are not disclosed
+	resp, err := http.Get(ts.URL + "/commits/" + hex.EncodeToString(testutils.SecureRandomBytes(16)) + "/")
+	require.NoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.NotContains(t, string(b), badger.ErrDBClosed.Error())
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/eventstream"
+)
+
+// eventsHeartbeatInterval is how often a comment is sent to keep idle
+// connections open through proxies
+const eventsHeartbeatInterval = 15 * time.Second
+
+func writeSSE(rw http.ResponseWriter, e *eventstream.Entry) error {
+	_, err := fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, e.Data)
+	return err
+}
+
+// handleEvents streams events as Server-Sent Events. Clients can resume after
+// the last event they received with the Last-Event-ID header or the lastEventId
+// query parameter. If events after it are no longer retained by the event log,
+// a reset event is sent first so that clients reload refs.
+func (s *Server) handleEvents(rw http.ResponseWriter, r *http.Request) {
+	var l *eventstream.Log
+	if s.getEventLog != nil {
+		l = s.getEventLog(r)
+	}
+	if l == nil {
+		SendError(rw, r, http.StatusNotFound, "event stream is not enabled")
+		return
+	}
+	if s.Draining() {
+		sendDraining(rw, r)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		SendError(rw, r, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	query := r.URL.Query()
+	prefixes := query["prefix"]
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = query.Get("lastEventId")
+	}
+	var seq uint64
+	if lastID != "" {
+		var err error
+		seq, err = strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			SendError(rw, r, http.StatusBadRequest, "invalid last event id")
+			return
+		}
+	}
+
+	backlog, ch, cancel := l.Subscribe(seq)
+	defer cancel()
+	if lastID == "" {
+		// only events published from now on
+		backlog = nil
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	extendWriteDeadline(rw)
+	for _, e := range backlog {
+		if !e.MatchPrefixes(prefixes) {
+			continue
+		}
+		if err := writeSSE(rw, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.drained:
+			// the client reconnects with the last event id
+			return
+		case <-ticker.C:
+			extendWriteDeadline(rw)
+			if _, err := fmt.Fprint(rw, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// dropped for falling behind, client should reconnect
+				return
+			}
+			if !e.MatchPrefixes(prefixes) {
+				continue
+			}
+			extendWriteDeadline(rw)
+			if err := writeSSE(rw, e); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
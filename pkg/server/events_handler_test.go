@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/testutils"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSE parses events from r into a channel until r is closed
+func readSSE(r io.Reader) <-chan *sseEvent {
+	ch := make(chan *sseEvent)
+	go func() {
+		defer close(ch)
+		scanner := bufio.NewScanner(r)
+		evt := &sseEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if evt.ID != "" {
+					ch <- evt
+				}
+				evt = &sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				evt.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				evt.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				evt.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return ch
+}
+
+func nextSSE(t *testing.T, ch <-chan *sseEvent) *sseEvent {
+	t.Helper()
+	select {
+	case evt, ok := <-ch:
+		require.True(t, ok, "stream closed")
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return nil
+}
+
+func (s *testSuite) TestEventsHandler(t *testing.T) {
+	_, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+
+	resp, err := cli.Request(http.MethodGet, "/events/?prefix=heads/al", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	ch := readSSE(resp.Body)
+
+	_, err = cli.Commit("beta", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	cr, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+
+	// events of heads/beta are filtered out
+	evt := nextSSE(t, ch)
+	assert.Equal(t, "commit", evt.Event)
+	assert.Contains(t, evt.Data, cr.Sum.String())
+	firstID := evt.ID
+	evt = nextSSE(t, ch)
+	assert.Equal(t, "branchCreated", evt.Event)
+	assert.Contains(t, evt.Data, `"ref":"heads/alpha"`)
+	require.NoError(t, resp.Body.Close())
+
+	// resume after the first event
+	resp, err = cli.Request(http.MethodGet, "/events/?prefix=heads/al", nil, map[string]string{
+		"Last-Event-ID": firstID,
+	})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	ch = readSSE(resp.Body)
+	evt = nextSSE(t, ch)
+	assert.Equal(t, "branchCreated", evt.Event)
+
+	// events after an unknown id cannot be replayed
+	resp, err = cli.Request(http.MethodGet, "/events/?prefix=heads/al&lastEventId=1000", nil, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	evt = nextSSE(t, readSSE(resp.Body))
+	assert.Equal(t, "reset", evt.Event)
+	assert.Equal(t, "{}", evt.Data)
+	assert.Less(t, firstID, evt.ID)
+
+	_, err = cli.Request(http.MethodGet, "/events/?lastEventId=abc", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid last event id")
+}
+
+func (s *testSuite) TestEventsOutliveWriteTimeout(t *testing.T) {
+	_, uri, _, cleanup := s.s.NewRemote(t, "", func(srv *http.Server) {
+		srv.WriteTimeout = 500 * time.Millisecond
+	})
+	defer cleanup()
+	cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(s.s.AdminToken(t)))
+	require.NoError(t, err)
+
+	resp, err := cli.Request(http.MethodGet, "/events/?prefix=heads/al", nil, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	ch := readSSE(resp.Body)
+
+	time.Sleep(time.Second)
+	_, err = cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	evt := nextSSE(t, ch)
+	assert.Equal(t, "commit", evt.Event)
+
+	// events without refs pass prefix filters
+	_, err = cli.Request(http.MethodPost, "/gc/", nil, nil)
+	require.NoError(t, err)
+	evt = nextSSE(t, ch)
+	assert.Equal(t, "branchCreated", evt.Event)
+	evt = nextSSE(t, ch)
+	assert.Equal(t, "gcCompleted", evt.Event)
+}
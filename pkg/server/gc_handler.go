@@ -1,20 +1,192 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"regexp"
+	"time"
 
-	"github.com/wrgl/wrgl/pkg/prune"
-	"github.com/wrgl/wrgl/pkg/transaction"
+	"github.com/google/uuid"
+	"github.com/wrgl/wrgl/pkg/api"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/gc"
+	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
+var gcJobURIPat = regexp.MustCompile(`/gc/jobs/([0-9a-f-]+)/`)
+
+func (s *Server) gcRunner(r *http.Request) *gc.Runner {
+	if s.getGCRunner == nil {
+		return nil
+	}
+	return s.getGCRunner(r)
+}
+
+// handleGC runs garbage collection and answers with the run. With query
+// param dryRun, it answers with what would be removed instead. With query
+// param async, it answers right away with a job to poll.
 func (s *Server) handleGC(rw http.ResponseWriter, r *http.Request) {
-	db := s.getDB(r)
-	rs := s.getRS(r)
+	query := r.URL.Query()
+	dryRun, err := getQueryBool(query, "dryRun")
+	if err != nil {
+		SendError(rw, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	async, err := getQueryBool(query, "async")
+	if err != nil {
+		SendError(rw, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	runner := s.gcRunner(r)
 	c := s.getConfig(r)
-	if err := transaction.GarbageCollect(db, rs, c.GetTransactionTTL(), nil); err != nil {
-		panic(err)
+	if async {
+		s.startGCJob(rw, r, runner, c.GetTransactionTTL(), dryRun)
+		return
+	}
+	if runner == nil {
+		// runs are neither serialized nor recorded without a shared runner
+		runner = gc.NewRunner(s.getDB(r), s.getRS(r), nil)
+	}
+	if dryRun {
+		report, err := runner.DryRun(c.GetTransactionTTL())
+		if err != nil {
+			s.handleErr(rw, r, err)
+			return
+		}
+		WriteJSON(rw, r, report)
+		return
+	}
+	run, err := runner.Run(gc.TriggerManual, c.GetTransactionTTL())
+	if err == gc.ErrRunning {
+		SendError(rw, r, http.StatusConflict, err.Error())
+		return
 	}
-	if err := prune.Prune(db, rs, nil); err != nil {
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	if err = s.gcCompletion(r)(run.FinishedAt.Sub(run.StartedAt)); err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	WriteJSON(rw, r, run)
+}
+
+func (s *Server) startGCJob(rw http.ResponseWriter, r *http.Request, runner *gc.Runner, transactionTTL time.Duration, dryRun bool) {
+	if runner == nil {
+		SendError(rw, r, http.StatusNotFound, "garbage collection jobs are not enabled")
+		return
+	}
+	var onDone func(j *gc.Job)
+	if !dryRun {
+		// the job finishes after r is answered
+		completed := s.gcCompletion(r)
+		onDone = func(j *gc.Job) {
+			if j.Status == gc.StatusSuccess {
+				if err := completed(j.FinishedAt.Sub(j.StartedAt)); err != nil {
+					s.logger.Error(err, "error completing garbage collection job", "job", j.ID.String())
+				}
+			}
+		}
+	}
+	job, err := runner.Start(gc.TriggerManual, transactionTTL, dryRun, onDone)
+	if err == gc.ErrRunning {
+		SendError(rw, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	rw.Header().Set("Content-Type", api.CTJSON)
+	rw.Header().Set("Location", r.URL.Path+"jobs/"+job.ID.String()+"/")
+	rw.WriteHeader(http.StatusAccepted)
+	WriteJSON(rw, r, job)
+}
+
+// gcCompletion returns a function that records a manual run in the audit log
+// and notifies webhooks. Who made the request, its ID and trace context are
+// read from r right away so the function can be called after r is answered.
+func (s *Server) gcCompletion(r *http.Request) func(elapsed time.Duration) error {
+	record := s.auditRecorder(r)
+	ws := s.webhookSender(r)
+	return func(elapsed time.Duration) error {
+		record(&audit.Record{Action: audit.ActionGarbageCollect})
+		ws.EnqueueEvent(&webhook.GCEvent{
+			ElapsedMs: elapsed.Milliseconds(),
+		})
+		if err := ws.Flush(); err != nil {
+			return fmt.Errorf("error saving webhook payloads: %w", err)
+		}
+		return nil
+	}
+}
+
+// SchedulerAuthor is recorded as the author of scheduled garbage collection
+// runs
+var SchedulerAuthor = &Author{Name: "wrgld scheduler"}
+
+// ScheduledGCCompleted records a scheduled garbage collection run in the
+// audit log and sends a gcCompleted event, as is done for manual runs. Getters
+// receive a request to the garbage collection endpoint with context ctx, made
+// by SchedulerAuthor.
+func (s *Server) ScheduledGCCompleted(ctx context.Context, run *gc.Run) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/gc/", nil)
+	if err != nil {
 		panic(err)
 	}
+	if err = s.gcCompletion(SetAuthor(r, SchedulerAuthor))(run.FinishedAt.Sub(run.StartedAt)); err != nil {
+		s.logger.Error(err, "error completing scheduled garbage collection")
+	}
+}
+
+// holdOffGC keeps garbage collection from running until release is called,
+// for requests that write objects. It answers 503 and returns false if
+// garbage collection is in progress.
+func (s *Server) holdOffGC(rw http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	runner := s.gcRunner(r)
+	if runner == nil {
+		return func() {}, true
+	}
+	release, err := runner.Acquire()
+	if err != nil {
+		sendGCInProgress(rw, r, err.Error())
+		return nil, false
+	}
+	return release, true
+}
+
+func sendGCInProgress(rw http.ResponseWriter, r *http.Request, message string) {
+	rw.Header().Set("Retry-After", "10")
+	sendErrorCode(rw, r, http.StatusServiceUnavailable, CodeGCInProgress, message)
+}
+
+func (s *Server) handleGetGC(rw http.ResponseWriter, r *http.Request) {
+	runner := s.gcRunner(r)
+	if runner == nil {
+		SendError(rw, r, http.StatusNotFound, "garbage collection status is not enabled")
+		return
+	}
+	WriteJSON(rw, r, runner.Status())
+}
+
+func (s *Server) handleGetGCJob(rw http.ResponseWriter, r *http.Request) {
+	runner := s.gcRunner(r)
+	m := gcJobURIPat.FindStringSubmatch(r.URL.Path)
+	if runner == nil || m == nil {
+		SendHTTPError(rw, r, http.StatusNotFound)
+		return
+	}
+	id, err := uuid.Parse(m[1])
+	if err != nil {
+		SendError(rw, r, http.StatusBadRequest, "invalid job id")
+		return
+	}
+	job, ok := runner.Job(id)
+	if !ok {
+		SendError(rw, r, http.StatusNotFound, "job not found")
+		return
+	}
+	WriteJSON(rw, r, job)
 }
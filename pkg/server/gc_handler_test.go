@@ -1,15 +1,30 @@
 package server_test
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/go-logr/logr/testr"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
 	"github.com/wrgl/wrgl/pkg/conf"
 	"github.com/wrgl/wrgl/pkg/factory"
 	"github.com/wrgl/wrgl/pkg/objects"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgld/pkg/audit"
+	"github.com/wrgl/wrgld/pkg/gc"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
 func (s *testSuite) TestGCHandler(t *testing.T) {
@@ -17,6 +32,8 @@ func (s *testSuite) TestGCHandler(t *testing.T) {
 	defer cleanup()
 	db := s.s.GetDB(repo)
 	rs := s.s.GetRS(repo)
+	getWebhookPayload, cleanup := s.setupWebhook(t, repo, webhook.GCCompletedEventType)
+	defer cleanup()
 
 	sum, _ := factory.CommitRandom(t, db, nil)
 	ctr, err := cli.CreateTransaction(nil)
@@ -38,4 +55,219 @@ func (s *testSuite) TestGCHandler(t *testing.T) {
 	assert.False(t, objects.CommitExist(db, sum))
 	_, err = rs.GetTransaction(tid)
 	assert.Error(t, err)
+
+	s.webhookWG.Wait()
+	pl := getWebhookPayload()
+	require.NotNil(t, pl)
+	require.Len(t, pl.Events, 1)
+	assert.Equal(t, webhook.GCCompletedEventType, pl.Events[0].GetType())
+}
+
+func (s *testSuite) TestGCStatus(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	do := func(method string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, uri+"/gc/", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	getStatus := func() *gc.Status {
+		t.Helper()
+		resp := do(http.MethodGet)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		st := &gc.Status{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(st))
+		return st
+	}
+
+	st := getStatus()
+	assert.False(t, st.Running)
+	assert.Nil(t, st.LastRun)
+	assert.Empty(t, st.Runs)
+
+	factory.CommitRandom(t, s.s.GetDB(repo), nil)
+	resp := do(http.MethodPost)
+	run := &gc.Run{}
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(run))
+	resp.Body.Close()
+	assert.Equal(t, gc.StatusSuccess, run.Status)
+
+	st = getStatus()
+	require.Len(t, st.Runs, 1)
+	require.NotNil(t, st.LastRun)
+	assert.Equal(t, gc.TriggerManual, st.LastRun.Trigger)
+	assert.Equal(t, gc.StatusSuccess, st.LastRun.Status)
+	assert.Equal(t, 1, st.LastRun.Reclaimed["commit"])
+	assert.False(t, st.LastRun.FinishedAt.Before(st.LastRun.StartedAt))
+}
+
+func (s *testSuite) TestGCDryRunAndJobs(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	db := s.s.GetDB(repo)
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, uri+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	decode := func(resp *http.Response, status int, v interface{}) {
+		t.Helper()
+		defer resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	sum, com := factory.CommitRandom(t, db, nil)
+
+	rep := &gc.Report{}
+	decode(do(http.MethodPost, "/gc/?dryRun=true"), http.StatusOK, rep)
+	require.Len(t, rep.Commits, 1)
+	assert.Equal(t, hex.EncodeToString(sum), rep.Commits[0].Sum)
+	require.Len(t, rep.Tables, 1)
+	assert.Equal(t, hex.EncodeToString(com.Table), rep.Tables[0].Sum)
+	assert.Greater(t, rep.Bytes, int64(0))
+	assert.True(t, objects.CommitExist(db, sum))
+
+	resp := do(http.MethodPost, "/gc/?async=true")
+	loc, err := resp.Location()
+	require.NoError(t, err)
+	job := &gc.Job{}
+	requestID := resp.Header.Get(server.RequestIDHeader)
+	require.NotEmpty(t, requestID)
+	decode(resp, http.StatusAccepted, job)
+	assert.Equal(t, "/gc/jobs/"+job.ID.String()+"/", loc.Path)
+	require.Eventually(t, func() bool {
+		decode(do(http.MethodGet, loc.Path), http.StatusOK, job)
+		return job.Status != gc.JobRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, gc.StatusSuccess, job.Status)
+	assert.Equal(t, 1, job.Reclaimed["commit"])
+	assert.Equal(t, 1, job.Reclaimed["table"])
+	assert.False(t, objects.CommitExist(db, sum))
+	var recs []*audit.Record
+	require.Eventually(t, func() bool {
+		recs, err = s.s.GetAuditLog(repo).List(&audit.Filter{Action: audit.ActionGarbageCollect})
+		require.NoError(t, err)
+		return len(recs) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// the job finishes after the request is answered but is still attributed
+	// to it
+	assert.Equal(t, requestID, recs[0].RequestID)
+	assert.Equal(t, server_testutils.Email, recs[0].Subject)
+	assert.NotEmpty(t, recs[0].ClientIP)
+
+	assertErrorCode(t, do(http.MethodPost, "/gc/?dryRun=abc"), http.StatusBadRequest, server.CodeBadRequest)
+	assertErrorCode(t, do(http.MethodGet, "/gc/jobs/"+uuid.New().String()+"/"), http.StatusNotFound, server.CodeNotFound)
+}
+
+func (s *testSuite) TestScheduledGCCompleted(t *testing.T) {
+	repo, _, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	_, ch, cancel := s.s.GetEventLog(repo).Subscribe(0)
+	defer cancel()
+
+	start := time.Now()
+	s.s.Server().ScheduledGCCompleted(server_testutils.ContextWithRepo(context.Background(), repo), &gc.Run{
+		Trigger:    gc.TriggerScheduled,
+		Status:     gc.StatusSuccess,
+		StartedAt:  start,
+		FinishedAt: start.Add(1500 * time.Millisecond),
+	})
+
+	recs, err := s.s.GetAuditLog(repo).List(&audit.Filter{Action: audit.ActionGarbageCollect})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, server.SchedulerAuthor.Name, recs[0].AuthorName)
+	select {
+	case e := <-ch:
+		assert.Equal(t, conf.WebhookEventType("gcCompleted"), e.Type)
+		evt := &webhook.GCEvent{}
+		require.NoError(t, json.Unmarshal(e.Data, evt))
+		assert.Equal(t, int64(1500), evt.ElapsedMs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for gcCompleted event")
+	}
+}
+
+func (s *testSuite) TestPushWhileGC(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	db := s.s.GetDB(repo)
+	rs := s.s.GetRS(repo)
+	require.NoError(t, s.s.GetConfS(repo).Save(server_testutils.ReceivePackConfig(true, true)))
+	runner := s.s.GetGCRunner(repo)
+	newClient := func() *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(s.s.AdminToken(t)))
+		require.NoError(t, err)
+		return cli
+	}
+	do := func(method, path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, uri+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	sum, c := factory.CommitRandom(t, dbc, nil)
+	require.NoError(t, ref.CommitHead(rsc, "alpha", sum, c, nil))
+	updates := map[string]*payload.Update{
+		"refs/heads/alpha": {Sum: payload.BytesToHex(sum)},
+	}
+
+	// pushes and commits are refused while a run waits for a write in
+	// progress to finish
+	release, err := runner.Acquire()
+	require.NoError(t, err)
+	resp := do(http.MethodPost, "/gc/?async=true")
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp.Body.Close()
+	require.Eventually(t, func() bool {
+		release, err := runner.Acquire()
+		if err == nil {
+			release()
+		}
+		return err == gc.ErrCollecting
+	}, 5*time.Second, time.Millisecond)
+	for _, path := range []string{"/receive-pack/", "/commits/"} {
+		resp := do(http.MethodPost, path)
+		assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+		assertErrorCode(t, resp, http.StatusServiceUnavailable, server.CodeGCInProgress)
+	}
+	_, err = newClient().PostReceivePack(updates, nil)
+	assertHTTPError(t, err, http.StatusServiceUnavailable, "garbage collection is in progress")
+	release()
+	require.Eventually(t, func() bool { return !runner.Running() }, 5*time.Second, 10*time.Millisecond)
+
+	// a push that garbage collection ran in the middle of starts over
+	cli := newClient()
+	resp, err = cli.PostReceivePack(updates, nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Len(t, s.s.GetRpSessions(repo).List(), 1)
+	_, err = runner.Run(gc.TriggerManual, time.Hour)
+	require.NoError(t, err)
+	_, err = cli.PostReceivePack(updates, nil)
+	assertHTTPError(t, err, http.StatusServiceUnavailable, "garbage collection ran during the push, push again")
+	assert.Empty(t, s.s.GetRpSessions(repo).List())
+
+	remoteRefs, err := ref.ListAllRefs(rs)
+	require.NoError(t, err)
+	updates = server_testutils.PushObjects(t, dbc, rsc, newClient(), updates, remoteRefs, 0)
+	assert.Empty(t, updates["refs/heads/alpha"].ErrMsg)
+	factory.AssertCommitsPersisted(t, db, [][]byte{sum})
+	assertRefEqual(t, rs, "heads/alpha", sum)
 }
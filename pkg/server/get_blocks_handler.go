@@ -19,7 +19,7 @@ var blocksURIPat = regexp.MustCompile(`/tables/([0-9a-f]{32})/blocks/`)
 func (s *Server) transferBlocks(rw http.ResponseWriter, r *http.Request, db objects.Store, tblProf []byte) {
 	tbl, err := objects.GetTable(db, tblProf)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	blkCount := len(tbl.Blocks)
@@ -52,51 +52,67 @@ func (s *Server) transferBlocks(rw http.ResponseWriter, r *http.Request, db obje
 	if v, ok := values["format"]; ok {
 		format = payload.BlockFormat(v[0])
 	}
-	s.cacheControlImmutable(rw)
 	switch format {
 	case payload.BlockFormatBinary:
-		rw.Header().Set("Content-Type", api.CTPackfile)
-		pw, err := packfile.NewPackfileWriter(rw)
-		if err != nil {
-			return
-		}
+		// the response starts with the first block so that failing to read it
+		// can still be answered with an error
+		var pw *packfile.PackfileWriter
 		for i := start; i < end; i++ {
 			b, err := objects.GetBlockBytes(db, tbl.Blocks[i])
 			if err != nil {
-				panic(err)
+				s.handleStreamErr(rw, r, err, pw != nil)
+				return
 			}
-			_, err = pw.WriteObject(packfile.ObjectBlock, b)
-			if err != nil {
-				panic(err)
+			if pw == nil {
+				s.cacheControlImmutable(rw)
+				rw.Header().Set("Content-Type", api.CTPackfile)
+				if pw, err = packfile.NewPackfileWriter(rw); err != nil {
+					return
+				}
+			}
+			if _, err = pw.WriteObject(packfile.ObjectBlock, b); err != nil {
+				// the client went away
+				return
 			}
 		}
 	case payload.BlockFormatCSV:
-		rw.Header().Set("Content-Encoding", "gzip")
-		gzw, err := gzip.NewWriterLevel(rw, 4)
-		if err != nil {
-			panic(err)
-		}
-		defer gzw.Close()
-		rw.Header().Set("Content-Type", api.CTCSV)
-		w := csv.NewWriter(gzw)
-		defer w.Flush()
-		if v, ok := values["columns"]; ok && v[0] == "true" {
-			if err := w.Write(tbl.Columns); err != nil {
-				panic(err)
+		var gzw *gzip.Writer
+		var w *csv.Writer
+		begin := func() error {
+			s.cacheControlImmutable(rw)
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Header().Set("Content-Type", api.CTCSV)
+			gzw, _ = gzip.NewWriterLevel(rw, 4)
+			w = csv.NewWriter(gzw)
+			if v, ok := values["columns"]; ok && v[0] == "true" {
+				return w.Write(tbl.Columns)
 			}
+			return nil
 		}
 		var buf []byte
 		var blk [][]string
 		for i := start; i < end; i++ {
 			blk, buf, err = objects.GetBlock(db, buf, tbl.Blocks[i])
 			if err != nil {
-				panic(err)
+				s.handleStreamErr(rw, r, err, w != nil)
+				return
 			}
-			err = w.WriteAll(blk)
-			if err != nil {
-				panic(err)
+			if w == nil {
+				if err = begin(); err != nil {
+					return
+				}
+			}
+			if err = w.WriteAll(blk); err != nil {
+				return
 			}
 		}
+		if w == nil {
+			if err = begin(); err != nil {
+				return
+			}
+		}
+		w.Flush()
+		gzw.Close()
 	default:
 		SendError(rw, r, http.StatusBadRequest, "invalid format")
 		return
@@ -112,7 +128,7 @@ func (s *Server) handleGetBlocks(rw http.ResponseWriter, r *http.Request) {
 	db := s.getDB(r)
 	com, err := objects.GetCommit(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	s.transferBlocks(rw, r, db, com.Table)
@@ -126,7 +142,8 @@ func (s *Server) handleGetTableBlocks(rw http.ResponseWriter, r *http.Request) {
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
 	}
 	db := s.getDB(r)
 	s.transferBlocks(rw, r, db, sum)
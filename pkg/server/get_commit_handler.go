@@ -11,15 +11,14 @@ import (
 
 var commitURIPat = regexp.MustCompile(`/commits/([0-9a-f]{32})/`)
 
-func writeCommitJSON(rw http.ResponseWriter, r *http.Request, db objects.Store, sum []byte) {
+func getCommitPayload(db objects.Store, sum []byte) (*payload.Commit, error) {
 	com, err := objects.GetCommit(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
-		return
+		return nil, notFound(err)
 	}
 	tbl, err := objects.GetTable(db, com.Table)
 	if err != nil && err != objects.ErrKeyNotFound {
-		panic(err)
+		return nil, err
 	}
 	resp := &payload.Commit{
 		Sum:         payload.BytesToHex(sum),
@@ -43,7 +42,7 @@ func writeCommitJSON(rw http.ResponseWriter, r *http.Request, db objects.Store,
 		copy((*h)[:], sum)
 		resp.Parents = append(resp.Parents, h)
 	}
-	WriteJSON(rw, r, resp)
+	return resp, nil
 }
 
 func (s *Server) handleGetCommit(rw http.ResponseWriter, r *http.Request) {
@@ -54,9 +53,14 @@ func (s *Server) handleGetCommit(rw http.ResponseWriter, r *http.Request) {
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
+	}
+	resp, err := getCommitPayload(s.getDB(r), sum)
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
 	}
-	db := s.getDB(r)
 	s.cacheControlImmutable(rw)
-	writeCommitJSON(rw, r, db, sum)
+	WriteJSON(rw, r, resp)
 }
@@ -2,14 +2,12 @@ package server
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 
-	"github.com/wrgl/wrgl/pkg/api"
 	"github.com/wrgl/wrgl/pkg/api/payload"
 	"github.com/wrgl/wrgl/pkg/objects"
 	"github.com/wrgl/wrgl/pkg/ref"
@@ -28,6 +26,16 @@ func getQueryInt(query url.Values, key string, initial int) (res int, err error)
 	return
 }
 
+func getQueryBool(query url.Values, key string) (res bool, err error) {
+	if v := query.Get(key); v != "" {
+		res, err = strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid " + key)
+		}
+	}
+	return
+}
+
 func CommitPayload(db objects.Store, com *objects.Commit) *payload.Commit {
 	obj := &payload.Commit{
 		AuthorName:  com.AuthorName,
@@ -113,19 +121,12 @@ func (s *Server) handleGetCommits(rw http.ResponseWriter, r *http.Request) {
 	db := s.getDB(r)
 	root, err := getCommitTree(db, sum, maxDepth)
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	resp := &payload.GetCommitsResponse{
 		Sum:  payload.BytesToHex(sum),
 		Root: *root,
 	}
-	b, err := json.Marshal(resp)
-	if err != nil {
-		panic(err)
-	}
-	rw.Header().Set("Content-Type", api.CTJSON)
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
-	}
+	WriteJSON(rw, r, resp)
 }
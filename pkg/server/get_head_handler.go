@@ -21,6 +21,10 @@ func (s *Server) handleGetHead(rw http.ResponseWriter, r *http.Request) {
 		SendHTTPError(rw, r, http.StatusNotFound)
 		return
 	}
-	db := s.getDB(r)
-	writeCommitJSON(rw, r, db, sum)
+	resp, err := getCommitPayload(s.getDB(r), sum)
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	WriteJSON(rw, r, resp)
 }
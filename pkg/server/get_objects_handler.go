@@ -37,7 +37,8 @@ func (s *Server) handleGetObjects(rw http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
 		}
 		tables[i] = tbl
 	}
@@ -50,28 +51,28 @@ func (s *Server) handleGetObjects(rw http.ResponseWriter, r *http.Request) {
 
 	pw, err := packfile.NewPackfileWriter(gzw)
 	if err != nil {
-		panic(err)
+		return
 	}
 	buf := bytes.NewBuffer(nil)
 	for _, tbl := range tables {
 		for _, blk := range tbl.Blocks {
 			b, err := objects.GetBlockBytes(db, blk)
 			if err != nil {
-				panic(err)
+				s.handleStreamErr(rw, r, err, true)
+				return
 			}
-			_, err = pw.WriteObject(packfile.ObjectBlock, b)
-			if err != nil {
-				panic(err)
+			if _, err = pw.WriteObject(packfile.ObjectBlock, b); err != nil {
+				// the client went away
+				return
 			}
 		}
 		buf.Reset()
-		_, err = tbl.WriteTo(buf)
-		if err != nil {
-			panic(err)
+		if _, err = tbl.WriteTo(buf); err != nil {
+			s.handleStreamErr(rw, r, err, true)
+			return
 		}
-		_, err = pw.WriteObject(packfile.ObjectTable, buf.Bytes())
-		if err != nil {
-			panic(err)
+		if _, err = pw.WriteObject(packfile.ObjectTable, buf.Bytes()); err != nil {
+			return
 		}
 	}
 }
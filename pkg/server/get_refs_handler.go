@@ -12,7 +12,8 @@ func (s *Server) handleGetRefs(rw http.ResponseWriter, r *http.Request) {
 	rs := s.getRS(r)
 	refs, err := ref.ListLocalRefs(rs, values["prefix"], values["notprefix"])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	resp := &payload.GetRefsResponse{
 		Refs: map[string]*payload.Hex{},
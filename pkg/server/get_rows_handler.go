@@ -21,7 +21,7 @@ var rowsURIPat = regexp.MustCompile(`/tables/([0-9a-f]{32})/rows/`)
 func (s *Server) transferRows(rw http.ResponseWriter, r *http.Request, db objects.Store, sum []byte) {
 	tbl, err := objects.GetTable(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	values := r.URL.Query()
@@ -35,7 +35,7 @@ func (s *Server) transferRows(rw http.ResponseWriter, r *http.Request, db object
 				SendError(rw, r, http.StatusBadRequest, fmt.Sprintf("invalid offset %q", s))
 				return
 			}
-			if u < 0 || u > int(tbl.RowsCount) {
+			if u < 0 || u >= int(tbl.RowsCount) {
 				SendError(rw, r, http.StatusBadRequest, fmt.Sprintf("offset out of range %q", s))
 				return
 			}
@@ -55,29 +55,26 @@ func (s *Server) transferRows(rw http.ResponseWriter, r *http.Request, db object
 	}
 	buf, err := diff.NewBlockBuffer([]objects.Store{db}, []*objects.Table{tbl})
 	if err != nil {
-		panic(err)
-	}
-	s.cacheControlImmutable(rw)
-	rw.Header().Set("Content-Encoding", "gzip")
-	gzw, err := gzip.NewWriterLevel(rw, 4)
-	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
-	defer gzw.Close()
-	rw.Header().Set("Content-Type", api.CTCSV)
-	w := csv.NewWriter(gzw)
-	defer w.Flush()
-	for _, o := range offsets {
+	// rows are read before answering so that read errors can be answered
+	rows := make([][]string, len(offsets))
+	for i, o := range offsets {
 		blk, row := diff.RowToBlockAndOffset(o)
-		strs, err := buf.GetRow(0, blk, row)
+		rows[i], err = buf.GetRow(0, blk, row)
 		if err != nil {
-			panic(err)
-		}
-		err = w.Write(strs)
-		if err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
 		}
 	}
+	s.cacheControlImmutable(rw)
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.Header().Set("Content-Type", api.CTCSV)
+	gzw, _ := gzip.NewWriterLevel(rw, 4)
+	defer gzw.Close()
+	// write errors mean that the client went away
+	_ = csv.NewWriter(gzw).WriteAll(rows)
 }
 
 func (s *Server) handleGetRows(rw http.ResponseWriter, r *http.Request) {
@@ -89,7 +86,7 @@ func (s *Server) handleGetRows(rw http.ResponseWriter, r *http.Request) {
 	db := s.getDB(r)
 	com, err := objects.GetCommit(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	s.transferRows(rw, r, db, com.Table)
@@ -103,7 +100,8 @@ func (s *Server) handleGetTableRows(rw http.ResponseWriter, r *http.Request) {
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
 	}
 	db := s.getDB(r)
 	s.transferRows(rw, r, db, sum)
@@ -39,6 +39,9 @@ func (s *testSuite) TestGetRowsHandler(t *testing.T) {
 	_, err = cli.GetTableRows(com.Table, []int{10})
 	assertHTTPError(t, err, http.StatusBadRequest, "offset out of range \"10\"")
 
+	_, err = cli.GetTableRows(com.Table, []int{3})
+	assertHTTPError(t, err, http.StatusBadRequest, "offset out of range \"3\"")
+
 	resp, err = cli.GetTableRows(com.Table, []int{0, 1})
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
@@ -19,12 +19,13 @@ func (s *Server) handleGetTable(rw http.ResponseWriter, r *http.Request) {
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
 	}
 	db := s.getDB(r)
 	tbl, err := objects.GetTable(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	resp := &payload.GetTableResponse{
@@ -41,7 +41,8 @@ func (s *Server) handleGetTransaction(rw http.ResponseWriter, r *http.Request) {
 			SendError(rw, r, http.StatusNotFound, "transaction not found")
 			return
 		}
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	resp := &payload.GetTransactionResponse{
 		Begin:  tx.Begin,
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+// ingestLimitError is returned when uploaded data trips one of the ingest
+// limits
+type ingestLimitError struct {
+	// Limit is the name of the limit as written in config
+	Limit string
+	Max   int64
+}
+
+func (e *ingestLimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded", e.Limit, e.Max)
+}
+
+// sendIngestLimitError responds with 413 if err was caused by an ingest limit
+func sendIngestLimitError(rw http.ResponseWriter, r *http.Request, err error) bool {
+	var v *ingestLimitError
+	if errors.As(err, &v) {
+		SendError(rw, r, http.StatusRequestEntityTooLarge, v.Error())
+		return true
+	}
+	return false
+}
+
+func (s *Server) ingestLimits(r *http.Request) *wrgldconf.IngestLimits {
+	if s.getIngestLimits == nil {
+		return nil
+	}
+	return s.getIngestLimits(r)
+}
+
+// bodyLimitReader fails once more than max bytes are read. Unlike
+// http.MaxBytesReader, it remembers the error so that it can be told apart
+// from the parse error that reading a truncated body causes.
+type bodyLimitReader struct {
+	io.ReadCloser
+	max int64
+	n   int64
+	err error
+}
+
+func (r *bodyLimitReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err = r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if r.n > r.max {
+		r.err = &ingestLimitError{"maxCommitBytes", r.max}
+		return 0, r.err
+	}
+	return n, err
+}
+
+// csvLimitReader scans CSV as it is read and fails as soon as the content
+// exceeds limits. It only tracks enough of the CSV grammar to count rows,
+// columns and cell lengths, parse errors are left to the CSV reader.
+type csvLimitReader struct {
+	r      io.Reader
+	limits *wrgldconf.IngestLimits
+
+	bytes      int64
+	records    int
+	fields     int
+	cellLen    int
+	inRecord   bool
+	fieldStart bool
+	inQuote    bool
+	quoteSeen  bool
+}
+
+func newCSVLimitReader(r io.Reader, limits *wrgldconf.IngestLimits) *csvLimitReader {
+	return &csvLimitReader{r: r, limits: limits, fieldStart: true}
+}
+
+func (r *csvLimitReader) startField() error {
+	r.fields++
+	r.cellLen = 0
+	r.fieldStart = true
+	if r.limits.MaxColumns > 0 && r.fields > r.limits.MaxColumns {
+		return &ingestLimitError{"maxColumns", int64(r.limits.MaxColumns)}
+	}
+	return nil
+}
+
+func (r *csvLimitReader) addCellByte() error {
+	r.cellLen++
+	r.fieldStart = false
+	if r.limits.MaxCellLength > 0 && r.cellLen > r.limits.MaxCellLength {
+		return &ingestLimitError{"maxCellLength", int64(r.limits.MaxCellLength)}
+	}
+	return nil
+}
+
+func (r *csvLimitReader) scanByte(c byte) error {
+	if r.inQuote {
+		if r.quoteSeen {
+			r.quoteSeen = false
+			if c == '"' {
+				return r.addCellByte()
+			}
+			r.inQuote = false
+		} else {
+			if c == '"' {
+				r.quoteSeen = true
+				return nil
+			}
+			return r.addCellByte()
+		}
+	}
+	switch c {
+	case '\r':
+		return nil
+	case '\n':
+		r.inRecord = false
+		return nil
+	}
+	if !r.inRecord {
+		r.inRecord = true
+		r.records++
+		r.fields = 0
+		// the first record is the header
+		if r.limits.MaxRows > 0 && r.records-1 > r.limits.MaxRows {
+			return &ingestLimitError{"maxRows", int64(r.limits.MaxRows)}
+		}
+		if err := r.startField(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case c == ',':
+		return r.startField()
+	case c == '"' && r.fieldStart:
+		r.inQuote = true
+		r.fieldStart = false
+		return nil
+	}
+	return r.addCellByte()
+}
+
+func (r *csvLimitReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.bytes += int64(n)
+	if r.limits.MaxCommitBytes > 0 && r.bytes > r.limits.MaxCommitBytes {
+		return 0, &ingestLimitError{"maxCommitBytes", r.limits.MaxCommitBytes}
+	}
+	for _, c := range p[:n] {
+		if lerr := r.scanByte(c); lerr != nil {
+			return 0, lerr
+		}
+	}
+	return n, err
+}
+
+// packLimitReader follows packfile framing as it is read so that it can fail
+// as soon as a push exceeds limits, before a large object is buffered. Counts
+// are kept in the session because a push may span several requests.
+type packLimitReader struct {
+	r      io.Reader
+	limits *wrgldconf.IngestLimits
+	ses    *ReceivePackSession
+
+	// skip is the number of bytes left in the packfile version header
+	skip int
+	// remaining is the number of bytes left in the current object
+	remaining uint64
+	inHeader  bool
+	objLen    uint64
+	lenBits   int
+}
+
+func newPackLimitReader(r io.Reader, limits *wrgldconf.IngestLimits, ses *ReceivePackSession) *packLimitReader {
+	return &packLimitReader{r: r, limits: limits, ses: ses, skip: 8}
+}
+
+// scanHeaderByte parses a byte of an object header. offset is the number of
+// bytes pushed so far including c.
+func (r *packLimitReader) scanHeaderByte(c byte, offset int64) error {
+	if !r.inHeader {
+		r.inHeader = true
+		r.objLen = uint64(c & 15)
+		r.lenBits = 4
+		r.ses.pushedObjects++
+		if r.limits.MaxPushObjects > 0 && r.ses.pushedObjects > r.limits.MaxPushObjects {
+			return &ingestLimitError{"maxPushObjects", int64(r.limits.MaxPushObjects)}
+		}
+		return nil
+	}
+	r.objLen |= uint64(c&127) << r.lenBits
+	r.lenBits += 7
+	if c&128 == 0 {
+		r.inHeader = false
+		r.remaining = r.objLen
+		if r.limits.MaxPushBytes > 0 && uint64(offset)+r.objLen > uint64(r.limits.MaxPushBytes) {
+			return &ingestLimitError{"maxPushBytes", r.limits.MaxPushBytes}
+		}
+	}
+	return nil
+}
+
+func (r *packLimitReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	offset := r.ses.pushedBytes
+	r.ses.pushedBytes += int64(n)
+	if r.limits.MaxPushBytes > 0 && r.ses.pushedBytes > r.limits.MaxPushBytes {
+		return 0, &ingestLimitError{"maxPushBytes", r.limits.MaxPushBytes}
+	}
+	for i := 0; i < n; {
+		switch {
+		case r.skip > 0:
+			k := n - i
+			if r.skip < k {
+				k = r.skip
+			}
+			r.skip -= k
+			i += k
+		case r.remaining > 0:
+			k := uint64(n - i)
+			if r.remaining < k {
+				k = r.remaining
+			}
+			r.remaining -= k
+			i += int(k)
+		default:
+			if lerr := r.scanHeaderByte(p[i], offset+int64(i)+1); lerr != nil {
+				return 0, lerr
+			}
+			i++
+		}
+	}
+	return n, err
+}
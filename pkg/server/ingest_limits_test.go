@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/factory"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/pbar"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+)
+
+func (s *testSuite) TestIngestLimits(t *testing.T) {
+	limits := &wrgldconf.IngestLimits{}
+	srv := server_testutils.NewServer(t, nil, server.WithIngestLimits(func(r *http.Request) *wrgldconf.IngestLimits {
+		return limits
+	}))
+	defer srv.Close()
+	repo, cli, _, cleanup := srv.NewClient(t, "", true)
+	defer cleanup()
+
+	commit := func(name, content string) error {
+		_, err := cli.Commit("main", "commit", name, strings.NewReader(content), nil, nil)
+		return err
+	}
+	content := "a,b,c\n1,\"q,\"\"x\"\"\",3\n\n4,5,6\r\n"
+	limits.MaxRows = 2
+	limits.MaxColumns = 3
+	limits.MaxCellLength = 5
+	limits.MaxCommitBytes = 1024
+	require.NoError(t, commit("file.csv", content))
+
+	limits.MaxRows = 1
+	assertHTTPError(t, commit("file.csv", content), http.StatusRequestEntityTooLarge, "maxRows limit of 1 exceeded")
+	limits.MaxRows = 0
+
+	limits.MaxColumns = 2
+	assertHTTPError(t, commit("file.csv", content), http.StatusRequestEntityTooLarge, "maxColumns limit of 2 exceeded")
+	limits.MaxColumns = 0
+
+	limits.MaxCellLength = 4
+	assertHTTPError(t, commit("file.csv", content), http.StatusRequestEntityTooLarge, "maxCellLength limit of 4 exceeded")
+	limits.MaxCellLength = 0
+
+	limits.MaxCommitBytes = 100
+	assertHTTPError(t, commit("file.csv", strings.Repeat("a,b\n", 100)), http.StatusRequestEntityTooLarge, "maxCommitBytes limit of 100 exceeded")
+
+	// decompressed size is also limited
+	limits.MaxCommitBytes = 500
+	buf := bytes.NewBuffer(nil)
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write([]byte("a,b\n" + strings.Repeat("1,2\n", 1000)))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	_, err = cli.Commit("main", "commit", "file.csv.gz", buf, nil, nil)
+	assertHTTPError(t, err, http.StatusRequestEntityTooLarge, "maxCommitBytes limit of 500 exceeded")
+	limits.MaxCommitBytes = 0
+
+	// push
+	rs := srv.GetRS(repo)
+	remoteRefs, err := ref.ListAllRefs(rs)
+	require.NoError(t, err)
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	sum1, c1 := factory.CommitRandom(t, dbc, nil)
+	require.NoError(t, ref.CommitHead(rsc, "alpha", sum1, c1, nil))
+	push := func() error {
+		ses, err := apiclient.NewReceivePackSession(dbc, rsc, cli, map[string]*payload.Update{
+			"refs/heads/alpha": {Sum: payload.BytesToHex(sum1)},
+		}, remoteRefs, 0)
+		require.NoError(t, err)
+		_, err = ses.Start(pbar.NewContainer(io.Discard, true))
+		return err
+	}
+	limits.MaxPushObjects = 2
+	assertHTTPError(t, push(), http.StatusRequestEntityTooLarge, "maxPushObjects limit of 2 exceeded")
+	limits.MaxPushObjects = 0
+
+	limits.MaxPushBytes = 64
+	assertHTTPError(t, push(), http.StatusRequestEntityTooLarge, "maxPushBytes limit of 64 exceeded")
+	_, err = ref.GetHead(rs, "alpha")
+	require.Error(t, err)
+
+	limits.MaxPushObjects = 100
+	limits.MaxPushBytes = 1024 * 1024
+	require.NoError(t, push())
+	assertRefEqual(t, rs, "heads/alpha", sum1)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/router"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// unmatchedRoute labels requests that no route matched
+const unmatchedRoute = "unmatched"
+
+// routeSegment returns the part of a route template that pat matches
+func routeSegment(pat *regexp.Regexp) string {
+	switch pat {
+	case nil:
+		return ""
+	case patSum:
+		return "{sum}/"
+	case patUUID:
+		return "{id}/"
+	case patHead:
+		return "heads/{branch}/"
+	case patDiff:
+		return "/diff/{sum}/{oldSum}/"
+	}
+	return strings.TrimPrefix(pat.String(), "^")
+}
+
+// instrumentRoutes makes every handler record its route template, such as
+// "/commits/{sum}/profile/", so that metrics are labeled with a bounded set
+// of routes instead of raw paths
+func instrumentRoutes(routes *router.Routes, prefix string) {
+	tmpl := prefix + routeSegment(routes.Pat)
+	if h := routes.HandlerFunc; h != nil {
+		routes.HandlerFunc = func(rw http.ResponseWriter, r *http.Request) {
+			if v := GetRequestInfo(r); v != nil {
+				v.Route = tmpl
+			}
+			h(rw, r)
+		}
+	}
+	for _, sub := range routes.Subs {
+		instrumentRoutes(sub, tmpl)
+	}
+}
+
+// RouteTemplate returns the template of the route that served r, or an empty
+// string if no route matched
+func RouteTemplate(r *http.Request) string {
+	if v := GetRequestInfo(r); v != nil {
+		return v.Route
+	}
+	return ""
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return
+}
+
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *metricsResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the wrapper
+func (w *metricsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets streaming handlers reach the underlying writer to extend the
+// write deadline
+func (w *metricsResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// instrument records count, latency and body sizes of requests served by
+// next, labeled with the template of the matched route. Each request is also
+// traced in a span continuing the trace of the caller, if any.
+func (s *Server) instrument(rw http.ResponseWriter, r *http.Request, next http.Handler) {
+	start := time.Now()
+	r, info := WithRequestInfo(r)
+	method := metricsMethod(r.Method)
+	ctx, span := tracing.Start(
+		tracing.Extract(r.Context(), r.Header), "HTTP "+method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(r.Method),
+			semconv.HTTPTarget(r.URL.RequestURI()),
+		),
+	)
+	assignRequestID(rw, r, info)
+	span.SetAttributes(requestIDKey.String(info.ID))
+	r = r.WithContext(ctx)
+	var body *countingReader
+	if r.Body != nil {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	mrw := &metricsResponseWriter{ResponseWriter: rw}
+	defer func() {
+		status := mrw.status
+		if v := recover(); v != nil {
+			// the panic is answered with 500 by the recovery middleware
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			defer panic(v)
+		} else if status == 0 {
+			status = http.StatusOK
+		}
+		route := info.Route
+		if route == "" {
+			route = unmatchedRoute
+		}
+		code := strconv.Itoa(status)
+		span.SetName(method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+		metrics.HTTPRequests.WithLabelValues(route, method, code).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, method, code).Observe(time.Since(start).Seconds())
+		if body != nil {
+			metrics.HTTPRequestBytes.WithLabelValues(route).Add(float64(body.n))
+		}
+		metrics.HTTPResponseBytes.WithLabelValues(route).Add(float64(mrw.n))
+	}()
+	next.ServeHTTP(mrw, r)
+}
@@ -0,0 +1,57 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/metrics"
+)
+
+// metrics are shared by suite tests running in parallel, so only lower
+// bounds of increments are asserted
+func (s *testSuite) TestMetrics(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	db := s.s.GetDB(repo)
+
+	// requests are labeled with route templates
+	profileNotFound := metrics.HTTPRequests.WithLabelValues("/commits/{sum}/profile/", http.MethodGet, "404")
+	before := testutil.ToFloat64(profileNotFound)
+	_, err := cli.GetCommitProfile(testutils.SecureRandomBytes(16))
+	assertHTTPError(t, err, http.StatusNotFound, "Not Found")
+	assert.GreaterOrEqual(t, testutil.ToFloat64(profileNotFound)-before, float64(1))
+
+	rowsBefore := testutil.ToFloat64(metrics.IngestRows)
+	reqBytes := metrics.HTTPRequestBytes.WithLabelValues("/commits/")
+	reqBytesBefore := testutil.ToFloat64(reqBytes)
+	buf := bytes.NewBuffer(nil)
+	w := csv.NewWriter(buf)
+	require.NoError(t, w.WriteAll([][]string{
+		{"a", "b"},
+		{"1", "q"},
+		{"2", "a"},
+	}))
+	w.Flush()
+	n := buf.Len()
+	_, err = cli.Commit("alpha", "initial commit", "file.csv", bytes.NewReader(buf.Bytes()), []string{"a"}, nil)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.IngestRows)-rowsBefore, float64(2))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(reqBytes)-reqBytesBefore, float64(n))
+
+	gcRuns := metrics.GCRuns.WithLabelValues("success")
+	gcBefore := testutil.ToFloat64(gcRuns)
+	commitsReclaimed := metrics.GCReclaimedObjects.WithLabelValues("commit")
+	commitsBefore := testutil.ToFloat64(commitsReclaimed)
+	factory.CommitRandom(t, db, nil)
+	_, err = cli.GarbageCollect()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(gcRuns)-gcBefore, float64(1))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(commitsReclaimed)-commitsBefore, float64(1))
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/encoding/packfile"
+	"github.com/wrgl/wrgl/pkg/objects"
+)
+
+const defaultMaxPackfileSize uint64 = 1024 * 1024 * 1024 * 2
+
+// PackObject is an object queued to be sent in a packfile
+type PackObject struct {
+	Type int          `json:"type"`
+	Sum  *payload.Hex `json:"sum"`
+
+	// content is read from the store when the object is sent if it is nil
+	content []byte
+}
+
+// SenderState is how far an object sender got, so that a resumed session
+// carries on from there instead of sending objects again
+type SenderState struct {
+	// Commits are commits whose objects are not queued yet, in order
+	Commits []*payload.Hex `json:"commits,omitempty"`
+
+	// Objects are queued objects that are not sent yet, in order
+	Objects []*PackObject `json:"objects,omitempty"`
+
+	// Tables and Blocks are what was queued so far. Along with objects of
+	// common commits, they are not sent again.
+	Tables []*payload.Hex `json:"tables,omitempty"`
+	Blocks []*payload.Hex `json:"blocks,omitempty"`
+}
+
+// objectSender writes the objects of commits into packfiles of bounded size.
+// It sends objects in the same order as apiutils.ObjectSender but its
+// progress can be saved.
+type objectSender struct {
+	db              objects.Store
+	commits         [][]byte
+	objs            []*PackObject
+	tablesToSend    map[string]struct{}
+	commonTables    map[string]struct{}
+	commonBlocks    map[string]struct{}
+	queuedTables    [][]byte
+	queuedBlocks    [][]byte
+	maxPackfileSize uint64
+	buf             *bytes.Buffer
+}
+
+func newObjectSender(db objects.Store, commits [][]byte, tablesToSend map[string]struct{}, commons [][]byte, maxPackfileSize uint64) (*objectSender, error) {
+	s, err := initObjectSender(db, tablesToSend, commons, maxPackfileSize)
+	if err != nil {
+		return nil, err
+	}
+	s.commits = commits
+	if err = s.enqueueNextCommit(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resumeObjectSender creates a sender that carries on from st
+func resumeObjectSender(db objects.Store, st *SenderState, tablesToSend map[string]struct{}, commons [][]byte, maxPackfileSize uint64) (*objectSender, error) {
+	s, err := initObjectSender(db, tablesToSend, commons, maxPackfileSize)
+	if err != nil {
+		return nil, err
+	}
+	s.commits = payload.HexSliceToBytesSlice(st.Commits)
+	s.objs = st.Objects
+	s.queuedTables = payload.HexSliceToBytesSlice(st.Tables)
+	for _, sum := range s.queuedTables {
+		s.commonTables[string(sum)] = struct{}{}
+	}
+	s.queuedBlocks = payload.HexSliceToBytesSlice(st.Blocks)
+	for _, sum := range s.queuedBlocks {
+		s.commonBlocks[string(sum)] = struct{}{}
+	}
+	return s, nil
+}
+
+func initObjectSender(db objects.Store, tablesToSend map[string]struct{}, commons [][]byte, maxPackfileSize uint64) (*objectSender, error) {
+	if maxPackfileSize == 0 {
+		maxPackfileSize = defaultMaxPackfileSize
+	}
+	s := &objectSender{
+		db:              db,
+		tablesToSend:    tablesToSend,
+		commonTables:    map[string]struct{}{},
+		commonBlocks:    map[string]struct{}{},
+		maxPackfileSize: maxPackfileSize,
+		buf:             bytes.NewBuffer(nil),
+	}
+	for _, sum := range commons {
+		com, err := objects.GetCommit(db, sum)
+		if err != nil {
+			return nil, err
+		}
+		s.commonTables[string(com.Table)] = struct{}{}
+	}
+	for sum := range s.commonTables {
+		tbl, err := objects.GetTable(db, []byte(sum))
+		if err == objects.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, blk := range tbl.Blocks {
+			s.commonBlocks[string(blk)] = struct{}{}
+		}
+	}
+	return s, nil
+}
+
+// state returns the progress of the sender
+func (s *objectSender) state() *SenderState {
+	return &SenderState{
+		Commits: payload.BytesSliceToHexSlice(s.commits),
+		Objects: s.objs,
+		Tables:  payload.BytesSliceToHexSlice(s.queuedTables),
+		Blocks:  payload.BytesSliceToHexSlice(s.queuedBlocks),
+	}
+}
+
+func (s *objectSender) push(typ int, sum, content []byte) {
+	s.objs = append(s.objs, &PackObject{Type: typ, Sum: payload.BytesToHex(sum), content: content})
+}
+
+func (s *objectSender) enqueueNextCommit() error {
+	if len(s.commits) == 0 {
+		return nil
+	}
+	com, err := objects.GetCommit(s.db, s.commits[0])
+	if err != nil {
+		return err
+	}
+	s.commits = s.commits[1:]
+	if _, ok := s.tablesToSend[string(com.Table)]; ok {
+		if _, ok := s.commonTables[string(com.Table)]; !ok {
+			if err = s.enqueueTable(com.Table); err != nil {
+				return err
+			}
+			s.commonTables[string(com.Table)] = struct{}{}
+			s.queuedTables = append(s.queuedTables, com.Table)
+		}
+	}
+	s.buf.Reset()
+	if _, err = com.WriteTo(s.buf); err != nil {
+		return err
+	}
+	s.push(packfile.ObjectCommit, com.Sum, append([]byte(nil), s.buf.Bytes()...))
+	return nil
+}
+
+func (s *objectSender) enqueueTable(sum []byte) error {
+	tbl, err := objects.GetTable(s.db, sum)
+	if err == objects.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, blk := range tbl.Blocks {
+		if _, ok := s.commonBlocks[string(blk)]; !ok {
+			s.push(packfile.ObjectBlock, blk, nil)
+			s.commonBlocks[string(blk)] = struct{}{}
+			s.queuedBlocks = append(s.queuedBlocks, blk)
+		}
+	}
+	s.buf.Reset()
+	if _, err = tbl.WriteTo(s.buf); err != nil {
+		return err
+	}
+	s.push(packfile.ObjectTable, sum, append([]byte(nil), s.buf.Bytes()...))
+	return nil
+}
+
+// content returns the encoded object
+func (s *objectSender) content(obj *PackObject) ([]byte, error) {
+	if obj.content != nil {
+		return obj.content, nil
+	}
+	sum := (*obj.Sum)[:]
+	s.buf.Reset()
+	switch obj.Type {
+	case packfile.ObjectCommit:
+		com, err := objects.GetCommit(s.db, sum)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = com.WriteTo(s.buf); err != nil {
+			return nil, err
+		}
+	case packfile.ObjectTable:
+		tbl, err := objects.GetTable(s.db, sum)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tbl.WriteTo(s.buf); err != nil {
+			return nil, err
+		}
+	default:
+		return objects.GetBlockBytes(s.db, sum)
+	}
+	return s.buf.Bytes(), nil
+}
+
+// writeObjects writes the next packfile into w. It returns true once all
+// objects are sent.
+func (s *objectSender) writeObjects(w io.Writer) (done bool, info *packfile.PackfileInfo, err error) {
+	pw, err := packfile.NewPackfileWriter(w)
+	if err != nil {
+		return
+	}
+	var size uint64
+	for len(s.objs) > 0 {
+		obj := s.objs[0]
+		b, err := s.content(obj)
+		if err != nil {
+			return false, nil, err
+		}
+		n, err := pw.WriteObject(obj.Type, b)
+		if err != nil {
+			return false, nil, err
+		}
+		if err = pw.Info.AddObject(obj.Type, (*obj.Sum)[:]); err != nil {
+			return false, nil, err
+		}
+		s.objs = s.objs[1:]
+		size += uint64(n)
+		if len(s.objs) == 0 {
+			if err = s.enqueueNextCommit(); err != nil {
+				return false, nil, err
+			}
+		}
+		if size >= s.maxPackfileSize {
+			break
+		}
+	}
+	return len(s.objs) == 0 && len(s.commits) == 0, pw.Info, nil
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+type payloadRecorderKey struct{}
+
+// payloadRecorder keeps JSON payloads of a request and its response so that
+// they can be logged
+type payloadRecorder struct {
+	requestInfo  interface{}
+	responseInfo interface{}
+}
+
+func setPayloadRecorder(r *http.Request, pr *payloadRecorder) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), payloadRecorderKey{}, pr))
+}
+
+func getPayloadRecorder(r *http.Request) *payloadRecorder {
+	if v := r.Context().Value(payloadRecorderKey{}); v != nil {
+		return v.(*payloadRecorder)
+	}
+	return nil
+}
+
+func setRequestInfo(r *http.Request, info interface{}) {
+	if v := getPayloadRecorder(r); v != nil {
+		v.requestInfo = info
+	}
+}
+
+func setResponseInfo(r *http.Request, info interface{}) {
+	if v := getPayloadRecorder(r); v != nil {
+		v.responseInfo = info
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+// newPreReceiveUpdate describes a proposed ref update. Sum is nil when the ref is
+// about to be deleted.
+func newPreReceiveUpdate(ctx context.Context, db objects.Store, refname string, oldSum, sum []byte, logger logr.Logger) (*webhook.PreReceiveUpdate, error) {
+	u := &webhook.PreReceiveUpdate{
+		Ref: refname,
+	}
+	if oldSum != nil {
+		u.OldSum = hex.EncodeToString(oldSum)
+	}
+	if sum != nil {
+		u.Sum = hex.EncodeToString(sum)
+		ds, err := summarizeDiff(ctx, db, oldSum, sum, logger)
+		if err != nil {
+			return nil, err
+		}
+		u.Diff = ds
+	}
+	return u, nil
+}
+
+// proposedUpdate is a ref update waiting for pre-receive hooks' approval
+type proposedUpdate struct {
+	Ref    string
+	OldSum []byte
+	Sum    []byte
+}
+
+// preReceive asks pre-receive hooks whether updates can proceed. It returns a
+// *webhook.PreReceiveError if any hook declined, timed out or could not be
+// reached.
+func preReceive(ctx context.Context, db objects.Store, ws *webhook.Sender, evt *webhook.PreReceiveEvent, updates []proposedUpdate, logger logr.Logger) error {
+	if ws == nil || !ws.HasPreReceiveHooks() {
+		return nil
+	}
+	for _, pu := range updates {
+		u, err := newPreReceiveUpdate(ctx, db, pu.Ref, pu.OldSum, pu.Sum, logger)
+		if err != nil {
+			return err
+		}
+		evt.Updates = append(evt.Updates, *u)
+	}
+	return ws.PreReceive(ctx, evt)
+}
+
+// refMoved returns true if the ref of u no longer points at u.OldSum, such as
+// when another request updated it while pre-receive hooks were deciding
+func refMoved(rs ref.Store, u proposedUpdate) (bool, error) {
+	sum, err := ref.GetRef(rs, u.Ref)
+	if err != nil && err != ref.ErrKeyNotFound {
+		return false, err
+	}
+	return !bytes.Equal(sum, u.OldSum), nil
+}
+
+// preReceiveDiffs returns the diff summaries sent to pre-receive hooks by ref,
+// so that they are not computed again for commit events. It returns nil if
+// evt was not sent.
+func preReceiveDiffs(evt *webhook.PreReceiveEvent) map[string]*webhook.DiffSummary {
+	var m map[string]*webhook.DiffSummary
+	for _, u := range evt.Updates {
+		if u.Diff != nil {
+			if m == nil {
+				m = map[string]*webhook.DiffSummary{}
+			}
+			m[u.Ref] = u.Diff
+		}
+	}
+	return m
+}
+
+// preReceiveError converts a *webhook.PreReceiveError to the error answered
+// to clients: 403 if a hook declined, 504 if it timed out and 502 if it could
+// not be reached. Other errors are returned as is.
+func preReceiveError(err error) error {
+	v, ok := err.(*webhook.PreReceiveError)
+	if !ok {
+		return err
+	}
+	e := &Error{Code: CodePreReceiveFailed, Message: v.Error(), Err: err}
+	switch v.Failure {
+	case webhook.PreReceiveTimedOut:
+		e.Status = http.StatusGatewayTimeout
+	case webhook.PreReceiveUnreachable:
+		e.Status = http.StatusBadGateway
+	default:
+		e.Status = http.StatusForbidden
+		e.Code = CodePreReceiveDeclined
+	}
+	return e
+}
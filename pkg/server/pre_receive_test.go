@@ -0,0 +1,250 @@
+package server_test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/objects"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+	"github.com/wrgl/wrgld/pkg/webhook"
+	webhooktest "github.com/wrgl/wrgld/pkg/webhook/test"
+)
+
+func (s *testSuite) setupPreReceiveHook(t *testing.T, repo, decline string) (getWebhookPayload func() (body *webhook.Payload), cleanup func()) {
+	t.Helper()
+	cs := s.s.GetConfS(repo)
+	wh, getWebhookPayload, cleanup := webhooktest.CreatePreReceiveHandler(t, decline)
+	c, err := cs.Open()
+	require.NoError(t, err)
+	c.Webhooks = append(c.Webhooks, wh)
+	require.NoError(t, cs.Save(c))
+	return getWebhookPayload, cleanup
+}
+
+func (s *testSuite) TestPreReceiveHook(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	rs := s.s.GetRS(repo)
+
+	cr1, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b"},
+		{"1", "q"},
+		{"2", "w"},
+	}), []string{"a"}, nil)
+	require.NoError(t, err)
+
+	// accepting hook receives proposed update with diff summary
+	getPayload, cleanup := s.setupPreReceiveHook(t, repo, "")
+	defer cleanup()
+	cr2, err := cli.Commit("alpha", "second commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b", "c"},
+		{"1", "e", "r"},
+		{"3", "t", "y"},
+	}), []string{"a"}, nil)
+	require.NoError(t, err)
+	pl := getPayload()
+	require.NotNil(t, pl)
+	require.Len(t, pl.Events, 1)
+	evt := pl.Events[0].(*webhook.PreReceiveEvent)
+	assert.Equal(t, "commit", evt.Action)
+	assert.Equal(t, server_testutils.Name, evt.AuthorName)
+	assert.Equal(t, []webhook.PreReceiveUpdate{
+		{
+			Ref:    "heads/alpha",
+			OldSum: cr1.Sum.String(),
+			Sum:    cr2.Sum.String(),
+			Diff: &webhook.DiffSummary{
+				RowsAdded:    1,
+				RowsRemoved:  1,
+				RowsModified: 1,
+				ColumnsAdded: []string{"c"},
+			},
+		},
+	}, evt.Updates)
+	assertRefEqual(t, rs, "heads/alpha", (*cr2.Sum)[:])
+
+	// declining hook aborts commit
+	_, cleanup = s.setupPreReceiveHook(t, repo, "alpha is frozen")
+	defer cleanup()
+	_, err = cli.Commit("alpha", "third commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	assertHTTPError(t, err, http.StatusForbidden, "pre-receive hook declined: alpha is frozen")
+	assertRefEqual(t, rs, "heads/alpha", (*cr2.Sum)[:])
+
+	// declining hook aborts transaction commit
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	rows := testutils.BuildRawCSV(3, 4)
+	_, err = cli.Commit("beta", "initial commit", "file.csv", testutils.RawCSVBytesReader(rows), nil, &tid)
+	require.NoError(t, err)
+	_, err = cli.CommitTransaction(tid)
+	assertHTTPError(t, err, http.StatusForbidden, "pre-receive hook declined: alpha is frozen")
+	pl = getPayload()
+	require.NotNil(t, pl)
+	evt = pl.Events[0].(*webhook.PreReceiveEvent)
+	assert.Equal(t, tid.String(), evt.TransactionID)
+	require.Len(t, evt.Updates, 1)
+	assert.Equal(t, "heads/beta", evt.Updates[0].Ref)
+	assert.Equal(t, &webhook.DiffSummary{
+		RowsAdded:    4,
+		ColumnsAdded: rows[0],
+	}, evt.Updates[0].Diff)
+	assertRefEqual(t, rs, "heads/beta", nil)
+	tx, err := rs.GetTransaction(tid)
+	require.NoError(t, err)
+	assert.Equal(t, ref.TSInProgress, tx.Status)
+}
+
+func (s *testSuite) TestPreReceiveHookRewrite(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	rs := s.s.GetRS(repo)
+
+	cr1, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b"},
+		{"1", "q"},
+		{"2", "w"},
+	}), []string{"a"}, nil)
+	require.NoError(t, err)
+
+	// rows cannot be matched once the primary key changes
+	getPayload, cleanup := s.setupPreReceiveHook(t, repo, "")
+	defer cleanup()
+	cr2, err := cli.Commit("alpha", "second commit", "file.csv", testutils.RawCSVBytesReader([][]string{
+		{"a", "b"},
+		{"1", "q"},
+		{"2", "w"},
+		{"3", "e"},
+	}), []string{"b"}, nil)
+	require.NoError(t, err)
+	pl := getPayload()
+	require.NotNil(t, pl)
+	assert.Equal(t, []webhook.PreReceiveUpdate{
+		{
+			Ref:    "heads/alpha",
+			OldSum: cr1.Sum.String(),
+			Sum:    cr2.Sum.String(),
+			Diff: &webhook.DiffSummary{
+				RowsAdded:   3,
+				RowsRemoved: 2,
+				Rewritten:   true,
+			},
+		},
+	}, pl.Events[0].(*webhook.PreReceiveEvent).Updates)
+	assertRefEqual(t, rs, "heads/alpha", (*cr2.Sum)[:])
+}
+
+func (s *testSuite) TestPreReceiveHookUnreachable(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	rs := s.s.GetRS(repo)
+	cs := s.s.GetConfS(repo)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	c, err := cs.Open()
+	require.NoError(t, err)
+	c.Webhooks = append(c.Webhooks, conf.Webhook{
+		URL:        srv.URL,
+		EventTypes: []conf.WebhookEventType{webhook.PreReceiveEventType},
+	})
+	require.NoError(t, cs.Save(c))
+
+	buf := bytes.NewBuffer(nil)
+	w := multipart.NewWriter(buf)
+	require.NoError(t, w.WriteField("branch", "alpha"))
+	require.NoError(t, w.WriteField("message", "initial commit"))
+	fw, err := w.CreateFormFile("file", "file.csv")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte("a,b\n1,q\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	req, err := http.NewRequest(http.MethodPost, uri+"/commits/", buf)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+s.s.AdminToken(t))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assertErrorCode(t, resp, http.StatusBadGateway, server.CodePreReceiveFailed)
+	assertRefEqual(t, rs, "heads/alpha", nil)
+}
+
+func (s *testSuite) TestPreReceiveRefMoved(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	db := s.s.GetDB(repo)
+	rs := s.s.GetRS(repo)
+	cs := s.s.GetConfS(repo)
+
+	// the hook moves alpha while it decides, as a concurrent request would
+	moves := make([][]byte, 3)
+	coms := make([]*objects.Commit, 3)
+	for i := range moves {
+		moves[i], coms[i] = factory.CommitRandom(t, db, nil)
+	}
+	var mutex sync.Mutex
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.NoError(t, ref.CommitHead(rs, "alpha", moves[0], coms[0], nil))
+		moves, coms = moves[1:], coms[1:]
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer hook.Close()
+	c := server_testutils.ReceivePackConfig(false, false)
+	c.Webhooks = append(c.Webhooks, conf.Webhook{
+		URL:        hook.URL,
+		EventTypes: []conf.WebhookEventType{webhook.PreReceiveEventType},
+	})
+	require.NoError(t, cs.Save(c))
+	currentHead := func() []byte {
+		t.Helper()
+		sum, err := ref.GetHead(rs, "alpha")
+		require.NoError(t, err)
+		return sum
+	}
+
+	_, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	assertHTTPError(t, err, http.StatusConflict, `branch "alpha" updated since commit started`)
+	head := currentHead()
+
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	_, err = cli.Commit("alpha", "second commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, &tid)
+	require.NoError(t, err)
+	_, err = cli.CommitTransaction(tid)
+	assertHTTPError(t, err, http.StatusConflict, `branch "alpha" updated since commit started`)
+	assert.NotEqual(t, head, currentHead())
+	head = currentHead()
+
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	sum, com := factory.CommitRandom(t, dbc, nil)
+	require.NoError(t, ref.CommitHead(rsc, "alpha", sum, com, nil))
+	remoteRefs, err := ref.ListAllRefs(rs)
+	require.NoError(t, err)
+	updates := server_testutils.PushObjects(t, dbc, rsc, cli, map[string]*payload.Update{
+		"refs/heads/alpha": {Sum: payload.BytesToHex(sum), OldSum: payload.BytesToHex(head)},
+	}, remoteRefs, 0)
+	assert.Equal(t, "remote ref updated since checkout", updates["refs/heads/alpha"].ErrMsg)
+	assert.NotEqual(t, head, currentHead())
+	assert.NotEqual(t, sum, currentHead())
+}
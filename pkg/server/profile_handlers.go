@@ -16,16 +16,17 @@ func (s *Server) handleGetCommitProfile(rw http.ResponseWriter, r *http.Request)
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
 	}
 	com, err := objects.GetCommit(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	prof, err := objects.GetTableProfile(db, com.Table)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	WriteJSON(rw, r, prof)
@@ -40,11 +41,12 @@ func (s *Server) handleGetTableProfile(rw http.ResponseWriter, r *http.Request)
 	}
 	sum, err := hex.DecodeString(m[1])
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, badRequest(CodeBadRequest, err))
+		return
 	}
 	prof, err := objects.GetTableProfile(db, sum)
 	if err != nil {
-		SendHTTPError(rw, r, http.StatusNotFound)
+		s.handleErr(rw, r, notFound(err))
 		return
 	}
 	WriteJSON(rw, r, prof)
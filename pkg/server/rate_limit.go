@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/audit"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+)
+
+// errTooManySessions is returned when a client already has the maximum number
+// of pack sessions allowed
+var errTooManySessions = errors.New("too many concurrent sessions")
+
+// routeClass returns the rate limit class of r
+func (s *Server) routeClass(r *http.Request) string {
+	p := r.URL.Path
+	if s.rootPath != nil {
+		p = "/" + strings.TrimPrefix(strings.TrimPrefix(p, s.rootPath.FindString(p)), "/")
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	switch {
+	case patUploadPack.MatchString(p):
+		return wrgldconf.RouteClassUploadPack
+	case patReceivePack.MatchString(p):
+		return wrgldconf.RouteClassReceivePack
+	case r.Method == http.MethodPost && p == "/commits/":
+		return wrgldconf.RouteClassCommit
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return wrgldconf.RouteClassRead
+	}
+	return wrgldconf.RouteClassWrite
+}
+
+// rateLimitClient identifies the client making r, preferring the subject of
+// its credential over its IP address
+func rateLimitClient(r *http.Request) string {
+	if sub := GetSubject(r); sub != "" {
+		return "sub:" + sub
+	}
+	return "ip:" + audit.ClientIP(r.RemoteAddr)
+}
+
+func (s *Server) rateLimiter(r *http.Request) *ratelimit.Limiter {
+	if s.getRateLimiter == nil {
+		return nil
+	}
+	return s.getRateLimiter(r)
+}
+
+func sendTooManyRequests(rw http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	SendError(rw, r, http.StatusTooManyRequests, message)
+}
+
+// rateLimit serves r with next unless the client has exceeded the rate or
+// concurrency limit of the route class. Concurrency of pack routes is
+// enforced per session instead, see exceedsSessionQuota.
+func (s *Server) rateLimit(rw http.ResponseWriter, r *http.Request, next http.Handler) {
+	l := s.rateLimiter(r)
+	if l == nil {
+		next.ServeHTTP(rw, r)
+		return
+	}
+	class := s.routeClass(r)
+	client := rateLimitClient(r)
+	if retryAfter, ok := l.Allow(class, client); !ok {
+		sendTooManyRequests(rw, r, retryAfter, "rate limit exceeded")
+		return
+	}
+	if class != wrgldconf.RouteClassUploadPack && class != wrgldconf.RouteClassReceivePack {
+		release, ok := l.Acquire(class, client)
+		if !ok {
+			sendTooManyRequests(rw, r, time.Second, "too many concurrent requests")
+			return
+		}
+		defer release()
+	}
+	next.ServeHTTP(rw, r)
+}
+
+// exceedsSessionQuota returns true if the client making r cannot start
+// another session of class. owners returns the owners of existing sessions.
+func (s *Server) exceedsSessionQuota(r *http.Request, class string, owners func() []string) bool {
+	l := s.rateLimiter(r)
+	if l == nil {
+		return false
+	}
+	max := l.MaxConcurrent(class)
+	if max <= 0 {
+		return false
+	}
+	client := rateLimitClient(r)
+	n := 0
+	for _, o := range owners() {
+		if o == client {
+			n++
+		}
+	}
+	return n >= max
+}
@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+)
+
+func (s *testSuite) TestRateLimit(t *testing.T) {
+	limiter := ratelimit.NewLimiter(&wrgldconf.RateLimits{
+		Classes: map[string]*wrgldconf.RateLimit{
+			wrgldconf.RouteClassRead:       {RequestsPerSecond: 0.01, Burst: 2},
+			wrgldconf.RouteClassUploadPack: {MaxConcurrent: 1},
+		},
+	})
+	srv := server_testutils.NewServer(t, nil, server.WithRateLimiter(func(r *http.Request) *ratelimit.Limiter {
+		return limiter
+	}))
+	defer srv.Close()
+	repo, uri, _, cleanup := srv.NewRemote(t, "")
+	defer cleanup()
+	db := srv.GetDB(repo)
+	rs := srv.GetRS(repo)
+	sum, com := factory.CommitRandom(t, db, nil)
+	require.NoError(t, ref.CommitHead(rs, "main", sum, com, nil))
+	adminTok := srv.AdminToken(t)
+	newClient := func(token string) *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(token))
+		require.NoError(t, err)
+		return cli
+	}
+
+	cli := newClient(adminTok)
+	for i := 0; i < 2; i++ {
+		_, err := cli.GetHead("main")
+		require.NoError(t, err)
+	}
+	req, err := http.NewRequest(http.MethodGet, uri+"/refs/heads/main/", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+adminTok)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "100", resp.Header.Get("Retry-After"))
+
+	// other clients have their own bucket
+	cli2 := newClient(srv.Authorize(t, "reader@test.com", "Reader", "read"))
+	_, err = cli2.GetHead("main")
+	require.NoError(t, err)
+
+	// writes are not throttled
+	_, err = cli.CreateTransaction(nil)
+	require.NoError(t, err)
+
+	// upload-pack session stays open while negotiating
+	_, _, err = cli.PostUploadPack(&payload.UploadPackRequest{
+		Wants: []*payload.Hex{payload.BytesToHex(sum)},
+		Haves: []*payload.Hex{payload.BytesToHex(testutils.SecureRandomBytes(16))},
+	})
+	require.NoError(t, err)
+	_, _, err = newClient(adminTok).PostUploadPack(&payload.UploadPackRequest{
+		Wants: []*payload.Hex{payload.BytesToHex(sum)},
+		Done:  true,
+	})
+	assertHTTPError(t, err, http.StatusTooManyRequests, "too many concurrent upload-pack sessions")
+
+	// another client can still open a session
+	_, _, err = cli2.PostUploadPack(&payload.UploadPackRequest{
+		Wants: []*payload.Hex{payload.BytesToHex(sum)},
+		Done:  true,
+	})
+	require.NoError(t, err)
+}
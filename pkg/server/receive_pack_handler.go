@@ -1,20 +1,42 @@
 package server
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/wrgl/wrgl/pkg/api"
 	apiutils "github.com/wrgl/wrgl/pkg/api/utils"
-	"github.com/wrgl/wrgld/pkg/webhook"
+	"github.com/wrgl/wrgld/pkg/audit"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
 )
 
+// ReceivePackSessionStore keeps sessions in between requests. Set and Get return
+// an error if sessions cannot be saved or read at the moment.
 type ReceivePackSessionStore interface {
-	Set(sid uuid.UUID, ses *ReceivePackSession)
-	Get(sid uuid.UUID) (ses *ReceivePackSession, ok bool)
+	Set(sid uuid.UUID, ses *ReceivePackSession) error
+	Get(sid uuid.UUID) (ses *ReceivePackSession, ok bool, err error)
 	Delete(sid uuid.UUID)
+	List() []uuid.UUID
 }
 
+// receivePackSessionOwners returns the owners of sessions. Sessions that cannot be
+// read are not counted.
+func receivePackSessionOwners(sessions ReceivePackSessionStore) []string {
+	sl := []string{}
+	for _, sid := range sessions.List() {
+		if ses, ok, err := sessions.Get(sid); err == nil && ok {
+			sl = append(sl, ses.owner)
+		}
+	}
+	return sl
+}
+
+// errCollectedDuringPush is answered when garbage collection ran in between
+// requests of a receive-pack session
+var errCollectedDuringPush = errors.New("garbage collection ran during the push, push again")
+
 func (s *Server) getReceivePackSession(r *http.Request, sessions ReceivePackSessionStore) (ses *ReceivePackSession, sid uuid.UUID, err error) {
 	var ok bool
 	c, err := r.Cookie(api.CookieReceivePackSession)
@@ -23,33 +45,97 @@ func (s *Server) getReceivePackSession(r *http.Request, sessions ReceivePackSess
 		if err != nil {
 			return
 		}
-		ses, ok = sessions.Get(sid)
+		ses, ok, err = sessions.Get(sid)
+		if err != nil {
+			err = sessionStoreError(err)
+			return
+		}
 		if !ok {
 			ses = nil
+		} else if ses.saved != nil {
+			c := s.getConfig(r)
+			ses.resume(s.getDB(r), s.getRS(r), &c, s.webhookSender(r), s.logger.V(1), s.receiverOptions()...)
+			s.attachReceivePackSession(r, ses)
 		}
 	}
 	if ses == nil {
+		if s.Draining() {
+			err = errDraining
+			return
+		}
 		sid, err = uuid.NewRandom()
 		if err != nil {
 			return
 		}
+		if s.exceedsSessionQuota(r, wrgldconf.RouteClassReceivePack, func() []string {
+			return receivePackSessionOwners(sessions)
+		}) {
+			err = errTooManySessions
+			return
+		}
 		db := s.getDB(r)
 		rs := s.getRS(r)
 		c := s.getConfig(r)
-		ws := webhook.NewSenderWithConfig(c, s.logger, s.webhookSenderOpts...)
-		opts := make([]apiutils.ObjectReceiveOption, len(s.receiverOpts))
-		copy(opts, s.receiverOpts)
-		ses = NewReceivePackSession(db, rs, &c, sid, ws, s.logger.V(1), opts...)
-		sessions.Set(sid, ses)
+		ws := s.webhookSender(r)
+		ses = NewReceivePackSession(db, rs, &c, sid, ws, s.logger.V(1), s.receiverOptions()...)
+		s.attachReceivePackSession(r, ses)
+		ses.owner = rateLimitClient(r)
+		if err = sessions.Set(sid, ses); err != nil {
+			err = sessionStoreError(err)
+			return
+		}
 	}
 	return
 }
 
+func (s *Server) receiverOptions() []apiutils.ObjectReceiveOption {
+	opts := make([]apiutils.ObjectReceiveOption, len(s.receiverOpts))
+	copy(opts, s.receiverOpts)
+	return opts
+}
+
+// attachReceivePackSession gives ses the policies of the server, which are not
+// part of the saved state of a session
+func (s *Server) attachReceivePackSession(r *http.Request, ses *ReceivePackSession) {
+	ses.refUpdateDenial = func(refname string) string {
+		return s.refUpdateDenial(r, refname, false)
+	}
+	ses.recordAudit = func(r *http.Request, updates []proposedUpdate) {
+		s.recordAudit(r, &audit.Record{
+			Action: audit.ActionReceivePack,
+			Refs:   auditRefUpdates(updates),
+		})
+	}
+	ses.limits = s.ingestLimits(r)
+	ses.handleErr = s.handleErr
+}
+
 func (s *Server) handleReceivePack(rw http.ResponseWriter, r *http.Request) {
+	defer s.trackPackRequest()()
+	release, ok := s.holdOffGC(rw, r)
+	if !ok {
+		return
+	}
+	defer release()
 	sessions := s.getRPSession(r)
 	ses, sid, err := s.getReceivePackSession(r, sessions)
+	if err == errDraining {
+		sendDraining(rw, r)
+		return
+	}
+	if err == errTooManySessions {
+		sendTooManyRequests(rw, r, time.Second, "too many concurrent receive-pack sessions")
+		return
+	}
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
+	}
+	if runner := s.gcRunner(r); runner != nil && runner.CollectedSince(ses.createdAt) {
+		// objects received in earlier requests may have been removed
+		sessions.Delete(sid)
+		sendGCInProgress(rw, r, errCollectedDuringPush.Error())
+		return
 	}
 	defer func() {
 		if s := recover(); s != nil {
@@ -59,5 +145,11 @@ func (s *Server) handleReceivePack(rw http.ResponseWriter, r *http.Request) {
 	}()
 	if done := ses.ServeHTTP(rw, r); done {
 		sessions.Delete(sid)
+	} else if err = sessions.Set(sid, ses); err != nil {
+		// stores that persist sessions save the new state. The response is
+		// already sent, so the session is dropped for the next request to
+		// fail rather than resume from an outdated state.
+		s.logErr(r, sessionStoreError(err), false)
+		sessions.Delete(sid)
 	}
 }
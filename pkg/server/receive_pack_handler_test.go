@@ -162,6 +162,7 @@ func (s *testSuite) TestReceivePackHandler(t *testing.T) {
 		assert.Equal(t, obj.Action, e.Action, "event #%d", i)
 		assert.Equal(t, obj.Message, e.Message, "event #%d", i)
 		assert.NotEmpty(t, obj.Time, "event #%d", i)
+		assert.NotEmpty(t, obj.ID, "event #%d", i)
 	}
 
 	// delete only
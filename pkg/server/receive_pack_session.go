@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/hex"
-	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -19,31 +20,61 @@ import (
 	"github.com/wrgl/wrgl/pkg/encoding/packfile"
 	"github.com/wrgl/wrgl/pkg/objects"
 	"github.com/wrgl/wrgl/pkg/ref"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
 	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
+// steps of a receive-pack session, saved in place of its state function
+const (
+	rpStepGreet          = "greet"
+	rpStepNegotiate      = "negotiate"
+	rpStepReceiveObjects = "receive_objects"
+)
+
 type ReceivePackSession struct {
 	db           objects.Store
 	rs           ref.Store
 	c            *conf.Config
 	updates      map[string]*payload.Update
 	state        stateFn
+	step         string
 	receiver     *apiutils.ObjectReceiver
 	id           uuid.UUID
 	receiverOpts []apiutils.ObjectReceiveOption
 	ws           *webhook.Sender
 	logger       logr.Logger
+	createdAt    time.Time
+
+	// commits are the commits that the receiver expects
+	commits [][]byte
+
+	// owner identifies the client that started the session
+	owner string
+
+	// saved is the state that a loaded session is resumed from
+	saved *ReceivePackState
+
+	// limits cap the objects received in this session
+	limits        *wrgldconf.IngestLimits
+	pushedObjects int
+	pushedBytes   int64
+
+	// refUpdateDenial returns the reason why a ref cannot be updated, or an
+	// empty string if it can
+	refUpdateDenial func(refname string) string
+
+	// recordAudit is called with ref updates once they are saved
+	recordAudit func(r *http.Request, updates []proposedUpdate)
+
+	// handleErr answers errors that end the session
+	handleErr func(rw http.ResponseWriter, r *http.Request, err error)
 }
 
 func parseReceivePackRequest(r *http.Request) (req *payload.ReceivePackRequest, err error) {
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		return
-	}
 	defer r.Body.Close()
 	req = &payload.ReceivePackRequest{}
-	if err = json.Unmarshal(b, req); err != nil {
-		return
+	if err = decodeJSON(r, req); err != nil {
+		return nil, err
 	}
 	return req, nil
 }
@@ -56,12 +87,28 @@ func NewReceivePackSession(db objects.Store, rs ref.Store, c *conf.Config, id uu
 		id:           id,
 		ws:           ws,
 		receiverOpts: receiverOpts,
+		createdAt:    time.Now(),
 		logger:       logger.WithName("ReceivePackSession").WithValues("session_id", id.String()),
 	}
-	s.state = s.greet
+	s.state = s.next(rpStepGreet)
 	return s
 }
 
+// next records step as the step of the next request and returns its state
+// function
+func (s *ReceivePackSession) next(step string) stateFn {
+	s.step = step
+	switch step {
+	case rpStepGreet:
+		return s.greet
+	case rpStepNegotiate:
+		return s.negotiate
+	case rpStepReceiveObjects:
+		return s.receiveObjects
+	}
+	return nil
+}
+
 func (s *ReceivePackSession) respondWithTableACKs(rw http.ResponseWriter, r *http.Request, acks [][]byte) {
 	rw.Header().Set("Content-Type", api.CTJSON)
 	http.SetCookie(rw, &http.Cookie{
@@ -71,76 +118,126 @@ func (s *ReceivePackSession) respondWithTableACKs(rw http.ResponseWriter, r *htt
 		HttpOnly: true,
 		MaxAge:   3600 * 3,
 	})
-	resp := &payload.ReceivePackResponse{
+	WriteJSON(rw, r, &payload.ReceivePackResponse{
 		TableACKs: payload.BytesSliceToHexSlice(acks),
+	})
+}
+
+// fail answers r with err and ends the session
+func (s *ReceivePackSession) fail(rw http.ResponseWriter, r *http.Request, err error) (nextState stateFn) {
+	if s.handleErr != nil {
+		s.handleErr(rw, r, err)
+	} else {
+		sendErr(rw, r, err)
 	}
-	b, err := json.Marshal(resp)
-	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
-	}
+	return nil
 }
 
-func (s *ReceivePackSession) saveRefs() error {
+// saveRefs applies ref updates that can be made and sets the reason of the
+// others. Webhook payloads are saved before it returns, and it returns an
+// error if they could not be.
+func (s *ReceivePackSession) saveRefs(r *http.Request) (err error) {
 	if s.ws != nil {
-		defer s.ws.Flush()
+		defer func() {
+			if ferr := s.ws.Flush(); ferr != nil && err == nil {
+				err = fmt.Errorf("error saving webhook payloads: %w", ferr)
+			}
+		}()
 	}
+	updates := []proposedUpdate{}
+	dsts := map[string]string{}
 	for dst, u := range s.updates {
 		oldSum, _ := ref.GetRef(s.rs, strings.TrimPrefix(dst, "refs/"))
 		if (u.OldSum == nil && oldSum != nil) || (u.OldSum != nil && !bytes.Equal(oldSum, (*u.OldSum)[:])) {
 			u.ErrMsg = "remote ref updated since checkout"
 			continue
 		}
-		var sum []byte
 		refname := strings.TrimPrefix(dst, "refs/")
+		dsts[refname] = dst
 		if u.Sum == nil {
 			if s.c.Receive != nil && *s.c.Receive.DenyDeletes {
 				u.ErrMsg = "remote does not support deleting refs"
-			} else {
-				err := ref.DeleteRef(s.rs, refname)
-				if err != nil {
-					return err
-				}
-				if s.ws != nil {
-					evt := &webhook.RefUpdateEvent{
-						Ref: refname,
-					}
-					if oldSum != nil {
-						evt.OldSum = hex.EncodeToString(oldSum)
-					}
-					s.ws.EnqueueEvent(evt)
-				}
+				continue
 			}
+			updates = append(updates, proposedUpdate{Ref: refname, OldSum: oldSum})
 			continue
-		} else {
-			sum = (*u.Sum)[:]
-			if !objects.CommitExist(s.db, sum) {
-				u.ErrMsg = "remote did not receive commit"
+		}
+		sum := (*u.Sum)[:]
+		if !objects.CommitExist(s.db, sum) {
+			u.ErrMsg = "remote did not receive commit"
+			continue
+		}
+		if oldSum != nil && s.c.Receive != nil && *s.c.Receive.DenyNonFastForwards {
+			fastForward, err := ref.IsAncestorOf(s.db, oldSum, sum)
+			if err != nil {
+				return err
+			} else if !fastForward {
+				u.ErrMsg = "remote does not support non-fast-fowards"
 				continue
 			}
 		}
-		var msg string
-		if oldSum != nil {
-			if s.c.Receive != nil && *s.c.Receive.DenyNonFastForwards {
-				fastForward, err := ref.IsAncestorOf(s.db, oldSum, sum)
-				if err != nil {
-					return err
-				} else if !fastForward {
-					u.ErrMsg = "remote does not support non-fast-fowards"
-					continue
+		updates = append(updates, proposedUpdate{Ref: refname, OldSum: oldSum, Sum: sum})
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Ref < updates[j].Ref
+	})
+	if len(updates) > 0 {
+		evt := &webhook.PreReceiveEvent{Action: "receive-pack"}
+		if s.c.User != nil {
+			evt.AuthorName = s.c.User.Name
+			evt.AuthorEmail = s.c.User.Email
+		}
+		if err := preReceive(r.Context(), s.db, s.ws, evt, updates, s.logger); err != nil {
+			if v, ok := err.(*webhook.PreReceiveError); ok {
+				for _, pu := range updates {
+					s.updates[dsts[pu.Ref]].ErrMsg = v.Error()
 				}
+				return nil
 			}
+			return err
+		}
+	}
+	n := 0
+	for _, pu := range updates {
+		moved, err := refMoved(s.rs, pu)
+		if err != nil {
+			return err
+		}
+		if moved {
+			s.updates[dsts[pu.Ref]].ErrMsg = "remote ref updated since checkout"
+			continue
+		}
+		updates[n] = pu
+		n++
+	}
+	updates = updates[:n]
+	for _, pu := range updates {
+		if pu.Sum == nil {
+			if err := ref.DeleteRef(s.rs, pu.Ref); err != nil {
+				return err
+			}
+			if s.ws != nil {
+				evt := &webhook.RefUpdateEvent{
+					Ref: pu.Ref,
+				}
+				if pu.OldSum != nil {
+					evt.OldSum = hex.EncodeToString(pu.OldSum)
+				}
+				s.ws.EnqueueEvent(evt)
+				s.enqueueBranchEvent(webhook.BranchDeletedEventType, pu.Ref, pu.OldSum)
+			}
+			continue
+		}
+		var msg string
+		if pu.OldSum != nil {
 			msg = "update ref"
 		} else {
 			msg = "create ref"
 		}
 		err := ref.SaveRef(
 			s.rs,
-			refname,
-			sum,
+			pu.Ref,
+			pu.Sum,
 			s.c.User.Name,
 			s.c.User.Email,
 			"receive-pack",
@@ -151,22 +248,46 @@ func (s *ReceivePackSession) saveRefs() error {
 		}
 		if s.ws != nil {
 			evt := &webhook.RefUpdateEvent{
-				Ref:     refname,
-				Sum:     hex.EncodeToString(sum),
+				Ref:     pu.Ref,
+				Sum:     hex.EncodeToString(pu.Sum),
 				Action:  "receive-pack",
 				Message: msg,
 			}
-			if oldSum != nil {
-				evt.OldSum = hex.EncodeToString(oldSum)
+			if pu.OldSum != nil {
+				evt.OldSum = hex.EncodeToString(pu.OldSum)
+			} else {
+				s.enqueueBranchEvent(webhook.BranchCreatedEventType, pu.Ref, pu.Sum)
 			}
 			s.ws.EnqueueEvent(evt)
 		}
 	}
+	if s.recordAudit != nil && len(updates) > 0 {
+		s.recordAudit(r, updates)
+	}
 	return nil
 }
 
+// enqueueBranchEvent enqueues a branch event if refname is a branch
+func (s *ReceivePackSession) enqueueBranchEvent(et conf.WebhookEventType, refname string, sum []byte) {
+	if !strings.HasPrefix(refname, "heads/") {
+		return
+	}
+	evt := &webhook.BranchEvent{
+		Type:   et,
+		Ref:    refname,
+		Sum:    hex.EncodeToString(sum),
+		Action: "receive-pack",
+	}
+	if s.c.User != nil {
+		evt.AuthorName = s.c.User.Name
+		evt.AuthorEmail = s.c.User.Email
+	}
+	s.ws.EnqueueEvent(evt)
+}
+
 func (s *ReceivePackSession) greet(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
-	defer s.logDuration("greet")()
+	r, end := s.startState(r, "greet")
+	defer end()
 	var err error
 	if v := r.Header.Get("Content-Type"); !strings.Contains(v, api.CTJSON) {
 		SendError(rw, r, http.StatusBadRequest, "updates expected")
@@ -174,9 +295,23 @@ func (s *ReceivePackSession) greet(rw http.ResponseWriter, r *http.Request) (nex
 	}
 	req, err := parseReceivePackRequest(r)
 	if err != nil {
-		return
+		sendErr(rw, r, err)
+		return nil
 	}
 	s.updates = req.Updates
+	if s.refUpdateDenial != nil {
+		dsts := make([]string, 0, len(s.updates))
+		for dst := range s.updates {
+			dsts = append(dsts, dst)
+		}
+		sort.Strings(dsts)
+		for _, dst := range dsts {
+			if msg := s.refUpdateDenial(strings.TrimPrefix(dst, "refs/")); msg != "" {
+				SendError(rw, r, http.StatusForbidden, msg)
+				return nil
+			}
+		}
+	}
 	commits := [][]byte{}
 	outdated := false
 	for dst, u := range s.updates {
@@ -196,13 +331,13 @@ func (s *ReceivePackSession) greet(rw http.ResponseWriter, r *http.Request) (nex
 		return s.reportStatus(rw, r)
 	}
 	if len(commits) > 0 {
+		s.commits = commits
 		s.receiver = apiutils.NewObjectReceiver(s.db, commits, s.logger.V(1), s.receiverOpts...)
 		s.respondWithTableACKs(rw, r, s.negotiateTables(req))
-		return s.negotiate
+		return s.next(rpStepNegotiate)
 	}
-	err = s.saveRefs()
-	if err != nil {
-		panic(err)
+	if err = s.saveRefs(r); err != nil {
+		return s.fail(rw, r, err)
 	}
 	return s.reportStatus(rw, r)
 }
@@ -218,44 +353,58 @@ func (s *ReceivePackSession) negotiateTables(req *payload.ReceivePackRequest) (a
 }
 
 func (s *ReceivePackSession) negotiate(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
-	defer s.logDuration("negotiate")()
+	r, end := s.startState(r, "negotiate")
+	defer end()
 	ct := r.Header.Get("Content-Type")
 	if ct == api.CTPackfile {
 		return s.receiveObjects(rw, r)
 	} else if strings.Contains(ct, api.CTJSON) {
 		req, err := parseReceivePackRequest(r)
 		if err != nil {
-			return
+			sendErr(rw, r, err)
+			return nil
 		}
 		s.respondWithTableACKs(rw, r, s.negotiateTables(req))
-		return s.negotiate
+		return s.next(rpStepNegotiate)
 	} else {
-		SendError(rw, r, http.StatusBadRequest, "unanticipated content-type")
+		SendError(rw, r, http.StatusUnsupportedMediaType, "unanticipated content-type")
 		return nil
 	}
 }
 
 func (s *ReceivePackSession) receiveObjects(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
-	defer s.logDuration("receive objects")()
+	r, end := s.startState(r, "receive objects")
+	defer end()
 	if v := r.Header.Get("Content-Type"); v != api.CTPackfile {
-		SendError(rw, r, http.StatusBadRequest, "packfile expected")
+		SendError(rw, r, http.StatusUnsupportedMediaType, "packfile expected")
 		return nil
 	}
 	body := r.Body
 	if r.Header.Get("Content-Encoding") == "gzip" {
 		gr, err := gzip.NewReader(r.Body)
 		if err != nil {
-			panic(err)
+			sendErr(rw, r, badRequest(CodeInvalidPackfile, err))
+			return nil
 		}
 		body = io.NopCloser(gr)
 	}
+	if s.limits != nil {
+		body = io.NopCloser(newPackLimitReader(body, s.limits, s))
+	}
 	pr, err := packfile.NewPackfileReader(body)
 	if err != nil {
-		panic(err)
+		if sendIngestLimitError(rw, r, err) {
+			return nil
+		}
+		sendErr(rw, r, badRequest(CodeInvalidPackfile, err))
+		return nil
 	}
 	done, err := s.receiver.Receive(pr, nil)
 	if err != nil {
-		panic(err)
+		if sendIngestLimitError(rw, r, err) {
+			return nil
+		}
+		return s.fail(rw, r, err)
 	}
 	if !done {
 		http.SetCookie(rw, &http.Cookie{
@@ -266,17 +415,17 @@ func (s *ReceivePackSession) receiveObjects(rw http.ResponseWriter, r *http.Requ
 			MaxAge:   3600 * 3,
 		})
 		rw.WriteHeader(http.StatusOK)
-		return s.receiveObjects
+		return s.next(rpStepReceiveObjects)
 	}
-	err = s.saveRefs()
-	if err != nil {
-		panic(err)
+	if err = s.saveRefs(r); err != nil {
+		return s.fail(rw, r, err)
 	}
 	return s.reportStatus(rw, r)
 }
 
 func (s *ReceivePackSession) reportStatus(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
-	defer s.logDuration("report status")()
+	r, end := s.startState(r, "report status")
+	defer end()
 	rw.Header().Set("Content-Type", api.CTJSON)
 	// remove cookie
 	http.SetCookie(rw, &http.Cookie{
@@ -286,20 +435,23 @@ func (s *ReceivePackSession) reportStatus(rw http.ResponseWriter, r *http.Reques
 		HttpOnly: true,
 		Expires:  time.Now().Add(time.Hour * -24),
 	})
-	resp := &payload.ReceivePackResponse{
+	WriteJSON(rw, r, &payload.ReceivePackResponse{
 		Updates: s.updates,
-	}
-	b, err := json.Marshal(resp)
-	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
-	}
+	})
 	return nil
 }
 
+// startState traces a state of the session in a span. The returned function
+// ends the span and logs the duration of the state.
+func (s *ReceivePackSession) startState(r *http.Request, name string) (*http.Request, func()) {
+	r, span := startSpan(r, "receive-pack "+name, sessionIDKey.String(s.id.String()))
+	logDuration := s.logDuration(name)
+	return r, func() {
+		span.End()
+		logDuration()
+	}
+}
+
 func (s *ReceivePackSession) logDuration(msg string) func() {
 	start := time.Now()
 	return func() {
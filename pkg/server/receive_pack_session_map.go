@@ -24,21 +24,34 @@ func NewReceivePackSessionMap(idle, ttl time.Duration) *ReceivePackSessionMap {
 	return m
 }
 
-func (m *ReceivePackSessionMap) Set(sid uuid.UUID, ses *ReceivePackSession) {
-	m.m.Add(sid.String(), ses, m.ttl)
+// Set adds a session, or replaces it without extending its TTL
+func (m *ReceivePackSessionMap) Set(sid uuid.UUID, ses *ReceivePackSession) error {
+	if !m.m.Replace(sid.String(), ses) {
+		m.m.Add(sid.String(), ses, m.ttl)
+	}
+	return nil
 }
 
-func (m *ReceivePackSessionMap) Get(sid uuid.UUID) (ses *ReceivePackSession, ok bool) {
+func (m *ReceivePackSessionMap) Get(sid uuid.UUID) (ses *ReceivePackSession, ok bool, err error) {
 	if v := m.m.Get(sid.String()); v != nil {
-		return v.(*ReceivePackSession), true
+		return v.(*ReceivePackSession), true, nil
 	}
-	return nil, false
+	return nil, false, nil
 }
 
 func (m *ReceivePackSessionMap) Delete(sid uuid.UUID) {
 	m.m.Pop(sid.String())
 }
 
+func (m *ReceivePackSessionMap) List() []uuid.UUID {
+	keys := m.m.Keys()
+	sl := make([]uuid.UUID, 0, len(keys))
+	for _, k := range keys {
+		sl = append(sl, uuid.MustParse(k))
+	}
+	return sl
+}
+
 func (m *ReceivePackSessionMap) Stop() {
 	m.m.Stop()
 }
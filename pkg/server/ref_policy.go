@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+type principalsKey struct{}
+
+// SetPrincipals stores the names the caller is known by, such as username,
+// email, roles and groups. They are matched against owners of ref policies.
+func SetPrincipals(r *http.Request, principals []string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalsKey{}, principals))
+}
+
+func GetPrincipals(r *http.Request) []string {
+	if i := r.Context().Value(principalsKey{}); i != nil {
+		return i.([]string)
+	}
+	return nil
+}
+
+// refUpdateDenial returns the reason why the caller cannot update refname, or
+// an empty string if the update is allowed. viaTransaction is true if the ref
+// is updated by committing a transaction.
+func (s *Server) refUpdateDenial(r *http.Request, refname string, viaTransaction bool) string {
+	if s.getRefPolicies == nil {
+		return ""
+	}
+	for _, p := range s.getRefPolicies(r) {
+		if !p.MatchRef(refname) {
+			continue
+		}
+		if p.ReadOnly {
+			return fmt.Sprintf("ref %q is read-only", refname)
+		}
+		if p.TransactionOnly && !viaTransaction {
+			return fmt.Sprintf("ref %q can only be updated by committing a transaction", refname)
+		}
+		if len(p.Owners) > 0 && !isOwner(&p, GetPrincipals(r)) {
+			return fmt.Sprintf("not allowed to update ref %q", refname)
+		}
+		return ""
+	}
+	return ""
+}
+
+func isOwner(p *wrgldconf.RefPolicy, principals []string) bool {
+	for _, o := range p.Owners {
+		for _, v := range principals {
+			if o == v {
+				return true
+			}
+		}
+	}
+	return false
+}
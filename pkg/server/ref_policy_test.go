@@ -0,0 +1,103 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/factory"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/pbar"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+func (s *testSuite) TestRefPolicies(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	s.s.SetRefPolicies(repo, []wrgldconf.RefPolicy{
+		{Refs: []string{"heads/frozen"}, ReadOnly: true},
+		{Refs: []string{"heads/release-*"}, TransactionOnly: true},
+		{Refs: []string{"heads/main", "heads/frozen"}, Owners: []string{"lead@domain.com"}},
+	})
+	newClient := func(email string) *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(
+			s.s.Authorize(t, email, "Someone", "read", "write"),
+		))
+		require.NoError(t, err)
+		return cli
+	}
+	cli := newClient("dev@domain.com")
+	lead := newClient("lead@domain.com")
+	rs := s.s.GetRS(repo)
+	csv := func() io.Reader {
+		return testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4))
+	}
+
+	_, err := cli.Commit("alpha", "initial commit", "file.csv", csv(), nil, nil)
+	require.NoError(t, err)
+
+	// only the first matching policy applies
+	_, err = lead.Commit("frozen", "initial commit", "file.csv", csv(), nil, nil)
+	assertHTTPError(t, err, http.StatusForbidden, `ref "heads/frozen" is read-only`)
+
+	_, err = cli.Commit("main", "initial commit", "file.csv", csv(), nil, nil)
+	assertHTTPError(t, err, http.StatusForbidden, `not allowed to update ref "heads/main"`)
+	cr, err := lead.Commit("main", "initial commit", "file.csv", csv(), nil, nil)
+	require.NoError(t, err)
+	assertRefEqual(t, rs, "heads/main", (*cr.Sum)[:])
+
+	_, err = cli.Commit("release-1", "initial commit", "file.csv", csv(), nil, nil)
+	assertHTTPError(t, err, http.StatusForbidden, `ref "heads/release-1" can only be updated by committing a transaction`)
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err := uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	_, err = cli.Commit("release-1", "initial commit", "file.csv", csv(), nil, &tid)
+	require.NoError(t, err)
+	_, err = cli.CommitTransaction(tid)
+	require.NoError(t, err)
+	_, err = ref.GetHead(rs, "release-1")
+	require.NoError(t, err)
+
+	// transactions are checked again on commit since policies may have changed
+	ctr, err = cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	tid, err = uuid.Parse(ctr.ID)
+	require.NoError(t, err)
+	_, err = cli.Commit("release-2", "initial commit", "file.csv", csv(), nil, &tid)
+	require.NoError(t, err)
+	s.s.SetRefPolicies(repo, []wrgldconf.RefPolicy{
+		{Refs: []string{"heads/release-*"}, ReadOnly: true},
+	})
+	_, err = cli.CommitTransaction(tid)
+	assertHTTPError(t, err, http.StatusForbidden, `ref "heads/release-2" is read-only`)
+	assertRefEqual(t, rs, "heads/release-2", nil)
+
+	// pushes are rejected before any object is sent
+	db := s.s.GetDB(repo)
+	remoteRefs, err := ref.ListAllRefs(rs)
+	require.NoError(t, err)
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	sum1, err := ref.GetHead(rs, "release-1")
+	require.NoError(t, err)
+	factory.CopyCommitsToNewStore(t, db, dbc, [][]byte{sum1})
+	sum2, c2 := factory.CommitRandom(t, dbc, [][]byte{sum1})
+	require.NoError(t, ref.CommitHead(rsc, "release-1", sum2, c2, nil))
+	ses, err := apiclient.NewReceivePackSession(dbc, rsc, cli, map[string]*payload.Update{
+		"refs/heads/release-1": {OldSum: payload.BytesToHex(sum1), Sum: payload.BytesToHex(sum2)},
+	}, remoteRefs, 0)
+	require.NoError(t, err)
+	_, err = ses.Start(pbar.NewContainer(io.Discard, true))
+	assertHTTPError(t, err, http.StatusForbidden, `ref "heads/release-1" is read-only`)
+	assertRefEqual(t, rs, "heads/release-1", sum1)
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the ID of a request. An ID given by the client is
+// kept if it is valid, otherwise one is generated. Either way it is sent back
+// in the response.
+const RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestInfoKey struct{}
+
+// RequestInfo collects details about a request from the middlewares and
+// handlers it goes through, so that they can be logged once it is served
+type RequestInfo struct {
+	// ID identifies the request in logs and error payloads
+	ID string
+
+	// Route is the template of the route that served the request, such as
+	// "/commits/{sum}/profile/", or an empty string if no route matched
+	Route string
+
+	// Subject identifies the credential of the request, see SetSubject
+	Subject string
+}
+
+// WithRequestInfo returns r with a RequestInfo attached if it does not
+// already have one
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if v := GetRequestInfo(r); v != nil {
+		return r, v
+	}
+	v := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, v)), v
+}
+
+// GetRequestInfo returns the RequestInfo attached to r, if any
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	if v, ok := r.Context().Value(requestInfoKey{}).(*RequestInfo); ok {
+		return v
+	}
+	return nil
+}
+
+// RequestID returns the ID assigned to r, or an empty string if none was
+func RequestID(r *http.Request) string {
+	if v := GetRequestInfo(r); v != nil {
+		return v.ID
+	}
+	return ""
+}
+
+func assignRequestID(rw http.ResponseWriter, r *http.Request, info *RequestInfo) {
+	if info.ID != "" {
+		return
+	}
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		info.ID = id
+	} else {
+		info.ID = uuid.New().String()
+	}
+	rw.Header().Set(RequestIDHeader, info.ID)
+}
+
+// RequestIDMiddleware assigns an ID to each request, reusing the one in
+// RequestIDHeader if valid, and echoes it in the response header. Server does
+// the same, this middleware only lets outer middlewares see the ID.
+func RequestIDMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r, info := WithRequestInfo(r)
+		assignRequestID(rw, r, info)
+		handler.ServeHTTP(rw, r)
+	})
+}
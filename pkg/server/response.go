@@ -9,34 +9,55 @@ import (
 	"github.com/wrgl/wrgl/pkg/api/payload"
 )
 
+// WriteJSON answers r with v encoded as JSON
 func WriteJSON(rw http.ResponseWriter, r *http.Request, v interface{}) {
-	setResponseInfo(r, v)
-	rw.Header().Set("Content-Type", api.CTJSON)
 	b, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
+		sendErr(rw, r, err)
+		return
 	}
+	setResponseInfo(r, v)
+	rw.Header().Set("Content-Type", api.CTJSON)
+	// write errors mean that the client went away
+	_, _ = rw.Write(b)
 }
 
-func SendError(rw http.ResponseWriter, r *http.Request, code int, message string) {
-	rw.Header().Set("Content-Type", api.CTJSON)
-	rw.WriteHeader(code)
-	errPayload := &payload.Error{
-		Message: message,
-	}
+// errorPayload extends payload.Error with a stable error code and the ID of
+// the request, which clients can quote when reporting a problem
+type errorPayload struct {
+	payload.Error
+	Code      ErrorCode `json:"code,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+}
+
+func writeErrorPayload(rw http.ResponseWriter, r *http.Request, status int, errPayload *errorPayload) {
+	errPayload.RequestID = RequestID(r)
 	setResponseInfo(r, errPayload)
-	b, err := json.Marshal(errPayload)
-	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
+	// error payloads only hold strings and numbers, they always encode
+	b, _ := json.Marshal(errPayload)
+	rw.Header().Set("Content-Type", api.CTJSON)
+	rw.WriteHeader(status)
+	_, _ = rw.Write(b)
+}
+
+// SendError answers r with an error payload. The error code is derived from
+// status.
+func SendError(rw http.ResponseWriter, r *http.Request, code int, message string) {
+	sendErrorCode(rw, r, code, "", message)
+}
+
+// sendErrorCode answers r with an error payload holding code, which defaults
+// to the code of status if empty
+func sendErrorCode(rw http.ResponseWriter, r *http.Request, status int, code ErrorCode, message string) {
+	if code == "" {
+		code = codeForStatus(status)
 	}
+	writeErrorPayload(rw, r, status, &errorPayload{
+		Error: payload.Error{
+			Message: message,
+		},
+		Code: code,
+	})
 }
 
 func SendHTTPError(rw http.ResponseWriter, r *http.Request, code int) {
@@ -44,23 +65,15 @@ func SendHTTPError(rw http.ResponseWriter, r *http.Request, code int) {
 }
 
 func sendCSVError(rw http.ResponseWriter, r *http.Request, obj *csv.ParseError) {
-	rw.Header().Set("Content-Type", api.CTJSON)
-	rw.WriteHeader(http.StatusBadRequest)
-	errPayload := &payload.Error{
-		Message: obj.Err.Error(),
-		CSV: &payload.CSVLocation{
-			StartLine: obj.StartLine,
-			Line:      obj.Line,
-			Column:    obj.Column,
+	writeErrorPayload(rw, r, http.StatusBadRequest, &errorPayload{
+		Error: payload.Error{
+			Message: obj.Err.Error(),
+			CSV: &payload.CSVLocation{
+				StartLine: obj.StartLine,
+				Line:      obj.Line,
+				Column:    obj.Column,
+			},
 		},
-	}
-	setResponseInfo(r, errPayload)
-	b, err := json.Marshal(errPayload)
-	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
-	}
+		Code: CodeInvalidCSV,
+	})
 }
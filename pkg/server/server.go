@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -15,6 +16,12 @@ import (
 	"github.com/wrgl/wrgl/pkg/ref"
 	"github.com/wrgl/wrgl/pkg/router"
 	"github.com/wrgl/wrgl/pkg/sorter"
+	"github.com/wrgl/wrgld/pkg/audit"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/eventstream"
+	"github.com/wrgl/wrgld/pkg/gc"
+	"github.com/wrgl/wrgld/pkg/ratelimit"
+	"github.com/wrgl/wrgld/pkg/tokens"
 	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
@@ -36,6 +43,17 @@ var (
 	patTransactions *regexp.Regexp
 	patUUID         *regexp.Regexp
 	patGC           *regexp.Regexp
+	patJobs         *regexp.Regexp
+	patWebhooks     *regexp.Regexp
+	patDeliveries   *regexp.Regexp
+	patRedeliver    *regexp.Regexp
+	patPing         *regexp.Regexp
+	patEvents       *regexp.Regexp
+	patChanges      *regexp.Regexp
+	patTokens       *regexp.Regexp
+	patSessions     *regexp.Regexp
+	patConfig       *regexp.Regexp
+	patAudit        *regexp.Regexp
 )
 
 func init() {
@@ -56,6 +74,17 @@ func init() {
 	patTransactions = regexp.MustCompile(`^/transactions/`)
 	patUUID = regexp.MustCompile(`^[0-9a-f-]+/`)
 	patGC = regexp.MustCompile(`^/gc/`)
+	patJobs = regexp.MustCompile(`^jobs/`)
+	patWebhooks = regexp.MustCompile(`^/webhooks/`)
+	patDeliveries = regexp.MustCompile(`^deliveries/`)
+	patRedeliver = regexp.MustCompile(`^redeliver/`)
+	patPing = regexp.MustCompile(`^ping/`)
+	patEvents = regexp.MustCompile(`^/events/`)
+	patChanges = regexp.MustCompile(`^/changes/`)
+	patTokens = regexp.MustCompile(`^/tokens/`)
+	patSessions = regexp.MustCompile(`^/sessions/`)
+	patConfig = regexp.MustCompile(`^/config/`)
+	patAudit = regexp.MustCompile(`^/audit/`)
 }
 
 type ServerOption func(s *Server)
@@ -78,6 +107,65 @@ func WithWebhookSenderOptions(opts ...webhook.SenderOption) ServerOption {
 	}
 }
 
+// WithTokenStore enables the /tokens endpoints that manage personal access
+// tokens and service-account tokens
+func WithTokenStore(getTokenStore func(r *http.Request) *tokens.Store) ServerOption {
+	return func(s *Server) {
+		s.getTokenStoreFn = getTokenStore
+	}
+}
+
+// WithEventLog makes events available to the /events endpoint. getEventLog
+// returns the log of the repository targeted by a request.
+func WithEventLog(getEventLog func(r *http.Request) *eventstream.Log) ServerOption {
+	return func(s *Server) {
+		s.getEventLog = getEventLog
+	}
+}
+
+// WithRefPolicies restricts updates to refs. getRefPolicies returns the
+// policies of the repository targeted by a request.
+func WithRefPolicies(getRefPolicies func(r *http.Request) []wrgldconf.RefPolicy) ServerOption {
+	return func(s *Server) {
+		s.getRefPolicies = getRefPolicies
+	}
+}
+
+// WithAuditLog records mutating actions and enables the /audit endpoint.
+// getAuditLog returns the log of the repository targeted by a request.
+func WithAuditLog(getAuditLog func(r *http.Request) *audit.Log) ServerOption {
+	return func(s *Server) {
+		s.getAuditLog = getAuditLog
+	}
+}
+
+// WithRateLimiter throttles clients and caps their concurrent requests and
+// pack sessions. getLimiter returns the limiter of the repository targeted by
+// a request.
+func WithRateLimiter(getLimiter func(r *http.Request) *ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.getRateLimiter = getLimiter
+	}
+}
+
+// WithIngestLimits caps the size of commits and pushes. getIngestLimits
+// returns the limits of the repository targeted by a request.
+func WithIngestLimits(getIngestLimits func(r *http.Request) *wrgldconf.IngestLimits) ServerOption {
+	return func(s *Server) {
+		s.getIngestLimits = getIngestLimits
+	}
+}
+
+// WithGCRunner runs garbage collection with a shared runner, so that manual
+// and scheduled runs never overlap, and enables the GET /gc/ status endpoint
+// as well as asynchronous runs.
+// getGCRunner returns the runner of the repository targeted by a request.
+func WithGCRunner(getGCRunner func(r *http.Request) *gc.Runner) ServerOption {
+	return func(s *Server) {
+		s.getGCRunner = getGCRunner
+	}
+}
+
 type PostCommitHook func(r *http.Request, commit *objects.Commit, sum []byte, branch string, tid *uuid.UUID)
 
 type Server struct {
@@ -93,6 +181,28 @@ type Server struct {
 	sPool             *sync.Pool
 	receiverOpts      []apiutils.ObjectReceiveOption
 	webhookSenderOpts []webhook.SenderOption
+	getEventLog       func(r *http.Request) *eventstream.Log
+	getTokenStoreFn   func(r *http.Request) *tokens.Store
+	getRefPolicies    func(r *http.Request) []wrgldconf.RefPolicy
+	getAuditLog       func(r *http.Request) *audit.Log
+	getRateLimiter    func(r *http.Request) *ratelimit.Limiter
+	getIngestLimits   func(r *http.Request) *wrgldconf.IngestLimits
+	getGCRunner       func(r *http.Request) *gc.Runner
+	rootPath          *regexp.Regexp
+
+	// draining is set once the server starts shutting down
+	draining atomic.Bool
+	// drained is closed once the server starts shutting down so that
+	// streaming handlers end
+	drained   chan struct{}
+	drainOnce sync.Once
+	// packInFlight counts upload-pack and receive-pack requests in progress
+	// and packLastEnd is when the last one ended, both guarded by packMutex
+	packMutex    sync.Mutex
+	packInFlight int
+	packLastEnd  time.Time
+	// webhookWG tracks webhook payloads that are yet to be sent or persisted
+	webhookWG sync.WaitGroup
 }
 
 func NewServer(
@@ -113,17 +223,18 @@ func NewServer(
 		getRPSession: getRPSession,
 		maxAge:       90 * 24 * time.Hour,
 		logger:       logger,
+		rootPath:     rootPath,
+		drained:      make(chan struct{}),
 		sPool: &sync.Pool{
 			New: func() interface{} {
-				s, err := sorter.NewSorter(sorter.WithRunSize(8 * 1024 * 1024))
-				if err != nil {
-					panic(err)
-				}
+				// NewSorter only fails while detecting the run size, which is
+				// given here
+				s, _ := sorter.NewSorter(sorter.WithRunSize(8 * 1024 * 1024))
 				return s
 			},
 		},
 	}
-	s.router = router.NewRouter(rootPath, &router.Routes{
+	routes := &router.Routes{
 		Subs: []*router.Routes{
 			{
 				Pat: patTransactions,
@@ -145,9 +256,108 @@ func NewServer(
 				},
 			},
 			{
-				Pat:         patGC,
-				Method:      http.MethodPost,
-				HandlerFunc: s.handleGC,
+				Pat: patGC,
+				Subs: []*router.Routes{
+					{
+						Method:      http.MethodPost,
+						HandlerFunc: s.handleGC,
+					},
+					{
+						Method:      http.MethodGet,
+						HandlerFunc: s.handleGetGC,
+					},
+					{
+						Method: http.MethodGet,
+						Pat:    patJobs,
+						Subs: []*router.Routes{
+							{
+								Pat:         patUUID,
+								HandlerFunc: s.handleGetGCJob,
+							},
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodGet,
+				Pat:         patEvents,
+				HandlerFunc: s.handleEvents,
+			},
+			{
+				Method:      http.MethodGet,
+				Pat:         patChanges,
+				HandlerFunc: s.handleChanges,
+			},
+			{
+				Pat: patTokens,
+				Subs: []*router.Routes{
+					{
+						Method:      http.MethodGet,
+						HandlerFunc: s.handleListTokens,
+					},
+					{
+						Method:      http.MethodPost,
+						HandlerFunc: s.handleCreateToken,
+					},
+					{
+						Method:      http.MethodDelete,
+						Pat:         patUUID,
+						HandlerFunc: s.handleRevokeToken,
+					},
+				},
+			},
+			{
+				Pat: patSessions,
+				Subs: []*router.Routes{
+					{
+						Method:      http.MethodGet,
+						HandlerFunc: s.handleListSessions,
+					},
+					{
+						Method:      http.MethodDelete,
+						Pat:         patUUID,
+						HandlerFunc: s.handleDeleteSession,
+					},
+				},
+			},
+			{
+				Method:      http.MethodGet,
+				Pat:         patConfig,
+				HandlerFunc: s.handleGetConfig,
+			},
+			{
+				Method:      http.MethodGet,
+				Pat:         patAudit,
+				HandlerFunc: s.handleGetAudit,
+			},
+			{
+				Pat: patWebhooks,
+				Subs: []*router.Routes{
+					{
+						Pat: patDeliveries,
+						Subs: []*router.Routes{
+							{
+								Method:      http.MethodGet,
+								HandlerFunc: s.handleGetDeliveries,
+							},
+							{
+								Pat: patUUID,
+								Subs: []*router.Routes{
+									{
+										Method:      http.MethodPost,
+										Pat:         patRedeliver,
+										HandlerFunc: s.handleRedeliver,
+									},
+								},
+							},
+						},
+					},
+					{
+						Method:      http.MethodPost,
+						Pat:         patPing,
+						HandlerFunc: s.handlePingWebhook,
+					},
+				},
 			},
 			{
 				Pat: patRefs,
@@ -243,19 +453,45 @@ func NewServer(
 				HandlerFunc: s.handleDiff,
 			},
 		},
-	})
+	}
+	instrumentRoutes(routes, "")
+	s.router = router.NewRouter(rootPath, routes)
 	for _, opt := range opts {
 		opt(s)
 	}
 	return s
 }
 
-func (s *Server) Ready() bool {
+// webhookSender creates a sender for events caused by request r
+func (s *Server) webhookSender(r *http.Request) *webhook.Sender {
+	opts := append(s.webhookSenderOpts[:len(s.webhookSenderOpts):len(s.webhookSenderOpts)],
+		webhook.WithWaitGroup(&s.webhookWG),
+		webhook.WithTraceContext(r.Context()),
+	)
+	if s.getEventLog != nil {
+		if l := s.getEventLog(r); l != nil {
+			opts = append(opts[:len(opts):len(opts)], webhook.WithEventSink(l))
+		}
+	}
+	return webhook.NewSenderWithConfig(s.getConfig(r), s.logger, opts...)
+}
+
+// flushWebhooks flushes ws before r is answered, so that webhook payloads are
+// saved to the outbox by the time the client learns of the change. It answers
+// an error and returns false if they could not be saved.
+func (s *Server) flushWebhooks(rw http.ResponseWriter, r *http.Request, ws *webhook.Sender) bool {
+	if err := ws.Flush(); err != nil {
+		s.handleErr(rw, r, fmt.Errorf("error saving webhook payloads: %w", err))
+		return false
+	}
 	return true
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	s.router.ServeHTTP(rw, r)
+	s.instrument(rw, r, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		defer s.recoverError(rw, r)
+		s.rateLimit(&unmatchedWriter{ResponseWriter: rw, r: r, info: GetRequestInfo(r)}, r, s.router)
+	}))
 }
 
 func (s *Server) cacheControlImmutable(rw http.ResponseWriter) {
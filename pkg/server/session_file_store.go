@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sessionDir keeps the state of each session as a JSON file in a directory.
+// Files are replaced atomically so that instances sharing the directory never
+// read a partially written state.
+type sessionDir struct {
+	dir string
+	ttl time.Duration
+}
+
+type sessionFile struct {
+	ExpiresAt time.Time       `json:"expiresAt"`
+	State     json.RawMessage `json:"state"`
+}
+
+func newSessionDir(dir string, ttl time.Duration) (*sessionDir, error) {
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &sessionDir{dir: dir, ttl: ttl}, nil
+}
+
+func (d *sessionDir) path(sid uuid.UUID) string {
+	return filepath.Join(d.dir, sid.String()+".json")
+}
+
+// save writes the state of a session. The session expires ttl after
+// createdAt.
+func (d *sessionDir) save(sid uuid.UUID, createdAt time.Time, state interface{}) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	b, err = json.Marshal(&sessionFile{ExpiresAt: createdAt.Add(d.ttl), State: b})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(d.dir, ".session-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.path(sid))
+}
+
+// load reads the state of a session into state. It returns false if the
+// session does not exist, has expired or cannot be read.
+func (d *sessionDir) load(sid uuid.UUID, state interface{}) (bool, error) {
+	b, err := os.ReadFile(d.path(sid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	sf := &sessionFile{}
+	if err = json.Unmarshal(b, sf); err != nil || time.Now().After(sf.ExpiresAt) ||
+		json.Unmarshal(sf.State, state) != nil {
+		// expired or unreadable sessions cannot be resumed
+		d.delete(sid)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (d *sessionDir) delete(sid uuid.UUID) {
+	os.Remove(d.path(sid))
+}
+
+// list returns the IDs of sessions that have not expired, sorted. Expired
+// sessions are removed along the way. Files that cannot be read are skipped.
+func (d *sessionDir) list() []uuid.UUID {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil
+	}
+	sl := []uuid.UUID{}
+	now := time.Now()
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		sid, err := uuid.Parse(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(d.dir, name))
+		if err != nil {
+			continue
+		}
+		sf := &sessionFile{}
+		if err = json.Unmarshal(b, sf); err != nil {
+			continue
+		}
+		if now.After(sf.ExpiresAt) {
+			d.delete(sid)
+			continue
+		}
+		sl = append(sl, sid)
+	}
+	sort.Slice(sl, func(i, j int) bool {
+		return sl[i].String() < sl[j].String()
+	})
+	return sl
+}
+
+// UploadPackSessionFileStore saves upload-pack sessions as files in a
+// directory, so that sessions survive restarts and can be resumed by any
+// instance that mounts the same directory.
+type UploadPackSessionFileStore struct {
+	d *sessionDir
+}
+
+// NewUploadPackSessionFileStore creates dir if it does not exist. Sessions
+// expire ttl after they start, which defaults to 24 hours.
+func NewUploadPackSessionFileStore(dir string, ttl time.Duration) (*UploadPackSessionFileStore, error) {
+	d, err := newSessionDir(dir, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadPackSessionFileStore{d: d}, nil
+}
+
+func (m *UploadPackSessionFileStore) Set(sid uuid.UUID, ses *UploadPackSession) error {
+	return m.d.save(sid, ses.createdAt, ses.State())
+}
+
+func (m *UploadPackSessionFileStore) Get(sid uuid.UUID) (ses *UploadPackSession, ok bool, err error) {
+	st := &UploadPackState{}
+	if ok, err = m.d.load(sid, st); err != nil || !ok {
+		return nil, false, err
+	}
+	return LoadUploadPackSession(st), true, nil
+}
+
+func (m *UploadPackSessionFileStore) Delete(sid uuid.UUID) {
+	m.d.delete(sid)
+}
+
+func (m *UploadPackSessionFileStore) List() []uuid.UUID {
+	return m.d.list()
+}
+
+// ReceivePackSessionFileStore saves receive-pack sessions as files in a
+// directory, so that sessions survive restarts and can be resumed by any
+// instance that mounts the same directory.
+type ReceivePackSessionFileStore struct {
+	d *sessionDir
+}
+
+// NewReceivePackSessionFileStore creates dir if it does not exist. Sessions
+// expire ttl after they start, which defaults to 24 hours.
+func NewReceivePackSessionFileStore(dir string, ttl time.Duration) (*ReceivePackSessionFileStore, error) {
+	d, err := newSessionDir(dir, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &ReceivePackSessionFileStore{d: d}, nil
+}
+
+func (m *ReceivePackSessionFileStore) Set(sid uuid.UUID, ses *ReceivePackSession) error {
+	return m.d.save(sid, ses.createdAt, ses.State())
+}
+
+func (m *ReceivePackSessionFileStore) Get(sid uuid.UUID) (ses *ReceivePackSession, ok bool, err error) {
+	st := &ReceivePackState{}
+	if ok, err = m.d.load(sid, st); err != nil || !ok {
+		return nil, false, err
+	}
+	return LoadReceivePackSession(st), true, nil
+}
+
+func (m *ReceivePackSessionFileStore) Delete(sid uuid.UUID) {
+	m.d.delete(sid)
+}
+
+func (m *ReceivePackSessionFileStore) List() []uuid.UUID {
+	return m.d.list()
+}
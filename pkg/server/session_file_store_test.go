@@ -0,0 +1,163 @@
+package server_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/api"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/factory"
+	"github.com/wrgl/wrgl/pkg/objects"
+	objmock "github.com/wrgl/wrgl/pkg/objects/mock"
+	"github.com/wrgl/wrgl/pkg/ref"
+	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+)
+
+// blockReadsStore counts reads of blocks
+type blockReadsStore struct {
+	objects.Store
+	n *int32
+}
+
+func (s blockReadsStore) Get(k []byte) ([]byte, error) {
+	if bytes.HasPrefix(k, []byte("blk/")) {
+		atomic.AddInt32(s.n, 1)
+	}
+	return s.Store.Get(k)
+}
+
+func TestSessionFileStores(t *testing.T) {
+	dir := t.TempDir()
+	db := objmock.NewStore()
+	var blockReads int32
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	c := server_testutils.ReceivePackConfig(false, false)
+	c.Pack = &conf.Pack{MaxFileSize: 1024}
+
+	// every request goes to a different instance, as if the instances were
+	// replicas behind a load balancer that share the session directory
+	var upStores []*server.UploadPackSessionFileStore
+	var instances []*server.Server
+	for i := 0; i < 2; i++ {
+		up, err := server.NewUploadPackSessionFileStore(filepath.Join(dir, "upload-pack"), 0)
+		require.NoError(t, err)
+		rp, err := server.NewReceivePackSessionFileStore(filepath.Join(dir, "receive-pack"), 0)
+		require.NoError(t, err)
+		upStores = append(upStores, up)
+		instances = append(instances, server.NewServer(
+			nil,
+			func(r *http.Request) objects.Store { return blockReadsStore{db, &blockReads} },
+			func(r *http.Request) ref.Store { return rs },
+			func(r *http.Request) conf.Config { return *c },
+			func(r *http.Request) server.UploadPackSessionStore { return up },
+			func(r *http.Request) server.ReceivePackSessionStore { return rp },
+			testr.New(t),
+		))
+	}
+	var n int32
+	var sessionsSeen int32
+	ts := httptest.NewServer(&server_testutils.GZIPAwareHandler{
+		T: t,
+		HandlerFunc: func(rw http.ResponseWriter, r *http.Request) {
+			i := atomic.AddInt32(&n, 1) % 2
+			// the other instance sees the session saved by the previous request
+			if len(upStores[1-i].List()) > 0 {
+				atomic.AddInt32(&sessionsSeen, 1)
+			}
+			instances[i].ServeHTTP(rw, r)
+		},
+	})
+	defer ts.Close()
+	cli, err := apiclient.NewClient(ts.URL, testr.New(t))
+	require.NoError(t, err)
+
+	sum1, _ := factory.CommitRandomN(t, db, 5, 1000, nil)
+	sum2, c2 := factory.CommitRandomN(t, db, 5, 1000, [][]byte{sum1})
+	sum3, _ := factory.CommitRandomN(t, db, 5, 1000, nil)
+	sum4, c4 := factory.CommitRandomN(t, db, 5, 1000, [][]byte{sum3})
+	require.NoError(t, ref.CommitHead(rs, "main", sum2, c2, nil))
+	require.NoError(t, ref.CommitHead(rs, "other", sum4, c4, nil))
+
+	// fetch in several negotiation rounds and several packfiles
+	dbc := objmock.NewStore()
+	rsc, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	factory.CopyCommitsToNewStore(t, db, dbc, [][]byte{sum3})
+	require.NoError(t, ref.SaveTag(rsc, "v0", sum3))
+	blocks, err := objects.GetAllBlockKeys(db)
+	require.NoError(t, err)
+	commits := server_testutils.FetchObjects(t, dbc, rsc, cli, [][]byte{sum2, sum4},
+		apiclient.WithUploadPackHavesPerRoundTrip(1),
+	)
+	factory.AssertCommitsPersisted(t, dbc, commits)
+	assert.Contains(t, commits, sum2)
+	assert.Contains(t, commits, sum4)
+	assert.Greater(t, atomic.LoadInt32(&sessionsSeen), int32(1))
+	assert.Len(t, upStores[0].List(), 0)
+	// resumed sessions carry on without sending blocks again
+	assert.LessOrEqual(t, int(atomic.LoadInt32(&blockReads)), len(blocks))
+
+	// push in several packfiles
+	sum5, c5 := factory.CommitRandomN(t, dbc, 5, 1000, [][]byte{sum2})
+	require.NoError(t, ref.CommitHead(rsc, "main", sum5, c5, nil))
+	remoteRefs, err := ref.ListAllRefs(rs)
+	require.NoError(t, err)
+	updates := server_testutils.PushObjects(t, dbc, rsc, cli, map[string]*payload.Update{
+		"refs/heads/main": {OldSum: payload.BytesToHex(sum2), Sum: payload.BytesToHex(sum5)},
+	}, remoteRefs, 1024)
+	assert.Empty(t, updates["refs/heads/main"].ErrMsg)
+	assertRefEqual(t, rs, "heads/main", sum5)
+	factory.AssertCommitsPersisted(t, db, [][]byte{sum5})
+}
+
+func TestSessionFileStoreExpiry(t *testing.T) {
+	dir := t.TempDir()
+	m, err := server.NewUploadPackSessionFileStore(dir, -1)
+	require.NoError(t, err)
+	ses := server.LoadUploadPackSession(&server.UploadPackState{ID: [16]byte{1}})
+	require.NoError(t, m.Set(ses.State().ID, ses))
+	_, ok, err := m.Get(ses.State().ID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Empty(t, m.List())
+}
+
+func TestSessionFileStoreUnavailable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "upload-pack")
+	db := objmock.NewStore()
+	rs, cleanup := refmock.NewStore(t)
+	defer cleanup()
+	up, err := server.NewUploadPackSessionFileStore(dir, 0)
+	require.NoError(t, err)
+	s := server.NewServer(
+		nil,
+		func(r *http.Request) objects.Store { return db },
+		func(r *http.Request) ref.Store { return rs },
+		func(r *http.Request) conf.Config { return conf.Config{} },
+		func(r *http.Request) server.UploadPackSessionStore { return up },
+		nil,
+		testr.New(t),
+	)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// sessions cannot be saved once the directory is gone
+	require.NoError(t, os.RemoveAll(dir))
+	resp, err := http.Post(ts.URL+"/upload-pack/", api.CTJSON, strings.NewReader("{}"))
+	require.NoError(t, err)
+	assertErrorCode(t, resp, http.StatusServiceUnavailable, server.CodeStorageUnavailable)
+}
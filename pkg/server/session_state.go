@@ -0,0 +1,254 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/wrgl/wrgl/pkg/api/payload"
+	apiutils "github.com/wrgl/wrgl/pkg/api/utils"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/objects"
+	"github.com/wrgl/wrgl/pkg/ref"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+// NegotiationRound is what the client sent in one round of commit
+// negotiation
+type NegotiationRound struct {
+	Wants []*payload.Hex `json:"wants,omitempty"`
+	Haves []*payload.Hex `json:"haves,omitempty"`
+	Done  bool           `json:"done,omitempty"`
+}
+
+// UploadPackState is the state of an upload-pack session in between
+// requests. Session stores that outlive the process save this instead of the
+// session.
+type UploadPackState struct {
+	ID              uuid.UUID `json:"id"`
+	Owner           string    `json:"owner,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+	Step            string    `json:"step"`
+	MaxPackfileSize uint64    `json:"maxPackfileSize,omitempty"`
+
+	// Depth and Rounds are replayed to rebuild the commits finder while
+	// commits are being negotiated
+	Depth  int                 `json:"depth,omitempty"`
+	Rounds []*NegotiationRound `json:"rounds,omitempty"`
+
+	// Commits, Commons and TablesToSend are what objects are sent from once
+	// negotiation is done
+	Commits         []*payload.Hex `json:"commits,omitempty"`
+	Commons         []*payload.Hex `json:"commons,omitempty"`
+	TablesToSend    []*payload.Hex `json:"tablesToSend,omitempty"`
+	CandidateTables []*payload.Hex `json:"candidateTables,omitempty"`
+
+	// PackfilesSent is the number of packfiles already sent
+	PackfilesSent int `json:"packfilesSent,omitempty"`
+
+	// Sender is where sending packfiles is at
+	Sender *SenderState `json:"sender,omitempty"`
+}
+
+func hexSet(m map[string]struct{}) []*payload.Hex {
+	sl := make([][]byte, 0, len(m))
+	for k := range m {
+		sl = append(sl, []byte(k))
+	}
+	return payload.BytesSliceToHexSlice(sl)
+}
+
+// State returns the state of the session, to be resumed with
+// LoadUploadPackSession
+func (s *UploadPackSession) State() *UploadPackState {
+	if s.saved != nil {
+		return s.saved
+	}
+	st := &UploadPackState{
+		ID:              s.id,
+		Owner:           s.owner,
+		CreatedAt:       s.createdAt,
+		Step:            s.step,
+		MaxPackfileSize: s.maxPackfileSize,
+		Depth:           s.depth,
+		Rounds:          s.rounds,
+		Commons:         payload.BytesSliceToHexSlice(s.commons),
+		TablesToSend:    hexSet(s.tablesToSend),
+		PackfilesSent:   s.packfilesSent,
+	}
+	for _, com := range s.commits {
+		st.Commits = payload.AppendHex(st.Commits, com.Sum)
+	}
+	for e := s.candidateTables.Front(); e != nil; e = e.Next() {
+		st.CandidateTables = payload.AppendHex(st.CandidateTables, e.Value.([]byte))
+	}
+	if s.sender != nil {
+		st.Sender = s.sender.state()
+	}
+	return st
+}
+
+// LoadUploadPackSession creates a session from its saved state. The session
+// is rebuilt against the store of the next request that it serves.
+func LoadUploadPackSession(st *UploadPackState) *UploadPackSession {
+	return &UploadPackSession{
+		id:        st.ID,
+		owner:     st.Owner,
+		createdAt: st.CreatedAt,
+		saved:     st,
+	}
+}
+
+// resume rebuilds a loaded session. It does nothing if the session was never
+// saved.
+func (s *UploadPackSession) resume(db objects.Store, rs ref.Store) (err error) {
+	st := s.saved
+	if st == nil {
+		return nil
+	}
+	s.db = db
+	s.rs = rs
+	s.maxPackfileSize = st.MaxPackfileSize
+	s.depth = st.Depth
+	s.rounds = st.Rounds
+	s.commons = payload.HexSliceToBytesSlice(st.Commons)
+	s.packfilesSent = st.PackfilesSent
+	s.candidateTables = list.New()
+	for _, sum := range st.CandidateTables {
+		s.candidateTables.PushBack(sum[:])
+	}
+	s.tablesToSend = map[string]struct{}{}
+	for _, sum := range st.TablesToSend {
+		s.tablesToSend[string(sum[:])] = struct{}{}
+	}
+	switch st.Step {
+	case upStepNegotiate:
+		s.finder = apiutils.NewClosedSetsFinder(db, rs, s.depth)
+		for _, rnd := range s.rounds {
+			if _, err = s.finder.Process(
+				payload.HexSliceToBytesSlice(rnd.Wants), payload.HexSliceToBytesSlice(rnd.Haves), rnd.Done,
+			); err != nil {
+				return err
+			}
+		}
+	case upStepNegotiateTables, upStepSendPackfile:
+		if s.commits, err = loadCommits(db, st.Commits); err != nil {
+			return err
+		}
+		if st.Step == upStepSendPackfile {
+			if st.Sender == nil {
+				return fmt.Errorf("upload-pack session %s has no sender state", st.ID)
+			}
+			s.sender, err = resumeObjectSender(db, st.Sender, s.tablesToSend, s.commons, s.maxPackfileSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	s.state = s.next(st.Step)
+	s.saved = nil
+	return nil
+}
+
+// loadCommits reads commits with the given sums, in order
+func loadCommits(db objects.Store, sums []*payload.Hex) ([]*objects.Commit, error) {
+	commits := make([]*objects.Commit, 0, len(sums))
+	for _, sum := range sums {
+		com, err := objects.GetCommit(db, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, com)
+	}
+	return commits, nil
+}
+
+// ReceivePackState is the state of a receive-pack session in between
+// requests. Session stores that outlive the process save this instead of the
+// session.
+type ReceivePackState struct {
+	ID        uuid.UUID                  `json:"id"`
+	Owner     string                     `json:"owner,omitempty"`
+	CreatedAt time.Time                  `json:"createdAt"`
+	Step      string                     `json:"step"`
+	Updates   map[string]*payload.Update `json:"updates,omitempty"`
+
+	// Commits are the commits expected by the receiver, Received are those
+	// that were already saved
+	Commits  []*payload.Hex `json:"commits,omitempty"`
+	Received []*payload.Hex `json:"received,omitempty"`
+
+	PushedObjects int   `json:"pushedObjects,omitempty"`
+	PushedBytes   int64 `json:"pushedBytes,omitempty"`
+}
+
+// State returns the state of the session, to be resumed with
+// LoadReceivePackSession
+func (s *ReceivePackSession) State() *ReceivePackState {
+	if s.saved != nil {
+		return s.saved
+	}
+	st := &ReceivePackState{
+		ID:            s.id,
+		Owner:         s.owner,
+		CreatedAt:     s.createdAt,
+		Step:          s.step,
+		Updates:       s.updates,
+		Commits:       payload.BytesSliceToHexSlice(s.commits),
+		PushedObjects: s.pushedObjects,
+		PushedBytes:   s.pushedBytes,
+	}
+	if s.receiver != nil {
+		st.Received = payload.BytesSliceToHexSlice(s.receiver.ReceivedCommits)
+	}
+	return st
+}
+
+// LoadReceivePackSession creates a session from its saved state. The session
+// is rebuilt against the store of the next request that it serves.
+func LoadReceivePackSession(st *ReceivePackState) *ReceivePackSession {
+	return &ReceivePackSession{
+		id:        st.ID,
+		owner:     st.Owner,
+		createdAt: st.CreatedAt,
+		saved:     st,
+	}
+}
+
+// resume rebuilds the receiver of a loaded session. It does nothing if the
+// session was never saved.
+func (s *ReceivePackSession) resume(db objects.Store, rs ref.Store, c *conf.Config, ws *webhook.Sender, logger logr.Logger, receiverOpts ...apiutils.ObjectReceiveOption) {
+	st := s.saved
+	if st == nil {
+		return
+	}
+	s.db = db
+	s.rs = rs
+	s.c = c
+	s.ws = ws
+	s.receiverOpts = receiverOpts
+	s.logger = logger.WithName("ReceivePackSession").WithValues("session_id", s.id.String())
+	s.updates = st.Updates
+	s.commits = payload.HexSliceToBytesSlice(st.Commits)
+	s.pushedObjects = st.PushedObjects
+	s.pushedBytes = st.PushedBytes
+	if st.Step != rpStepGreet {
+		received := payload.HexSliceToBytesSlice(st.Received)
+		m := map[string]struct{}{}
+		for _, sum := range received {
+			m[string(sum)] = struct{}{}
+		}
+		expected := [][]byte{}
+		for _, sum := range s.commits {
+			if _, ok := m[string(sum)]; !ok {
+				expected = append(expected, sum)
+			}
+		}
+		s.receiver = apiutils.NewObjectReceiver(db, expected, s.logger.V(1), receiverOpts...)
+		s.receiver.ReceivedCommits = received
+	}
+	s.state = s.next(st.Step)
+	s.saved = nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SessionTypeUploadPack  = "upload-pack"
+	SessionTypeReceivePack = "receive-pack"
+)
+
+var sessionURIPat = regexp.MustCompile(`/sessions/([0-9a-f-]+)/`)
+
+// SessionPayload describes an ongoing upload-pack or receive-pack session
+type SessionPayload struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []*SessionPayload `json:"sessions"`
+}
+
+func (s *Server) handleListSessions(rw http.ResponseWriter, r *http.Request) {
+	resp := &ListSessionsResponse{Sessions: []*SessionPayload{}}
+	upSessions := s.getUpSession(r)
+	for _, sid := range upSessions.List() {
+		ses, ok, err := upSessions.Get(sid)
+		if err != nil {
+			s.handleErr(rw, r, sessionStoreError(err))
+			return
+		}
+		if ok {
+			resp.Sessions = append(resp.Sessions, &SessionPayload{
+				ID:        sid.String(),
+				Type:      SessionTypeUploadPack,
+				CreatedAt: ses.createdAt,
+			})
+		}
+	}
+	rpSessions := s.getRPSession(r)
+	for _, sid := range rpSessions.List() {
+		ses, ok, err := rpSessions.Get(sid)
+		if err != nil {
+			s.handleErr(rw, r, sessionStoreError(err))
+			return
+		}
+		if ok {
+			resp.Sessions = append(resp.Sessions, &SessionPayload{
+				ID:        sid.String(),
+				Type:      SessionTypeReceivePack,
+				CreatedAt: ses.createdAt,
+			})
+		}
+	}
+	sort.Slice(resp.Sessions, func(i, j int) bool {
+		return resp.Sessions[i].CreatedAt.Before(resp.Sessions[j].CreatedAt)
+	})
+	WriteJSON(rw, r, resp)
+}
+
+// handleDeleteSession aborts an upload-pack or receive-pack session. The
+// client gets an error on its next request.
+func (s *Server) handleDeleteSession(rw http.ResponseWriter, r *http.Request) {
+	m := sessionURIPat.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		SendHTTPError(rw, r, http.StatusNotFound)
+		return
+	}
+	sid, err := uuid.Parse(m[1])
+	if err != nil {
+		SendHTTPError(rw, r, http.StatusNotFound)
+		return
+	}
+	upSessions := s.getUpSession(r)
+	if _, ok, err := upSessions.Get(sid); err != nil {
+		s.handleErr(rw, r, sessionStoreError(err))
+		return
+	} else if ok {
+		upSessions.Delete(sid)
+		return
+	}
+	rpSessions := s.getRPSession(r)
+	if _, ok, err := rpSessions.Get(sid); err != nil {
+		s.handleErr(rw, r, sessionStoreError(err))
+		return
+	} else if ok {
+		rpSessions.Delete(sid)
+		return
+	}
+	SendError(rw, r, http.StatusNotFound, "session not found")
+}
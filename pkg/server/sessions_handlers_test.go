@@ -0,0 +1,62 @@
+package server_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgld/pkg/server"
+)
+
+func (s *testSuite) TestSessionsHandlers(t *testing.T) {
+	repo, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(s.s.AdminToken(t)))
+	require.NoError(t, err)
+	db := s.s.GetDB(repo)
+	rs := s.s.GetRS(repo)
+	c, err := s.s.GetConfS(repo).Open()
+	require.NoError(t, err)
+
+	upID := uuid.New()
+	require.NoError(t, s.s.GetUpSessions(repo).Set(upID, server.NewUploadPackSession(db, rs, upID, 0)))
+	rpID := uuid.New()
+	require.NoError(t, s.s.GetRpSessions(repo).Set(rpID, server.NewReceivePackSession(db, rs, c, rpID, nil, testr.New(t))))
+
+	listSessions := func() []*server.SessionPayload {
+		t.Helper()
+		resp, err := cli.Request(http.MethodGet, "/sessions/", nil, nil)
+		require.NoError(t, err)
+		lsr := &server.ListSessionsResponse{}
+		parseJSONResponse(t, resp, lsr)
+		return lsr.Sessions
+	}
+	sl := listSessions()
+	require.Len(t, sl, 2)
+	assert.Equal(t, upID.String(), sl[0].ID)
+	assert.Equal(t, server.SessionTypeUploadPack, sl[0].Type)
+	assert.Equal(t, rpID.String(), sl[1].ID)
+	assert.Equal(t, server.SessionTypeReceivePack, sl[1].Type)
+
+	_, err = cli.Request(http.MethodDelete, "/sessions/"+rpID.String()+"/", nil, nil)
+	require.NoError(t, err)
+	_, err = cli.Request(http.MethodDelete, "/sessions/"+rpID.String()+"/", nil, nil)
+	assertHTTPError(t, err, http.StatusNotFound, "session not found")
+	sl = listSessions()
+	require.Len(t, sl, 1)
+	assert.Equal(t, upID.String(), sl[0].ID)
+
+	// sessions can only be managed with the admin scope
+	writer, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(
+		s.s.Authorize(t, "dev@domain.com", "Dev", "write"),
+	))
+	require.NoError(t, err)
+	_, err = writer.Request(http.MethodGet, "/sessions/", nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+	_, err = writer.Request(http.MethodDelete, "/sessions/"+upID.String()+"/", nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+}
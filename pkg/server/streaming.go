@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// streamWriteTimeout is how long each chunk of a streaming response has to be
+// written. Streaming responses outlive the write timeout of the http.Server,
+// which would otherwise cut them at a fixed time after the request was read.
+const streamWriteTimeout = 30 * time.Second
+
+// extendWriteDeadline pushes the write deadline of the connection serving rw
+// to streamWriteTimeout from now. It returns false if rw cannot change its
+// deadline, in which case the stream ends at the write timeout of the
+// http.Server and clients have to resume from where they were cut.
+func extendWriteDeadline(rw http.ResponseWriter) bool {
+	for {
+		switch v := rw.(type) {
+		case interface{ SetWriteDeadline(time.Time) error }:
+			return v.SetWriteDeadline(time.Now().Add(streamWriteTimeout)) == nil
+		case interface{ Unwrap() http.ResponseWriter }:
+			rw = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server_test
 
 import (
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -24,12 +25,16 @@ type testSuite struct {
 	postCommit          func(r *http.Request, commit *objects.Commit, sum []byte, branch string, tid *uuid.UUID)
 	receiverSaveObjHook func(objType int, sum []byte)
 	webhookWG           *sync.WaitGroup
+	deliveryLog         *webhook.DeliveryLog
 }
 
 func newSuite(t *testing.T) *testSuite {
 	ts := &testSuite{
 		webhookWG: &sync.WaitGroup{},
 	}
+	var err error
+	ts.deliveryLog, err = webhook.NewDeliveryLog(filepath.Join(t.TempDir(), "deliveries.jsonl"))
+	require.NoError(t, err)
 	ts.s = server_testutils.NewServer(t, nil,
 		server.WithPostCommitCallback(func(r *http.Request, commit *objects.Commit, sum []byte, branch string, tid *uuid.UUID) {
 			if ts.postCommit != nil {
@@ -43,7 +48,10 @@ func newSuite(t *testing.T) *testSuite {
 				}
 			}),
 		),
-		server.WithWebhookSenderOptions(webhook.WithWaitGroup(ts.webhookWG)),
+		server.WithWebhookSenderOptions(
+			webhook.WithWaitGroup(ts.webhookWG),
+			webhook.WithDeliveryLog(ts.deliveryLog),
+		),
 	)
 	return ts
 }
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -25,8 +26,13 @@ import (
 	"github.com/wrgl/wrgl/pkg/ref"
 	refmock "github.com/wrgl/wrgl/pkg/ref/mock"
 	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/audit"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/eventstream"
+	"github.com/wrgl/wrgld/pkg/gc"
 	wrgldoapiserver "github.com/wrgl/wrgld/pkg/oapi/server"
 	"github.com/wrgl/wrgld/pkg/server"
+	"github.com/wrgl/wrgld/pkg/tokens"
 )
 
 const (
@@ -48,6 +54,12 @@ func setRepo(r *http.Request, repo string) *http.Request {
 	return r.WithContext(context.WithValue(r.Context(), repoKey{}, repo))
 }
 
+// ContextWithRepo returns a copy of ctx that getters resolve to repo, for
+// calling server methods outside of a request
+func ContextWithRepo(ctx context.Context, repo string) context.Context {
+	return context.WithValue(ctx, repoKey{}, repo)
+}
+
 func getRepo(r *http.Request) string {
 	if i := r.Context().Value(repoKey{}); i != nil {
 		return i.(string)
@@ -56,16 +68,26 @@ func getRepo(r *http.Request) string {
 }
 
 type Server struct {
-	mx         sync.Mutex
-	db         map[string]objects.Store
-	rs         map[string]ref.Store
-	authzS     map[string]auth.AuthzStore
-	confS      map[string]conf.Store
-	upSessions map[string]*server.UploadPackSessionMap
-	rpSessions map[string]*server.ReceivePackSessionMap
-	s          *server.Server
-	T          *testing.T
-	cleanups   []func()
+	mx          sync.Mutex
+	db          map[string]objects.Store
+	rs          map[string]ref.Store
+	authzS      map[string]auth.AuthzStore
+	confS       map[string]conf.Store
+	upSessions  map[string]*server.UploadPackSessionMap
+	rpSessions  map[string]*server.ReceivePackSessionMap
+	eventLogs   map[string]*eventstream.Log
+	tokenS      map[string]*tokens.Store
+	refPolicies map[string][]wrgldconf.RefPolicy
+	auditLogs   map[string]*audit.Log
+	gcRunners   map[string]*gc.Runner
+	s           *server.Server
+	T           *testing.T
+	cleanups    []func()
+}
+
+// Server returns the server under test
+func (s *Server) Server() *server.Server {
+	return s.s
 }
 
 func (s *Server) Close() {
@@ -83,13 +105,18 @@ func (s *Server) Close() {
 
 func NewServer(t *testing.T, rootPath *regexp.Regexp, opts ...server.ServerOption) *Server {
 	ts := &Server{
-		db:         map[string]objects.Store{},
-		rs:         map[string]ref.Store{},
-		authzS:     map[string]auth.AuthzStore{},
-		confS:      map[string]conf.Store{},
-		upSessions: map[string]*server.UploadPackSessionMap{},
-		rpSessions: map[string]*server.ReceivePackSessionMap{},
-		T:          t,
+		db:          map[string]objects.Store{},
+		rs:          map[string]ref.Store{},
+		authzS:      map[string]auth.AuthzStore{},
+		confS:       map[string]conf.Store{},
+		upSessions:  map[string]*server.UploadPackSessionMap{},
+		rpSessions:  map[string]*server.ReceivePackSessionMap{},
+		eventLogs:   map[string]*eventstream.Log{},
+		tokenS:      map[string]*tokens.Store{},
+		refPolicies: map[string][]wrgldconf.RefPolicy{},
+		auditLogs:   map[string]*audit.Log{},
+		gcRunners:   map[string]*gc.Runner{},
+		T:           t,
 	}
 	ts.s = server.NewServer(
 		rootPath,
@@ -112,7 +139,23 @@ func NewServer(t *testing.T, rootPath *regexp.Regexp, opts ...server.ServerOptio
 			return ts.GetRpSessions(getRepo(r))
 		},
 		testr.New(t),
-		opts...,
+		append([]server.ServerOption{
+			server.WithEventLog(func(r *http.Request) *eventstream.Log {
+				return ts.GetEventLog(getRepo(r))
+			}),
+			server.WithTokenStore(func(r *http.Request) *tokens.Store {
+				return ts.GetTokenStore(getRepo(r))
+			}),
+			server.WithRefPolicies(func(r *http.Request) []wrgldconf.RefPolicy {
+				return ts.GetRefPolicies(getRepo(r))
+			}),
+			server.WithAuditLog(func(r *http.Request) *audit.Log {
+				return ts.GetAuditLog(getRepo(r))
+			}),
+			server.WithGCRunner(func(r *http.Request) *gc.Runner {
+				return ts.GetGCRunner(getRepo(r))
+			}),
+		}, opts...)...,
 	)
 	return ts
 }
@@ -181,6 +224,64 @@ func (s *Server) GetRpSessions(repo string) server.ReceivePackSessionStore {
 	return s.rpSessions[repo]
 }
 
+func (s *Server) GetEventLog(repo string) *eventstream.Log {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.eventLogs[repo]; !ok {
+		l, err := eventstream.NewLog(testr.New(s.T))
+		require.NoError(s.T, err)
+		s.eventLogs[repo] = l
+	}
+	return s.eventLogs[repo]
+}
+
+func (s *Server) GetTokenStore(repo string) *tokens.Store {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.tokenS[repo]; !ok {
+		ts, err := tokens.NewStore(filepath.Join(s.T.TempDir(), "tokens.json"))
+		require.NoError(s.T, err)
+		s.tokenS[repo] = ts
+	}
+	return s.tokenS[repo]
+}
+
+func (s *Server) GetAuditLog(repo string) *audit.Log {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.auditLogs[repo]; !ok {
+		l, err := audit.NewLog(filepath.Join(s.T.TempDir(), "audit.jsonl"))
+		require.NoError(s.T, err)
+		s.auditLogs[repo] = l
+	}
+	return s.auditLogs[repo]
+}
+
+func (s *Server) GetGCRunner(repo string) *gc.Runner {
+	db := s.GetDB(repo)
+	rs := s.GetRS(repo)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if _, ok := s.gcRunners[repo]; !ok {
+		h, err := gc.NewHistory()
+		require.NoError(s.T, err)
+		s.gcRunners[repo] = gc.NewRunner(db, rs, h)
+	}
+	return s.gcRunners[repo]
+}
+
+func (s *Server) GetRefPolicies(repo string) []wrgldconf.RefPolicy {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.refPolicies[repo]
+}
+
+func (s *Server) SetRefPolicies(repo string, policies []wrgldconf.RefPolicy) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.refPolicies[repo] = policies
+}
+
 func (s *Server) Authorize(t *testing.T, email, name string, scopes ...string) (signedToken string) {
 	t.Helper()
 	tok := jwt.NewWithClaims(jwt.SigningMethodNone, &Claims{
@@ -194,10 +295,12 @@ func (s *Server) Authorize(t *testing.T, email, name string, scopes ...string) (
 }
 
 func (s *Server) AdminToken(t *testing.T) (signedToken string) {
-	return s.Authorize(t, Email, Name, "read", "write")
+	return s.Authorize(t, Email, Name, "read", "write", "admin")
 }
 
-func (s *Server) NewRemote(t *testing.T, pathPrefix string) (repo string, uri string, m *RequestCaptureMiddleware, cleanup func()) {
+// NewRemote serves a new repository at pathPrefix. configure is applied to the
+// http.Server before it starts.
+func (s *Server) NewRemote(t *testing.T, pathPrefix string, configure ...func(srv *http.Server)) (repo string, uri string, m *RequestCaptureMiddleware, cleanup func()) {
 	t.Helper()
 	repo = testutils.BrokenRandomLowerAlphaString(6)
 	cs := s.GetConfS(repo)
@@ -225,14 +328,16 @@ func (s *Server) NewRemote(t *testing.T, pathPrefix string) (repo string, uri st
 		},
 		CustomEnforce: func(r *http.Request, resource uma.Resource, scopes []string) bool {
 			var existingScopes []string
-			if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+			if tok := tokens.GetToken(r); tok != nil {
+				existingScopes = tok.GrantedScopes()
+			} else if authHeader := r.Header.Get("Authorization"); authHeader != "" {
 				claims := &Claims{}
 				_, err := jwt.ParseWithClaims(
 					strings.TrimPrefix(authHeader, "Bearer "), claims,
 					func(t *jwt.Token) (interface{}, error) { return jwt.UnsafeAllowNoneSignatureType, nil },
 				)
 				require.NoError(t, err)
-				existingScopes = claims.Scopes
+				existingScopes = tokens.ExpandScopes(claims.Scopes)
 			} else {
 				cs := s.GetConfS(repo)
 				c, _ := cs.Open()
@@ -256,14 +361,21 @@ func (s *Server) NewRemote(t *testing.T, pathPrefix string) (repo string, uri st
 		EditUnauthorizedResponse: func(rw http.ResponseWriter) {
 			rw.Header().Add("Content-Type", "application/json")
 			rw.WriteHeader(http.StatusUnauthorized)
-			rw.Write([]byte(`{"message":"Unauthorized"}`))
+			rw.Write([]byte(`{"message":"Unauthorized","code":"unauthorized"}`))
 		},
 	}, testr.New(t))
 	var handler http.Handler = ApplyMiddlewares(
 		m,
 		func(h http.Handler) http.Handler {
 			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-				if s := r.Header.Get("Authorization"); s != "" {
+				if tok := tokens.GetToken(r); tok != nil {
+					r = server.SetAuthor(r, &server.Author{
+						Email: tok.AuthorEmail,
+						Name:  tok.AuthorName,
+					})
+					r = server.SetPrincipals(r, []string{tok.Name, tok.AuthorEmail})
+					r = server.SetSubject(r, "token:"+tok.ID)
+				} else if s := r.Header.Get("Authorization"); s != "" {
 					claims := &Claims{}
 					_, err := jwt.ParseWithClaims(
 						strings.TrimPrefix(s, "Bearer "), claims,
@@ -274,18 +386,37 @@ func (s *Server) NewRemote(t *testing.T, pathPrefix string) (repo string, uri st
 						Email: claims.Email,
 						Name:  claims.Name,
 					})
+					r = server.SetPrincipals(r, []string{claims.Email})
+					r = server.SetSubject(r, claims.Email)
 				}
 				h.ServeHTTP(rw, r)
 			})
 		},
 		umaMan.Middleware,
+		func(h http.Handler) http.Handler {
+			return tokens.Middleware(
+				func(r *http.Request) *tokens.Store { return s.GetTokenStore(repo) },
+				h, h, func(rw http.ResponseWriter) {
+					rw.Header().Add("Content-Type", "application/json")
+					rw.WriteHeader(http.StatusUnauthorized)
+					rw.Write([]byte(`{"message":"Unauthorized","code":"unauthorized"}`))
+				},
+				func(rw http.ResponseWriter, r *http.Request, err error) {
+					server.SendError(rw, r, http.StatusServiceUnavailable, "token store unavailable")
+				},
+			)
+		},
 	)
 	if pathPrefix != "" {
 		mux := http.NewServeMux()
 		mux.Handle(pathPrefix, handler)
 		handler = mux
 	}
-	ts := httptest.NewServer(handler)
+	ts := httptest.NewUnstartedServer(handler)
+	for _, f := range configure {
+		f(ts.Config)
+	}
+	ts.Start()
 	return repo, strings.TrimSuffix(ts.URL+pathPrefix, "/"), m, ts.Close
 }
 
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+var tokenURIPat = regexp.MustCompile(`/tokens/([0-9a-f-]+)/`)
+
+// TokenPayload describes a token without its secret or hash
+type TokenPayload struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Kind        string     `json:"kind"`
+	AuthorName  string     `json:"authorName,omitempty"`
+	AuthorEmail string     `json:"authorEmail,omitempty"`
+	Scopes      []string   `json:"scopes"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+type CreateTokenRequest struct {
+	Name   string   `json:"name"`
+	Kind   string   `json:"kind"`
+	Scopes []string `json:"scopes"`
+
+	// AuthorName and AuthorEmail identify commits made with a service-account
+	// token. Personal tokens act as the user who created them.
+	AuthorName  string     `json:"authorName"`
+	AuthorEmail string     `json:"authorEmail"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+}
+
+type CreateTokenResponse struct {
+	TokenPayload
+
+	// Token is the secret to send as bearer token. It is only returned once.
+	Token string `json:"token"`
+}
+
+type ListTokensResponse struct {
+	Tokens []*TokenPayload `json:"tokens"`
+}
+
+func tokenPayload(tok *tokens.Token) *TokenPayload {
+	return &TokenPayload{
+		ID:          tok.ID,
+		Name:        tok.Name,
+		Kind:        tok.Kind,
+		AuthorName:  tok.AuthorName,
+		AuthorEmail: tok.AuthorEmail,
+		Scopes:      tok.Scopes,
+		CreatedAt:   tok.CreatedAt,
+		ExpiresAt:   tok.ExpiresAt,
+		LastUsedAt:  tok.LastUsedAt,
+	}
+}
+
+// getTokenStore returns the token store of the request, or responds with 404
+// if tokens are not enabled
+func (s *Server) getTokenStore(rw http.ResponseWriter, r *http.Request) *tokens.Store {
+	var ts *tokens.Store
+	if s.getTokenStoreFn != nil {
+		ts = s.getTokenStoreFn(r)
+	}
+	if ts == nil {
+		SendError(rw, r, http.StatusNotFound, "tokens are not enabled")
+		return nil
+	}
+	return ts
+}
+
+func (s *Server) handleListTokens(rw http.ResponseWriter, r *http.Request) {
+	ts := s.getTokenStore(rw, r)
+	if ts == nil {
+		return
+	}
+	sl, err := ts.List()
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	resp := &ListTokensResponse{Tokens: make([]*TokenPayload, len(sl))}
+	for i, tok := range sl {
+		resp.Tokens[i] = tokenPayload(tok)
+	}
+	WriteJSON(rw, r, resp)
+}
+
+func (s *Server) handleCreateToken(rw http.ResponseWriter, r *http.Request) {
+	ts := s.getTokenStore(rw, r)
+	if ts == nil {
+		return
+	}
+	req := &CreateTokenRequest{}
+	if !parseJSONRequest(r, rw, req) {
+		return
+	}
+	if req.Name == "" {
+		SendError(rw, r, http.StatusBadRequest, "name is required")
+		return
+	}
+	if err := tokens.ValidateScopes(req.Scopes); err != nil {
+		SendError(rw, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		SendError(rw, r, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+	tok := &tokens.Token{
+		Name:      req.Name,
+		Kind:      req.Kind,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	switch req.Kind {
+	case "", tokens.KindPersonal:
+		author := GetAuthor(r)
+		if author == nil {
+			SendError(rw, r, http.StatusBadRequest, "personal tokens require an authenticated user")
+			return
+		}
+		tok.Kind = tokens.KindPersonal
+		tok.AuthorName = author.Name
+		tok.AuthorEmail = author.Email
+	case tokens.KindService:
+		tok.AuthorName = req.AuthorName
+		if tok.AuthorName == "" {
+			tok.AuthorName = req.Name
+		}
+		tok.AuthorEmail = req.AuthorEmail
+	default:
+		SendError(rw, r, http.StatusBadRequest, fmt.Sprintf("invalid kind %q", req.Kind))
+		return
+	}
+	tok, secret, err := ts.Create(tok)
+	if err != nil {
+		s.handleErr(rw, r, err)
+		return
+	}
+	WriteJSON(rw, r, &CreateTokenResponse{
+		TokenPayload: *tokenPayload(tok),
+		Token:        secret,
+	})
+}
+
+func (s *Server) handleRevokeToken(rw http.ResponseWriter, r *http.Request) {
+	m := tokenURIPat.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		SendHTTPError(rw, r, http.StatusNotFound)
+		return
+	}
+	ts := s.getTokenStore(rw, r)
+	if ts == nil {
+		return
+	}
+	if err := ts.Revoke(m[1]); err != nil {
+		if errors.Is(err, tokens.ErrNotFound) {
+			SendError(rw, r, http.StatusNotFound, err.Error())
+			return
+		}
+		s.handleErr(rw, r, err)
+		return
+	}
+}
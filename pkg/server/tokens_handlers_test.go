@@ -0,0 +1,89 @@
+package server_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/server"
+	server_testutils "github.com/wrgl/wrgld/pkg/server/testutils"
+	"github.com/wrgl/wrgld/pkg/tokens"
+)
+
+func createToken(t *testing.T, cli *apiclient.Client, req *server.CreateTokenRequest) *server.CreateTokenResponse {
+	t.Helper()
+	resp, err := cli.JsonRequest(http.MethodPost, "/tokens/", req)
+	require.NoError(t, err)
+	ctr := &server.CreateTokenResponse{}
+	parseJSONResponse(t, resp, ctr)
+	return ctr
+}
+
+func (s *testSuite) TestTokensHandlers(t *testing.T) {
+	_, uri, _, cleanup := s.s.NewRemote(t, "")
+	defer cleanup()
+	newClient := func(token string) *apiclient.Client {
+		cli, err := apiclient.NewClient(uri, testr.New(t), apiclient.WithRelyingPartyToken(token))
+		require.NoError(t, err)
+		return cli
+	}
+	cli := newClient(s.s.AdminToken(t))
+
+	_, err := cli.JsonRequest(http.MethodPost, "/tokens/", &server.CreateTokenRequest{Name: "abc", Scopes: []string{"delete"}})
+	assertHTTPError(t, err, http.StatusBadRequest, `invalid scope "delete"`)
+	_, err = cli.JsonRequest(http.MethodPost, "/tokens/", &server.CreateTokenRequest{Name: "abc", Kind: "robot", Scopes: []string{"read"}})
+	assertHTTPError(t, err, http.StatusBadRequest, `invalid kind "robot"`)
+	_, err = cli.JsonRequest(http.MethodPost, "/tokens/", &server.CreateTokenRequest{Scopes: []string{"read"}})
+	assertHTTPError(t, err, http.StatusBadRequest, "name is required")
+
+	// personal tokens act as the user who created them
+	pat := createToken(t, cli, &server.CreateTokenRequest{Name: "laptop", Scopes: []string{tokens.ScopeWrite}})
+	assert.True(t, strings.HasPrefix(pat.Token, tokens.Prefix))
+	assert.Equal(t, tokens.KindPersonal, pat.Kind)
+	assert.Equal(t, server_testutils.Name, pat.AuthorName)
+	assert.Equal(t, server_testutils.Email, pat.AuthorEmail)
+	patCli := newClient(pat.Token)
+	cr, err := patCli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	com, err := patCli.GetCommit((*cr.Sum)[:])
+	require.NoError(t, err)
+	assert.Equal(t, server_testutils.Email, com.AuthorEmail)
+	_, err = patCli.Request(http.MethodGet, "/tokens/", nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+
+	// read-only service-account token
+	sat := createToken(t, cli, &server.CreateTokenRequest{Name: "ci", Kind: tokens.KindService, Scopes: []string{tokens.ScopeRead}})
+	assert.Equal(t, "ci", sat.AuthorName)
+	satCli := newClient(sat.Token)
+	_, err = satCli.GetRefs(nil, nil)
+	require.NoError(t, err)
+	_, err = satCli.Commit("alpha", "second commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+
+	// admin tokens can manage tokens
+	adm := createToken(t, cli, &server.CreateTokenRequest{Name: "admin", Kind: tokens.KindService, Scopes: []string{tokens.ScopeAdmin}})
+	admCli := newClient(adm.Token)
+	resp, err := admCli.Request(http.MethodGet, "/tokens/", nil, nil)
+	require.NoError(t, err)
+	ltr := &server.ListTokensResponse{}
+	parseJSONResponse(t, resp, ltr)
+	require.Len(t, ltr.Tokens, 3)
+	for i, id := range []string{pat.ID, sat.ID, adm.ID} {
+		assert.Equal(t, id, ltr.Tokens[i].ID)
+		assert.NotNil(t, ltr.Tokens[i].LastUsedAt)
+	}
+
+	_, err = admCli.Request(http.MethodDelete, "/tokens/"+pat.ID+"/", nil, nil)
+	require.NoError(t, err)
+	_, err = admCli.Request(http.MethodDelete, "/tokens/"+pat.ID+"/", nil, nil)
+	assertHTTPError(t, err, http.StatusNotFound, "token not found")
+	_, err = patCli.GetRefs(nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+	_, err = newClient(tokens.Prefix+"abc").GetRefs(nil, nil)
+	assertHTTPError(t, err, http.StatusUnauthorized, "Unauthorized")
+}
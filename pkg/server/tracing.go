@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/wrgl/wrgld/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sessionIDKey is the span attribute holding the id of an upload-pack or
+// receive-pack session
+const sessionIDKey = attribute.Key("wrgld.session.id")
+
+// requestIDKey is the span attribute holding the id of a request, see
+// RequestIDHeader
+const requestIDKey = attribute.Key("wrgld.request.id")
+
+// startSpan starts a span as a child of the span of r and returns r with the
+// new span in its context
+func startSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx, span := tracing.Start(r.Context(), name, trace.WithAttributes(attrs...))
+	return r.WithContext(ctx), span
+}
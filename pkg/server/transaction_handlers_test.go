@@ -1,6 +1,7 @@
 package server_test
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -94,17 +95,25 @@ func (s *testSuite) TestTransaction(t *testing.T) {
 	sort.Slice(ce.Commits, func(i, j int) bool {
 		return ce.Commits[i].Ref < ce.Commits[j].Ref
 	})
+	// commits are rewritten so they are reported with the new heads
+	rs := s.s.GetRS(repo)
+	alpha, err := ref.GetHead(rs, "alpha")
+	require.NoError(t, err)
+	assert.NotEqual(t, (*cr4.Sum)[:], alpha)
+	beta, err := ref.GetHead(rs, "beta")
+	require.NoError(t, err)
 	assert.Equal(t, &webhook.CommitEvent{
+		ID:            ce.ID,
 		Type:          conf.CommitEventType,
 		TransactionID: tid.String(),
 		Commits: []webhook.Commit{
 			{
-				Sum:     cr4.Sum.String(),
+				Sum:     hex.EncodeToString(alpha),
 				Ref:     "heads/alpha",
 				Message: fmt.Sprintf("commit [tx/%s]\nsecond commit", tid.String()),
 			},
 			{
-				Sum:     cr5.Sum.String(),
+				Sum:     hex.EncodeToString(beta),
 				Ref:     "heads/beta",
 				Message: fmt.Sprintf("commit [tx/%s]\ninitial commit", tid.String()),
 			},
@@ -147,3 +156,62 @@ func (s *testSuite) TestTransaction(t *testing.T) {
 	_, err = cli.CreateTransaction(req)
 	assert.Error(t, err)
 }
+
+func (s *testSuite) TestTransactionEvents(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	getWebhookPayload, cleanup := s.setupWebhook(t, repo,
+		webhook.TransactionCreatedEventType,
+		webhook.TransactionCommittedEventType,
+		webhook.TransactionDiscardedEventType,
+		webhook.BranchCreatedEventType,
+	)
+	defer cleanup()
+
+	ctr, err := cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	s.webhookWG.Wait()
+	pl := getWebhookPayload()
+	require.NotNil(t, pl)
+	require.Len(t, pl.Events, 1)
+	te := pl.Events[0].(*webhook.TransactionEvent)
+	assert.Equal(t, webhook.TransactionCreatedEventType, te.Type)
+	assert.Equal(t, ctr.ID, te.TransactionID)
+	assert.Equal(t, server_testutils.Email, te.AuthorEmail)
+
+	tid := uuid.Must(uuid.Parse(ctr.ID))
+	cr, err := cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, &tid)
+	require.NoError(t, err)
+	_, err = cli.CommitTransaction(tid)
+	require.NoError(t, err)
+	s.webhookWG.Wait()
+	pl = getWebhookPayload()
+	require.NotNil(t, pl)
+	require.Len(t, pl.Events, 2)
+	te = pl.Events[0].(*webhook.TransactionEvent)
+	assert.Equal(t, webhook.TransactionCommittedEventType, te.Type)
+	assert.Equal(t, []string{"heads/alpha"}, te.Refs)
+	be := pl.Events[1].(*webhook.BranchEvent)
+	assert.Equal(t, webhook.BranchCreatedEventType, be.Type)
+	assert.Equal(t, "heads/alpha", be.Ref)
+	assert.Equal(t, "transaction", be.Action)
+	assert.Equal(t, ctr.ID, be.TransactionID)
+	com, err := cli.GetHead("alpha")
+	require.NoError(t, err)
+	assert.Equal(t, cr.Table, com.Table.Sum)
+	assert.Equal(t, com.Sum.String(), be.Sum)
+
+	ctr, err = cli.CreateTransaction(nil)
+	require.NoError(t, err)
+	s.webhookWG.Wait()
+	getWebhookPayload()
+	_, err = cli.DiscardTransaction(uuid.Must(uuid.Parse(ctr.ID)))
+	require.NoError(t, err)
+	s.webhookWG.Wait()
+	pl = getWebhookPayload()
+	require.NotNil(t, pl)
+	require.Len(t, pl.Events, 1)
+	te = pl.Events[0].(*webhook.TransactionEvent)
+	assert.Equal(t, webhook.TransactionDiscardedEventType, te.Type)
+	assert.Equal(t, ctr.ID, te.TransactionID)
+}
@@ -3,28 +3,42 @@ package server
 import (
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 
 	"github.com/wrgl/wrgl/pkg/api"
 	"github.com/wrgl/wrgl/pkg/api/payload"
+	"github.com/wrgl/wrgl/pkg/ref"
 	"github.com/wrgl/wrgl/pkg/transaction"
+	"github.com/wrgl/wrgld/pkg/audit"
 	"github.com/wrgl/wrgld/pkg/webhook"
 )
 
+// decodeJSON reads the body of r into obj. Errors are caused by the client.
+func decodeJSON(r *http.Request, obj interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return badRequest(CodeBadRequest, fmt.Errorf("error reading body: %w", err))
+	}
+	if err = json.Unmarshal(b, obj); err != nil {
+		return badRequest(CodeInvalidJSON, fmt.Errorf("invalid JSON payload: %w", err))
+	}
+	return nil
+}
+
+// parseJSONRequest reads the JSON body of r into obj. If that fails, an error
+// is sent and false is returned.
 func parseJSONRequest(r *http.Request, rw http.ResponseWriter, obj interface{}) bool {
 	if v := r.Header.Get("Content-Type"); !strings.Contains(v, api.CTJSON) {
-		SendError(rw, r, http.StatusBadRequest, "JSON payload expected")
+		SendError(rw, r, http.StatusUnsupportedMediaType, "JSON payload expected")
 		return false
 	}
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(b, obj)
-	if err != nil {
-		panic(err)
+	if err := decodeJSON(r, obj); err != nil {
+		sendErr(rw, r, err)
+		return false
 	}
 	return true
 }
@@ -46,22 +60,76 @@ func (s *Server) handleUpdateTransaction(rw http.ResponseWriter, r *http.Request
 		return
 	}
 	if req.Commit {
-		commitsMap, err := transaction.Commit(db, rs, *tid)
+		ws := s.webhookSender(r)
+		refs, _, err := transaction.Diff(rs, *tid)
 		if err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
+		}
+		updates := make([]proposedUpdate, 0, len(refs))
+		for branch, sums := range refs {
+			updates = append(updates, proposedUpdate{
+				Ref: ref.HeadRef(branch), Sum: sums[0], OldSum: sums[1],
+			})
+		}
+		sort.Slice(updates, func(i, j int) bool {
+			return updates[i].Ref < updates[j].Ref
+		})
+		for _, u := range updates {
+			if msg := s.refUpdateDenial(r, u.Ref, true); msg != "" {
+				SendError(rw, r, http.StatusForbidden, msg)
+				return
+			}
+		}
+		preEvt := &webhook.PreReceiveEvent{
+			Action:        "commit",
+			TransactionID: tid.String(),
+			AuthorName:    author.Name,
+			AuthorEmail:   author.Email,
+		}
+		if err = preReceive(r.Context(), db, ws, preEvt, updates, s.logger); err != nil {
+			s.handleErr(rw, r, preReceiveError(err))
+			return
 		}
-		ws, err := webhook.NewSender(s.getConfig(r), s.logger, s.webhookSenderOpts...)
+		for _, u := range updates {
+			if moved, err := refMoved(rs, u); err != nil {
+				s.handleErr(rw, r, err)
+				return
+			} else if moved {
+				SendError(rw, r, http.StatusConflict, fmt.Sprintf("branch %q updated since commit started", strings.TrimPrefix(u.Ref, ref.HeadPrefix)))
+				return
+			}
+		}
+		commitsMap, err := transaction.Commit(db, rs, *tid)
 		if err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
+		}
+		// transaction.Commit rewrites commits without setting their new sums,
+		// so new heads must be read back
+		heads := make(map[string][]byte, len(updates))
+		for _, u := range updates {
+			if heads[u.Ref], err = ref.GetRef(rs, u.Ref); err != nil {
+				s.handleErr(rw, r, err)
+				return
+			}
 		}
-		defer ws.Flush()
 		commits := []webhook.Commit{}
-		for refname, com := range commitsMap {
+		parents := [][]byte{}
+		for _, u := range updates {
+			com, ok := commitsMap[u.Ref]
+			if !ok {
+				continue
+			}
 			commits = append(commits, webhook.Commit{
-				Sum:     hex.EncodeToString(com.Sum),
-				Ref:     refname,
+				Sum:     hex.EncodeToString(heads[u.Ref]),
+				Ref:     u.Ref,
 				Message: com.Message,
 			})
+			parents = append(parents, u.OldSum)
+		}
+		if err = addDiffStats(r.Context(), db, ws, commits, parents, preReceiveDiffs(preEvt), s.logger); err != nil {
+			s.logger.Error(err, "error computing diff stats", "transaction", tid.String())
 		}
 		ws.EnqueueEvent(&webhook.CommitEvent{
 			TransactionID: tid.String(),
@@ -69,9 +137,57 @@ func (s *Server) handleUpdateTransaction(rw http.ResponseWriter, r *http.Request
 			AuthorName:    author.Name,
 			AuthorEmail:   author.Email,
 		})
+		evt := &webhook.TransactionEvent{
+			Type:          webhook.TransactionCommittedEventType,
+			TransactionID: tid.String(),
+			AuthorName:    author.Name,
+			AuthorEmail:   author.Email,
+		}
+		for _, u := range updates {
+			evt.Refs = append(evt.Refs, u.Ref)
+			if u.OldSum == nil {
+				ws.EnqueueEvent(&webhook.BranchEvent{
+					Type:          webhook.BranchCreatedEventType,
+					Ref:           u.Ref,
+					Sum:           hex.EncodeToString(heads[u.Ref]),
+					Action:        "transaction",
+					TransactionID: tid.String(),
+					AuthorName:    author.Name,
+					AuthorEmail:   author.Email,
+				})
+			}
+		}
+		ws.EnqueueEvent(evt)
+		rec := &audit.Record{
+			Action:        audit.ActionTransactionCommit,
+			TransactionID: tid.String(),
+		}
+		for _, u := range updates {
+			u.Sum = heads[u.Ref]
+			rec.Refs = append(rec.Refs, auditRefUpdates([]proposedUpdate{u})...)
+		}
+		s.recordAudit(r, rec)
+		if !s.flushWebhooks(rw, r, ws) {
+			return
+		}
 	} else if req.Discard {
 		if err := transaction.Discard(rs, *tid); err != nil {
-			panic(err)
+			s.handleErr(rw, r, err)
+			return
+		}
+		ws := s.webhookSender(r)
+		ws.EnqueueEvent(&webhook.TransactionEvent{
+			Type:          webhook.TransactionDiscardedEventType,
+			TransactionID: tid.String(),
+			AuthorName:    author.Name,
+			AuthorEmail:   author.Email,
+		})
+		s.recordAudit(r, &audit.Record{
+			Action:        audit.ActionTransactionDiscard,
+			TransactionID: tid.String(),
+		})
+		if !s.flushWebhooks(rw, r, ws) {
+			return
 		}
 	} else {
 		SendError(rw, r, http.StatusBadRequest, "must either discard or commit transaction")
@@ -2,15 +2,32 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/wrgl/wrgl/pkg/api"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
 )
 
+// UploadPackSessionStore keeps sessions in between requests. Set and Get return
+// an error if sessions cannot be saved or read at the moment.
 type UploadPackSessionStore interface {
-	Set(sid uuid.UUID, ses *UploadPackSession)
-	Get(sid uuid.UUID) (ses *UploadPackSession, ok bool)
+	Set(sid uuid.UUID, ses *UploadPackSession) error
+	Get(sid uuid.UUID) (ses *UploadPackSession, ok bool, err error)
 	Delete(sid uuid.UUID)
+	List() []uuid.UUID
+}
+
+// uploadPackSessionOwners returns the owners of sessions. Sessions that cannot be
+// read are not counted.
+func uploadPackSessionOwners(sessions UploadPackSessionStore) []string {
+	sl := []string{}
+	for _, sid := range sessions.List() {
+		if ses, ok, err := sessions.Get(sid); err == nil && ok {
+			sl = append(sl, ses.owner)
+		}
+	}
+	return sl
 }
 
 func (s *Server) getUploadPackSession(r *http.Request, sessions UploadPackSessionStore) (ses *UploadPackSession, sid uuid.UUID, err error) {
@@ -21,30 +38,62 @@ func (s *Server) getUploadPackSession(r *http.Request, sessions UploadPackSessio
 		if err != nil {
 			return
 		}
-		ses, ok = sessions.Get(sid)
+		ses, ok, err = sessions.Get(sid)
+		if err != nil {
+			err = sessionStoreError(err)
+			return
+		}
 		if !ok {
 			ses = nil
+		} else if err = ses.resume(s.getDB(r), s.getRS(r)); err != nil {
+			sessions.Delete(sid)
+			return
 		}
 	}
 	if ses == nil {
+		if s.Draining() {
+			err = errDraining
+			return
+		}
 		sid, err = uuid.NewRandom()
 		if err != nil {
 			return
 		}
+		if s.exceedsSessionQuota(r, wrgldconf.RouteClassUploadPack, func() []string {
+			return uploadPackSessionOwners(sessions)
+		}) {
+			err = errTooManySessions
+			return
+		}
 		db := s.getDB(r)
 		rs := s.getRS(r)
 		c := s.getConfig(r)
 		ses = NewUploadPackSession(db, rs, sid, c.MaxPackFileSize())
-		sessions.Set(sid, ses)
+		ses.owner = rateLimitClient(r)
+		if err = sessions.Set(sid, ses); err != nil {
+			err = sessionStoreError(err)
+			return
+		}
 	}
+	ses.handleErr = s.handleStreamErr
 	return
 }
 
 func (s *Server) handleUploadPack(rw http.ResponseWriter, r *http.Request) {
+	defer s.trackPackRequest()()
 	sessions := s.getUpSession(r)
 	ses, sid, err := s.getUploadPackSession(r, sessions)
+	if err == errDraining {
+		sendDraining(rw, r)
+		return
+	}
+	if err == errTooManySessions {
+		sendTooManyRequests(rw, r, time.Second, "too many concurrent upload-pack sessions")
+		return
+	}
 	if err != nil {
-		panic(err)
+		s.handleErr(rw, r, err)
+		return
 	}
 	defer func() {
 		if s := recover(); s != nil {
@@ -54,5 +103,11 @@ func (s *Server) handleUploadPack(rw http.ResponseWriter, r *http.Request) {
 	}()
 	if done := ses.ServeHTTP(rw, r); done {
 		sessions.Delete(sid)
+	} else if err = sessions.Set(sid, ses); err != nil {
+		// stores that persist sessions save the new state. The response is
+		// already sent, so the session is dropped for the next request to
+		// fail rather than resume from an outdated state.
+		s.logErr(r, sessionStoreError(err), false)
+		sessions.Delete(sid)
 	}
 }
@@ -3,9 +3,8 @@ package server
 import (
 	"compress/gzip"
 	"container/list"
-	"encoding/json"
-	"io"
 	"net/http"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/wrgl/wrgl/pkg/api"
@@ -13,34 +12,61 @@ import (
 	apiutils "github.com/wrgl/wrgl/pkg/api/utils"
 	"github.com/wrgl/wrgl/pkg/objects"
 	"github.com/wrgl/wrgl/pkg/ref"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type stateFn func(rw http.ResponseWriter, r *http.Request) (nextState stateFn)
 
 func parseUploadPackRequest(r *http.Request) (req *payload.UploadPackRequest, err error) {
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		return
-	}
 	req = &payload.UploadPackRequest{}
-	err = json.Unmarshal(b, req)
-	if err != nil {
+	if err = decodeJSON(r, req); err != nil {
 		return nil, err
 	}
 	setRequestInfo(r, req)
 	return
 }
 
+// steps of an upload-pack session, saved in place of its state function
+const (
+	upStepGreet           = "greet"
+	upStepNegotiate       = "negotiate"
+	upStepNegotiateTables = "negotiate_tables"
+	upStepSendPackfile    = "send_packfile"
+)
+
 type UploadPackSession struct {
 	db              objects.Store
 	id              uuid.UUID
 	finder          *apiutils.ClosedSetsFinder
-	sender          *apiutils.ObjectSender
+	sender          *objectSender
 	state           stateFn
+	step            string
 	rs              ref.Store
 	maxPackfileSize uint64
 	candidateTables *list.List
 	tablesToSend    map[string]struct{}
+	createdAt       time.Time
+
+	// depth and rounds are what the finder was fed, so that it can be rebuilt
+	depth  int
+	rounds []*NegotiationRound
+
+	// commits and commons are what the sender is created with
+	commits []*objects.Commit
+	commons [][]byte
+
+	// packfilesSent is the number of packfiles written by the sender
+	packfilesSent int
+
+	// owner identifies the client that started the session
+	owner string
+
+	// saved is the state that a loaded session is resumed from
+	saved *UploadPackState
+
+	// handleErr answers errors that end the session. started is true if part
+	// of the response was already sent.
+	handleErr func(rw http.ResponseWriter, r *http.Request, err error, started bool)
 }
 
 func NewUploadPackSession(db objects.Store, rs ref.Store, id uuid.UUID, maxPackfileSize uint64) *UploadPackSession {
@@ -51,11 +77,29 @@ func NewUploadPackSession(db objects.Store, rs ref.Store, id uuid.UUID, maxPackf
 		maxPackfileSize: maxPackfileSize,
 		candidateTables: list.New(),
 		tablesToSend:    map[string]struct{}{},
+		createdAt:       time.Now(),
 	}
-	s.state = s.greet
+	s.state = s.next(upStepGreet)
 	return s
 }
 
+// next records step as the step of the next request and returns its state
+// function
+func (s *UploadPackSession) next(step string) stateFn {
+	s.step = step
+	switch step {
+	case upStepGreet:
+		return s.greet
+	case upStepNegotiate:
+		return s.negotiate
+	case upStepNegotiateTables:
+		return s.negotiateTables
+	case upStepSendPackfile:
+		return s.sendPackfile
+	}
+	return nil
+}
+
 func (s *UploadPackSession) sendJSONResponse(rw http.ResponseWriter, r *http.Request, acks, tableHaves [][]byte) {
 	rw.Header().Set("Content-Type", api.CTJSON)
 	http.SetCookie(rw, &http.Cookie{
@@ -72,18 +116,24 @@ func (s *UploadPackSession) sendJSONResponse(rw http.ResponseWriter, r *http.Req
 	for _, sum := range tableHaves {
 		resp.TableHaves = payload.AppendHex(resp.TableHaves, sum)
 	}
-	setResponseInfo(r, resp)
-	b, err := json.Marshal(resp)
-	if err != nil {
-		panic(err)
-	}
-	_, err = rw.Write(b)
-	if err != nil {
-		panic(err)
+	WriteJSON(rw, r, resp)
+}
+
+// fail answers r with err and ends the session
+func (s *UploadPackSession) fail(rw http.ResponseWriter, r *http.Request, err error, started bool) (nextState stateFn) {
+	if s.handleErr != nil {
+		s.handleErr(rw, r, err, started)
+	} else if !started {
+		sendErr(rw, r, err)
+	} else {
+		panic(http.ErrAbortHandler)
 	}
+	return nil
 }
 
 func (s *UploadPackSession) sendPackfile(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
+	r, span := s.startState(r, "send packfile")
+	defer span.End()
 	rw.Header().Set("Content-Type", api.CTPackfile)
 	rw.Header().Set("Content-Encoding", "gzip")
 	rw.Header().Set("Trailer", api.HeaderPurgeUploadPackSession)
@@ -98,36 +148,45 @@ func (s *UploadPackSession) sendPackfile(rw http.ResponseWriter, r *http.Request
 	gzw := gzip.NewWriter(rw)
 	defer gzw.Close()
 
-	done, info, err := s.sender.WriteObjects(gzw, nil)
+	done, info, err := s.sender.writeObjects(gzw)
 	if err != nil {
-		panic(err)
+		return s.fail(rw, r, err, true)
 	}
+	s.packfilesSent++
 	setResponseInfo(r, info)
 	if done {
 		// TODO: figure out whether to enable this trailer once more servers can deal with it?
 		// rw.Header().Set(api.HeaderPurgeUploadPackSession, "true")
 		return nil
 	}
-	return s.sendPackfile
+	return s.next(upStepSendPackfile)
 }
 
 func (s *UploadPackSession) findClosedSets(rw http.ResponseWriter, r *http.Request, req *payload.UploadPackRequest) (nextState stateFn) {
+	r, span := s.startState(r, "find closed sets")
+	defer span.End()
 	acks, err := s.finder.Process(payload.HexSliceToBytesSlice(req.Wants), payload.HexSliceToBytesSlice(req.Haves), req.Done)
 	if err != nil {
 		if v, ok := err.(*apiutils.UnrecognizedWantsError); ok {
 			SendError(rw, r, http.StatusBadRequest, v.Error())
 			return nil
 		}
-		panic(err)
+		return s.fail(rw, r, err, false)
 	}
+	s.rounds = append(s.rounds, &NegotiationRound{Wants: req.Wants, Haves: req.Haves, Done: req.Done})
 	if len(s.finder.Wants) > 0 && !req.Done {
 		s.sendJSONResponse(rw, r, acks, nil)
-		return s.negotiate
+		return s.next(upStepNegotiate)
 	}
 	s.tablesToSend, err = s.finder.TablesToSend()
 	if err != nil {
-		panic(err)
+		return s.fail(rw, r, err, false)
+	}
+	s.commits, err = s.finder.CommitsToSend()
+	if err != nil {
+		return s.fail(rw, r, err, false)
 	}
+	s.commons = s.finder.CommonCommmits()
 	for sum := range s.tablesToSend {
 		s.candidateTables.PushFront([]byte(sum))
 	}
@@ -135,10 +194,14 @@ func (s *UploadPackSession) findClosedSets(rw http.ResponseWriter, r *http.Reque
 }
 
 func (s *UploadPackSession) greet(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
+	r, span := s.startState(r, "greet")
+	defer span.End()
 	req, err := parseUploadPackRequest(r)
 	if err != nil {
-		panic(err)
+		sendErr(rw, r, err)
+		return nil
 	}
+	s.depth = req.Depth
 	s.finder = apiutils.NewClosedSetsFinder(s.db, s.rs, req.Depth)
 	if len(req.Wants) == 0 {
 		SendError(rw, r, http.StatusBadRequest, "empty wants list")
@@ -148,22 +211,28 @@ func (s *UploadPackSession) greet(rw http.ResponseWriter, r *http.Request) (next
 }
 
 func (s *UploadPackSession) negotiate(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
+	r, span := s.startState(r, "negotiate")
+	defer span.End()
 	req, err := parseUploadPackRequest(r)
 	if err != nil {
-		panic(err)
+		sendErr(rw, r, err)
+		return nil
 	}
 	return s.findClosedSets(rw, r, req)
 }
 
 func (s *UploadPackSession) sendTableHaves(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
+	r, span := s.startState(r, "send table haves")
+	defer span.End()
 	if s.candidateTables.Len() == 0 {
-		commits, err := s.finder.CommitsToSend()
-		if err != nil {
-			panic(err)
+		var err error
+		sums := make([][]byte, len(s.commits))
+		for i, com := range s.commits {
+			sums[i] = com.Sum
 		}
-		s.sender, err = apiutils.NewObjectSender(s.db, commits, s.tablesToSend, s.finder.CommonCommmits(), s.maxPackfileSize)
+		s.sender, err = newObjectSender(s.db, sums, s.tablesToSend, s.commons, s.maxPackfileSize)
 		if err != nil {
-			panic(err)
+			return s.fail(rw, r, err, false)
 		}
 		return s.sendPackfile(rw, r)
 	}
@@ -175,13 +244,16 @@ func (s *UploadPackSession) sendTableHaves(rw http.ResponseWriter, r *http.Reque
 		tbls = append(tbls, s.candidateTables.Remove(s.candidateTables.Front()).([]byte))
 	}
 	s.sendJSONResponse(rw, r, nil, tbls)
-	return s.negotiateTables
+	return s.next(upStepNegotiateTables)
 }
 
 func (s *UploadPackSession) negotiateTables(rw http.ResponseWriter, r *http.Request) (nextState stateFn) {
+	r, span := s.startState(r, "negotiate tables")
+	defer span.End()
 	req, err := parseUploadPackRequest(r)
 	if err != nil {
-		panic(err)
+		sendErr(rw, r, err)
+		return nil
 	}
 	for _, sum := range req.TableACKs {
 		delete(s.tablesToSend, string((*sum)[:]))
@@ -189,11 +261,16 @@ func (s *UploadPackSession) negotiateTables(rw http.ResponseWriter, r *http.Requ
 	return s.sendTableHaves(rw, r)
 }
 
+// startState traces a state of the session in a span
+func (s *UploadPackSession) startState(r *http.Request, name string) (*http.Request, trace.Span) {
+	return startSpan(r, "upload-pack "+name, sessionIDKey.String(s.id.String()))
+}
+
 // ServeHTTP negotiates which commits to be sent and send them in one or more packfiles,
 // returns true when this session is completed and should be removed.
 func (s *UploadPackSession) ServeHTTP(rw http.ResponseWriter, r *http.Request) bool {
 	if ct := r.Header.Get("Content-Type"); ct != api.CTJSON {
-		SendError(rw, r, http.StatusUnsupportedMediaType, "")
+		SendError(rw, r, http.StatusUnsupportedMediaType, "JSON payload expected")
 		return true
 	}
 	s.state = s.state(rw, r)
@@ -27,21 +27,34 @@ func NewUploadPackSessionMap(idle, ttl time.Duration) *UploadPackSessionMap {
 	return m
 }
 
-func (m *UploadPackSessionMap) Set(sid uuid.UUID, ses *UploadPackSession) {
-	m.m.Add(sid.String(), ses, m.ttl)
+// Set adds a session, or replaces it without extending its TTL
+func (m *UploadPackSessionMap) Set(sid uuid.UUID, ses *UploadPackSession) error {
+	if !m.m.Replace(sid.String(), ses) {
+		m.m.Add(sid.String(), ses, m.ttl)
+	}
+	return nil
 }
 
-func (m *UploadPackSessionMap) Get(sid uuid.UUID) (ses *UploadPackSession, ok bool) {
+func (m *UploadPackSessionMap) Get(sid uuid.UUID) (ses *UploadPackSession, ok bool, err error) {
 	if v := m.m.Get(sid.String()); v != nil {
-		return v.(*UploadPackSession), true
+		return v.(*UploadPackSession), true, nil
 	}
-	return nil, false
+	return nil, false, nil
 }
 
 func (m *UploadPackSessionMap) Delete(sid uuid.UUID) {
 	m.m.Pop(sid.String())
 }
 
+func (m *UploadPackSessionMap) List() []uuid.UUID {
+	keys := m.m.Keys()
+	sl := make([]uuid.UUID, 0, len(keys))
+	for _, k := range keys {
+		sl = append(sl, uuid.MustParse(k))
+	}
+	return sl
+}
+
 func (m *UploadPackSessionMap) Stop() {
 	m.m.Stop()
 }
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+var deliveryURIPat = regexp.MustCompile(`/webhooks/deliveries/([0-9a-f-]+)/`)
+
+type GetDeliveriesResponse struct {
+	Deliveries []*webhook.DeliveryRecord `json:"deliveries"`
+}
+
+type PingWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+func (s *Server) sendWebhookError(rw http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, webhook.ErrNoDeliveryLog),
+		errors.Is(err, webhook.ErrDeliveryNotFound),
+		errors.Is(err, webhook.ErrWebhookNotFound):
+		SendError(rw, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, webhook.ErrPayloadNotRecorded):
+		SendError(rw, r, http.StatusConflict, err.Error())
+	default:
+		s.handleErr(rw, r, err)
+	}
+}
+
+func parseDeliveryFilter(r *http.Request) (*webhook.DeliveryFilter, error) {
+	query := r.URL.Query()
+	f := &webhook.DeliveryFilter{
+		URL:       query.Get("url"),
+		EventID:   query.Get("eventId"),
+		EventType: conf.WebhookEventType(query.Get("eventType")),
+	}
+	switch v := query.Get("status"); v {
+	case "":
+	case "succeeded", "failed":
+		b := v == "succeeded"
+		f.Succeeded = &b
+	default:
+		return nil, errors.New("invalid status")
+	}
+	for key, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := query.Get(key); v != "" {
+			var err error
+			*t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.New("invalid " + key)
+			}
+		}
+	}
+	limit, err := getQueryInt(query, "limit", 100)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return nil, errors.New("invalid limit")
+	}
+	f.Limit = limit
+	return f, nil
+}
+
+func (s *Server) handleGetDeliveries(rw http.ResponseWriter, r *http.Request) {
+	f, err := parseDeliveryFilter(r)
+	if err != nil {
+		SendError(rw, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	sl, err := s.webhookSender(r).Deliveries(f)
+	if err != nil {
+		s.sendWebhookError(rw, r, err)
+		return
+	}
+	resp := &GetDeliveriesResponse{Deliveries: make([]*webhook.DeliveryRecord, len(sl))}
+	for i, rec := range sl {
+		// payloads can be large, they are only needed for redelivery
+		obj := *rec
+		obj.Payload = nil
+		resp.Deliveries[i] = &obj
+	}
+	WriteJSON(rw, r, resp)
+}
+
+func (s *Server) handleRedeliver(rw http.ResponseWriter, r *http.Request) {
+	m := deliveryURIPat.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		SendHTTPError(rw, r, http.StatusNotFound)
+		return
+	}
+	rec, err := s.webhookSender(r).Redeliver(r.Context(), m[1])
+	if err != nil {
+		s.sendWebhookError(rw, r, err)
+		return
+	}
+	rec.Payload = nil
+	WriteJSON(rw, r, rec)
+}
+
+func (s *Server) handlePingWebhook(rw http.ResponseWriter, r *http.Request) {
+	req := &PingWebhookRequest{}
+	if !parseJSONRequest(r, rw, req) {
+		return
+	}
+	if req.URL == "" {
+		SendError(rw, r, http.StatusBadRequest, "url is required")
+		return
+	}
+	rec, err := s.webhookSender(r).Ping(r.Context(), req.URL)
+	if err != nil {
+		s.sendWebhookError(rw, r, err)
+		return
+	}
+	rec.Payload = nil
+	WriteJSON(rw, r, rec)
+}
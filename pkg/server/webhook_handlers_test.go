@@ -0,0 +1,99 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apiclient "github.com/wrgl/wrgl/pkg/api/client"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgl/pkg/testutils"
+	"github.com/wrgl/wrgld/pkg/server"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+func parseJSONResponse(t *testing.T, resp *http.Response, obj interface{}) {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.NoError(t, json.Unmarshal(b, obj))
+}
+
+func getDeliveries(t *testing.T, cli *apiclient.Client, query url.Values) []*webhook.DeliveryRecord {
+	t.Helper()
+	resp, err := cli.Request(http.MethodGet, "/webhooks/deliveries/?"+query.Encode(), nil, nil)
+	require.NoError(t, err)
+	gdr := &server.GetDeliveriesResponse{}
+	parseJSONResponse(t, resp, gdr)
+	return gdr.Deliveries
+}
+
+func (s *testSuite) TestWebhookDeliveries(t *testing.T) {
+	repo, cli, _, cleanup := s.s.NewClient(t, "", true)
+	defer cleanup()
+	getWebhookPayload, cleanup := s.setupWebhook(t, repo, conf.CommitEventType)
+	defer cleanup()
+	c, err := s.s.GetConfS(repo).Open()
+	require.NoError(t, err)
+	whURL := c.Webhooks[len(c.Webhooks)-1].URL
+
+	_, err = cli.Commit("alpha", "initial commit", "file.csv", testutils.RawCSVBytesReader(testutils.BuildRawCSV(3, 4)), nil, nil)
+	require.NoError(t, err)
+	s.webhookWG.Wait()
+	pl := getWebhookPayload()
+	require.NotNil(t, pl)
+	evtID := pl.Events[0].(*webhook.CommitEvent).ID
+
+	sl := getDeliveries(t, cli, url.Values{"eventId": []string{evtID}})
+	require.Len(t, sl, 1)
+	assert.Equal(t, whURL, sl[0].URL)
+	assert.Equal(t, []string{evtID}, sl[0].EventIDs)
+	assert.Equal(t, []conf.WebhookEventType{conf.CommitEventType}, sl[0].EventTypes)
+	assert.Equal(t, http.StatusOK, sl[0].StatusCode)
+	assert.Empty(t, sl[0].Error)
+	assert.Empty(t, sl[0].Payload)
+	assert.Empty(t, getDeliveries(t, cli, url.Values{"eventId": []string{evtID}, "status": []string{"failed"}}))
+	assert.Len(t, getDeliveries(t, cli, url.Values{"url": []string{whURL}, "status": []string{"succeeded"}}), 1)
+
+	_, err = cli.Request(http.MethodGet, "/webhooks/deliveries/?status=abc", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid status")
+	_, err = cli.Request(http.MethodGet, "/webhooks/deliveries/?since=abc", nil, nil)
+	assertHTTPError(t, err, http.StatusBadRequest, "invalid since")
+
+	// redeliver
+	resp, err := cli.Request(http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%s/redeliver/", sl[0].ID), nil, nil)
+	require.NoError(t, err)
+	rec := &webhook.DeliveryRecord{}
+	parseJSONResponse(t, resp, rec)
+	assert.NotEqual(t, sl[0].ID, rec.ID)
+	assert.Equal(t, http.StatusOK, rec.StatusCode)
+	pl = getWebhookPayload()
+	require.NotNil(t, pl)
+	assert.Equal(t, evtID, pl.Events[0].(*webhook.CommitEvent).ID)
+	assert.Len(t, getDeliveries(t, cli, url.Values{"eventId": []string{evtID}}), 2)
+
+	_, err = cli.Request(http.MethodPost, "/webhooks/deliveries/6b0b5a5c-1b1e-4f1c-9a3c-9c1e7f3e2d11/redeliver/", nil, nil)
+	assertHTTPError(t, err, http.StatusNotFound, "delivery not found")
+
+	// ping
+	resp, err = cli.JsonRequest(http.MethodPost, "/webhooks/ping/", &server.PingWebhookRequest{URL: whURL})
+	require.NoError(t, err)
+	rec = &webhook.DeliveryRecord{}
+	parseJSONResponse(t, resp, rec)
+	assert.Equal(t, http.StatusOK, rec.StatusCode)
+	assert.Equal(t, []conf.WebhookEventType{webhook.PingEventType}, rec.EventTypes)
+	pl = getWebhookPayload()
+	require.NotNil(t, pl)
+	assert.Equal(t, rec.EventIDs[0], pl.Events[0].(*webhook.PingEvent).ID)
+
+	_, err = cli.JsonRequest(http.MethodPost, "/webhooks/ping/", &server.PingWebhookRequest{URL: "http://unknown.hook"})
+	assertHTTPError(t, err, http.StatusNotFound, "webhook not found")
+	_, err = cli.JsonRequest(http.MethodPost, "/webhooks/ping/", &server.PingWebhookRequest{})
+	assertHTTPError(t, err, http.StatusBadRequest, "url is required")
+}
@@ -0,0 +1,173 @@
+// Package tlsreload serves TLS with a certificate, key and client CA bundle
+// that are reloaded whenever their files change, so that certificates can be
+// rotated without restarting wrgld.
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// DefaultCheckInterval is how often files are checked for changes
+const DefaultCheckInterval = 10 * time.Second
+
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	interval     time.Duration
+	logger       logr.Logger
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+type ReloaderOption func(r *Reloader)
+
+// WithClientCA verifies client certificates against the CA bundle in file
+func WithClientCA(file string) ReloaderOption {
+	return func(r *Reloader) {
+		r.clientCAFile = file
+	}
+}
+
+// WithCheckInterval changes how often files are checked for changes
+func WithCheckInterval(d time.Duration) ReloaderOption {
+	return func(r *Reloader) {
+		r.interval = d
+	}
+}
+
+// NewReloader loads the certificate and key, returning an error if they are
+// invalid
+func NewReloader(certFile, keyFile string, logger logr.Logger, opts ...ReloaderOption) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: DefaultCheckInterval,
+		logger:   logger.WithName("tlsreload"),
+		modTimes: map[string]time.Time{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	sl := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		sl = append(sl, r.clientCAFile)
+	}
+	return sl
+}
+
+// load reads all files. It must be called with mutex held or before the
+// reloader is shared.
+func (r *Reloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, fp := range r.files() {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			return err
+		}
+		modTimes[fp] = fi.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		b, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificate found in %s", r.clientCAFile)
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// maybeReload reloads files if any of them changed since they were loaded.
+// Errors are logged and the previous certificate is kept.
+func (r *Reloader) maybeReload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastCheck) < r.interval {
+		return
+	}
+	r.lastCheck = now
+	changed := false
+	for _, fp := range r.files() {
+		fi, err := os.Stat(fp)
+		if err != nil {
+			r.logger.Error(err, "error checking tls file", "file", fp)
+			return
+		}
+		if !fi.ModTime().Equal(r.modTimes[fp]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		r.logger.Error(err, "error reloading tls files, keeping previous certificate")
+		return
+	}
+	r.logger.Info("reloaded tls certificate", "file", r.certFile)
+}
+
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.maybeReload()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cert, r.clientCAs
+}
+
+// TLSConfig returns a config that always serves the latest certificate.
+// Client certificates are verified against the client CA bundle according to
+// clientAuth, which is ignored if no bundle is set. HTTP/2 is offered along
+// with HTTP/1.1.
+func (r *Reloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	base.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := r.current()
+		// cloning keeps protocols and session ticket keys of the base config
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*cert}
+		if pool != nil {
+			c.ClientCAs = pool
+			c.ClientAuth = clientAuth
+		}
+		return c, nil
+	}
+	return base
+}
@@ -0,0 +1,139 @@
+package tlsreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newKeyPair(t *testing.T, cn string, parent *keyPair) *keyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &keyPair{cert: cert, key: key}
+}
+
+func (p *keyPair) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.cert.Raw})
+}
+
+func (p *keyPair) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(certFile, p.certPEM(), 0600))
+	b, err := x509.MarshalECPrivateKey(p.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600))
+}
+
+func (p *keyPair) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{p.cert.Raw}, PrivateKey: p.key}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	ca := newKeyPair(t, "ca", nil)
+	require.NoError(t, os.WriteFile(caFile, ca.certPEM(), 0600))
+	srvPair1 := newKeyPair(t, "server-1", ca)
+	srvPair1.write(t, certFile, keyFile)
+	client := newKeyPair(t, "client", ca)
+
+	_, err := NewReloader(certFile, filepath.Join(dir, "missing.key"), testr.New(t))
+	assert.Error(t, err)
+
+	rl, err := NewReloader(certFile, keyFile, testr.New(t), WithClientCA(caFile), WithCheckInterval(0))
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			rw.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+		}
+	}))
+	ts.TLS = rl.TLSConfig(tls.VerifyClientCertIfGiven)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (serverCN, body string) {
+		t.Helper()
+		c := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := c.Get(ts.URL)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, 2, resp.ProtoMajor)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.TLS.PeerCertificates[0].Subject.CommonName, string(b)
+	}
+	cn, body := get()
+	assert.Equal(t, "server-1", cn)
+	assert.Equal(t, "", body)
+	cn, body = get(client.tlsCert())
+	assert.Equal(t, "server-1", cn)
+	assert.Equal(t, "client", body)
+
+	// certificate is rotated
+	srvPair2 := newKeyPair(t, "server-2", ca)
+	srvPair2.write(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	cn, _ = get()
+	assert.Equal(t, "server-2", cn)
+
+	// invalid files are ignored
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	future = future.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, future, future))
+	cn, _ = get()
+	assert.Equal(t, "server-2", cn)
+}
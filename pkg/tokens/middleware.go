@@ -0,0 +1,65 @@
+package tokens
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type tokenKey struct{}
+
+func SetToken(r *http.Request, tok *Token) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, tok))
+}
+
+// GetToken returns the token that authenticated the request, or nil if the
+// request was not authenticated with a wrgld token
+func GetToken(r *http.Request) *Token {
+	if i := r.Context().Value(tokenKey{}); i != nil {
+		return i.(*Token)
+	}
+	return nil
+}
+
+// BearerSecret returns the bearer token of the request if it was issued by
+// wrgld
+func BearerSecret(r *http.Request) string {
+	s := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.HasPrefix(s, Prefix) {
+		return s
+	}
+	return ""
+}
+
+// Middleware authenticates requests bearing a wrgld token. Authenticated
+// requests are passed to tokenHandler with the token stored in the request
+// context, while other requests are passed to fallback untouched. Requests
+// bearing an unknown or expired token get a 401 response from unauthorized.
+// If the token store cannot be read, the request is answered by failed.
+func Middleware(getStore func(r *http.Request) *Store, fallback, tokenHandler http.Handler, unauthorized func(rw http.ResponseWriter), failed func(rw http.ResponseWriter, r *http.Request, err error)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		secret := BearerSecret(r)
+		if secret == "" {
+			fallback.ServeHTTP(rw, r)
+			return
+		}
+		var s *Store
+		if getStore != nil {
+			s = getStore(r)
+		}
+		if s == nil {
+			unauthorized(rw)
+			return
+		}
+		tok, err := s.Authenticate(secret)
+		if err == ErrNotFound || err == ErrExpired {
+			unauthorized(rw)
+			return
+		}
+		if err != nil {
+			failed(rw, r, err)
+			return
+		}
+		tokenHandler.ServeHTTP(rw, SetToken(r, tok))
+	})
+}
@@ -0,0 +1,64 @@
+package tokens
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := NewStore(fp)
+	require.NoError(t, err)
+	tok, secret, err := s.Create(&Token{Name: "ci", Scopes: []string{ScopeRead}})
+	require.NoError(t, err)
+
+	var got *Token
+	var failure error
+	h := Middleware(
+		func(r *http.Request) *Store { return s },
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusNoContent)
+		}),
+		http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			got = GetToken(r)
+			rw.WriteHeader(http.StatusOK)
+		}),
+		func(rw http.ResponseWriter) {
+			rw.WriteHeader(http.StatusUnauthorized)
+		},
+		func(rw http.ResponseWriter, r *http.Request, err error) {
+			failure = err
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		},
+	)
+	serve := func(bearer string) int {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(""))
+	assert.Equal(t, http.StatusUnauthorized, serve(Prefix+"unknown"))
+	assert.Equal(t, http.StatusOK, serve(secret))
+	require.NotNil(t, got)
+	assert.Equal(t, tok.ID, got.ID)
+
+	// an unreadable store is answered by the error callback instead of
+	// panicking
+	require.NoError(t, os.WriteFile(fp, []byte("not json"), 0644))
+	require.NoError(t, os.Chtimes(fp, time.Now(), time.Now().Add(time.Hour)))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(secret))
+	assert.Error(t, failure)
+}
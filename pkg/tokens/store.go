@@ -0,0 +1,311 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Prefix starts every token issued by wrgld, which tells them apart from
+	// tokens issued by the authorization server
+	Prefix = "wrgl_"
+
+	KindPersonal = "personal"
+	KindService  = "service"
+
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+
+	// lastUsedPrecision is how often last-used time is persisted for a token
+	// that is used continuously
+	lastUsedPrecision = time.Minute
+)
+
+var (
+	ErrNotFound     = errors.New("token not found")
+	ErrExpired      = errors.New("token expired")
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// impliedScopes lists scopes granted by each scope in addition to itself
+var impliedScopes = map[string][]string{
+	ScopeRead:  nil,
+	ScopeWrite: {ScopeRead},
+	ScopeAdmin: {ScopeRead, ScopeWrite},
+}
+
+// Token is a personal access token or a service-account token. The secret is
+// never stored, only its hash.
+type Token struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Kind        string     `json:"kind"`
+	AuthorName  string     `json:"authorName,omitempty"`
+	AuthorEmail string     `json:"authorEmail,omitempty"`
+	Scopes      []string   `json:"scopes"`
+	Hash        string     `json:"hash"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// GrantedScopes returns the scopes of the token together with the scopes they
+// imply
+func (t *Token) GrantedScopes() []string {
+	return ExpandScopes(t.Scopes)
+}
+
+// ExpandScopes returns scopes together with the scopes they imply, sorted
+func ExpandScopes(scopes []string) []string {
+	m := map[string]struct{}{}
+	for _, s := range scopes {
+		m[s] = struct{}{}
+		for _, v := range impliedScopes[s] {
+			m[v] = struct{}{}
+		}
+	}
+	sl := make([]string, 0, len(m))
+	for s := range m {
+		sl = append(sl, s)
+	}
+	sort.Strings(sl)
+	return sl
+}
+
+// HasScopes returns true if the token grants all of the given scopes
+func (t *Token) HasScopes(scopes ...string) bool {
+	granted := t.GrantedScopes()
+outer:
+	for _, s := range scopes {
+		for _, v := range granted {
+			if v == s {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// ValidateScopes returns ErrInvalidScope if any scope is unknown
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+	for _, s := range scopes {
+		if _, ok := impliedScopes[s]; !ok {
+			return fmt.Errorf("%w %q", ErrInvalidScope, s)
+		}
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	b := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(b[:])
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Prefix + hex.EncodeToString(b), nil
+}
+
+// Store persists tokens in a single JSON file. Changes made to the file by
+// another process, such as the "wrgld token" command, are picked up on the
+// next lookup.
+type Store struct {
+	path    string
+	mutex   sync.Mutex
+	tokens  []*Token
+	modTime time.Time
+	size    int64
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) reload() error {
+	fi, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		s.tokens = nil
+		s.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size && s.tokens != nil {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	tokens := []*Token{}
+	if err = json.Unmarshal(b, &tokens); err != nil {
+		return fmt.Errorf("error parsing %s: %w", s.path, err)
+	}
+	s.tokens = tokens
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+		s.size = fi.Size()
+	}
+	return nil
+}
+
+// Create adds a token and returns it along with its secret. The secret cannot
+// be retrieved afterward.
+func (s *Store) Create(tok *Token) (*Token, string, error) {
+	if err := ValidateScopes(tok.Scopes); err != nil {
+		return nil, "", err
+	}
+	if tok.Kind == "" {
+		tok.Kind = KindPersonal
+	}
+	if tok.Kind != KindPersonal && tok.Kind != KindService {
+		return nil, "", fmt.Errorf("invalid kind %q", tok.Kind)
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, "", err
+	}
+	obj := *tok
+	obj.ID = uuid.New().String()
+	obj.Hash = hashSecret(secret)
+	obj.CreatedAt = time.Now()
+	obj.LastUsedAt = nil
+	s.tokens = append(s.tokens, &obj)
+	if err := s.save(); err != nil {
+		return nil, "", err
+	}
+	result := obj
+	return &result, secret, nil
+}
+
+// List returns all tokens, oldest first
+func (s *Store) List() ([]*Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	result := make([]*Token, len(s.tokens))
+	for i, t := range s.tokens {
+		obj := *t
+		result[i] = &obj
+	}
+	return result, nil
+}
+
+// Get returns the token with the given id
+func (s *Store) Get(id string) (*Token, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	for _, t := range s.tokens {
+		if t.ID == id {
+			obj := *t
+			return &obj, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Revoke deletes the token with the given id
+func (s *Store) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for i, t := range s.tokens {
+		if t.ID == id {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			return s.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Authenticate finds the token matching secret and records its use. It returns
+// ErrNotFound for unknown secrets and ErrExpired for expired tokens.
+func (s *Store) Authenticate(secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, Prefix) {
+		return nil, ErrNotFound
+	}
+	hash := hashSecret(secret)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, t := range s.tokens {
+		// compare in constant time so that response times do not reveal how
+		// much of a hash matches
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if t.Expired(now) {
+			return nil, ErrExpired
+		}
+		if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= lastUsedPrecision {
+			t.LastUsedAt = &now
+			if err := s.save(); err != nil {
+				return nil, err
+			}
+		}
+		obj := *t
+		return &obj, nil
+	}
+	return nil, ErrNotFound
+}
@@ -0,0 +1,67 @@
+package tokens
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "tokens.json")
+	s, err := NewStore(fp)
+	require.NoError(t, err)
+
+	_, _, err = s.Create(&Token{Name: "ci", Scopes: []string{"delete"}})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+	_, _, err = s.Create(&Token{Name: "ci"})
+	assert.ErrorIs(t, err, ErrInvalidScope)
+
+	tok, secret, err := s.Create(&Token{
+		Name:        "ci",
+		Kind:        KindService,
+		AuthorName:  "CI",
+		AuthorEmail: "ci@example.com",
+		Scopes:      []string{ScopeWrite},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, Prefix))
+	assert.NotContains(t, tok.Hash, secret)
+	assert.Equal(t, []string{ScopeRead, ScopeWrite}, tok.GrantedScopes())
+	assert.True(t, tok.HasScopes(ScopeRead, ScopeWrite))
+	assert.False(t, tok.HasScopes(ScopeAdmin))
+
+	past := time.Now().Add(-time.Hour)
+	expired, expiredSecret, err := s.Create(&Token{Name: "old", Scopes: []string{ScopeRead}, ExpiresAt: &past})
+	require.NoError(t, err)
+	assert.Equal(t, KindPersonal, expired.Kind)
+
+	_, err = s.Authenticate(Prefix + "abc")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Authenticate(expiredSecret)
+	assert.Equal(t, ErrExpired, err)
+	authed, err := s.Authenticate(secret)
+	require.NoError(t, err)
+	assert.Equal(t, tok.ID, authed.ID)
+	require.NotNil(t, authed.LastUsedAt)
+
+	// another process sees the same tokens, including last-used time
+	s2, err := NewStore(fp)
+	require.NoError(t, err)
+	sl, err := s2.List()
+	require.NoError(t, err)
+	require.Len(t, sl, 2)
+	assert.Equal(t, tok.ID, sl[0].ID)
+	assert.NotNil(t, sl[0].LastUsedAt)
+	assert.Equal(t, expired.ID, sl[1].ID)
+
+	require.NoError(t, s2.Revoke(tok.ID))
+	assert.Equal(t, ErrNotFound, s2.Revoke(tok.ID))
+	_, err = s.Authenticate(secret)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Get(tok.ID)
+	assert.Equal(t, ErrNotFound, err)
+}
@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var req *coltracepb.ExportTraceServiceRequest
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/base/v1/traces", r.URL.Path)
+		header = r.Header.Clone()
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		req = &coltracepb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(b, req))
+	}))
+	defer srv.Close()
+
+	exp, err := newOTLPExporter(context.Background(), srv.URL+"/base/", map[string]string{"Authorization": "Bearer abc"})
+	require.NoError(t, err)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("wrgld"))),
+	)
+	ctx, parent := tp.Tracer(InstrumentationName).Start(context.Background(), "parent")
+	_, child := tp.Tracer(InstrumentationName).Start(ctx, "child",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.Int("rows", 3),
+			attribute.StringSlice("refs", []string{"heads/main"}),
+		),
+	)
+	End(child, errors.New("boom"))
+	require.NotNil(t, req)
+	assert.Equal(t, "Bearer abc", header.Get("Authorization"))
+	assert.Equal(t, "application/x-protobuf", header.Get("Content-Type"))
+	require.Len(t, req.ResourceSpans, 1)
+	rs := req.ResourceSpans[0]
+	assert.Equal(t, "service.name", rs.Resource.Attributes[0].Key)
+	assert.Equal(t, "wrgld", rs.Resource.Attributes[0].Value.GetStringValue())
+	require.Len(t, rs.ScopeSpans, 1)
+	assert.Equal(t, InstrumentationName, rs.ScopeSpans[0].Scope.Name)
+	require.Len(t, rs.ScopeSpans[0].Spans, 1)
+	span := rs.ScopeSpans[0].Spans[0]
+	assert.Equal(t, "child", span.Name)
+	traceID, spanID, parentID := child.SpanContext().TraceID(), child.SpanContext().SpanID(), parent.SpanContext().SpanID()
+	assert.Equal(t, traceID[:], span.TraceId)
+	assert.Equal(t, spanID[:], span.SpanId)
+	assert.Equal(t, parentID[:], span.ParentSpanId)
+	assert.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, span.Kind)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, span.Status.Code)
+	assert.Equal(t, "boom", span.Status.Message)
+	assert.Equal(t, "rows", span.Attributes[0].Key)
+	assert.Equal(t, int64(3), span.Attributes[0].Value.GetIntValue())
+	assert.Equal(t, "heads/main", span.Attributes[1].Value.GetArrayValue().Values[0].GetStringValue())
+	require.Len(t, span.Events, 1)
+	assert.Equal(t, "exception", span.Events[0].Name)
+
+	_, err = newOTLPExporter(context.Background(), "localhost:4318", nil)
+	assert.Error(t, err)
+}
+
+func TestPropagation(t *testing.T) {
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), header)
+	sc := trace.SpanContextFromContext(ctx)
+	assert.Equal(t, traceID, sc.TraceID())
+	assert.Equal(t, spanID, sc.SpanID())
+	assert.True(t, sc.IsSampled())
+	assert.True(t, sc.IsRemote())
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	detached := Detach(ctx)
+	assert.NoError(t, detached.Err())
+	m := InjectMap(detached)
+	assert.Equal(t, map[string]string{"traceparent": header.Get("traceparent")}, m)
+	assert.Equal(t, sc, trace.SpanContextFromContext(ExtractMap(context.Background(), m)))
+
+	out := http.Header{}
+	Inject(ExtractMap(context.Background(), m), out)
+	assert.Equal(t, header.Get("traceparent"), out.Get("traceparent"))
+
+	assert.Nil(t, InjectMap(context.Background()))
+}
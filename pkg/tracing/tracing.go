@@ -0,0 +1,171 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are created with the
+// global tracer provider, which discards them until Setup installs exporters.
+// Trace context is propagated with W3C Trace Context headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const InstrumentationName = "github.com/wrgl/wrgld"
+
+type Options struct {
+	// ServiceName and ServiceVersion describe the traced process
+	ServiceName    string
+	ServiceVersion string
+
+	// OTLPEndpoint is the base URL of an OTLP/HTTP receiver, such as
+	// http://localhost:4318. Spans are posted to <OTLPEndpoint>/v1/traces.
+	// Proxies are taken from the HTTPS_PROXY and HTTP_PROXY environment
+	// variables.
+	OTLPEndpoint string
+	// OTLPHeaders are sent with every export request, usually for auth
+	OTLPHeaders map[string]string
+
+	// File receives spans as JSON lines
+	File string
+
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// started by a sampled parent are always sampled.
+	SampleRatio float64
+}
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newOTLPExporter creates an exporter posting protobuf encoded spans to
+// <endpoint>/v1/traces
+func newOTLPExporter(ctx context.Context, endpoint string, headers map[string]string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid otlp endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q: scheme must be http or https", endpoint)
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(headers))
+	}
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// Setup installs the W3C propagator globally and, if an exporter is
+// configured, a global tracer provider. The returned shutdown function flushes pending
+// spans.
+func Setup(opts Options) (shutdown func(ctx context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagator)
+	var tpOpts []sdktrace.TracerProviderOption
+	var closers []func() error
+	if opts.OTLPEndpoint != "" {
+		exp, err := newOTLPExporter(context.Background(), opts.OTLPEndpoint, opts.OTLPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		tpOpts = append(tpOpts, sdktrace.WithBatcher(exp))
+	}
+	if opts.File != "" {
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening trace file: %w", err)
+		}
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		tpOpts = append(tpOpts, sdktrace.WithBatcher(exp))
+		closers = append(closers, f.Close)
+	}
+	if len(tpOpts) == 0 {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+		semconv.ServiceVersion(opts.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(append(tpOpts,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)...)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		for _, c := range closers {
+			if cerr := c(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(InstrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err, if any, on span then ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Detach returns a context carrying the span of ctx without its deadline and
+// cancellation, for work that outlives the request that caused it
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+}
+
+// Inject writes the trace context of ctx into header
+func Inject(ctx context.Context, header http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Extract returns ctx with the trace context found in header
+func Extract(ctx context.Context, header http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// InjectMap writes the trace context of ctx into a map, for persisting it
+// alongside work that is carried out later
+func InjectMap(ctx context.Context) map[string]string {
+	m := propagation.MapCarrier{}
+	propagator.Inject(ctx, m)
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// ExtractMap returns ctx with the trace context found in m
+func ExtractMap(ctx context.Context, m map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(m))
+}
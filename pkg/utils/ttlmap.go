@@ -2,6 +2,7 @@ package wrgldutils
 
 import (
 	"container/heap"
+	"sort"
 	"sync"
 	"time"
 )
@@ -66,6 +67,18 @@ func (m *TTLMap) Add(key string, obj interface{}, ttl time.Duration) {
 	heap.Push(m.keys, ttlItem{key, time.Now().Add(ttl)})
 }
 
+// Replace sets the object of key without changing when it expires. It
+// returns false if key is not found.
+func (m *TTLMap) Replace(key string, obj interface{}) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.items[key]; !ok {
+		return false
+	}
+	m.items[key] = obj
+	return true
+}
+
 func (m *TTLMap) Pop(key string) interface{} {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -85,6 +98,18 @@ func (m *TTLMap) Get(key string) interface{} {
 	return nil
 }
 
+// Keys returns the keys of all items that have not been removed, sorted
+func (m *TTLMap) Keys() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sl := make([]string, 0, len(m.items))
+	for k := range m.items {
+		sl = append(sl, k)
+	}
+	sort.Strings(sl)
+	return sl
+}
+
 func (m *TTLMap) removeExpiredItems() (sleepDuration time.Duration) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
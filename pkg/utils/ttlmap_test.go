@@ -22,4 +22,10 @@ func TestTTLMap(t *testing.T) {
 	time.Sleep(time.Millisecond * 200)
 	assert.Nil(t, m.Get("def"))
 	assert.Equal(t, 234, m.Get("qwe"))
+	assert.Equal(t, []string{"qwe"}, m.Keys())
+
+	assert.True(t, m.Replace("qwe", 345))
+	assert.Equal(t, 345, m.Get("qwe"))
+	assert.False(t, m.Replace("def", 567))
+	assert.Nil(t, m.Get("def"))
 }
@@ -0,0 +1,370 @@
+package webhook
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// DefaultMaxDeliveryRecords is the number of most recent records kept by a
+	// DeliveryLog
+	DefaultMaxDeliveryRecords = 10000
+
+	// maxResponseSnippetSize caps how much of a webhook's response is recorded
+	maxResponseSnippetSize = 1024
+)
+
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// DeliveryRecord describes a single attempt to send a payload to a webhook
+type DeliveryRecord struct {
+	ID string `json:"id"`
+
+	// DeliveryID is the id of the outbox delivery this attempt belongs to. It is
+	// empty for attempts that are not retried such as pre-receive and ping.
+	DeliveryID string                  `json:"deliveryId,omitempty"`
+	URL        string                  `json:"url"`
+	EventIDs   []string                `json:"eventIds"`
+	EventTypes []conf.WebhookEventType `json:"eventTypes"`
+	Attempt    int                     `json:"attempt"`
+	StatusCode int                     `json:"statusCode,omitempty"`
+	LatencyMs  int64                   `json:"latencyMs"`
+	Response   string                  `json:"response,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+	Time       time.Time               `json:"time"`
+
+	// Payload is kept so that the delivery can be redelivered
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Succeeded returns true if the webhook answered 2xx
+func (rec *DeliveryRecord) Succeeded() bool {
+	return rec.Error == "" && rec.StatusCode >= 200 && rec.StatusCode < 300
+}
+
+// DeliveryFilter narrows down records returned by DeliveryLog.List. Zero
+// fields are ignored.
+type DeliveryFilter struct {
+	URL       string
+	EventID   string
+	EventType conf.WebhookEventType
+
+	// Succeeded filters by outcome when not nil
+	Succeeded *bool
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+func (f *DeliveryFilter) match(rec *DeliveryRecord) bool {
+	if f.URL != "" && f.URL != rec.URL {
+		return false
+	}
+	if f.EventID != "" && !containsString(rec.EventIDs, f.EventID) {
+		return false
+	}
+	if f.EventType != "" {
+		found := false
+		for _, et := range rec.EventTypes {
+			if et == f.EventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Succeeded != nil && *f.Succeeded != rec.Succeeded() {
+		return false
+	}
+	if !f.Since.IsZero() && rec.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+func containsString(sl []string, s string) bool {
+	for _, v := range sl {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DeliveryLog is an append-only log of delivery attempts stored as newline
+// delimited JSON. Only the most recent records are kept. Records are indexed
+// in memory without their payload and response, so that lookups only read
+// and decode the records they return.
+type DeliveryLog struct {
+	fp         string
+	maxRecords int
+	entries    []*logEntry
+	mutex      sync.Mutex
+}
+
+// logEntry locates a record in the file. rec holds the fields that filters
+// match on.
+type logEntry struct {
+	offset int64
+	size   int
+	rec    *DeliveryRecord
+}
+
+type DeliveryLogOption func(l *DeliveryLog)
+
+func WithMaxDeliveryRecords(n int) DeliveryLogOption {
+	return func(l *DeliveryLog) {
+		l.maxRecords = n
+	}
+}
+
+func NewDeliveryLog(fp string, opts ...DeliveryLogOption) (*DeliveryLog, error) {
+	l := &DeliveryLog{
+		fp:         fp,
+		maxRecords: DefaultMaxDeliveryRecords,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.loadIndex(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func newLogEntry(offset int64, line []byte) (*logEntry, error) {
+	rec := &DeliveryRecord{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return nil, err
+	}
+	rec.Payload = nil
+	rec.Response = ""
+	return &logEntry{offset: offset, size: len(line), rec: rec}, nil
+}
+
+// loadIndex reads the whole file once to index its records
+func (l *DeliveryLog) loadIndex() error {
+	l.entries = nil
+	f, err := os.Open(l.fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			if e, err := newLogEntry(offset, line[:len(line)-1]); err == nil {
+				l.entries = append(l.entries, e)
+			}
+			// skip lines that were partially written
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (l *DeliveryLog) readLine(f *os.File, e *logEntry) ([]byte, error) {
+	b := make([]byte, e.size)
+	if _, err := f.ReadAt(b, e.offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// read decodes the records of entries in full
+func (l *DeliveryLog) read(entries []*logEntry) ([]*DeliveryRecord, error) {
+	result := make([]*DeliveryRecord, 0, len(entries))
+	if len(entries) == 0 {
+		return result, nil
+	}
+	f, err := os.Open(l.fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for _, e := range entries {
+		b, err := l.readLine(f, e)
+		if err != nil {
+			return nil, err
+		}
+		rec := &DeliveryRecord{}
+		if err := json.Unmarshal(b, rec); err != nil {
+			return nil, err
+		}
+		result = append(result, rec)
+	}
+	return result, nil
+}
+
+// compact rewrites the log keeping only the most recent maxRecords records
+func (l *DeliveryLog) compact() error {
+	entries := l.entries
+	if len(entries) > l.maxRecords {
+		entries = entries[len(entries)-l.maxRecords:]
+	}
+	src, err := os.Open(l.fp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := l.fp + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	kept := make([]*logEntry, 0, len(entries))
+	var offset int64
+	for _, e := range entries {
+		b, err := l.readLine(src, e)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		kept = append(kept, &logEntry{offset: offset, size: e.size, rec: e.rec})
+		offset += int64(e.size) + 1
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.fp); err != nil {
+		return err
+	}
+	l.entries = kept
+	return nil
+}
+
+// Record appends rec to the log
+func (l *DeliveryLog) Record(rec *DeliveryRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.fp, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	e, err := newLogEntry(fi.Size(), b)
+	if err != nil {
+		return err
+	}
+	l.entries = append(l.entries, e)
+	if len(l.entries) > l.maxRecords*2 {
+		return l.compact()
+	}
+	return nil
+}
+
+// Get returns the record with the given id
+func (l *DeliveryLog) Get(id string) (*DeliveryRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].rec.ID == id {
+			sl, err := l.read(l.entries[i : i+1])
+			if err != nil {
+				return nil, err
+			}
+			return sl[0], nil
+		}
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+// List returns records matching f, most recent first
+func (l *DeliveryLog) List(f *DeliveryFilter) ([]*DeliveryRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	matched := []*logEntry{}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if f != nil && !f.match(l.entries[i].rec) {
+			continue
+		}
+		matched = append(matched, l.entries[i])
+		if f != nil && f.Limit > 0 && len(matched) >= f.Limit {
+			break
+		}
+	}
+	return l.read(matched)
+}
+
+// doRequest sends req and records the outcome into rec. The request is traced
+// in a client span whose context is propagated to the webhook.
+func doRequest(client *http.Client, req *http.Request, rec *DeliveryRecord) (resp *http.Response, body []byte, err error) {
+	ctx, span := tracing.Start(req.Context(), "webhook "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(req.Method),
+			semconv.HTTPURL(req.URL.String()),
+		),
+	)
+	defer func() { tracing.End(span, err) }()
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+	start := time.Now()
+	rec.Time = start
+	resp, err = client.Do(req)
+	rec.LatencyMs = time.Since(start).Milliseconds()
+	metrics.WebhookDeliveryDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		rec.Error = err.Error()
+		metrics.WebhookDeliveries.WithLabelValues("error").Inc()
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	rec.StatusCode = resp.StatusCode
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		metrics.WebhookDeliveries.WithLabelValues("success").Inc()
+	} else {
+		metrics.WebhookDeliveries.WithLabelValues("failure").Inc()
+	}
+	body, _ = io.ReadAll(io.LimitReader(resp.Body, maxResponseSnippetSize))
+	io.Copy(io.Discard, resp.Body)
+	rec.Response = string(body)
+	return resp, body, nil
+}
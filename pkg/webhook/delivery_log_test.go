@@ -0,0 +1,87 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+)
+
+func TestDeliveryLog(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "deliveries.jsonl")
+	l, err := webhook.NewDeliveryLog(fp, webhook.WithMaxDeliveryRecords(3))
+	require.NoError(t, err)
+
+	start := time.Now().Truncate(time.Second)
+	for i := 0; i < 6; i++ {
+		rec := &webhook.DeliveryRecord{
+			ID:         fmt.Sprintf("rec-%d", i),
+			URL:        fmt.Sprintf("http://hook-%d", i%2),
+			EventIDs:   []string{fmt.Sprintf("evt-%d", i)},
+			EventTypes: []conf.WebhookEventType{conf.CommitEventType},
+			Attempt:    1,
+			StatusCode: 200,
+			Time:       start.Add(time.Duration(i) * time.Minute),
+			Response:   "ok",
+			Payload:    json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+		}
+		if i%3 == 0 {
+			rec.StatusCode = 500
+		}
+		require.NoError(t, l.Record(rec))
+	}
+
+	ids := func(sl []*webhook.DeliveryRecord) (result []string) {
+		for _, rec := range sl {
+			result = append(result, rec.ID)
+		}
+		return
+	}
+	sl, err := l.List(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rec-5", "rec-4", "rec-3", "rec-2", "rec-1", "rec-0"}, ids(sl))
+
+	failed := false
+	for _, c := range []struct {
+		f   *webhook.DeliveryFilter
+		ids []string
+	}{
+		{&webhook.DeliveryFilter{URL: "http://hook-1"}, []string{"rec-5", "rec-3", "rec-1"}},
+		{&webhook.DeliveryFilter{EventID: "evt-2"}, []string{"rec-2"}},
+		{&webhook.DeliveryFilter{EventType: conf.RefUpdateEventType}, nil},
+		{&webhook.DeliveryFilter{Succeeded: &failed}, []string{"rec-3", "rec-0"}},
+		{&webhook.DeliveryFilter{Since: start.Add(2 * time.Minute), Until: start.Add(4 * time.Minute)}, []string{"rec-4", "rec-3", "rec-2"}},
+		{&webhook.DeliveryFilter{Limit: 2}, []string{"rec-5", "rec-4"}},
+	} {
+		sl, err = l.List(c.f)
+		require.NoError(t, err)
+		assert.Equal(t, c.ids, ids(sl), "filter %+v", c.f)
+	}
+
+	rec, err := l.Get("rec-2")
+	require.NoError(t, err)
+	assert.Equal(t, "http://hook-0", rec.URL)
+	assert.Equal(t, "ok", rec.Response)
+	assert.JSONEq(t, `{"n":2}`, string(rec.Payload))
+	_, err = l.Get("abc")
+	assert.Equal(t, webhook.ErrDeliveryNotFound, err)
+
+	// compacted down to max records
+	require.NoError(t, l.Record(&webhook.DeliveryRecord{ID: "rec-6"}))
+	rec, err = l.Get("rec-5")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"n":5}`, string(rec.Payload))
+	_, err = l.Get("rec-3")
+	assert.Equal(t, webhook.ErrDeliveryNotFound, err)
+	l, err = webhook.NewDeliveryLog(fp, webhook.WithMaxDeliveryRecords(3))
+	require.NoError(t, err)
+	sl, err = l.List(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rec-6", "rec-5", "rec-4"}, ids(sl))
+}
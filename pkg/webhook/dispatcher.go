@@ -0,0 +1,271 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/wrgl/wrgld/pkg/metrics"
+	"github.com/wrgl/wrgld/pkg/tracing"
+)
+
+const (
+	DefaultConcurrency = 1
+	DefaultTimeout     = 10 * time.Second
+	DefaultMaxAttempts = 10
+	DefaultMinBackoff  = time.Second
+	DefaultMaxBackoff  = 10 * time.Minute
+)
+
+// Dispatcher delivers payloads from an Outbox in the background. Failed
+// deliveries are retried with exponential backoff when the webhook is
+// unreachable or answers 5xx, 408 or 429, and are dead-lettered after their
+// last attempt or when the webhook answers any other non-2xx status. A
+// Retry-After header longer than the backoff delays the next attempt further.
+type Dispatcher struct {
+	outbox     *Outbox
+	client     *http.Client
+	logger     logr.Logger
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	log        *DeliveryLog
+	slots      map[string]chan struct{}
+	mutex      sync.Mutex
+	wg         sync.WaitGroup
+	done       chan struct{}
+}
+
+type DispatcherOption func(d *Dispatcher)
+
+// WithBackoff sets the delay before the first retry and the maximum delay
+// between retries
+func WithBackoff(min, max time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.minBackoff = min
+		d.maxBackoff = max
+	}
+}
+
+// WithDispatcherClient sets the http client used to deliver payloads
+func WithDispatcherClient(client *http.Client) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithDispatcherDeliveryLog records every delivery attempt into l
+func WithDispatcherDeliveryLog(l *DeliveryLog) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.log = l
+	}
+}
+
+func NewDispatcher(outbox *Outbox, logger logr.Logger, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		outbox:     outbox,
+		client:     http.DefaultClient,
+		logger:     logger.WithName("Dispatcher"),
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		slots:      map[string]chan struct{}{},
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// Start resumes pending deliveries left in the outbox by a previous process
+func (d *Dispatcher) Start() error {
+	sl, err := d.outbox.Pending()
+	if err != nil {
+		return err
+	}
+	for _, del := range sl {
+		d.schedule(del)
+	}
+	if len(sl) > 0 {
+		d.logger.Info("resumed pending deliveries", "count", len(sl))
+	}
+	return nil
+}
+
+// Enqueue persists a delivery then schedules it to be sent
+func (d *Dispatcher) Enqueue(del *Delivery) error {
+	if del.CreatedAt.IsZero() {
+		del.CreatedAt = time.Now()
+	}
+	if del.NextAttempt.IsZero() {
+		del.NextAttempt = del.CreatedAt
+	}
+	if err := d.outbox.Save(del); err != nil {
+		return err
+	}
+	d.schedule(del)
+	return nil
+}
+
+// Stop stops scheduling new attempts and waits for in-flight attempts to
+// finish. Deliveries still pending remain in the outbox.
+func (d *Dispatcher) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// slot returns the semaphore limiting concurrent attempts to the URL of del.
+// Semaphores are keyed by concurrency as well so that a change of concurrency
+// in config takes effect on new deliveries.
+func (d *Dispatcher) slot(del *Delivery) chan struct{} {
+	n := del.Concurrency
+	if n <= 0 {
+		n = DefaultConcurrency
+	}
+	k := fmt.Sprintf("%d %s", n, del.URL)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.slots[k]; !ok {
+		d.slots[k] = make(chan struct{}, n)
+	}
+	return d.slots[k]
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.minBackoff
+	for i := 1; i < attempts; i++ {
+		b *= 2
+		if b >= d.maxBackoff {
+			return d.maxBackoff
+		}
+	}
+	return b
+}
+
+func (d *Dispatcher) schedule(del *Delivery) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		slot := d.slot(del)
+		for {
+			timer := time.NewTimer(time.Until(del.NextAttempt))
+			select {
+			case <-d.done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			select {
+			case <-d.done:
+				return
+			case slot <- struct{}{}:
+			}
+			retryAfter, retry, err := d.attempt(del)
+			<-slot
+			if err == nil {
+				if err := d.outbox.Remove(del.ID); err != nil {
+					d.logger.Error(err, "error removing delivery", "id", del.ID)
+				}
+				return
+			}
+			del.LastError = err.Error()
+			maxAttempts := del.MaxAttempts
+			if maxAttempts <= 0 {
+				maxAttempts = DefaultMaxAttempts
+			}
+			if !retry || del.Attempts >= maxAttempts {
+				d.logger.Info("delivery dead-lettered", "id", del.ID, "url", del.URL, "attempts", del.Attempts, "error", del.LastError)
+				metrics.WebhookDeadLetters.Inc()
+				if err := d.outbox.Bury(del); err != nil {
+					d.logger.Error(err, "error dead-lettering delivery", "id", del.ID)
+				}
+				return
+			}
+			delay := d.backoff(del.Attempts)
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+			del.NextAttempt = time.Now().Add(delay)
+			if err := d.outbox.Save(del); err != nil {
+				d.logger.Error(err, "error saving delivery", "id", del.ID)
+			}
+		}
+	}()
+}
+
+// retryable returns true if status means the webhook may accept the delivery
+// later
+func retryable(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, which
+// is either a number of seconds or an HTTP date, or 0 if there is none
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// attempt sends the delivery once. retry is true if the error is transient,
+// in which case retryAfter is the delay requested by the webhook, if any.
+func (d *Dispatcher) attempt(del *Delivery) (retryAfter time.Duration, retry bool, err error) {
+	del.Attempts++
+	timeout := del.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(tracing.ExtractMap(context.Background(), del.TraceContext), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if del.Signature != "" {
+		req.Header.Set(SignatureHeader, del.Signature)
+	}
+	rec := &DeliveryRecord{
+		ID:         uuid.New().String(),
+		DeliveryID: del.ID,
+		URL:        del.URL,
+		EventIDs:   del.EventIDs,
+		EventTypes: del.EventTypes,
+		Attempt:    del.Attempts,
+		Payload:    del.Payload,
+	}
+	resp, _, err := doRequest(d.client, req, rec)
+	if d.log != nil {
+		if err := d.log.Record(rec); err != nil {
+			d.logger.Error(err, "error recording delivery", "id", del.ID)
+		}
+	}
+	if err != nil {
+		d.logger.Info("delivery attempt failed", "id", del.ID, "url", del.URL, "attempt", del.Attempts, "error", err.Error())
+		return 0, true, err
+	}
+	d.logger.Info("sent payload to webhook", "id", del.ID, "url", del.URL, "attempt", del.Attempts, "status", resp.StatusCode)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, false, nil
+	}
+	err = fmt.Errorf("webhook answered status %d", resp.StatusCode)
+	if !retryable(resp.StatusCode) {
+		return 0, false, err
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), true, err
+}
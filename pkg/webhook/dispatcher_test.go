@@ -0,0 +1,318 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type flakyHandler struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   [][]byte
+}
+
+func (h *flakyHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	status := http.StatusOK
+	if len(h.statuses) > 0 {
+		status = h.statuses[0]
+		h.statuses = h.statuses[1:]
+	}
+	if status == http.StatusOK {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		h.bodies = append(h.bodies, b)
+	}
+	rw.WriteHeader(status)
+}
+
+func (h *flakyHandler) received() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.bodies)
+}
+
+func waitForOutbox(t *testing.T, outbox *webhook.Outbox, pending, dead int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		p, err := outbox.Pending()
+		require.NoError(t, err)
+		d, err := outbox.Dead()
+		require.NoError(t, err)
+		return len(p) == pending && len(d) == dead
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDispatcher(t *testing.T) {
+	logger := testr.New(t)
+	outbox, err := webhook.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	log, err := webhook.NewDeliveryLog(filepath.Join(t.TempDir(), "deliveries.jsonl"))
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger,
+		webhook.WithBackoff(10*time.Millisecond, 40*time.Millisecond),
+		webhook.WithDispatcherDeliveryLog(log),
+	)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+
+	// retries on 5xx until delivered
+	h1 := &flakyHandler{statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable}}
+	srv1 := httptest.NewServer(h1)
+	defer srv1.Close()
+	s := webhook.NewSenderWithConfig(conf.Config{}, logger,
+		webhook.WithDispatcher(d),
+		webhook.WithWebhooks(wrgldconf.Webhook{
+			Webhook: conf.Webhook{
+				URL:        srv1.URL,
+				EventTypes: []conf.WebhookEventType{conf.RefUpdateEventType},
+			},
+		}),
+	)
+	s.EnqueueEvent(&webhook.RefUpdateEvent{Ref: "heads/main", Sum: "abc"})
+	require.NoError(t, s.Flush())
+	waitForOutbox(t, outbox, 0, 0)
+	require.Equal(t, 1, h1.received())
+	pl := &webhook.Payload{}
+	require.NoError(t, json.Unmarshal(h1.bodies[0], pl))
+	assert.Equal(t, "heads/main", pl.Events[0].(*webhook.RefUpdateEvent).Ref)
+
+	// dead-lettered after max attempts
+	h2 := &flakyHandler{statuses: []int{500, 500, 500, 500}}
+	srv2 := httptest.NewServer(h2)
+	defer srv2.Close()
+	require.NoError(t, d.Enqueue(&webhook.Delivery{
+		ID:          "max-attempts",
+		URL:         srv2.URL,
+		Payload:     []byte(`{"events":[]}`),
+		MaxAttempts: 3,
+	}))
+	waitForOutbox(t, outbox, 0, 1)
+	dead, err := outbox.Dead()
+	require.NoError(t, err)
+	assert.Equal(t, "max-attempts", dead[0].ID)
+	assert.Equal(t, 3, dead[0].Attempts)
+	assert.Equal(t, "webhook answered status 500", dead[0].LastError)
+	recs, err := log.List(&webhook.DeliveryFilter{URL: srv2.URL})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	for i, rec := range recs {
+		assert.Equal(t, "max-attempts", rec.DeliveryID)
+		assert.Equal(t, 3-i, rec.Attempt)
+		assert.Equal(t, 500, rec.StatusCode)
+	}
+
+	// dead-lettered right away on 4xx
+	h3 := &flakyHandler{statuses: []int{http.StatusNotFound}}
+	srv3 := httptest.NewServer(h3)
+	defer srv3.Close()
+	require.NoError(t, d.Enqueue(&webhook.Delivery{
+		ID:      "not-found",
+		URL:     srv3.URL,
+		Payload: []byte(`{"events":[]}`),
+	}))
+	waitForOutbox(t, outbox, 0, 2)
+	dead, err = outbox.Dead()
+	require.NoError(t, err)
+	assert.Equal(t, 1, dead[1].Attempts)
+}
+
+func TestDispatcherResume(t *testing.T) {
+	logger := testr.New(t)
+	dir := t.TempDir()
+	outbox, err := webhook.NewOutbox(dir)
+	require.NoError(t, err)
+
+	// deliveries left by a previous process
+	h := &flakyHandler{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	require.NoError(t, outbox.Save(&webhook.Delivery{
+		ID:          "left-over",
+		URL:         srv.URL,
+		Payload:     []byte(`{"events":[]}`),
+		CreatedAt:   time.Now(),
+		NextAttempt: time.Now(),
+	}))
+
+	outbox, err = webhook.NewOutbox(dir)
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+	waitForOutbox(t, outbox, 0, 0)
+	assert.Equal(t, 1, h.received())
+}
+
+func TestDispatcherTraceContext(t *testing.T) {
+	logger := testr.New(t)
+	outbox, err := webhook.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})))
+	s := webhook.NewSenderWithConfig(conf.Config{}, logger,
+		webhook.WithDispatcher(d),
+		webhook.WithTraceContext(ctx),
+		webhook.WithWebhooks(wrgldconf.Webhook{
+			Webhook: conf.Webhook{
+				URL:        srv.URL,
+				EventTypes: []conf.WebhookEventType{conf.RefUpdateEventType},
+			},
+		}),
+	)
+	// deliveries outlive the request that caused them
+	cancel()
+	s.EnqueueEvent(&webhook.RefUpdateEvent{Ref: "heads/main", Sum: "abc"})
+	require.NoError(t, s.Flush())
+	select {
+	case h := <-headers:
+		assert.Contains(t, h.Get("traceparent"), traceID.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for delivery")
+	}
+}
+
+func TestSenderFlushOutboxError(t *testing.T) {
+	logger := testr.New(t)
+	dir := t.TempDir()
+	outbox, err := webhook.NewOutbox(dir)
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+	s := webhook.NewSenderWithConfig(conf.Config{}, logger,
+		webhook.WithDispatcher(d),
+		webhook.WithWebhooks(wrgldconf.Webhook{
+			Webhook: conf.Webhook{
+				URL:        "http://localhost",
+				EventTypes: []conf.WebhookEventType{conf.RefUpdateEventType},
+			},
+		}),
+	)
+
+	// failing to save payloads is reported to the caller of Flush
+	require.NoError(t, os.RemoveAll(dir))
+	s.EnqueueEvent(&webhook.RefUpdateEvent{Ref: "heads/main", Sum: "abc"})
+	assert.Error(t, s.Flush())
+
+	// events are not flushed twice
+	assert.NoError(t, s.Flush())
+}
+
+func TestDispatcherRetryAfter(t *testing.T) {
+	logger := testr.New(t)
+	outbox, err := webhook.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger, webhook.WithBackoff(10*time.Millisecond, 40*time.Millisecond))
+	require.NoError(t, d.Start())
+	defer d.Stop()
+
+	// 408 and 429 are retried, waiting for as long as Retry-After asks
+	var mutex sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		times = append(times, time.Now())
+		switch len(times) {
+		case 1:
+			rw.WriteHeader(http.StatusRequestTimeout)
+		case 2:
+			rw.Header().Set("Retry-After", "1")
+			rw.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	require.NoError(t, d.Enqueue(&webhook.Delivery{
+		ID:      "throttled",
+		URL:     srv.URL,
+		Payload: []byte(`{"events":[]}`),
+	}))
+	waitForOutbox(t, outbox, 0, 0)
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, times, 3)
+	assert.Less(t, times[1].Sub(times[0]), time.Second)
+	assert.GreaterOrEqual(t, times[2].Sub(times[1]), time.Second)
+}
+
+func TestDispatcherConcurrencyChange(t *testing.T) {
+	logger := testr.New(t)
+	outbox, err := webhook.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	d := webhook.NewDispatcher(outbox, logger)
+	require.NoError(t, d.Start())
+	defer d.Stop()
+
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		<-release
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+	}))
+	defer srv.Close()
+	defer close(release)
+	getMax := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return maxInFlight
+	}
+
+	require.NoError(t, d.Enqueue(&webhook.Delivery{
+		ID: "a", URL: srv.URL, Payload: []byte(`{"events":[]}`), Concurrency: 1,
+	}))
+	require.Eventually(t, func() bool { return getMax() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// concurrency raised in config applies to new deliveries
+	for _, id := range []string{"b", "c"} {
+		require.NoError(t, d.Enqueue(&webhook.Delivery{
+			ID: id, URL: srv.URL, Payload: []byte(`{"events":[]}`), Concurrency: 2,
+		}))
+	}
+	require.Eventually(t, func() bool { return getMax() == 3 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,102 @@
+package webhook
+
+import (
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+// filterEvent returns the part of evt that concerns refs matching the ref
+// patterns of wh, or nil if no part of evt does. Events that do not concern any
+// ref are returned as is. Diff stats are removed from commit events unless wh
+// enables them.
+func filterEvent(evt Event, wh *wrgldconf.Webhook) Event {
+	if len(wh.Refs) == 0 && wh.DiffStats {
+		return evt
+	}
+	switch v := evt.(type) {
+	case *CommitEvent:
+		if len(v.Commits) == 0 {
+			return evt
+		}
+		commits := []Commit{}
+		for _, com := range v.Commits {
+			if !wh.MatchRef(com.Ref) {
+				continue
+			}
+			if !wh.DiffStats {
+				com.ParentSum = ""
+				com.Diff = nil
+			}
+			commits = append(commits, com)
+		}
+		if len(commits) == 0 {
+			return nil
+		}
+		obj := *v
+		obj.Commits = commits
+		return &obj
+	}
+	if len(wh.Refs) == 0 {
+		return evt
+	}
+	switch v := evt.(type) {
+	case *RefUpdateEvent:
+		if !wh.MatchRef(v.Ref) {
+			return nil
+		}
+	case *BranchEvent:
+		if !wh.MatchRef(v.Ref) {
+			return nil
+		}
+	case *TransactionEvent:
+		if len(v.Refs) == 0 {
+			return evt
+		}
+		refs := []string{}
+		for _, r := range v.Refs {
+			if wh.MatchRef(r) {
+				refs = append(refs, r)
+			}
+		}
+		if len(refs) == 0 {
+			return nil
+		}
+		obj := *v
+		obj.Refs = refs
+		return &obj
+	case *PreReceiveEvent:
+		updates := []PreReceiveUpdate{}
+		for _, u := range v.Updates {
+			if wh.MatchRef(u.Ref) {
+				updates = append(updates, u)
+			}
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		obj := *v
+		obj.Updates = updates
+		return &obj
+	}
+	return evt
+}
+
+// EventRefs returns refs that evt concerns
+func EventRefs(evt Event) (refs []string) {
+	switch v := evt.(type) {
+	case *CommitEvent:
+		for _, com := range v.Commits {
+			refs = append(refs, com.Ref)
+		}
+	case *RefUpdateEvent:
+		refs = []string{v.Ref}
+	case *BranchEvent:
+		refs = []string{v.Ref}
+	case *TransactionEvent:
+		refs = v.Refs
+	case *PreReceiveEvent:
+		for _, u := range v.Updates {
+			refs = append(refs, u.Ref)
+		}
+	}
+	return
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wrgl/wrgl/pkg/conf"
+)
+
+const (
+	outboxPendingDir = "pending"
+	outboxDeadDir    = "dead"
+)
+
+// Delivery is a payload waiting to be sent to a single webhook
+type Delivery struct {
+	ID         string                  `json:"id"`
+	URL        string                  `json:"url"`
+	EventIDs   []string                `json:"eventIds"`
+	EventTypes []conf.WebhookEventType `json:"eventTypes"`
+
+	// Signature is the hex digest sent via SignatureHeader. It is computed once
+	// when the delivery is created so that the secret token is never persisted.
+	Signature   string          `json:"signature,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Concurrency int             `json:"concurrency,omitempty"`
+	Timeout     time.Duration   `json:"timeout,omitempty"`
+	MaxAttempts int             `json:"maxAttempts,omitempty"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	LastError   string          `json:"lastError,omitempty"`
+
+	// TraceContext carries the trace of the request that caused the delivery
+	// so that attempts made later are traced as part of it
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+}
+
+// Outbox persists deliveries on disk so that they survive process restarts.
+// Deliveries that exhausted all attempts are moved to a dead-letter directory.
+type Outbox struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	for _, name := range []string{outboxPendingDir, outboxDeadDir} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+func (o *Outbox) path(sub, id string) string {
+	return filepath.Join(o.dir, sub, id+".json")
+}
+
+func (o *Outbox) write(sub string, d *Delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	fp := o.path(sub, d.ID)
+	tmp := fp + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fp)
+}
+
+// Save creates or updates a pending delivery
+func (o *Outbox) Save(d *Delivery) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.write(outboxPendingDir, d)
+}
+
+// Remove deletes a pending delivery, typically after it was delivered
+func (o *Outbox) Remove(id string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	err := os.Remove(o.path(outboxPendingDir, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Bury moves a pending delivery to the dead-letter queue
+func (o *Outbox) Bury(d *Delivery) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err := o.write(outboxDeadDir, d); err != nil {
+		return err
+	}
+	err := os.Remove(o.path(outboxPendingDir, d.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (o *Outbox) list(sub string) ([]*Delivery, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	entries, err := os.ReadDir(filepath.Join(o.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	result := []*Delivery{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(o.dir, sub, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		d := &Delivery{}
+		if err = json.Unmarshal(b, d); err != nil {
+			return nil, fmt.Errorf("error parsing delivery %s: %w", e.Name(), err)
+		}
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// Pending returns deliveries that are still being attempted, oldest first
+func (o *Outbox) Pending() ([]*Delivery, error) {
+	return o.list(outboxPendingDir)
+}
+
+// Dead returns deliveries that exhausted all attempts, oldest first
+func (o *Outbox) Dead() ([]*Delivery, error) {
+	return o.list(outboxDeadDir)
+}
@@ -5,7 +5,25 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/wrgl/wrgl/pkg/conf"
+	diffprof "github.com/wrgl/wrgl/pkg/diff/prof"
+)
+
+const (
+	// PreReceiveEventType is sent synchronously before refs are updated. A webhook
+	// subscribed to this event type can decline the update by answering non-2xx.
+	PreReceiveEventType conf.WebhookEventType = "preReceive"
+
+	// PingEventType is sent on demand to test that a webhook is reachable
+	PingEventType conf.WebhookEventType = "ping"
+
+	TransactionCreatedEventType   conf.WebhookEventType = "transactionCreated"
+	TransactionCommittedEventType conf.WebhookEventType = "transactionCommitted"
+	TransactionDiscardedEventType conf.WebhookEventType = "transactionDiscarded"
+	BranchCreatedEventType        conf.WebhookEventType = "branchCreated"
+	BranchDeletedEventType        conf.WebhookEventType = "branchDeleted"
+	GCCompletedEventType          conf.WebhookEventType = "gcCompleted"
 )
 
 type Event interface {
@@ -13,6 +31,34 @@ type Event interface {
 	SetType()
 }
 
+// newEventID returns id if it is already set, otherwise a new random id
+func newEventID(id string) string {
+	if id != "" {
+		return id
+	}
+	return uuid.New().String()
+}
+
+func getEventID(e Event) string {
+	switch v := e.(type) {
+	case *CommitEvent:
+		return v.ID
+	case *RefUpdateEvent:
+		return v.ID
+	case *PreReceiveEvent:
+		return v.ID
+	case *PingEvent:
+		return v.ID
+	case *TransactionEvent:
+		return v.ID
+	case *BranchEvent:
+		return v.ID
+	case *GCEvent:
+		return v.ID
+	}
+	return ""
+}
+
 type Events []Event
 
 type Payload struct {
@@ -36,6 +82,16 @@ func (sl *Events) UnmarshalJSON(b []byte) error {
 			continue
 		case conf.RefUpdateEventType:
 			e = &RefUpdateEvent{}
+		case PreReceiveEventType:
+			e = &PreReceiveEvent{}
+		case PingEventType:
+			e = &PingEvent{}
+		case TransactionCreatedEventType, TransactionCommittedEventType, TransactionDiscardedEventType:
+			e = &TransactionEvent{}
+		case BranchCreatedEventType, BranchDeletedEventType:
+			e = &BranchEvent{}
+		case GCCompletedEventType:
+			e = &GCEvent{}
 		default:
 			return fmt.Errorf("unhandled event type %q", ce.Type)
 		}
@@ -51,9 +107,14 @@ type Commit struct {
 	Sum     string `json:"sum"`
 	Ref     string `json:"ref"`
 	Message string `json:"message"`
+
+	// ParentSum and Diff are only sent to webhooks with diff stats enabled
+	ParentSum string       `json:"parentSum,omitempty"`
+	Diff      *DiffSummary `json:"diff,omitempty"`
 }
 
 type CommitEvent struct {
+	ID            string                `json:"id"`
 	Type          conf.WebhookEventType `json:"type"`
 	TransactionID string                `json:"transactionId,omitempty"`
 	Commits       []Commit              `json:"commits"`
@@ -68,10 +129,12 @@ func (e *CommitEvent) GetType() conf.WebhookEventType {
 
 func (e *CommitEvent) SetType() {
 	e.Type = conf.CommitEventType
+	e.ID = newEventID(e.ID)
 	e.Time = time.Now().Format(time.RFC3339)
 }
 
 type RefUpdateEvent struct {
+	ID      string                `json:"id"`
 	Type    conf.WebhookEventType `json:"type"`
 	OldSum  string                `json:"oldSum"`
 	Sum     string                `json:"sum"`
@@ -87,5 +150,152 @@ func (e *RefUpdateEvent) GetType() conf.WebhookEventType {
 
 func (e *RefUpdateEvent) SetType() {
 	e.Type = conf.RefUpdateEventType
+	e.ID = newEventID(e.ID)
+	e.Time = time.Now().Format(time.RFC3339)
+}
+
+// DiffSummary summarizes the changes between the old and the new table of a ref
+type DiffSummary struct {
+	RowsAdded      int      `json:"rowsAdded"`
+	RowsRemoved    int      `json:"rowsRemoved"`
+	RowsModified   int      `json:"rowsModified"`
+	ColumnsAdded   []string `json:"columnsAdded,omitempty"`
+	ColumnsRemoved []string `json:"columnsRemoved,omitempty"`
+
+	// Rewritten is true if rows of the new table cannot be matched with rows
+	// of the old table, because the primary key changed or because columns
+	// of a table without primary key changed. Every old row is then counted
+	// as removed and every new row as added.
+	Rewritten bool `json:"rewritten,omitempty"`
+
+	// DataProfile is the difference between table profiles. It is only included
+	// in commit events.
+	DataProfile *diffprof.TableProfileDiff `json:"dataProfile,omitempty"`
+}
+
+type PreReceiveUpdate struct {
+	Ref    string `json:"ref"`
+	OldSum string `json:"oldSum,omitempty"`
+
+	// Sum is empty if the ref is about to be deleted
+	Sum  string       `json:"sum,omitempty"`
+	Diff *DiffSummary `json:"diff,omitempty"`
+}
+
+type PreReceiveEvent struct {
+	ID            string                `json:"id"`
+	Type          conf.WebhookEventType `json:"type"`
+	Action        string                `json:"action"`
+	TransactionID string                `json:"transactionId,omitempty"`
+	Updates       []PreReceiveUpdate    `json:"updates"`
+	AuthorName    string                `json:"authorName,omitempty"`
+	AuthorEmail   string                `json:"authorEmail,omitempty"`
+	Time          string                `json:"time"`
+}
+
+func (e *PreReceiveEvent) GetType() conf.WebhookEventType {
+	return PreReceiveEventType
+}
+
+func (e *PreReceiveEvent) SetType() {
+	e.Type = PreReceiveEventType
+	e.ID = newEventID(e.ID)
+	e.Time = time.Now().Format(time.RFC3339)
+}
+
+type PingEvent struct {
+	ID   string                `json:"id"`
+	Type conf.WebhookEventType `json:"type"`
+	Time string                `json:"time"`
+}
+
+func (e *PingEvent) GetType() conf.WebhookEventType {
+	return PingEventType
+}
+
+func (e *PingEvent) SetType() {
+	e.Type = PingEventType
+	e.ID = newEventID(e.ID)
+	e.Time = time.Now().Format(time.RFC3339)
+}
+
+// TransactionEvent is sent when a transaction is created, committed or
+// discarded. Type must be set to one of TransactionCreatedEventType,
+// TransactionCommittedEventType or TransactionDiscardedEventType.
+type TransactionEvent struct {
+	ID            string                `json:"id"`
+	Type          conf.WebhookEventType `json:"type"`
+	TransactionID string                `json:"transactionId"`
+
+	// Refs are the refs updated by a committed transaction
+	Refs        []string `json:"refs,omitempty"`
+	AuthorName  string   `json:"authorName,omitempty"`
+	AuthorEmail string   `json:"authorEmail,omitempty"`
+	Time        string   `json:"time"`
+}
+
+func (e *TransactionEvent) GetType() conf.WebhookEventType {
+	return e.Type
+}
+
+// SetType panics if Type is not a transaction event type since it can only be
+// set wrong by a programming error
+func (e *TransactionEvent) SetType() {
+	switch e.Type {
+	case TransactionCreatedEventType, TransactionCommittedEventType, TransactionDiscardedEventType:
+	default:
+		panic(fmt.Errorf("invalid transaction event type %q", e.Type))
+	}
+	e.ID = newEventID(e.ID)
+	e.Time = time.Now().Format(time.RFC3339)
+}
+
+// BranchEvent is sent when a branch is created or deleted. Type must be set to
+// either BranchCreatedEventType or BranchDeletedEventType.
+type BranchEvent struct {
+	ID   string                `json:"id"`
+	Type conf.WebhookEventType `json:"type"`
+	Ref  string                `json:"ref"`
+
+	// Sum is the first commit of a created branch or the last commit of a
+	// deleted branch
+	Sum           string `json:"sum,omitempty"`
+	Action        string `json:"action,omitempty"`
+	TransactionID string `json:"transactionId,omitempty"`
+	AuthorName    string `json:"authorName,omitempty"`
+	AuthorEmail   string `json:"authorEmail,omitempty"`
+	Time          string `json:"time"`
+}
+
+func (e *BranchEvent) GetType() conf.WebhookEventType {
+	return e.Type
+}
+
+// SetType panics if Type is not a branch event type since it can only be set
+// wrong by a programming error
+func (e *BranchEvent) SetType() {
+	switch e.Type {
+	case BranchCreatedEventType, BranchDeletedEventType:
+	default:
+		panic(fmt.Errorf("invalid branch event type %q", e.Type))
+	}
+	e.ID = newEventID(e.ID)
+	e.Time = time.Now().Format(time.RFC3339)
+}
+
+type GCEvent struct {
+	ID        string                `json:"id"`
+	Type      conf.WebhookEventType `json:"type"`
+	ElapsedMs int64                 `json:"elapsedMs"`
+	Time      string                `json:"time"`
+}
+
+func (e *GCEvent) GetType() conf.WebhookEventType {
+	return GCCompletedEventType
+}
+
+func (e *GCEvent) SetType() {
+	e.Type = GCCompletedEventType
+	e.ID = newEventID(e.ID)
 	e.Time = time.Now().Format(time.RFC3339)
 }
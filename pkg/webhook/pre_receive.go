@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PreReceiveFailure tells why a pre-receive hook did not approve an update
+type PreReceiveFailure int
+
+const (
+	// PreReceiveDeclined means the hook answered non-2xx
+	PreReceiveDeclined PreReceiveFailure = iota
+
+	// PreReceiveTimedOut means the hook did not answer within the
+	// pre-receive timeout
+	PreReceiveTimedOut
+
+	// PreReceiveUnreachable means the hook could not be sent the event
+	PreReceiveUnreachable
+)
+
+// PreReceiveError is returned by Sender.PreReceive when a pre-receive hook
+// declines the update, times out or cannot be reached.
+type PreReceiveError struct {
+	URL     string
+	Message string
+	Failure PreReceiveFailure
+}
+
+func (e *PreReceiveError) Error() string {
+	switch e.Failure {
+	case PreReceiveTimedOut:
+		return "pre-receive hook timed out"
+	case PreReceiveUnreachable:
+		return "pre-receive hook unreachable"
+	}
+	return fmt.Sprintf("pre-receive hook declined: %s", e.Message)
+}
+
+func (s *Sender) preReceiveHooks() (hooks []int) {
+	for i, wh := range s.webhooks {
+		for _, et := range wh.EventTypes {
+			if et == PreReceiveEventType {
+				hooks = append(hooks, i)
+				break
+			}
+		}
+	}
+	return
+}
+
+// HasPreReceiveHooks returns true if at least one webhook subscribes to
+// PreReceiveEventType. Callers can use this to skip computing diff summaries.
+func (s *Sender) HasPreReceiveHooks() bool {
+	return len(s.preReceiveHooks()) > 0
+}
+
+// PreReceive sends evt to every pre-receive hook in order and waits for their
+// answers. A hook with ref patterns only receives the updates to matching refs,
+// and is skipped if there are none. It returns a *PreReceiveError as soon as
+// one hook answers non-2xx or does not answer within the pre-receive timeout.
+func (s *Sender) PreReceive(ctx context.Context, evt *PreReceiveEvent) error {
+	hooks := s.preReceiveHooks()
+	if len(hooks) == 0 {
+		return nil
+	}
+	evt.SetType()
+	for _, i := range hooks {
+		wh := s.webhooks[i]
+		e := filterEvent(evt, wh)
+		if e == nil {
+			continue
+		}
+		if err := s.sendPreReceive(ctx, i, &Payload{Events: []Event{e}}); err != nil {
+			s.logger.Info("pre-receive hook did not approve update", "url", wh.URL, "reason", err.Message)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sender) sendPreReceive(ctx context.Context, i int, pl *Payload) *PreReceiveError {
+	wh := s.webhooks[i]
+	ctx, cancel := context.WithTimeout(ctx, s.preReceiveTimeout)
+	defer cancel()
+	rec, b, err := newDeliveryRecord(wh.URL, pl)
+	if err != nil {
+		s.logger.Error(err, "error marshaling json")
+		return &PreReceiveError{URL: wh.URL, Message: "error creating request", Failure: PreReceiveUnreachable}
+	}
+	req, err := newPayloadRequest(ctx, &wh.Webhook, b)
+	if err != nil {
+		s.logger.Error(err, "error creating new request", "url", wh.URL)
+		return &PreReceiveError{URL: wh.URL, Message: "error creating request", Failure: PreReceiveUnreachable}
+	}
+	resp, body, err := doRequest(http.DefaultClient, req, rec)
+	s.record(rec)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &PreReceiveError{URL: wh.URL, Message: "timed out", Failure: PreReceiveTimedOut}
+		}
+		s.logger.Error(err, "error sending pre-receive payload", "url", wh.URL)
+		return &PreReceiveError{URL: wh.URL, Message: "hook unreachable", Failure: PreReceiveUnreachable}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return &PreReceiveError{URL: wh.URL, Message: declineMessage(resp.StatusCode, body)}
+}
+
+// declineMessage extracts the reason from a declining response. It accepts
+// either a JSON object with a "message" field or plain text.
+func declineMessage(status int, b []byte) string {
+	obj := struct {
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(b, &obj); err == nil && obj.Message != "" {
+		return obj.Message
+	}
+	if msg := strings.TrimSpace(string(b)); msg != "" {
+		return msg
+	}
+	return http.StatusText(status)
+}
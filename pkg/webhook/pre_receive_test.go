@@ -0,0 +1,82 @@
+package webhook_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr/testr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wrgl/wrgl/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/webhook"
+	webhooktest "github.com/wrgl/wrgld/pkg/webhook/test"
+)
+
+func TestPreReceive(t *testing.T) {
+	logger := testr.New(t)
+	evt := &webhook.PreReceiveEvent{
+		Action: "commit",
+		Updates: []webhook.PreReceiveUpdate{
+			{
+				Ref: "heads/main",
+				Sum: "abc",
+				Diff: &webhook.DiffSummary{
+					RowsAdded: 3,
+				},
+			},
+		},
+	}
+
+	// no pre-receive hook
+	wh1, pl1, cleanup := webhooktest.CreateWebhookHandler(t, []conf.WebhookEventType{conf.CommitEventType}, false)
+	defer cleanup()
+	s := webhook.NewSenderWithConfig(conf.Config{Webhooks: []conf.Webhook{wh1}}, logger)
+	assert.False(t, s.HasPreReceiveHooks())
+	require.NoError(t, s.PreReceive(context.Background(), evt))
+	assert.Nil(t, pl1())
+
+	// accepted
+	wh2, pl2, cleanup := webhooktest.CreatePreReceiveHandler(t, "")
+	defer cleanup()
+	s = webhook.NewSenderWithConfig(conf.Config{Webhooks: []conf.Webhook{wh1, wh2}}, logger)
+	assert.True(t, s.HasPreReceiveHooks())
+	require.NoError(t, s.PreReceive(context.Background(), evt))
+	assert.Equal(t, webhook.PreReceiveEventType, evt.Type)
+	assert.NotEmpty(t, evt.Time)
+	assert.Equal(t, &webhook.Payload{Events: []webhook.Event{evt}}, pl2())
+	assert.Nil(t, pl1())
+
+	// declined
+	wh3, pl3, cleanup := webhooktest.CreatePreReceiveHandler(t, "main is frozen")
+	defer cleanup()
+	s = webhook.NewSenderWithConfig(conf.Config{Webhooks: []conf.Webhook{wh2, wh3}}, logger)
+	err := s.PreReceive(context.Background(), evt)
+	assert.Equal(t, &webhook.PreReceiveError{URL: wh3.URL, Message: "main is frozen"}, err)
+	assert.Equal(t, "pre-receive hook declined: main is frozen", err.Error())
+	assert.NotNil(t, pl2())
+	assert.NotNil(t, pl3())
+
+	// timed out
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+	s = webhook.NewSenderWithConfig(conf.Config{Webhooks: []conf.Webhook{
+		{URL: srv.URL, EventTypes: []conf.WebhookEventType{webhook.PreReceiveEventType}},
+	}}, logger, webhook.WithPreReceiveTimeout(50*time.Millisecond))
+	err = s.PreReceive(context.Background(), evt)
+	assert.Equal(t, &webhook.PreReceiveError{URL: srv.URL, Message: "timed out", Failure: webhook.PreReceiveTimedOut}, err)
+	assert.Equal(t, "pre-receive hook timed out", err.Error())
+
+	// unreachable
+	srv.Close()
+	s = webhook.NewSenderWithConfig(conf.Config{Webhooks: []conf.Webhook{
+		{URL: srv.URL, EventTypes: []conf.WebhookEventType{webhook.PreReceiveEventType}},
+	}}, logger)
+	err = s.PreReceive(context.Background(), evt)
+	assert.Equal(t, &webhook.PreReceiveError{URL: srv.URL, Message: "hook unreachable", Failure: webhook.PreReceiveUnreachable}, err)
+	assert.Equal(t, "pre-receive hook unreachable", err.Error())
+}
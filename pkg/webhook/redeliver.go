@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+)
+
+var (
+	ErrNoDeliveryLog      = errors.New("delivery log is not enabled")
+	ErrWebhookNotFound    = errors.New("webhook not found")
+	ErrPayloadNotRecorded = errors.New("delivery payload was not recorded")
+)
+
+func (s *Sender) webhookByURL(url string) *wrgldconf.Webhook {
+	for _, wh := range s.webhooks {
+		if wh.URL == url {
+			return wh
+		}
+	}
+	return nil
+}
+
+// Deliveries returns recorded delivery attempts matching f, most recent first
+func (s *Sender) Deliveries(f *DeliveryFilter) ([]*DeliveryRecord, error) {
+	if s.log == nil {
+		return nil, ErrNoDeliveryLog
+	}
+	return s.log.List(f)
+}
+
+// deliver sends rec.Payload to wh once, waits for the answer and records the attempt
+func (s *Sender) deliver(ctx context.Context, wh *wrgldconf.Webhook, rec *DeliveryRecord) *DeliveryRecord {
+	timeout := time.Duration(wh.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := newPayloadRequest(ctx, &wh.Webhook, rec.Payload)
+	if err != nil {
+		rec.Error = err.Error()
+	} else if _, _, err = doRequest(http.DefaultClient, req, rec); err != nil {
+		s.logger.Info("delivery attempt failed", "url", wh.URL, "error", err.Error())
+	}
+	s.record(rec)
+	return rec
+}
+
+// Redeliver sends the payload of a recorded delivery attempt again to the same
+// webhook. The webhook must still be configured so that the payload can be
+// signed with its current secret.
+func (s *Sender) Redeliver(ctx context.Context, id string) (*DeliveryRecord, error) {
+	if s.log == nil {
+		return nil, ErrNoDeliveryLog
+	}
+	prev, err := s.log.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(prev.Payload) == 0 {
+		return nil, ErrPayloadNotRecorded
+	}
+	wh := s.webhookByURL(prev.URL)
+	if wh == nil {
+		return nil, ErrWebhookNotFound
+	}
+	return s.deliver(ctx, wh, &DeliveryRecord{
+		ID:         uuid.New().String(),
+		DeliveryID: prev.DeliveryID,
+		URL:        prev.URL,
+		EventIDs:   prev.EventIDs,
+		EventTypes: prev.EventTypes,
+		Attempt:    prev.Attempt + 1,
+		Payload:    prev.Payload,
+	}), nil
+}
+
+// Ping sends a PingEvent to the configured webhook with the given url and
+// waits for its answer
+func (s *Sender) Ping(ctx context.Context, url string) (*DeliveryRecord, error) {
+	wh := s.webhookByURL(url)
+	if wh == nil {
+		return nil, ErrWebhookNotFound
+	}
+	evt := &PingEvent{}
+	evt.SetType()
+	rec, _, err := newDeliveryRecord(wh.URL, &Payload{Events: []Event{evt}})
+	if err != nil {
+		return nil, err
+	}
+	return s.deliver(ctx, wh, rec), nil
+}
@@ -2,34 +2,107 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/google/uuid"
 	"github.com/wrgl/wrgl/pkg/conf"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
+	"github.com/wrgl/wrgld/pkg/tracing"
 )
 
 const (
 	SignatureHeader = "X-Wrgl-Signature-256"
+
+	DefaultPreReceiveTimeout = 10 * time.Second
 )
 
 type Sender struct {
-	webhooks []*conf.Webhook
-	events   map[conf.WebhookEventType][]Event
-	logger   logr.Logger
-	wg       *sync.WaitGroup
-	mutex    sync.Mutex
+	webhooks          []*wrgldconf.Webhook
+	events            map[conf.WebhookEventType][]Event
+	logger            logr.Logger
+	wgs               []*sync.WaitGroup
+	mutex             sync.Mutex
+	preReceiveTimeout time.Duration
+	dispatcher        *Dispatcher
+	log               *DeliveryLog
+	sinks             []EventSink
+	queued            []Event
+	ctx               context.Context
+}
+
+// EventSink receives every event flushed by a Sender in the order they were
+// enqueued, whether or not a webhook subscribes to them
+type EventSink interface {
+	Publish(evts ...Event)
 }
 
 type SenderOption func(s *Sender)
 
+// WithPreReceiveTimeout sets how long to wait for a pre-receive hook to answer
+// before the update is aborted. Defaults to DefaultPreReceiveTimeout.
+func WithPreReceiveTimeout(d time.Duration) SenderOption {
+	return func(s *Sender) {
+		s.preReceiveTimeout = d
+	}
+}
+
+// WithWebhooks registers webhooks in addition to those defined in repository
+// config
+func WithWebhooks(whs ...wrgldconf.Webhook) SenderOption {
+	return func(s *Sender) {
+		for _, wh := range whs {
+			obj := &wrgldconf.Webhook{}
+			*obj = wh
+			s.webhooks = append(s.webhooks, obj)
+		}
+	}
+}
+
+// WithDispatcher makes Flush persist payloads to the dispatcher's outbox instead
+// of sending them right away, so that failed deliveries are retried.
+func WithDispatcher(d *Dispatcher) SenderOption {
+	return func(s *Sender) {
+		s.dispatcher = d
+	}
+}
+
+// WithDeliveryLog records every delivery attempt made by the sender into l
+func WithDeliveryLog(l *DeliveryLog) SenderOption {
+	return func(s *Sender) {
+		s.log = l
+	}
+}
+
+// WithEventSink publishes flushed events to sink
+func WithEventSink(sink EventSink) SenderOption {
+	return func(s *Sender) {
+		s.sinks = append(s.sinks, sink)
+	}
+}
+
+// WithWaitGroup adds each flush to wg until its payloads are sent. Flushes
+// with a dispatcher are not added since they return once payloads are saved.
+// Can be given multiple times.
 func WithWaitGroup(wg *sync.WaitGroup) SenderOption {
 	return func(s *Sender) {
-		s.wg = wg
+		s.wgs = append(s.wgs, wg)
+	}
+}
+
+// WithTraceContext traces deliveries as part of the trace found in ctx.
+// Cancellation of ctx does not affect deliveries.
+func WithTraceContext(ctx context.Context) SenderOption {
+	return func(s *Sender) {
+		s.ctx = tracing.Detach(ctx)
 	}
 }
 
@@ -40,13 +113,14 @@ func NewSender(c conf.Config, logger logr.Logger, opts ...SenderOption) (*Sender
 
 func NewSenderWithConfig(c conf.Config, logger logr.Logger, opts ...SenderOption) *Sender {
 	s := &Sender{
-		webhooks: make([]*conf.Webhook, len(c.Webhooks)),
-		events:   map[conf.WebhookEventType][]Event{},
-		logger:   logger,
+		webhooks:          make([]*wrgldconf.Webhook, len(c.Webhooks)),
+		events:            map[conf.WebhookEventType][]Event{},
+		logger:            logger,
+		preReceiveTimeout: DefaultPreReceiveTimeout,
+		ctx:               context.Background(),
 	}
 	for i, wh := range c.Webhooks {
-		s.webhooks[i] = &conf.Webhook{}
-		*s.webhooks[i] = wh
+		s.webhooks[i] = &wrgldconf.Webhook{Webhook: wh}
 	}
 	for _, opt := range opts {
 		opt(s)
@@ -54,59 +128,203 @@ func NewSenderWithConfig(c conf.Config, logger logr.Logger, opts ...SenderOption
 	return s
 }
 
+// HasDiffStatsHooks returns true if at least one webhook subscribing to commit
+// events enables diff stats. Callers can use this to skip computing them.
+func (s *Sender) HasDiffStatsHooks() bool {
+	for _, wh := range s.webhooks {
+		if !wh.DiffStats {
+			continue
+		}
+		for _, et := range wh.EventTypes {
+			if et == conf.CommitEventType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *Sender) EnqueueEvent(evt Event) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	evt.SetType()
 	s.events[evt.GetType()] = append(s.events[evt.GetType()], evt)
+	if len(s.sinks) > 0 {
+		s.queued = append(s.queued, evt)
+	}
 }
 
-func (s *Sender) Flush() {
-	if s.wg != nil {
-		s.wg.Add(1)
-	}
-	go func() {
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
-		if s.wg != nil {
-			defer s.wg.Done()
+// Flush publishes enqueued events to event sinks and delivers them to the
+// webhooks that subscribe to them. With a dispatcher, payloads are saved to its
+// outbox before Flush returns, so that callers can report a failure to save
+// them, and are sent in the background. Otherwise they are sent in the
+// background right away.
+func (s *Sender) Flush() error {
+	s.mutex.Lock()
+	queued := s.queued
+	s.queued = nil
+	events := s.events
+	s.events = map[conf.WebhookEventType][]Event{}
+	s.mutex.Unlock()
+	if len(queued) > 0 {
+		for _, sink := range s.sinks {
+			sink.Publish(queued...)
 		}
-		for _, wh := range s.webhooks {
-			pl := &Payload{}
-			for _, et := range wh.EventTypes {
-				pl.Events = append(pl.Events, s.events[et]...)
-			}
-			if len(pl.Events) == 0 {
-				continue
-			}
-			b, err := json.Marshal(pl)
-			if err != nil {
-				s.logger.Error(err, "error marshaling json")
-			}
-			req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(b))
-			if err != nil {
-				s.logger.Error(err, "error creating new request", "url", wh.URL)
+	}
+	type delivery struct {
+		wh *wrgldconf.Webhook
+		pl *Payload
+	}
+	deliveries := []delivery{}
+	for _, wh := range s.webhooks {
+		pl := &Payload{}
+		for _, et := range wh.EventTypes {
+			for _, evt := range events[et] {
+				if evt = filterEvent(evt, wh); evt != nil {
+					pl.Events = append(pl.Events, evt)
+				}
 			}
-			req.Header.Set("Content-Type", "application/json")
-			if wh.SecretToken != "" {
-				h := hmac.New(sha256.New, []byte(wh.SecretToken))
-				_, err := h.Write(b)
-				if err != nil {
-					s.logger.Error(err, "error digesting payload")
+		}
+		if len(pl.Events) > 0 {
+			deliveries = append(deliveries, delivery{wh, pl})
+		}
+	}
+	if s.dispatcher != nil {
+		var firstErr error
+		for _, d := range deliveries {
+			if err := s.enqueueDelivery(d.wh, d.pl); err != nil {
+				s.logger.Error(err, "error enqueuing delivery", "url", d.wh.URL)
+				if firstErr == nil {
+					firstErr = err
 				}
-				req.Header.Set(SignatureHeader, hex.EncodeToString(h.Sum(nil)))
 			}
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				s.logger.Error(err, "error sending payload")
-			} else {
-				s.logger.Info("sent payload to webhook",
-					"url", wh.URL,
-					"status", resp.StatusCode,
-					"events_count", len(pl.Events),
-				)
+		}
+		return firstErr
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	for _, wg := range s.wgs {
+		wg.Add(1)
+	}
+	go func() {
+		defer func() {
+			for _, wg := range s.wgs {
+				wg.Done()
 			}
+		}()
+		for _, d := range deliveries {
+			s.send(d.wh, d.pl)
 		}
-		s.events = map[conf.WebhookEventType][]Event{}
 	}()
+	return nil
+}
+
+func (s *Sender) record(rec *DeliveryRecord) {
+	if s.log == nil {
+		return
+	}
+	if err := s.log.Record(rec); err != nil {
+		s.logger.Error(err, "error recording delivery", "url", rec.URL)
+	}
+}
+
+func (s *Sender) send(wh *wrgldconf.Webhook, pl *Payload) {
+	rec, b, err := newDeliveryRecord(wh.URL, pl)
+	if err != nil {
+		s.logger.Error(err, "error marshaling json")
+		return
+	}
+	req, err := newPayloadRequest(s.ctx, &wh.Webhook, b)
+	if err != nil {
+		s.logger.Error(err, "error creating new request", "url", wh.URL)
+		return
+	}
+	resp, _, err := doRequest(http.DefaultClient, req, rec)
+	s.record(rec)
+	if err != nil {
+		s.logger.Error(err, "error sending payload")
+	} else {
+		s.logger.Info("sent payload to webhook",
+			"url", wh.URL,
+			"status", resp.StatusCode,
+			"events_count", len(pl.Events),
+		)
+	}
+}
+
+func (s *Sender) enqueueDelivery(wh *wrgldconf.Webhook, pl *Payload) error {
+	rec, b, err := newDeliveryRecord(wh.URL, pl)
+	if err != nil {
+		return fmt.Errorf("error marshaling json: %w", err)
+	}
+	return s.enqueuePayload(wh, b, rec.EventIDs, rec.EventTypes)
+}
+
+func (s *Sender) enqueuePayload(wh *wrgldconf.Webhook, b []byte, eventIDs []string, eventTypes []conf.WebhookEventType) error {
+	sig, err := sign(wh.SecretToken, b)
+	if err != nil {
+		return fmt.Errorf("error digesting payload: %w", err)
+	}
+	return s.dispatcher.Enqueue(&Delivery{
+		ID:          uuid.New().String(),
+		URL:         wh.URL,
+		EventIDs:    eventIDs,
+		EventTypes:  eventTypes,
+		Signature:   sig,
+		Payload:     b,
+		Concurrency: wh.Concurrency,
+		Timeout:     time.Duration(wh.Timeout),
+		MaxAttempts: wh.MaxAttempts,
+
+		TraceContext: tracing.InjectMap(s.ctx),
+	})
+}
+
+// newDeliveryRecord marshals pl and returns a record describing its delivery to
+// url
+func newDeliveryRecord(url string, pl *Payload) (*DeliveryRecord, []byte, error) {
+	b, err := json.Marshal(pl)
+	if err != nil {
+		return nil, nil, err
+	}
+	rec := &DeliveryRecord{
+		ID:      uuid.New().String(),
+		URL:     url,
+		Attempt: 1,
+		Payload: b,
+	}
+	for _, evt := range pl.Events {
+		rec.EventIDs = append(rec.EventIDs, getEventID(evt))
+		rec.EventTypes = append(rec.EventTypes, evt.GetType())
+	}
+	return rec, b, nil
+}
+
+// sign returns hex digest of payload b, or an empty string if secret is empty
+func sign(secret string, b []byte) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	if _, err := h.Write(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newPayloadRequest(ctx context.Context, wh *conf.Webhook, b []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	sig, err := sign(wh.SecretToken, b)
+	if err != nil {
+		return nil, fmt.Errorf("error digesting payload: %w", err)
+	}
+	if sig != "" {
+		req.Header.Set(SignatureHeader, sig)
+	}
+	return req, nil
 }
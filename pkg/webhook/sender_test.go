@@ -11,6 +11,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/wrgl/wrgl/pkg/conf"
 	"github.com/wrgl/wrgl/pkg/testutils"
+	wrgldconf "github.com/wrgl/wrgld/pkg/conf"
 	"github.com/wrgl/wrgld/pkg/webhook"
 	webhooktest "github.com/wrgl/wrgld/pkg/webhook/test"
 )
@@ -20,9 +21,11 @@ func TestSender(t *testing.T) {
 	wg := &sync.WaitGroup{}
 
 	// test zero webhook registered
-	s := webhook.NewSenderWithConfig(conf.Config{}, logger, webhook.WithWaitGroup(wg))
+	wg2 := &sync.WaitGroup{}
+	s := webhook.NewSenderWithConfig(conf.Config{}, logger, webhook.WithWaitGroup(wg), webhook.WithWaitGroup(wg2))
 	s.Flush()
 	wg.Wait()
+	wg2.Wait()
 
 	// test webhooks registered
 	wh1, pl1, cleanup := webhooktest.CreateWebhookHandler(t, []conf.WebhookEventType{conf.CommitEventType}, false)
@@ -125,3 +128,77 @@ func TestSender(t *testing.T) {
 		},
 	})
 }
+
+func TestSenderRefFilter(t *testing.T) {
+	logger := testr.New(t)
+	wg := &sync.WaitGroup{}
+	eventTypes := []conf.WebhookEventType{
+		conf.CommitEventType,
+		webhook.BranchCreatedEventType,
+		webhook.TransactionCommittedEventType,
+		webhook.GCCompletedEventType,
+	}
+	wh1, pl1, cleanup := webhooktest.CreateWebhookHandler(t, eventTypes, false)
+	defer cleanup()
+	wh2, pl2, cleanup := webhooktest.CreateWebhookHandler(t, eventTypes, false)
+	defer cleanup()
+	s := webhook.NewSenderWithConfig(conf.Config{
+		Webhooks: []conf.Webhook{wh1},
+	}, logger, webhook.WithWaitGroup(wg), webhook.WithWebhooks(wrgldconf.Webhook{
+		Webhook: wh2,
+		Refs:    []string{"heads/release-*"},
+	}))
+
+	tid := uuid.New().String()
+	ce := &webhook.CommitEvent{
+		TransactionID: tid,
+		Commits: []webhook.Commit{
+			{Sum: "abc", Ref: "heads/main", Message: "first"},
+			{Sum: "def", Ref: "heads/release-1", Message: "second"},
+		},
+	}
+	be := &webhook.BranchEvent{Type: webhook.BranchCreatedEventType, Ref: "heads/main", Sum: "abc"}
+	te := &webhook.TransactionEvent{
+		Type:          webhook.TransactionCommittedEventType,
+		TransactionID: tid,
+		Refs:          []string{"heads/main", "heads/release-1"},
+	}
+	ge := &webhook.GCEvent{ElapsedMs: 10}
+	for _, e := range []webhook.Event{ce, be, te, ge} {
+		s.EnqueueEvent(e)
+	}
+	s.Flush()
+	wg.Wait()
+	assert.Equal(t, &webhook.Payload{
+		Events: []webhook.Event{ce, be, te, ge},
+	}, pl1())
+	assert.Equal(t, &webhook.Payload{
+		Events: []webhook.Event{
+			&webhook.CommitEvent{
+				ID:            ce.ID,
+				Type:          conf.CommitEventType,
+				TransactionID: tid,
+				Commits:       ce.Commits[1:],
+				Time:          ce.Time,
+			},
+			&webhook.TransactionEvent{
+				ID:            te.ID,
+				Type:          webhook.TransactionCommittedEventType,
+				TransactionID: tid,
+				Refs:          []string{"heads/release-1"},
+				Time:          te.Time,
+			},
+			ge,
+		},
+	}, pl2())
+}
+
+func TestSenderInvalidEventType(t *testing.T) {
+	s := webhook.NewSenderWithConfig(conf.Config{}, testr.New(t))
+	assert.PanicsWithError(t, `invalid branch event type "transactionCreated"`, func() {
+		s.EnqueueEvent(&webhook.BranchEvent{Type: webhook.TransactionCreatedEventType, Ref: "heads/main"})
+	})
+	assert.PanicsWithError(t, `invalid transaction event type ""`, func() {
+		s.EnqueueEvent(&webhook.TransactionEvent{TransactionID: uuid.New().String()})
+	})
+}
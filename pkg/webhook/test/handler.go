@@ -18,9 +18,10 @@ import (
 )
 
 type webhookHandler struct {
-	body   *webhook.Payload
-	t      *testing.T
-	secret string
+	body    *webhook.Payload
+	t       *testing.T
+	secret  string
+	decline string
 }
 
 func (h *webhookHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
@@ -37,6 +38,15 @@ func (h *webhookHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		require.NoError(h.t, err)
 		assert.True(h.t, hmac.Equal(sig, hash.Sum(nil)))
 	}
+	if h.decline != "" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusForbidden)
+		b, err := json.Marshal(map[string]string{"message": h.decline})
+		require.NoError(h.t, err)
+		_, err = rw.Write(b)
+		require.NoError(h.t, err)
+		return
+	}
 	rw.WriteHeader(http.StatusOK)
 }
 
@@ -63,3 +73,18 @@ func CreateWebhookHandler(t *testing.T, eventTypes []conf.WebhookEventType, with
 		srv.Close()
 	}
 }
+
+// CreatePreReceiveHandler creates a pre-receive hook that declines every update
+// with message decline, or accepts every update if decline is empty.
+func CreatePreReceiveHandler(t *testing.T, decline string) (
+	wh conf.Webhook, getPayload func() (body *webhook.Payload), cleanup func(),
+) {
+	h := &webhookHandler{t: t, decline: decline}
+	srv := httptest.NewServer(h)
+	return conf.Webhook{
+		URL:        srv.URL,
+		EventTypes: []conf.WebhookEventType{webhook.PreReceiveEventType},
+	}, h.getPayload, func() {
+		srv.Close()
+	}
+}